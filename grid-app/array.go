@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"./functions"
+)
+
+// pythonArrayPrefix marks Python function results that are lists, the rows follow as JSON
+const pythonArrayPrefix = "#ARRAY#"
+
+// maximumArraySize prevents functions like SEQUENCE from allocating arrays no sheet can hold
+const maximumArraySize = 1000000
+
+func init() {
+
+	ranges := functions.Range
+	scalar := functions.Scalar
+
+	functions.Register(&functions.Definition{Name: "SEQUENCE", MinimumArguments: 1, MaximumArguments: 4,
+		Syntax: "SEQUENCE(rows, [columns], [start], [step])", Description: "Returns an array of a sequence of numbers",
+		Native: func(call *functionCall) *DynamicValue { return sequence(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "TRANSPOSE", MinimumArguments: 1, MaximumArguments: 1, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "TRANSPOSE(range)", Description: "Swaps the rows and columns of a range",
+		Native: func(call *functionCall) *DynamicValue { return transpose(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "SORT", MinimumArguments: 1, MaximumArguments: 4, ArgumentKinds: []functions.ArgumentKind{ranges, scalar},
+		Syntax: "SORT(range, [sort_index], [sort_order], [by_column])", Description: "Sorts the rows of a range",
+		Native: func(call *functionCall) *DynamicValue { return sortFunc(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "UNIQUE", MinimumArguments: 1, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{ranges, scalar},
+		Syntax: "UNIQUE(range, [by_column], [exactly_once])", Description: "Returns the unique rows of a range",
+		Native: func(call *functionCall) *DynamicValue { return unique(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "FILTER", MinimumArguments: 2, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "FILTER(range, include, [if_empty])", Description: "Returns the rows of a range for which include is true",
+		Native: func(call *functionCall) *DynamicValue { return filterFunc(call.Arguments, call.Grid) }})
+}
+
+func isArrayOperand(dv *DynamicValue) bool {
+	return dv.ValueType == DynamicValueTypeArray || (dv.ValueType == DynamicValueTypeReference && strings.Contains(dv.DataString, ":"))
+}
+
+// arrayArgument returns the rows of a range or array argument, single values are a 1x1 array
+func arrayArgument(dv *DynamicValue, grid *Grid) ([][]*DynamicValue, *DynamicValue) {
+
+	if dv.ValueType == DynamicValueTypeError {
+		return nil, dv
+	}
+
+	if dv.ValueType == DynamicValueTypeReference {
+		if _, errorDv := getLookupRange(dv, grid); errorDv != nil {
+			return nil, errorDv
+		}
+	}
+
+	if rows, isArray := arrayRows(dv, grid); isArray {
+		return rows, nil
+	}
+
+	if dv.ValueType == DynamicValueTypeArray {
+		return nil, makeErrorDv(ErrorCodeCalc, "Empty array")
+	}
+
+	return [][]*DynamicValue{{dv}}, nil
+}
+
+// arrayValues flattens an array value row by row
+func arrayValues(dv *DynamicValue) []*DynamicValue {
+	dvs := []*DynamicValue{}
+	for _, row := range dv.DataArray {
+		dvs = append(dvs, row...)
+	}
+	return dvs
+}
+
+// arrayElement returns an element of rows, a single row or column is repeated to fit the other operand
+func arrayElement(rows [][]*DynamicValue, row int, column int) *DynamicValue {
+
+	if len(rows) == 1 {
+		row = 0
+	}
+	if len(rows[0]) == 1 {
+		column = 0
+	}
+
+	if row >= len(rows) || column >= len(rows[row]) {
+		return makeErrorDv(ErrorCodeNotAvailable, "Arrays of different sizes")
+	}
+
+	return rows[row][column]
+}
+
+// arrayOperation applies an operator element by element, the result is as large as the largest operand
+func arrayOperation(operator string, LHS *DynamicValue, RHS *DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
+
+	leftRows, errorDv := arrayArgument(LHS, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+	rightRows, errorDv := arrayArgument(RHS, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	rowCount := len(leftRows)
+	if len(rightRows) > rowCount {
+		rowCount = len(rightRows)
+	}
+	columnCount := len(leftRows[0])
+	if len(rightRows[0]) > columnCount {
+		columnCount = len(rightRows[0])
+	}
+
+	rows := [][]*DynamicValue{}
+
+	for row := 0; row < rowCount; row++ {
+		values := []*DynamicValue{}
+		for column := 0; column < columnCount; column++ {
+			left := copyDv(arrayElement(leftRows, row, column))
+			right := copyDv(arrayElement(rightRows, row, column))
+			values = append(values, binaryOperation(operator, left, right, targetRef))
+		}
+		rows = append(rows, values)
+	}
+
+	result := makeArrayDv(rows)
+	result.SheetIndex = targetRef.SheetIndex
+	return result
+}
+
+func transposeRows(rows [][]*DynamicValue) [][]*DynamicValue {
+
+	transposed := [][]*DynamicValue{}
+
+	for column := 0; column < len(rows[0]); column++ {
+		values := []*DynamicValue{}
+		for row := 0; row < len(rows); row++ {
+			values = append(values, rows[row][column])
+		}
+		transposed = append(transposed, values)
+	}
+
+	return transposed
+}
+
+// booleanArgument reads optional flags like by_col, a missing argument is false
+func booleanArgument(arguments []*DynamicValue, index int) (bool, *DynamicValue) {
+
+	if index >= len(arguments) {
+		return false, nil
+	}
+	if arguments[index].ValueType == DynamicValueTypeError {
+		return false, arguments[index]
+	}
+
+	return convertToBool(arguments[index]).DataBool, nil
+}
+
+// SEQUENCE(rows, [columns], [start], [step])
+func sequence(arguments []*DynamicValue) *DynamicValue {
+
+	rowCount, errorDv := integerArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	columnCount := 1
+	if len(arguments) > 1 {
+		if columnCount, errorDv = integerArgument(arguments[1]); errorDv != nil {
+			return errorDv
+		}
+	}
+
+	if rowCount < 1 || columnCount < 1 {
+		return makeErrorDv(ErrorCodeCalc, "SEQUENCE requires at least one row and column")
+	}
+	if rowCount*columnCount > maximumArraySize {
+		return makeErrorDv(ErrorCodeNumber, "SEQUENCE is too large")
+	}
+
+	start, step := 1.0, 1.0
+
+	if len(arguments) > 2 {
+		startDv := convertToFloat(arguments[2])
+		if startDv.ValueType == DynamicValueTypeError {
+			return startDv
+		}
+		start = startDv.DataFloat
+	}
+	if len(arguments) > 3 {
+		stepDv := convertToFloat(arguments[3])
+		if stepDv.ValueType == DynamicValueTypeError {
+			return stepDv
+		}
+		step = stepDv.DataFloat
+	}
+
+	rows := [][]*DynamicValue{}
+	for row := 0; row < rowCount; row++ {
+		values := []*DynamicValue{}
+		for column := 0; column < columnCount; column++ {
+			values = append(values, &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: start + step*float64(row*columnCount+column)})
+		}
+		rows = append(rows, values)
+	}
+
+	return makeArrayDv(rows)
+}
+
+func transpose(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	rows, errorDv := arrayArgument(arguments[0], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	return makeArrayDv(transposeRows(rows))
+}
+
+// SORT(array, [sort_index], [sort_order], [by_col]) sorts rows (or columns) on one of their values,
+// blanks sort last
+func sortFunc(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	rows, errorDv := arrayArgument(arguments[0], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	byColumn, errorDv := booleanArgument(arguments, 3)
+	if errorDv != nil {
+		return errorDv
+	}
+	if byColumn {
+		rows = transposeRows(rows)
+	}
+
+	sortIndex := 1
+	if len(arguments) > 1 {
+		if sortIndex, errorDv = integerArgument(arguments[1]); errorDv != nil {
+			return errorDv
+		}
+	}
+	if sortIndex < 1 || sortIndex > len(rows[0]) {
+		return makeErrorDv(ErrorCodeValue, "SORT index is outside of the array")
+	}
+
+	sortOrder := 1
+	if len(arguments) > 2 {
+		if sortOrder, errorDv = integerArgument(arguments[2]); errorDv != nil {
+			return errorDv
+		}
+	}
+	if sortOrder != 1 && sortOrder != -1 {
+		return makeErrorDv(ErrorCodeValue, "SORT order should be 1 or -1")
+	}
+
+	sorted := make([][]*DynamicValue, len(rows))
+	copy(sorted, rows)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+
+		dv1 := sorted[i][sortIndex-1]
+		dv2 := sorted[j][sortIndex-1]
+
+		if isEmptyLookupValue(dv1) || isEmptyLookupValue(dv2) {
+			return !isEmptyLookupValue(dv1) && isEmptyLookupValue(dv2)
+		}
+
+		return compareLookupValues(dv1, dv2)*sortOrder < 0
+	})
+
+	if byColumn {
+		sorted = transposeRows(sorted)
+	}
+
+	return makeArrayDv(sorted)
+}
+
+// UNIQUE(array, [by_col], [exactly_once]) keeps the first of equal rows (or columns), or only
+// the rows that occur once
+func unique(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	rows, errorDv := arrayArgument(arguments[0], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	byColumn, errorDv := booleanArgument(arguments, 1)
+	if errorDv != nil {
+		return errorDv
+	}
+	exactlyOnce, errorDv := booleanArgument(arguments, 2)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	if byColumn {
+		rows = transposeRows(rows)
+	}
+
+	rowsEqual := func(row1 []*DynamicValue, row2 []*DynamicValue) bool {
+		for i := range row1 {
+			if !lookupValuesEqual(row1[i], row2[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	occurrences := make([]int, len(rows))
+	firstOccurrence := make([]int, len(rows))
+
+	for i := range rows {
+		firstOccurrence[i] = i
+		for j := 0; j < i; j++ {
+			if firstOccurrence[j] == j && rowsEqual(rows[i], rows[j]) {
+				firstOccurrence[i] = j
+				break
+			}
+		}
+		occurrences[firstOccurrence[i]]++
+	}
+
+	uniqueRows := [][]*DynamicValue{}
+	for i, row := range rows {
+		if firstOccurrence[i] == i && (!exactlyOnce || occurrences[i] == 1) {
+			uniqueRows = append(uniqueRows, row)
+		}
+	}
+
+	if len(uniqueRows) == 0 {
+		return makeErrorDv(ErrorCodeCalc, "UNIQUE has no values")
+	}
+
+	if byColumn {
+		uniqueRows = transposeRows(uniqueRows)
+	}
+
+	return makeArrayDv(uniqueRows)
+}
+
+// FILTER(array, include, [if_empty]) keeps the rows (or columns) for which include is TRUE,
+// include is a column as high as the array or a row as wide as it
+func filterFunc(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	rows, errorDv := arrayArgument(arguments[0], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+	include, errorDv := arrayArgument(arguments[1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	byColumn := false
+
+	if len(include[0]) == 1 && len(include) == len(rows) {
+		include = transposeRows(include)
+	} else if len(include) == 1 && len(include[0]) == len(rows[0]) {
+		byColumn = true
+		rows = transposeRows(rows)
+	} else {
+		return makeErrorDv(ErrorCodeValue, "FILTER include needs to match the height or width of the array")
+	}
+
+	filteredRows := [][]*DynamicValue{}
+
+	for i, dv := range include[0] {
+		if dv.ValueType == DynamicValueTypeError {
+			return dv
+		}
+		if convertToBool(dv).DataBool {
+			filteredRows = append(filteredRows, rows[i])
+		}
+	}
+
+	if len(filteredRows) == 0 {
+		if len(arguments) == 3 {
+			return arguments[2]
+		}
+		return makeErrorDv(ErrorCodeCalc, "FILTER has no matching values")
+	}
+
+	if byColumn {
+		filteredRows = transposeRows(filteredRows)
+	}
+
+	return makeArrayDv(filteredRows)
+}
+
+// pythonArrayResult turns the JSON rows of a Python list result into an array
+func pythonArrayResult(result string) *DynamicValue {
+
+	var values [][]interface{}
+
+	if err := json.Unmarshal([]byte(result[len(pythonArrayPrefix):]), &values); err != nil || len(values) == 0 || len(values[0]) == 0 {
+		return makeErrorDv(ErrorCodeValue, "Python function returned an invalid list")
+	}
+
+	rows := [][]*DynamicValue{}
+
+	for _, row := range values {
+
+		// ragged rows are padded with blanks
+		dvs := []*DynamicValue{}
+		for column := 0; column < len(values[0]); column++ {
+
+			dv := &DynamicValue{ValueType: DynamicValueTypeString}
+
+			if column < len(row) {
+				switch value := row[column].(type) {
+				case float64:
+					dv = &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value}
+				case bool:
+					dv = &DynamicValue{ValueType: DynamicValueTypeBool, DataBool: value}
+				case string:
+					dv = &DynamicValue{ValueType: DynamicValueTypeString, DataString: value}
+				}
+			}
+
+			dvs = append(dvs, dv)
+		}
+		rows = append(rows, dvs)
+	}
+
+	return makeArrayDv(rows)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// CellKey addresses a cell by its sheet, row and column packed in one number. It's the key of the
+// cells in the grid and of the dependency sets, A1 strings are only used in formulas and in the
+// messages to the client and Python.
+type CellKey uint64
+
+// noCellKey is the zero key, rows and columns start at 1 so no cell has it
+const noCellKey CellKey = 0
+
+const cellKeyColumnBits = 24
+const cellKeyRowBits = 24
+const cellKeySheetBits = 16
+
+// the largest row, column and sheet ID a key holds, sheets can't grow beyond them
+const maximumRowCount = 1<<cellKeyRowBits - 1
+const maximumColumnCount = 1<<cellKeyColumnBits - 1
+const maximumSheetID = 1<<cellKeySheetBits - 1
+
+// checkSheetSize returns an error for sizes with cells that keys can't address
+func checkSheetSize(sheetSize SheetSize) error {
+
+	if sheetSize.RowCount < 1 || sheetSize.ColumnCount < 1 {
+		return errors.New("a sheet needs at least one row and one column")
+	}
+	if sheetSize.RowCount > maximumRowCount {
+		return errors.New("a sheet can have at most " + strconv.Itoa(maximumRowCount) + " rows")
+	}
+	if sheetSize.ColumnCount > maximumColumnCount {
+		return errors.New("a sheet can have at most " + strconv.Itoa(maximumColumnCount) + " columns")
+	}
+
+	return nil
+}
+
+// cellFitsKey reports whether a row and column can be packed in a key, larger ones would spill into
+// the bits of the sheet and alias a cell on another sheet
+func cellFitsKey(row int, column int) bool {
+	return row >= 1 && column >= 1 && row <= maximumRowCount && column <= maximumColumnCount
+}
+
+// rangeFitsKeys checks both ends of a range like "A1:B2" or "Sheet2!A1:B2" with cellFitsKey
+func rangeFitsKeys(rangeString string) bool {
+
+	// a quoted sheet name can hold colons, so the sheet is cut off first
+	rangeString = rangeString[strings.LastIndex(rangeString, "!")+1:]
+
+	for _, end := range strings.Split(rangeString, ":") {
+		if !cellFitsKey(parseCellString(end)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// makeCellKey returns noCellKey for rows and columns that don't fit in a key
+func makeCellKey(sheetIndex SheetID, row int, column int) CellKey {
+	if !cellFitsKey(row, column) {
+		return noCellKey
+	}
+	return CellKey(uint64(uint16(sheetIndex))<<(cellKeyRowBits+cellKeyColumnBits) | uint64(row)<<cellKeyColumnBits | uint64(column))
+}
+
+func (key CellKey) SheetIndex() SheetID {
+	return SheetID(uint16(key >> (cellKeyRowBits + cellKeyColumnBits)))
+}
+
+func (key CellKey) Row() int {
+	return int(key>>cellKeyColumnBits) & (1<<cellKeyRowBits - 1)
+}
+
+func (key CellKey) Column() int {
+	return int(key) & (1<<cellKeyColumnBits - 1)
+}
+
+// String returns the key like "0!A1", for messages
+func (key CellKey) String() string {
+	return strconv.Itoa(int(key.SheetIndex())) + "!" + indexesToReferenceString(key.Row(), key.Column())
+}
+
+// parseCellString returns the row and column of a cell like "A1" or "$A$1", without allocating. Rows
+// and columns stop growing once they no longer fit in a key, so long references can't wrap around.
+func parseCellString(cell string) (int, int) {
+
+	row := 0
+	column := 0
+
+	for i := 0; i < len(cell); i++ {
+
+		character := cell[i]
+
+		switch {
+		case character >= 'A' && character <= 'Z':
+			if column <= maximumColumnCount {
+				column = column*26 + int(character-'A') + 1
+			}
+		case character >= 'a' && character <= 'z':
+			if column <= maximumColumnCount {
+				column = column*26 + int(character-'a') + 1
+			}
+		case character >= '0' && character <= '9':
+			if row <= maximumRowCount {
+				row = row*10 + int(character-'0')
+			}
+		case character == '!':
+			// a sheet prefix, the cell follows it
+			row = 0
+			column = 0
+		}
+	}
+
+	return row, column
+}
+
+func getCellKeyFromReference(reference Reference) CellKey {
+	row, column := parseCellString(reference.String)
+	return makeCellKey(reference.SheetIndex, row, column)
+}
+
+func getReferenceFromCellKey(key CellKey) Reference {
+	return Reference{String: indexesToReferenceString(key.Row(), key.Column()), SheetIndex: key.SheetIndex()}
+}
+
+// getCellKeyFromMapIndex returns the key of a cell like "0!A1", the way cells were keyed in sheets
+// saved before cell keys
+func getCellKeyFromMapIndex(index string) CellKey {
+
+	parts := strings.SplitN(index, "!", 2)
+	if len(parts) != 2 {
+		return noCellKey
+	}
+
+	sheetIndex, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return noCellKey
+	}
+
+	row, column := parseCellString(parts[1])
+	return makeCellKey(SheetID(sheetIndex), row, column)
+}
+
+// legacyDynamicValue and legacyGrid decode sheets saved when cells were keyed by strings, before
+// any of the fields that came after cell keys
+type legacyDynamicValue struct {
+	ValueType     int8
+	DataFloat     float64
+	DataString    string
+	DataBool      bool
+	DataFormula   string
+	SheetIndex    SheetID
+	DependIn      map[string]bool
+	DependOut     map[string]bool
+	DependInTemp  map[string]bool
+	DependOutTemp map[string]bool
+}
+
+type legacyGrid struct {
+	Data                map[string]*legacyDynamicValue
+	DirtyCells          map[string]bool
+	ActiveSheet         SheetID
+	SheetNames          map[string]SheetID
+	PerformanceCounting map[string]int
+	SheetList           []string
+	SheetSizes          []SheetSize
+}
+
+func convertLegacyKeySet(set map[string]bool) map[CellKey]bool {
+
+	converted := make(map[CellKey]bool)
+	for index, value := range set {
+		converted[getCellKeyFromMapIndex(index)] = value
+	}
+	return converted
+}
+
+func convertLegacyDv(legacyDv *legacyDynamicValue) *DynamicValue {
+
+	if legacyDv == nil {
+		return nil
+	}
+
+	return &DynamicValue{
+		ValueType:     legacyDv.ValueType,
+		DataFloat:     legacyDv.DataFloat,
+		DataString:    legacyDv.DataString,
+		DataBool:      legacyDv.DataBool,
+		DataFormula:   legacyDv.DataFormula,
+		SheetIndex:    legacyDv.SheetIndex,
+		DependIn:      convertLegacyKeySet(legacyDv.DependIn),
+		DependOut:     convertLegacyKeySet(legacyDv.DependOut),
+		DependInTemp:  convertLegacyKeySet(legacyDv.DependInTemp),
+		DependOutTemp: convertLegacyKeySet(legacyDv.DependOutTemp),
+	}
+}
+
+// convertLegacyGrid rekeys a sheet saved with string cell keys, the fields added since are
+// initialised when the sheet is loaded
+func convertLegacyGrid(legacy legacyGrid) Grid {
+
+	grid := Grid{
+		Data:                make(map[CellKey]*DynamicValue),
+		DirtyCells:          convertLegacyKeySet(legacy.DirtyCells),
+		ActiveSheet:         legacy.ActiveSheet,
+		SheetNames:          legacy.SheetNames,
+		PerformanceCounting: legacy.PerformanceCounting,
+		SheetList:           legacy.SheetList,
+		SheetSizes:          legacy.SheetSizes,
+	}
+
+	for index, legacyDv := range legacy.Data {
+		grid.Data[getCellKeyFromMapIndex(index)] = convertLegacyDv(legacyDv)
+	}
+
+	return grid
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"./functions"
+)
+
+func init() {
+
+	ranges := functions.Range
+	scalar := functions.Scalar
+
+	functions.RegisterNames([]string{"SUMIF", "AVERAGEIF"}, functions.Definition{MinimumArguments: 2, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{ranges, scalar, ranges},
+		Syntax: "SUMIF(range, criterion, [value_range])", Description: "Sums or averages the values for which the range matches the criterion",
+		Native: func(call *functionCall) *DynamicValue {
+			return singleConditionAggregate(call.Name, strings.TrimSuffix(call.Name, "IF"), call.Arguments, call.Grid)
+		}})
+
+	functions.RegisterNames([]string{"SUMIFS", "AVERAGEIFS", "MAXIFS", "MINIFS"}, functions.Definition{MinimumArguments: 3, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges, ranges, scalar}, RepeatedArguments: 2,
+		Syntax: "SUMIFS(value_range, range1, criterion1, [range2, criterion2], ...)", Description: "Aggregates the values for which all ranges match their criterion",
+		Native: func(call *functionCall) *DynamicValue {
+			return multipleConditionAggregate(call.Name, strings.TrimSuffix(call.Name, "IFS"), call.Arguments, call.Grid)
+		}})
+
+	functions.Register(&functions.Definition{Name: "COUNTIF", MinimumArguments: 2, MaximumArguments: 2, ArgumentKinds: []functions.ArgumentKind{ranges, scalar},
+		Syntax: "COUNTIF(range, criterion)", Description: "Counts the cells that match the criterion",
+		Native: func(call *functionCall) *DynamicValue { return countIf(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "COUNTIFS", MinimumArguments: 2, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges, scalar}, RepeatedArguments: 2,
+		Syntax: "COUNTIFS(range1, criterion1, [range2, criterion2], ...)", Description: "Counts the rows for which all ranges match their criterion",
+		Native: func(call *functionCall) *DynamicValue { return countIfs(call.Arguments, call.Grid) }})
+}
+
+// criterion is a parsed criteria argument like ">10", "<>foo" or "ab*"
+type criterion struct {
+	Operator string
+	Value    *DynamicValue
+}
+
+func parseCriterion(dv *DynamicValue) criterion {
+
+	if dv.ValueType != DynamicValueTypeString {
+		return criterion{Operator: "=", Value: dv}
+	}
+
+	operator := "="
+	operand := dv.DataString
+
+	for _, prefix := range []string{">=", "<=", "<>", ">", "<", "="} {
+		if strings.HasPrefix(operand, prefix) {
+			operator = prefix
+			operand = operand[len(prefix):]
+			break
+		}
+	}
+
+	if value, err := strconv.ParseFloat(strings.TrimSpace(operand), 64); err == nil {
+		return criterion{Operator: operator, Value: &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value}}
+	}
+
+	if serial, ok := parseDateString(operand, false); ok {
+		return criterion{Operator: operator, Value: makeDateDv(serial)}
+	}
+
+	switch strings.ToUpper(operand) {
+	case "TRUE":
+		return criterion{Operator: operator, Value: &DynamicValue{ValueType: DynamicValueTypeBool, DataBool: true}}
+	case "FALSE":
+		return criterion{Operator: operator, Value: &DynamicValue{ValueType: DynamicValueTypeBool, DataBool: false}}
+	}
+
+	return criterion{Operator: operator, Value: &DynamicValue{ValueType: DynamicValueTypeString, DataString: operand}}
+}
+
+func (c criterion) matches(dv *DynamicValue) bool {
+
+	if dv.ValueType == DynamicValueTypeError {
+		return false
+	}
+
+	// text criteria use wildcards for (in)equality
+	if c.Value.ValueType == DynamicValueTypeString && (c.Operator == "=" || c.Operator == "<>") {
+
+		isMatch := false
+		if len(c.Value.DataString) == 0 {
+			isMatch = isEmptyLookupValue(dv)
+		} else if dv.ValueType == DynamicValueTypeString {
+			isMatch = wildcardMatch(c.Value.DataString, dv.DataString)
+		}
+
+		if c.Operator == "<>" {
+			return !isMatch
+		}
+		return isMatch
+	}
+
+	// numbers stored as text match numeric criteria for equality
+	if c.Value.ValueType == DynamicValueTypeFloat && dv.ValueType == DynamicValueTypeString && (c.Operator == "=" || c.Operator == "<>") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(dv.DataString), 64)
+		isMatch := err == nil && value == c.Value.DataFloat
+		if c.Operator == "<>" {
+			return !isMatch
+		}
+		return isMatch
+	}
+
+	sameType := lookupTypeOrder(dv) == lookupTypeOrder(c.Value) && !isEmptyLookupValue(dv)
+
+	if c.Operator == "<>" {
+		return !sameType || compareLookupValues(dv, c.Value) != 0
+	}
+
+	// ordering only compares values of the same type
+	if !sameType {
+		return false
+	}
+
+	comparison := compareLookupValues(dv, c.Value)
+
+	switch c.Operator {
+	case "=":
+		return comparison == 0
+	case ">":
+		return comparison > 0
+	case "<":
+		return comparison < 0
+	case ">=":
+		return comparison >= 0
+	case "<=":
+		return comparison <= 0
+	}
+
+	return false
+}
+
+// matchingCells returns the cells of the value range for which all criteria ranges
+// match their criterion. Criteria arguments come in range, criterion pairs and all
+// ranges need to have the same size.
+func matchingCells(function string, valueArgument *DynamicValue, criteriaArguments []*DynamicValue, grid *Grid) ([]*DynamicValue, *DynamicValue) {
+
+	if len(criteriaArguments) == 0 || len(criteriaArguments)%2 != 0 {
+		return nil, makeErrorDv(ErrorCodeValue, function+" requires pairs of ranges and criteria")
+	}
+
+	valueRange, errorDv := getLookupRange(valueArgument, grid)
+	if errorDv != nil {
+		return nil, errorDv
+	}
+
+	values := valueRange.cells()
+
+	isMatch := make([]bool, len(values))
+	for i := range isMatch {
+		isMatch[i] = true
+	}
+
+	for i := 0; i < len(criteriaArguments); i += 2 {
+
+		criteriaRange, errorDv := getLookupRange(criteriaArguments[i], grid)
+		if errorDv != nil {
+			return nil, errorDv
+		}
+
+		if criteriaRange.Rows != valueRange.Rows || criteriaRange.Columns != valueRange.Columns {
+			return nil, makeErrorDv(ErrorCodeValue, function+" ranges need to be the same size")
+		}
+
+		condition := parseCriterion(criteriaArguments[i+1])
+
+		for index, dv := range criteriaRange.cells() {
+			if isMatch[index] && !condition.matches(dv) {
+				isMatch[index] = false
+			}
+		}
+	}
+
+	matches := []*DynamicValue{}
+	for index, dv := range values {
+		if isMatch[index] {
+			matches = append(matches, dv)
+		}
+	}
+
+	return matches, nil
+}
+
+// numericValues keeps the numbers of dvs, text and booleans are ignored and errors are returned
+func numericValues(dvs []*DynamicValue) ([]float64, *DynamicValue) {
+	values := []float64{}
+	for _, dv := range dvs {
+		if dv.ValueType == DynamicValueTypeError {
+			return nil, dv
+		}
+		if dv.ValueType == DynamicValueTypeFloat || dv.ValueType == DynamicValueTypeDate {
+			values = append(values, dv.DataFloat)
+		}
+	}
+	return values, nil
+}
+
+// conditionalAggregate implements the IF(S) functions on top of matchingCells, the
+// aggregation is one of SUM, COUNT, AVERAGE, MAX and MIN
+func conditionalAggregate(function string, aggregation string, valueArgument *DynamicValue, criteriaArguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	matches, errorDv := matchingCells(function, valueArgument, criteriaArguments, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	if aggregation == "COUNT" {
+		return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(len(matches))}
+	}
+
+	values, errorDv := numericValues(matches)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	result := 0.0
+
+	switch aggregation {
+	case "SUM", "AVERAGE":
+		for _, value := range values {
+			result += value
+		}
+		if aggregation == "AVERAGE" {
+			if len(values) == 0 {
+				return makeErrorDv(ErrorCodeDivisionByZero, function+" has no matching numbers")
+			}
+			result /= float64(len(values))
+		}
+	case "MAX", "MIN":
+		for index, value := range values {
+			if index == 0 || (aggregation == "MAX" && value > result) || (aggregation == "MIN" && value < result) {
+				result = value
+			}
+		}
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: result}
+}
+
+// SUMIF(range, criterion, [sum_range]) and AVERAGEIF(range, criterion, [average_range])
+func singleConditionAggregate(function string, aggregation string, arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	valueArgument := arguments[0]
+	if len(arguments) == 3 {
+		valueArgument = arguments[2]
+	}
+
+	return conditionalAggregate(function, aggregation, valueArgument, arguments[0:2], grid)
+}
+
+// SUMIFS, AVERAGEIFS, MAXIFS and MINIFS take the value range first, followed by range, criterion pairs
+func multipleConditionAggregate(function string, aggregation string, arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	return conditionalAggregate(function, aggregation, arguments[0], arguments[1:], grid)
+}
+
+func countIf(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	return conditionalAggregate("COUNTIF", "COUNT", arguments[0], arguments, grid)
+}
+
+func countIfs(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	return conditionalAggregate("COUNTIFS", "COUNT", arguments[0], arguments, grid)
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Conditional formats are rules on a range that change how its cells look depending on their values.
+// They're kept in grid.ConditionalFormats by priority, when rules set the same style property the
+// first one wins. The rules are evaluated after the dirty cells are computed, their result isn't saved
+// but sent along with the cells as an overlay on the style of the cell. The result of every rule is
+// kept, after a computation only the rules whose range or formula reads a changed cell are evaluated
+// again.
+
+type ConditionalFormat struct {
+	Range    ReferenceRange
+	Type     string    // cell-value, formula, top-n, color-scale or data-bar
+	Operator string    // the comparison of cell-value rules, top or bottom for top-n rules
+	Value    string    // the value compared with, the formula or the number of cells
+	Value2   string    // the upper value of between and not-between
+	Style    CellStyle // applied to the matching cells of cell-value, formula and top-n rules
+	MinColor string    // colour scales go from MinColor over the optional MidColor to MaxColor
+	MidColor string
+	MaxColor string
+	BarColor string
+}
+
+// conditionalStyle is what the rules do to a cell
+type conditionalStyle struct {
+	Style        CellStyle `json:"style"`
+	DataBar      float64   `json:"dataBar,omitempty"` // the length of the bar as part of the cell width
+	DataBarColor string    `json:"dataBarColor,omitempty"`
+}
+
+var conditionalFormatTypes = map[string]bool{"cell-value": true, "formula": true, "top-n": true, "color-scale": true, "data-bar": true}
+var conditionalOperators = map[string]bool{">": true, ">=": true, "<": true, "<=": true, "=": true, "<>": true, "between": true, "not-between": true}
+
+// newConditionalFormat creates a rule from the arguments of the client, properties are pairs of a
+// style property like on SET-STYLE or one of min-color, mid-color, max-color and bar-color, and a value
+func newConditionalFormat(cellRange ReferenceRange, formatType string, operator string, value string, value2 string, properties []string, grid *Grid) (ConditionalFormat, error) {
+
+	if !strings.Contains(cellRange.String, ":") {
+		cellRange.String = cellRange.String + ":" + cellRange.String
+	}
+
+	format := ConditionalFormat{Range: cellRange, Type: formatType, Operator: operator, Value: value, Value2: value2}
+
+	lowerRow, lowerColumn, upperRow, upperColumn := cellRangeBoundaries(cellRange.String)
+	topLeft := Reference{String: indexesToReferenceString(lowerRow, lowerColumn), SheetIndex: cellRange.SheetIndex}
+	bottomRight := Reference{String: indexesToReferenceString(upperRow, upperColumn), SheetIndex: cellRange.SheetIndex}
+
+	if !isWithinSheet(topLeft, grid) || !isWithinSheet(bottomRight, grid) {
+		return format, errors.New("the range " + cellRange.String + " isn't inside the sheet")
+	}
+
+	if !conditionalFormatTypes[formatType] {
+		return format, errors.New("unknown conditional format " + formatType)
+	}
+
+	if len(properties)%2 != 0 {
+		return format, errors.New("conditional format properties should come with a value")
+	}
+
+	for i := 0; i < len(properties); i += 2 {
+
+		property := properties[i]
+		propertyValue := strings.ToLower(properties[i+1])
+
+		switch property {
+		case "min-color", "mid-color", "max-color", "bar-color":
+
+			if !isValidColor(propertyValue) {
+				return format, errors.New("colours should be like #ff0000, " + properties[i+1] + " isn't")
+			}
+
+			switch property {
+			case "min-color":
+				format.MinColor = propertyValue
+			case "mid-color":
+				format.MidColor = propertyValue
+			case "max-color":
+				format.MaxColor = propertyValue
+			case "bar-color":
+				format.BarColor = propertyValue
+			}
+
+		default:
+			if err := setStyleProperty(&format.Style, property, properties[i+1]); err != nil {
+				return format, err
+			}
+		}
+	}
+
+	switch formatType {
+	case "cell-value":
+
+		if !conditionalOperators[operator] {
+			return format, errors.New("unknown comparison " + operator)
+		}
+
+	case "formula":
+
+		format.Value = strings.TrimPrefix(value, "=")
+		if len(format.Value) == 0 || !isValidFormula(format.Value) {
+			return format, errors.New("the condition " + value + " isn't a valid formula")
+		}
+
+	case "top-n":
+
+		if operator != "top" && operator != "bottom" {
+			return format, errors.New("top-n rules are top or bottom, not " + operator)
+		}
+
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return format, errors.New("the number of cells should be a whole number of at least 1")
+		}
+
+	case "color-scale":
+
+		if len(format.MinColor) == 0 || len(format.MaxColor) == 0 {
+			return format, errors.New("colour scales need a min-color and a max-color")
+		}
+
+	case "data-bar":
+
+		if len(format.BarColor) == 0 {
+			format.BarColor = "#638ec6"
+		}
+	}
+
+	return format, nil
+}
+
+// deleteConditionalFormats removes the rules that overlap a range and returns how many were removed
+func deleteConditionalFormats(cellRange ReferenceRange, grid *Grid) int {
+
+	formats := []ConditionalFormat{}
+	for _, format := range grid.ConditionalFormats {
+		if !rangesOverlap(format.Range, cellRange) {
+			formats = append(formats, format)
+		}
+	}
+
+	removed := len(grid.ConditionalFormats) - len(formats)
+	grid.ConditionalFormats = formats
+
+	return removed
+}
+
+// shiftConditionalFormats moves the ranges of the rules on a sheet when rows or columns are inserted
+// (amount 1) or deleted (amount -1) at index, rules on only deleted cells are removed
+func shiftConditionalFormats(sheetIndex SheetID, isColumn bool, index int, amount int, grid *Grid) {
+
+	formats := []ConditionalFormat{}
+
+	for _, format := range grid.ConditionalFormats {
+
+		if format.Range.SheetIndex == sheetIndex {
+
+			rangeString, isRemaining := shiftRangeString(format.Range.String, isColumn, index, amount)
+			if !isRemaining {
+				continue
+			}
+			format.Range.String = rangeString
+		}
+
+		formats = append(formats, format)
+	}
+
+	grid.ConditionalFormats = formats
+}
+
+// evaluateConditionalFormats applies all rules to the cells again and returns the cells that look different
+func evaluateConditionalFormats(grid *Grid) []CellKey {
+	return updateConditionalFormats(func(format ConditionalFormat) bool { return true }, grid)
+}
+
+// evaluateChangedConditionalFormats applies the rules that read one of the changed cells again, and
+// rules that are new, and returns the cells that look different
+func evaluateChangedConditionalFormats(changedCells []CellKey, grid *Grid) []CellKey {
+	return updateConditionalFormats(func(format ConditionalFormat) bool { return conditionalFormatReads(format, changedCells, grid) }, grid)
+}
+
+func updateConditionalFormats(needsEvaluation func(format ConditionalFormat) bool, grid *Grid) []CellKey {
+
+	results := make(map[ConditionalFormat]map[CellKey]conditionalStyle)
+
+	// the cells of rules that are evaluated again or removed may look different
+	affectedCells := make(map[CellKey]bool)
+
+	for _, format := range grid.ConditionalFormats {
+
+		if _, ok := results[format]; ok {
+			continue
+		}
+
+		previous, ok := grid.conditionalResults[format]
+		if ok && !needsEvaluation(format) {
+			results[format] = previous
+			continue
+		}
+
+		results[format] = evaluateConditionalFormat(format, grid)
+
+		for index := range previous {
+			affectedCells[index] = true
+		}
+		for index := range results[format] {
+			affectedCells[index] = true
+		}
+	}
+
+	for format, previous := range grid.conditionalResults {
+		if _, ok := results[format]; !ok {
+			for index := range previous {
+				affectedCells[index] = true
+			}
+		}
+	}
+
+	grid.conditionalResults = results
+	if grid.conditionalStyles == nil {
+		grid.conditionalStyles = make(map[CellKey]conditionalStyle)
+	}
+
+	changedCells := []CellKey{}
+
+	for index := range affectedCells {
+
+		result, hasResult := combineConditionalStyles(index, grid)
+		previous, hadResult := grid.conditionalStyles[index]
+
+		if hasResult {
+			grid.conditionalStyles[index] = result
+		} else {
+			delete(grid.conditionalStyles, index)
+		}
+
+		if hasResult != hadResult || previous != result {
+			changedCells = append(changedCells, index)
+		}
+	}
+
+	return changedCells
+}
+
+// combineConditionalStyles returns what all rules together do to a cell, false when no rule applies to it
+func combineConditionalStyles(index CellKey, grid *Grid) (conditionalStyle, bool) {
+
+	combined := conditionalStyle{}
+	hasResult := false
+
+	// later rules first, so the properties of earlier ones replace theirs
+	for i := len(grid.ConditionalFormats) - 1; i >= 0; i-- {
+
+		result, ok := grid.conditionalResults[grid.ConditionalFormats[i]][index]
+		if !ok {
+			continue
+		}
+
+		hasResult = true
+		combined.Style = overlayStyle(combined.Style, result.Style)
+		if result.DataBar > 0 {
+			combined.DataBar = result.DataBar
+			combined.DataBarColor = result.DataBarColor
+		}
+	}
+
+	return combined, hasResult
+}
+
+// conditionalFormatReads checks whether the result of a rule can depend on one of the cells
+func conditionalFormatReads(format ConditionalFormat, cells []CellKey, grid *Grid) bool {
+
+	areas := []ReferenceRange{format.Range}
+
+	if format.Type == "formula" {
+		inputs, ok := conditionalFormulaInputs(format, grid)
+		if !ok {
+			return true
+		}
+		areas = append(areas, inputs...)
+	}
+
+	for _, area := range areas {
+
+		lowerRow, lowerColumn, upperRow, upperColumn := rangeBounds(area)
+
+		for _, index := range cells {
+			if index.SheetIndex() == area.SheetIndex && index.Row() >= lowerRow && index.Row() <= upperRow && index.Column() >= lowerColumn && index.Column() <= upperColumn {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// conditionalFormulaInputs returns the ranges the formula of a rule reads for all the cells of its
+// range, the references at the top left and the bottom right cell span them. It returns false when
+// the inputs can't be told from the formula, like with defined names or volatile functions.
+func conditionalFormulaInputs(format ConditionalFormat, grid *Grid) ([]ReferenceRange, bool) {
+
+	if len(usedDefinitions(format.Value, grid)) > 0 || isVolatileFormula(format.Value, grid) {
+		return nil, false
+	}
+
+	lowerRow, lowerColumn, upperRow, upperColumn := rangeBounds(format.Range)
+	topLeft := Reference{String: indexesToReferenceString(lowerRow, lowerColumn), SheetIndex: format.Range.SheetIndex}
+	bottomRight := Reference{String: indexesToReferenceString(upperRow, upperColumn), SheetIndex: format.Range.SheetIndex}
+
+	firstReferences := findReferenceStrings(format.Value)
+	lastReferences := findReferenceStrings(incrementFormula(format.Value, topLeft, bottomRight, false, grid))
+
+	// references that move off the sheet
+	if len(firstReferences) != len(lastReferences) {
+		return nil, false
+	}
+
+	inputs := []ReferenceRange{}
+
+	for i := range firstReferences {
+
+		if isWholeRangeString(firstReferences[i]) {
+			return nil, false
+		}
+
+		first := conditionalInputRange(firstReferences[i], format.Range.SheetIndex, grid)
+		last := conditionalInputRange(lastReferences[i], format.Range.SheetIndex, grid)
+		if first.SheetIndex != last.SheetIndex {
+			return nil, false
+		}
+
+		// references only move down and to the right from the top left to the bottom right cell
+		inputLowerRow, inputLowerColumn, _, _ := rangeBounds(first)
+		_, _, inputUpperRow, inputUpperColumn := rangeBounds(last)
+
+		inputs = append(inputs, ReferenceRange{String: indexesToReferenceString(inputLowerRow, inputLowerColumn) + ":" + indexesToReferenceString(inputUpperRow, inputUpperColumn), SheetIndex: first.SheetIndex})
+	}
+
+	return inputs, true
+}
+
+// conditionalInputRange returns a reference or range of a formula as a range
+func conditionalInputRange(referenceString string, sheetIndex SheetID, grid *Grid) ReferenceRange {
+
+	referenceRange := getRangeReferenceFromString(referenceString, sheetIndex, grid)
+	if !strings.Contains(referenceRange.String, ":") {
+		referenceRange.String = referenceRange.String + ":" + referenceRange.String
+	}
+
+	return referenceRange
+}
+
+// overlayStyle returns the style with the properties that are set in overlay replaced
+func overlayStyle(style CellStyle, overlay CellStyle) CellStyle {
+
+	style.Bold = style.Bold || overlay.Bold
+	style.Italic = style.Italic || overlay.Italic
+	style.Underline = style.Underline || overlay.Underline
+
+	overlayString := func(value *string, overlayValue string) {
+		if len(overlayValue) > 0 {
+			*value = overlayValue
+		}
+	}
+
+	overlayString(&style.FontFamily, overlay.FontFamily)
+	overlayString(&style.FontColor, overlay.FontColor)
+	overlayString(&style.FillColor, overlay.FillColor)
+	overlayString(&style.BorderTop, overlay.BorderTop)
+	overlayString(&style.BorderRight, overlay.BorderRight)
+	overlayString(&style.BorderBottom, overlay.BorderBottom)
+	overlayString(&style.BorderLeft, overlay.BorderLeft)
+	overlayString(&style.BorderColor, overlay.BorderColor)
+	overlayString(&style.HorizontalAlign, overlay.HorizontalAlign)
+	overlayString(&style.VerticalAlign, overlay.VerticalAlign)
+
+	if overlay.FontSize > 0 {
+		style.FontSize = overlay.FontSize
+	}
+
+	return style
+}
+
+type conditionalCell struct {
+	index CellKey
+	value *DynamicValue
+}
+
+// conditionalFormatCells returns the cells in the range of a rule that have a value
+func conditionalFormatCells(format ConditionalFormat, grid *Grid) []conditionalCell {
+
+	cells := []conditionalCell{}
+
+	for _, index := range storedRangeKeys(format.Range, grid) {
+
+		if !isWithinSheet(getReferenceFromCellKey(index), grid) {
+			continue
+		}
+
+		value := grid.Data[index]
+		if value.ValueType == DynamicValueTypeArray {
+			value = arrayFirstValue(value)
+		}
+
+		if isEmptyLookupValue(value) {
+			continue
+		}
+
+		cells = append(cells, conditionalCell{index: index, value: value})
+	}
+
+	return cells
+}
+
+func isNumericValue(dv *DynamicValue) bool {
+	return dv.ValueType == DynamicValueTypeFloat || dv.ValueType == DynamicValueTypeDate
+}
+
+// isConditionTrue evaluates a condition written for the top left cell of a range for another cell
+// of it, relative references shift along
+func isConditionTrue(formula string, topLeft Reference, reference Reference, grid *Grid) bool {
+	return isFormulaTrue(incrementFormula(formula, topLeft, reference, false, grid), reference, grid)
+}
+
+// isFormulaTrue evaluates a formula at reference, only TRUE and numbers other than 0 are true
+func isFormulaTrue(formula string, reference Reference, grid *Grid) bool {
+
+	result := parse(makeDv(formula), grid, reference)
+	if result.ValueType == DynamicValueTypeArray {
+		result = arrayFirstValue(result)
+	}
+
+	return (result.ValueType == DynamicValueTypeBool && result.DataBool) || (isNumericValue(result) && result.DataFloat != 0)
+}
+
+func evaluateConditionalFormat(format ConditionalFormat, grid *Grid) map[CellKey]conditionalStyle {
+
+	results := make(map[CellKey]conditionalStyle)
+
+	if !sheetExists(format.Range.SheetIndex, grid) {
+		return results
+	}
+
+	// formulas are evaluated for every stored cell, they can hold for cells without a value
+	if format.Type == "formula" {
+
+		lowerRow, lowerColumn, _, _ := cellRangeBoundaries(format.Range.String)
+		topLeft := Reference{String: indexesToReferenceString(lowerRow, lowerColumn), SheetIndex: format.Range.SheetIndex}
+
+		for _, index := range storedRangeKeys(format.Range, grid) {
+
+			reference := getReferenceFromCellKey(index)
+			if !isWithinSheet(reference, grid) {
+				continue
+			}
+
+			if isConditionTrue(format.Value, topLeft, reference, grid) {
+				results[index] = conditionalStyle{Style: format.Style}
+			}
+		}
+
+		return results
+	}
+
+	cells := conditionalFormatCells(format, grid)
+
+	if format.Type == "cell-value" {
+
+		for _, cell := range cells {
+
+			isMatch := false
+
+			switch format.Operator {
+			case "between", "not-between":
+				lowerCriterion := parseCriterion(&DynamicValue{ValueType: DynamicValueTypeString, DataString: ">=" + format.Value})
+				upperCriterion := parseCriterion(&DynamicValue{ValueType: DynamicValueTypeString, DataString: "<=" + format.Value2})
+				isMatch = lowerCriterion.matches(cell.value) && upperCriterion.matches(cell.value)
+				if format.Operator == "not-between" {
+					isMatch = !isMatch && cell.value.ValueType != DynamicValueTypeError
+				}
+			default:
+				isMatch = parseCriterion(&DynamicValue{ValueType: DynamicValueTypeString, DataString: format.Operator + format.Value}).matches(cell.value)
+			}
+
+			if isMatch {
+				results[cell.index] = conditionalStyle{Style: format.Style}
+			}
+		}
+
+		return results
+	}
+
+	// the other rules only look at the numbers in the range
+	numericCells := []conditionalCell{}
+	for _, cell := range cells {
+		if isNumericValue(cell.value) {
+			numericCells = append(numericCells, cell)
+		}
+	}
+
+	if len(numericCells) == 0 {
+		return results
+	}
+
+	minimum := math.Inf(1)
+	maximum := math.Inf(-1)
+	for _, cell := range numericCells {
+		minimum = math.Min(minimum, cell.value.DataFloat)
+		maximum = math.Max(maximum, cell.value.DataFloat)
+	}
+
+	switch format.Type {
+	case "top-n":
+
+		values := []float64{}
+		for _, cell := range numericCells {
+			values = append(values, cell.value.DataFloat)
+		}
+
+		if format.Operator == "top" {
+			sort.Sort(sort.Reverse(sort.Float64Slice(values)))
+		} else {
+			sort.Float64s(values)
+		}
+
+		count, _ := strconv.Atoi(format.Value)
+		if count > len(values) {
+			count = len(values)
+		}
+
+		// cells tied with the last one are included
+		threshold := values[count-1]
+
+		for _, cell := range numericCells {
+			if (format.Operator == "top" && cell.value.DataFloat >= threshold) || (format.Operator == "bottom" && cell.value.DataFloat <= threshold) {
+				results[cell.index] = conditionalStyle{Style: format.Style}
+			}
+		}
+
+	case "color-scale":
+
+		for _, cell := range numericCells {
+
+			position := 0.5
+			if maximum > minimum {
+				position = (cell.value.DataFloat - minimum) / (maximum - minimum)
+			}
+
+			var color string
+			if len(format.MidColor) == 0 {
+				color = interpolateColor(format.MinColor, format.MaxColor, position)
+			} else if position < 0.5 {
+				color = interpolateColor(format.MinColor, format.MidColor, position*2)
+			} else {
+				color = interpolateColor(format.MidColor, format.MaxColor, position*2-1)
+			}
+
+			results[cell.index] = conditionalStyle{Style: CellStyle{FillColor: color}}
+		}
+
+	case "data-bar":
+
+		// bars start at zero, unless there are negative numbers
+		lower := math.Min(minimum, 0)
+
+		for _, cell := range numericCells {
+
+			if maximum <= lower {
+				continue
+			}
+
+			length := (cell.value.DataFloat - lower) / (maximum - lower)
+			if length > 0 {
+				results[cell.index] = conditionalStyle{DataBar: length, DataBarColor: format.BarColor}
+			}
+		}
+	}
+
+	return results
+}
+
+// parseColor returns the red, green and blue of a colour like "#ff0000" or "#f00"
+func parseColor(color string) [3]float64 {
+
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	rgb := [3]float64{}
+	for i := 0; i < 3 && len(hex) == 6; i++ {
+		component, _ := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+		rgb[i] = float64(component)
+	}
+
+	return rgb
+}
+
+// interpolateColor returns the colour at position between 0 (from) and 1 (to)
+func interpolateColor(from string, to string, position float64) string {
+
+	fromRGB := parseColor(from)
+	toRGB := parseColor(to)
+
+	color := "#"
+	for i := 0; i < 3; i++ {
+		component := int(math.Round(fromRGB[i] + (toRGB[i]-fromRGB[i])*position))
+		color += strconv.FormatInt(int64(component)+0x100, 16)[1:]
+	}
+
+	return color
+}
+
+// getConditionalStyleString returns what the rules do to a cell for the client, empty when nothing
+func getConditionalStyleString(index CellKey, grid *Grid) string {
+
+	result, ok := grid.conditionalStyles[index]
+	if !ok || result == (conditionalStyle{}) {
+		return ""
+	}
+
+	resultJSON, _ := json.Marshal(result)
+	return string(resultJSON)
+}
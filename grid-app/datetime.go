@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"./functions"
+)
+
+// dates are stored as serial numbers in DataFloat: days since 1899-12-30 with the time
+// of day as fraction, the same numbering spreadsheets use so date arithmetic is plain arithmetic
+var serialEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+var isoDateLayouts = []string{"2006-1-2", "2006-1-2 15:04", "2006-1-2 15:04:05", "2006-1-2T15:04", "2006-1-2T15:04:05", time.RFC3339, "2006/1/2", "2006/1/2 15:04", "2006/1/2 15:04:05"}
+var monthFirstDateLayouts = []string{"1/2/2006", "1/2/2006 15:04", "1/2/2006 15:04:05", "1-2-2006", "1-2-2006 15:04", "1-2-2006 15:04:05"}
+var dayFirstDateLayouts = []string{"2/1/2006", "2/1/2006 15:04", "2/1/2006 15:04:05", "2-1-2006", "2-1-2006 15:04", "2-1-2006 15:04:05"}
+var otherDateLayouts = []string{"2.1.2006", "2.1.2006 15:04", "2.1.2006 15:04:05", "Jan 2, 2006", "January 2, 2006", "Jan 2 2006", "January 2 2006", "2 Jan 2006", "2 January 2006", "2-Jan-2006", "2-Jan-06"}
+
+var numericDateRegex = regexp.MustCompile(`^([0-9]{1,2})[/-]([0-9]{1,2})[/-][0-9]{4}`)
+
+func init() {
+
+	functions.Register(&functions.Definition{Name: "DATE", MinimumArguments: 3, MaximumArguments: 3,
+		Syntax: "DATE(year, month, day)", Description: "Returns a date",
+		Native: func(call *functionCall) *DynamicValue { return dateFunc(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "TIME", MinimumArguments: 3, MaximumArguments: 3,
+		Syntax: "TIME(hour, minute, second)", Description: "Returns a time as a fraction of a day",
+		Native: func(call *functionCall) *DynamicValue { return timeFunc(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "TODAY", MinimumArguments: 0, MaximumArguments: 0, IsVolatile: true,
+		Syntax: "TODAY()", Description: "Returns the current date",
+		Native: func(call *functionCall) *DynamicValue { return currentDate() }})
+
+	functions.Register(&functions.Definition{Name: "NOW", MinimumArguments: 0, MaximumArguments: 0, IsVolatile: true,
+		Syntax: "NOW()", Description: "Returns the current date and time",
+		Native: func(call *functionCall) *DynamicValue { return currentTime() }})
+
+	functions.Register(&functions.Definition{Name: "DATEVALUE", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "DATEVALUE(text)", Description: "Converts a text to a date",
+		Native: func(call *functionCall) *DynamicValue { return dateValue(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "EDATE", MinimumArguments: 2, MaximumArguments: 2,
+		Syntax: "EDATE(date, months)", Description: "Returns the date a number of months before or after a date",
+		Native: func(call *functionCall) *DynamicValue { return monthOffset(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "EOMONTH", MinimumArguments: 2, MaximumArguments: 2,
+		Syntax: "EOMONTH(date, months)", Description: "Returns the last day of the month a number of months before or after a date",
+		Native: func(call *functionCall) *DynamicValue { return monthOffset(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "DATEDIF", MinimumArguments: 3, MaximumArguments: 3,
+		Syntax: "DATEDIF(start_date, end_date, unit)", Description: "Returns the years (Y), months (M) or days (D) between two dates",
+		Native: func(call *functionCall) *DynamicValue { return dateDif(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "WEEKDAY", MinimumArguments: 1, MaximumArguments: 2,
+		Syntax: "WEEKDAY(date, [type])", Description: "Returns the day of the week, from 1 (Sunday) to 7 by default",
+		Native: func(call *functionCall) *DynamicValue { return weekday(call.Arguments) }})
+
+	functions.RegisterNames([]string{"YEAR", "MONTH", "DAY", "HOUR", "MINUTE", "SECOND"}, functions.Definition{MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "YEAR(date)", Description: "Returns a part of a date or time",
+		Native: func(call *functionCall) *DynamicValue { return datePart(call.Name, call.Arguments) }})
+}
+
+func makeDateDv(serial float64) *DynamicValue {
+	return &DynamicValue{ValueType: DynamicValueTypeDate, DataFloat: serial}
+}
+
+func timeToSerial(t time.Time) float64 {
+
+	// use the wall clock of the time, regardless of its location
+	year, month, day := t.Date()
+	hour, minute, second := t.Clock()
+	wallTime := time.Date(year, month, day, hour, minute, second, t.Nanosecond(), time.UTC)
+
+	// durations overflow after 292 years, count seconds instead
+	return float64(wallTime.Unix()-serialEpoch.Unix())/86400 + float64(wallTime.Nanosecond())/86400e9
+}
+
+func serialToTime(serial float64) time.Time {
+	days := math.Floor(serial)
+	seconds := math.Round((serial - days) * 86400)
+	return serialEpoch.AddDate(0, 0, int(days)).Add(time.Duration(seconds) * time.Second)
+}
+
+// formatDate shows dates as ISO 8601, with the time only when there is one
+func formatDate(serial float64) string {
+
+	t := serialToTime(serial)
+
+	if serial >= 0 && serial < 1 {
+		return t.Format("15:04:05")
+	}
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// dateFormula is the formula that recreates a date value, e.g. for imported dates
+func dateFormula(serial float64) string {
+
+	t := serialToTime(serial)
+
+	formula := "DATE(" + strconv.Itoa(t.Year()) + "," + strconv.Itoa(int(t.Month())) + "," + strconv.Itoa(t.Day()) + ")"
+
+	if t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0 {
+		formula += "+TIME(" + strconv.Itoa(t.Hour()) + "," + strconv.Itoa(t.Minute()) + "," + strconv.Itoa(t.Second()) + ")"
+	}
+
+	return formula
+}
+
+// parseDateString recognizes ISO dates, numeric dates and dates with month names. Numeric
+// dates like 03/04/2020 are read month first, unless dayFirst is set.
+func parseDateString(value string, dayFirst bool) (float64, bool) {
+
+	value = strings.TrimSpace(value)
+
+	// dates need digits, skip the layouts for everything else
+	if len(value) < 6 || !strings.ContainsAny(value, "0123456789") {
+		return 0, false
+	}
+
+	numericLayouts := monthFirstDateLayouts
+	if dayFirst {
+		numericLayouts = dayFirstDateLayouts
+	}
+
+	for _, layouts := range [][]string{isoDateLayouts, numericLayouts, otherDateLayouts} {
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return timeToSerial(t), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// detectDayFirst checks whether a column of numeric dates is written day first, which is
+// the case when any of them starts with a number that can't be a month
+func detectDayFirst(values []string) bool {
+	for _, value := range values {
+		match := numericDateRegex.FindStringSubmatch(strings.TrimSpace(value))
+		if match == nil {
+			continue
+		}
+		first, _ := strconv.Atoi(match[1])
+		second, _ := strconv.Atoi(match[2])
+		if first > 12 && second <= 12 {
+			return true
+		}
+	}
+	return false
+}
+
+func dateArgument(dv *DynamicValue) (time.Time, *DynamicValue) {
+
+	switch dv.ValueType {
+	case DynamicValueTypeError:
+		return time.Time{}, dv
+	case DynamicValueTypeDate, DynamicValueTypeFloat:
+		return serialToTime(dv.DataFloat), nil
+	case DynamicValueTypeString:
+		if serial, ok := parseDateString(dv.DataString, false); ok {
+			return serialToTime(serial), nil
+		}
+	}
+
+	return time.Time{}, makeErrorDv(ErrorCodeValue, "Can't make date from "+convertToString(copyDv(dv)).DataString)
+}
+
+func daysInMonth(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// addMonths keeps the day of the month, but clamps it to the end of shorter months
+func addMonths(t time.Time, months int) time.Time {
+
+	firstOfMonth := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, months, 0)
+
+	day := t.Day()
+	if lastDay := daysInMonth(firstOfMonth.Year(), firstOfMonth.Month()); day > lastDay {
+		day = lastDay
+	}
+
+	return time.Date(firstOfMonth.Year(), firstOfMonth.Month(), day, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// DATE(year, month, day), months and days outside their range roll over
+func dateFunc(arguments []*DynamicValue) *DynamicValue {
+
+	parts := []int{}
+	for _, argument := range arguments {
+		part, errorDv := integerArgument(argument)
+		if errorDv != nil {
+			return errorDv
+		}
+		parts = append(parts, part)
+	}
+
+	year := parts[0]
+	if year < 0 || year > 9999 {
+		return makeErrorDv(ErrorCodeNumber, "DATE year must be between 0 and 9999")
+	}
+
+	// two and three digit years are counted from 1900
+	if year < 1900 {
+		year += 1900
+	}
+
+	return makeDateDv(timeToSerial(time.Date(year, time.Month(parts[1]), parts[2], 0, 0, 0, 0, time.UTC)))
+}
+
+// TIME(hour, minute, second) returns the fraction of a day
+func timeFunc(arguments []*DynamicValue) *DynamicValue {
+
+	seconds := 0
+	for index, multiplier := range []int{3600, 60, 1} {
+		part, errorDv := integerArgument(arguments[index])
+		if errorDv != nil {
+			return errorDv
+		}
+		seconds += part * multiplier
+	}
+
+	if seconds < 0 {
+		return makeErrorDv(ErrorCodeNumber, "TIME can't be negative")
+	}
+
+	serial := float64(seconds%86400) / 86400
+
+	return makeDateDv(serial)
+}
+
+func currentDate() *DynamicValue {
+	now := time.Now()
+	return makeDateDv(timeToSerial(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)))
+}
+
+func currentTime() *DynamicValue {
+	return makeDateDv(timeToSerial(time.Now()))
+}
+
+// DATEVALUE(text) parses a date
+func dateValue(arguments []*DynamicValue) *DynamicValue {
+
+	t, errorDv := dateArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	return makeDateDv(timeToSerial(t))
+}
+
+// EDATE(date, months) and EOMONTH(date, months)
+func monthOffset(function string, arguments []*DynamicValue) *DynamicValue {
+
+	t, errorDv := dateArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	months, errorDv := integerArgument(arguments[1])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	result := addMonths(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), months)
+
+	if function == "EOMONTH" {
+		result = time.Date(result.Year(), result.Month(), daysInMonth(result.Year(), result.Month()), 0, 0, 0, 0, time.UTC)
+	}
+
+	return makeDateDv(timeToSerial(result))
+}
+
+// DATEDIF(start, end, unit) with the units Y, M, D, MD, YM and YD
+func dateDif(arguments []*DynamicValue) *DynamicValue {
+
+	start, errorDv := dateArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+	end, errorDv := dateArgument(arguments[1])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	if end.Before(start) {
+		return makeErrorDv(ErrorCodeNumber, "DATEDIF start date is after the end date")
+	}
+
+	// complete months between the dates
+	months := (end.Year()-start.Year())*12 + int(end.Month()) - int(start.Month())
+	if end.Day() < start.Day() {
+		months--
+	}
+
+	var result int
+
+	switch strings.ToUpper(convertToString(arguments[2]).DataString) {
+	case "Y":
+		result = months / 12
+	case "M":
+		result = months
+	case "YM":
+		result = months % 12
+	case "D":
+		result = int(math.Floor(timeToSerial(end)) - math.Floor(timeToSerial(start)))
+	case "MD":
+		result = end.Day() - start.Day()
+		if result < 0 {
+			previousMonth := addMonths(time.Date(end.Year(), end.Month(), 1, 0, 0, 0, 0, time.UTC), -1)
+			result += daysInMonth(previousMonth.Year(), previousMonth.Month())
+		}
+	case "YD":
+		startInYear := time.Date(end.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		if startInYear.After(end) {
+			startInYear = time.Date(end.Year()-1, start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		result = int(math.Floor(timeToSerial(end)) - timeToSerial(startInYear))
+	default:
+		return makeErrorDv(ErrorCodeNumber, "DATEDIF unit must be one of Y, M, D, MD, YM or YD")
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(result)}
+}
+
+// WEEKDAY(date, [type]), type 1 counts from Sunday = 1, type 2 from Monday = 1 and type 3 from Monday = 0
+func weekday(arguments []*DynamicValue) *DynamicValue {
+
+	t, errorDv := dateArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	returnType := 1
+	if len(arguments) == 2 {
+		returnType, errorDv = integerArgument(arguments[1])
+		if errorDv != nil {
+			return errorDv
+		}
+	}
+
+	day := int(t.Weekday())
+	mondayBased := (day + 6) % 7
+
+	switch returnType {
+	case 1:
+		day = day + 1
+	case 2:
+		day = mondayBased + 1
+	case 3:
+		day = mondayBased
+	default:
+		return makeErrorDv(ErrorCodeNumber, "WEEKDAY type must be 1, 2 or 3")
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(day)}
+}
+
+// YEAR, MONTH, DAY, HOUR, MINUTE and SECOND take one part of a date
+func datePart(function string, arguments []*DynamicValue) *DynamicValue {
+
+	t, errorDv := dateArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	var part int
+	switch function {
+	case "YEAR":
+		part = t.Year()
+	case "MONTH":
+		part = int(t.Month())
+	case "DAY":
+		part = t.Day()
+	case "HOUR":
+		part = t.Hour()
+	case "MINUTE":
+		part = t.Minute()
+	case "SECOND":
+		part = t.Second()
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(part)}
+}
+
+// isDateFormat checks whether a number format contains date or time codes
+func isDateFormat(format string) bool {
+
+	inQuotes := false
+	for _, c := range strings.ToLower(format) {
+		if c == '"' {
+			inQuotes = !inQuotes
+		} else if !inQuotes && strings.ContainsRune("ydhs", c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatDateWithPattern formats a date serial with codes like yyyy-mm-dd, d mmm yy or h:mm AM/PM.
+// The code m means minutes when it follows an hour or precedes seconds.
+func formatDateWithPattern(serial float64, format string) string {
+
+	t := serialToTime(serial)
+
+	type dateToken struct {
+		Code    string
+		Literal string
+	}
+
+	tokens := []dateToken{}
+	hasAmPm := strings.Contains(strings.ToUpper(format), "AM/PM") || strings.Contains(strings.ToUpper(format), "A/P")
+
+	runes := []rune(format)
+	for i := 0; i < len(runes); i++ {
+
+		c := runes[i]
+		lower := strings.ToLower(string(c))
+
+		switch {
+		case c == '"':
+			var literal bytes.Buffer
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				literal.WriteRune(runes[i])
+			}
+			tokens = append(tokens, dateToken{Literal: literal.String()})
+		case c == '\\' && i+1 < len(runes):
+			i++
+			tokens = append(tokens, dateToken{Literal: string(runes[i])})
+		case strings.HasPrefix(strings.ToUpper(string(runes[i:])), "AM/PM"):
+			tokens = append(tokens, dateToken{Code: "AM/PM"})
+			i += 4
+		case strings.HasPrefix(strings.ToUpper(string(runes[i:])), "A/P"):
+			tokens = append(tokens, dateToken{Code: "A/P"})
+			i += 2
+		case strings.Contains("ymdhs", lower):
+			code := lower
+			for i+1 < len(runes) && strings.ToLower(string(runes[i+1])) == lower {
+				code += lower
+				i++
+			}
+			tokens = append(tokens, dateToken{Code: code})
+		default:
+			tokens = append(tokens, dateToken{Literal: string(c)})
+		}
+	}
+
+	hour := t.Hour()
+	if hasAmPm {
+		hour = hour % 12
+		if hour == 0 {
+			hour = 12
+		}
+	}
+
+	pad := func(value int, code string) string {
+		if len(code) > 1 && value < 10 {
+			return "0" + strconv.Itoa(value)
+		}
+		return strconv.Itoa(value)
+	}
+
+	var buff bytes.Buffer
+
+	lastCode := ""
+	for index, token := range tokens {
+
+		if len(token.Code) == 0 {
+			buff.WriteString(token.Literal)
+			continue
+		}
+
+		switch token.Code[0] {
+		case 'y':
+			if len(token.Code) > 2 {
+				buff.WriteString(strconv.Itoa(t.Year()))
+			} else {
+				buff.WriteString(pad(t.Year()%100, "yy"))
+			}
+		case 'd':
+			switch len(token.Code) {
+			case 1, 2:
+				buff.WriteString(pad(t.Day(), token.Code))
+			case 3:
+				buff.WriteString(t.Weekday().String()[:3])
+			default:
+				buff.WriteString(t.Weekday().String())
+			}
+		case 'h':
+			buff.WriteString(pad(hour, token.Code))
+		case 's':
+			buff.WriteString(pad(t.Second(), token.Code))
+		case 'm':
+			isMinute := strings.HasPrefix(lastCode, "h")
+			for _, next := range tokens[index+1:] {
+				if len(next.Code) > 0 {
+					isMinute = isMinute || strings.HasPrefix(next.Code, "s")
+					break
+				}
+			}
+
+			switch {
+			case isMinute && len(token.Code) <= 2:
+				buff.WriteString(pad(t.Minute(), token.Code))
+			case len(token.Code) <= 2:
+				buff.WriteString(pad(int(t.Month()), token.Code))
+			case len(token.Code) == 3:
+				buff.WriteString(t.Month().String()[:3])
+			case len(token.Code) == 4:
+				buff.WriteString(t.Month().String())
+			default:
+				buff.WriteString(t.Month().String()[:1])
+			}
+		case 'A':
+			isMorning := t.Hour() < 12
+			if token.Code == "AM/PM" {
+				if isMorning {
+					buff.WriteString("AM")
+				} else {
+					buff.WriteString("PM")
+				}
+			} else if isMorning {
+				buff.WriteString("A")
+			} else {
+				buff.WriteString("P")
+			}
+		}
+
+		lastCode = token.Code
+	}
+
+	return buff.String()
+}
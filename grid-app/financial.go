@@ -0,0 +1,390 @@
+package main
+
+import (
+	"math"
+
+	"./functions"
+)
+
+// the iterative solvers of IRR, XIRR and RATE give up with #NUM! when they don't converge in time
+const solverMaximumIterations = 100
+const solverTolerance = 1e-10
+
+func init() {
+
+	ranges := functions.Range
+	scalar := functions.Scalar
+
+	functions.Register(&functions.Definition{Name: "PV", MinimumArguments: 3, MaximumArguments: 5,
+		Syntax: "PV(rate, nper, pmt, [fv], [type])", Description: "Returns the present value of an annuity",
+		Native: func(call *functionCall) *DynamicValue { return presentValue(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "FV", MinimumArguments: 3, MaximumArguments: 5,
+		Syntax: "FV(rate, nper, pmt, [pv], [type])", Description: "Returns the future value of an annuity",
+		Native: func(call *functionCall) *DynamicValue { return futureValue(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "PMT", MinimumArguments: 3, MaximumArguments: 5,
+		Syntax: "PMT(rate, nper, pv, [fv], [type])", Description: "Returns the payment per period of an annuity",
+		Native: func(call *functionCall) *DynamicValue { return payment(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "NPER", MinimumArguments: 3, MaximumArguments: 5,
+		Syntax: "NPER(rate, pmt, pv, [fv], [type])", Description: "Returns the number of periods of an annuity",
+		Native: func(call *functionCall) *DynamicValue { return periods(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "RATE", MinimumArguments: 3, MaximumArguments: 6,
+		Syntax: "RATE(nper, pmt, pv, [fv], [type], [guess])", Description: "Returns the interest rate per period of an annuity",
+		Native: func(call *functionCall) *DynamicValue { return rateFunc(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "NPV", MinimumArguments: 2, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{scalar, ranges},
+		Syntax: "NPV(rate, value1, [value2], ...)", Description: "Returns the net present value of periodic cash flows",
+		Native: func(call *functionCall) *DynamicValue { return npv(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "IRR", MinimumArguments: 1, MaximumArguments: 2, ArgumentKinds: []functions.ArgumentKind{ranges, scalar},
+		Syntax: "IRR(values, [guess])", Description: "Returns the internal rate of return of periodic cash flows",
+		Native: func(call *functionCall) *DynamicValue { return irr(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "XNPV", MinimumArguments: 3, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{scalar, ranges, ranges},
+		Syntax: "XNPV(rate, values, dates)", Description: "Returns the net present value of dated cash flows",
+		Native: func(call *functionCall) *DynamicValue { return xnpv(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "XIRR", MinimumArguments: 2, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{ranges, ranges, scalar},
+		Syntax: "XIRR(values, dates, [guess])", Description: "Returns the internal rate of return of dated cash flows",
+		Native: func(call *functionCall) *DynamicValue { return xirr(call.Arguments, call.Grid) }})
+}
+
+func floatArgument(dv *DynamicValue) (float64, *DynamicValue) {
+	floatDv := convertToFloat(dv)
+	if floatDv.ValueType == DynamicValueTypeError {
+		return 0, floatDv
+	}
+	return floatDv.DataFloat, nil
+}
+
+// floatArguments reads the arguments as numbers, missing optional arguments get their default
+func floatArguments(arguments []*DynamicValue, defaults []float64) ([]float64, *DynamicValue) {
+
+	values := append([]float64{}, defaults...)
+
+	for index, dv := range arguments {
+		value, errorDv := floatArgument(dv)
+		if errorDv != nil {
+			return nil, errorDv
+		}
+		values[index] = value
+	}
+
+	return values, nil
+}
+
+// solveRate finds the rate for which f is zero with Newton's method, starting at guess
+func solveRate(f func(rate float64) float64, guess float64) (float64, bool) {
+
+	rate := guess
+
+	for iteration := 0; iteration < solverMaximumIterations; iteration++ {
+
+		value := f(rate)
+
+		// the derivative is approximated, the functions solved are smooth above -1
+		step := 1e-7 * math.Max(1, math.Abs(rate))
+		derivative := (f(rate+step) - value) / step
+
+		if derivative == 0 || math.IsNaN(derivative) || math.IsInf(derivative, 0) {
+			return 0, false
+		}
+
+		newRate := rate - value/derivative
+
+		if newRate <= -1 || math.IsNaN(newRate) || math.IsInf(newRate, 0) {
+			return 0, false
+		}
+
+		if math.Abs(newRate-rate) < solverTolerance {
+			return newRate, true
+		}
+
+		rate = newRate
+	}
+
+	return 0, false
+}
+
+// annuity returns the future value of the present value, payments and future value, which is
+// zero at the right rate. Payments are made at the end of every period, or at the start when
+// isStart is set.
+func annuity(rate float64, periods float64, payment float64, presentValue float64, futureValue float64, isStart bool) float64 {
+
+	if rate == 0 {
+		return presentValue + payment*periods + futureValue
+	}
+
+	timing := 1.0
+	if isStart {
+		timing = 1 + rate
+	}
+
+	growth := math.Pow(1+rate, periods)
+
+	return presentValue*growth + payment*timing*(growth-1)/rate + futureValue
+}
+
+func financialResult(function string, value float64) *DynamicValue {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return makeErrorDv(ErrorCodeNumber, function+" has no result for these arguments")
+	}
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value}
+}
+
+// PV(rate, nper, pmt, [fv], [type])
+func presentValue(arguments []*DynamicValue) *DynamicValue {
+
+	values, errorDv := floatArguments(arguments, []float64{0, 0, 0, 0, 0})
+	if errorDv != nil {
+		return errorDv
+	}
+	rate, periods, payment, futureValue, isStart := values[0], values[1], values[2], values[3], values[4] != 0
+
+	// solve annuity(pv) = 0, which is linear in pv
+	growth := math.Pow(1+rate, periods)
+
+	return financialResult("PV", -annuity(rate, periods, payment, 0, futureValue, isStart)/growth)
+}
+
+// FV(rate, nper, pmt, [pv], [type])
+func futureValue(arguments []*DynamicValue) *DynamicValue {
+
+	values, errorDv := floatArguments(arguments, []float64{0, 0, 0, 0, 0})
+	if errorDv != nil {
+		return errorDv
+	}
+	rate, periods, payment, presentValue, isStart := values[0], values[1], values[2], values[3], values[4] != 0
+
+	return financialResult("FV", -annuity(rate, periods, payment, presentValue, 0, isStart))
+}
+
+// PMT(rate, nper, pv, [fv], [type])
+func payment(arguments []*DynamicValue) *DynamicValue {
+
+	values, errorDv := floatArguments(arguments, []float64{0, 0, 0, 0, 0})
+	if errorDv != nil {
+		return errorDv
+	}
+	rate, periods, presentValue, futureValue, isStart := values[0], values[1], values[2], values[3], values[4] != 0
+
+	if periods == 0 {
+		return makeErrorDv(ErrorCodeNumber, "PMT requires a number of periods")
+	}
+
+	// annuity is linear in the payment as well
+	withoutPayment := annuity(rate, periods, 0, presentValue, futureValue, isStart)
+	perPayment := annuity(rate, periods, 1, 0, 0, isStart)
+
+	return financialResult("PMT", -withoutPayment/perPayment)
+}
+
+// NPER(rate, pmt, pv, [fv], [type])
+func periods(arguments []*DynamicValue) *DynamicValue {
+
+	values, errorDv := floatArguments(arguments, []float64{0, 0, 0, 0, 0})
+	if errorDv != nil {
+		return errorDv
+	}
+	rate, payment, presentValue, futureValue, isStart := values[0], values[1], values[2], values[3], values[4] != 0
+
+	if rate == 0 {
+		if payment == 0 {
+			return makeErrorDv(ErrorCodeNumber, "NPER requires a payment when the rate is 0")
+		}
+		return financialResult("NPER", -(presentValue+futureValue)/payment)
+	}
+
+	timing := 1.0
+	if isStart {
+		timing = 1 + rate
+	}
+
+	return financialResult("NPER", math.Log((payment*timing-futureValue*rate)/(payment*timing+presentValue*rate))/math.Log(1+rate))
+}
+
+// RATE(nper, pmt, pv, [fv], [type], [guess])
+func rateFunc(arguments []*DynamicValue) *DynamicValue {
+
+	values, errorDv := floatArguments(arguments, []float64{0, 0, 0, 0, 0, 0.1})
+	if errorDv != nil {
+		return errorDv
+	}
+	periods, payment, presentValue, futureValue, isStart, guess := values[0], values[1], values[2], values[3], values[4] != 0, values[5]
+
+	rate, ok := solveRate(func(rate float64) float64 {
+		return annuity(rate, periods, payment, presentValue, futureValue, isStart)
+	}, guess)
+
+	if !ok {
+		return makeErrorDv(ErrorCodeNumber, "RATE didn't converge, try another guess")
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: rate}
+}
+
+// netPresentValue discounts the cash flows, the first one is discounted by offset periods
+func netPresentValue(rate float64, cashFlows []float64, offset float64) float64 {
+	total := 0.0
+	for index, cashFlow := range cashFlows {
+		total += cashFlow / math.Pow(1+rate, float64(index)+offset)
+	}
+	return total
+}
+
+// NPV(rate, value1, [value2], ...) discounts every value by one period more than the previous,
+// starting with the first
+func npv(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	rate, errorDv := floatArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	cashFlows, errorDv := statisticValues("NPV", arguments[1:], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	return financialResult("NPV", netPresentValue(rate, cashFlows, 1))
+}
+
+// hasSignChange checks that there is both a positive and a negative cash flow, otherwise there
+// is no rate of return
+func hasSignChange(cashFlows []float64) bool {
+	isPositive, isNegative := false, false
+	for _, cashFlow := range cashFlows {
+		isPositive = isPositive || cashFlow > 0
+		isNegative = isNegative || cashFlow < 0
+	}
+	return isPositive && isNegative
+}
+
+// IRR(values, [guess])
+func irr(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	cashFlows, errorDv := statisticValues("IRR", arguments[0:1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	guess := 0.1
+	if len(arguments) == 2 {
+		guess, errorDv = floatArgument(arguments[1])
+		if errorDv != nil {
+			return errorDv
+		}
+	}
+
+	if !hasSignChange(cashFlows) {
+		return makeErrorDv(ErrorCodeNumber, "IRR requires at least one positive and one negative value")
+	}
+
+	rate, ok := solveRate(func(rate float64) float64 {
+		return netPresentValue(rate, cashFlows, 0)
+	}, guess)
+
+	if !ok {
+		return makeErrorDv(ErrorCodeNumber, "IRR didn't converge, try another guess")
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: rate}
+}
+
+// datedCashFlows reads the values and dates of XNPV and XIRR, both need to be the same size and
+// hold numbers only
+func datedCashFlows(function string, valuesArgument *DynamicValue, datesArgument *DynamicValue, grid *Grid) ([]float64, []float64, *DynamicValue) {
+
+	valueCells, errorDv := statisticCells(valuesArgument, grid)
+	if errorDv != nil {
+		return nil, nil, errorDv
+	}
+	dateCells, errorDv := statisticCells(datesArgument, grid)
+	if errorDv != nil {
+		return nil, nil, errorDv
+	}
+
+	if len(valueCells) != len(dateCells) {
+		return nil, nil, makeErrorDv(ErrorCodeNumber, function+" requires as many dates as values")
+	}
+
+	cashFlows, errorDv := numericValues(valueCells)
+	if errorDv != nil {
+		return nil, nil, errorDv
+	}
+	dates, errorDv := numericValues(dateCells)
+	if errorDv != nil {
+		return nil, nil, errorDv
+	}
+
+	if len(cashFlows) != len(valueCells) || len(dates) != len(dateCells) {
+		return nil, nil, makeErrorDv(ErrorCodeValue, function+" requires numbers and dates only")
+	}
+
+	for _, date := range dates {
+		if date < dates[0] {
+			return nil, nil, makeErrorDv(ErrorCodeNumber, function+" requires dates after the first date")
+		}
+	}
+
+	return cashFlows, dates, nil
+}
+
+// datedPresentValue discounts every cash flow by the years since the first date
+func datedPresentValue(rate float64, cashFlows []float64, dates []float64) float64 {
+	total := 0.0
+	for index, cashFlow := range cashFlows {
+		total += cashFlow / math.Pow(1+rate, (dates[index]-dates[0])/365)
+	}
+	return total
+}
+
+// XNPV(rate, values, dates)
+func xnpv(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	rate, errorDv := floatArgument(arguments[0])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	cashFlows, dates, errorDv := datedCashFlows("XNPV", arguments[1], arguments[2], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	return financialResult("XNPV", datedPresentValue(rate, cashFlows, dates))
+}
+
+// XIRR(values, dates, [guess])
+func xirr(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	cashFlows, dates, errorDv := datedCashFlows("XIRR", arguments[0], arguments[1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	guess := 0.1
+	if len(arguments) == 3 {
+		guess, errorDv = floatArgument(arguments[2])
+		if errorDv != nil {
+			return errorDv
+		}
+	}
+
+	if !hasSignChange(cashFlows) {
+		return makeErrorDv(ErrorCodeNumber, "XIRR requires at least one positive and one negative value")
+	}
+
+	rate, ok := solveRate(func(rate float64) float64 {
+		return datedPresentValue(rate, cashFlows, dates)
+	}, guess)
+
+	if !ok {
+		return makeErrorDv(ErrorCodeNumber, "XIRR didn't converge, try another guess")
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: rate}
+}
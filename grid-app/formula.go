@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// token kinds produced by tokenizeFormula
+const (
+	formulaTokenNumber     int8 = 0
+	formulaTokenString     int8 = 1
+	formulaTokenBool       int8 = 2
+	formulaTokenReference  int8 = 3
+	formulaTokenRange      int8 = 4
+	formulaTokenName       int8 = 5
+	formulaTokenOperator   int8 = 6
+	formulaTokenOpenParen  int8 = 7
+	formulaTokenCloseParen int8 = 8
+	formulaTokenComma      int8 = 9
+	formulaTokenEnd        int8 = 10
+	formulaTokenError      int8 = 11
+	formulaTokenWholeRange int8 = 12 // whole columns or rows like A:C and 3:5
+)
+
+// node kinds of the formula AST
+const (
+	formulaNodeNumber    int8 = 0
+	formulaNodeString    int8 = 1
+	formulaNodeBool      int8 = 2
+	formulaNodeReference int8 = 3
+	formulaNodeRange     int8 = 4
+	formulaNodeUnary     int8 = 5
+	formulaNodeBinary    int8 = 6
+	formulaNodeFunction  int8 = 7
+	formulaNodeError     int8 = 8
+	formulaNodeName      int8 = 9
+	formulaNodeValue     int8 = 10 // a value bound to a name by LET or a LAMBDA call
+)
+
+type formulaToken struct {
+	Kind  int8
+	Text  string
+	Start int
+	End   int
+
+	// only set for number, string and bool tokens
+	Number float64
+	Bool   bool
+}
+
+type formulaNode struct {
+	Kind     int8
+	Number   float64
+	Bool     bool
+	Text     string // string literal, error code, operator, function name or reference as written
+	Children []*formulaNode
+	Value    *DynamicValue // only set for value nodes
+
+	// where the name of name and function nodes is in the formula
+	Start int
+	End   int
+}
+
+// compiledFormula caches the AST of a DynamicValue's DataFormula, it's rebuilt whenever DataFormula changes
+type compiledFormula struct {
+	formula string
+	root    *formulaNode
+	err     error
+}
+
+var cellReferenceRegex *regexp.Regexp
+var sheetNameRegex *regexp.Regexp
+var definedNameRegex *regexp.Regexp
+var columnReferenceRegex *regexp.Regexp
+var rowReferenceRegex *regexp.Regexp
+
+// binary operators and their precedence, higher binds stronger (all left associative)
+var binaryOperatorPrecedence = map[string]int{
+	">": 1, "<": 1, ">=": 1, "<=": 1, "==": 1, "<>": 1, "!=": 1,
+	"+": 2, "-": 2,
+	"*": 3, "/": 3,
+	"^": 4,
+}
+
+func formulaInit() {
+	cellReferenceRegex = regexp.MustCompile(`^\$?[A-Z]+\$?[1-9][0-9]*$`)
+	sheetNameRegex = regexp.MustCompile(`^[\pL_][\pL\pN_.]*$`)
+	definedNameRegex = regexp.MustCompile(`^[\pL_][\pL\pN_]*(\.[\pL_][\pL\pN_]*)*$`)
+	columnReferenceRegex = regexp.MustCompile(`^\$?[A-Z]+$`)
+	rowReferenceRegex = regexp.MustCompile(`^\$?[1-9][0-9]*$`)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '$'
+}
+
+// wholeRowRangeEnd returns the end of a row range like 3:5 or 3:$5 that starts at k, or -1
+func wholeRowRangeEnd(runes []rune, k int) int {
+
+	readRow := func(start int) int {
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		if !rowReferenceRegex.MatchString(string(runes[start:end])) {
+			return -1
+		}
+		return end
+	}
+
+	end := readRow(k)
+	if end == -1 || end >= len(runes) || runes[end] != ':' {
+		return -1
+	}
+
+	return readRow(end + 1)
+}
+
+func tokenizeFormula(formula string) ([]formulaToken, error) {
+
+	tokens := []formulaToken{}
+	runes := []rune(formula)
+
+	// byte offsets are kept so tokens can be replaced in the original string
+	offsets := make([]int, len(runes)+1)
+	offset := 0
+	for k, r := range runes {
+		offsets[k] = offset
+		offset += len(string(r))
+	}
+	offsets[len(runes)] = offset
+
+	readWord := func(start int) int {
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		return end
+	}
+
+	k := 0
+
+	for k < len(runes) {
+
+		r := runes[k]
+
+		if unicode.IsSpace(r) {
+			k++
+			continue
+		}
+
+		start := k
+
+		switch {
+		case r == '"':
+
+			var buf bytes.Buffer
+			closed := false
+			k++
+
+			for k < len(runes) {
+				if runes[k] == '\\' && k+1 < len(runes) && (runes[k+1] == '"' || runes[k+1] == '\\') {
+					buf.WriteRune(runes[k+1])
+					k += 2
+					continue
+				}
+				if runes[k] == '"' {
+					closed = true
+					k++
+					break
+				}
+				buf.WriteRune(runes[k])
+				k++
+			}
+
+			if !closed {
+				return tokens, errors.New("unterminated string")
+			}
+
+			tokens = append(tokens, formulaToken{Kind: formulaTokenString, Text: buf.String(), Start: offsets[start], End: offsets[k]})
+
+		case unicode.IsDigit(r) && wholeRowRangeEnd(runes, k) != -1:
+
+			k = wholeRowRangeEnd(runes, k)
+			tokens = append(tokens, formulaToken{Kind: formulaTokenWholeRange, Text: string(runes[start:k]), Start: offsets[start], End: offsets[k]})
+
+		case unicode.IsDigit(r) || (r == '.' && k+1 < len(runes) && unicode.IsDigit(runes[k+1])):
+
+			for k < len(runes) && unicode.IsDigit(runes[k]) {
+				k++
+			}
+			if k < len(runes) && runes[k] == '.' {
+				k++
+				if k >= len(runes) || !unicode.IsDigit(runes[k]) {
+					return tokens, fmt.Errorf("invalid number at position %d", start)
+				}
+				for k < len(runes) && unicode.IsDigit(runes[k]) {
+					k++
+				}
+			}
+
+			// optional exponent, only consumed when digits follow
+			if k < len(runes) && (runes[k] == 'e' || runes[k] == 'E') {
+				exponentEnd := k + 1
+				if exponentEnd < len(runes) && (runes[exponentEnd] == '+' || runes[exponentEnd] == '-') {
+					exponentEnd++
+				}
+				if exponentEnd < len(runes) && unicode.IsDigit(runes[exponentEnd]) {
+					for exponentEnd < len(runes) && unicode.IsDigit(runes[exponentEnd]) {
+						exponentEnd++
+					}
+					k = exponentEnd
+				}
+			}
+
+			text := string(runes[start:k])
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return tokens, fmt.Errorf("invalid number %s", text)
+			}
+
+			tokens = append(tokens, formulaToken{Kind: formulaTokenNumber, Text: text, Number: value, Start: offsets[start], End: offsets[k]})
+
+		case r == '\'' || unicode.IsLetter(r) || r == '_' || r == '$':
+
+			hasSheet := false
+
+			if r == '\'' {
+				closing := k + 1
+				for closing < len(runes) && runes[closing] != '\'' {
+					closing++
+				}
+				if closing >= len(runes) || closing == k+1 {
+					return tokens, errors.New("unterminated sheet name")
+				}
+				if closing+1 >= len(runes) || runes[closing+1] != '!' {
+					return tokens, errors.New("quoted sheet name should be followed by !")
+				}
+				k = closing + 2
+				hasSheet = true
+			} else {
+				end := readWord(k)
+				if end < len(runes) && runes[end] == '!' && !(end+1 < len(runes) && runes[end+1] == '=') {
+					if !sheetNameRegex.MatchString(string(runes[k:end])) {
+						return tokens, fmt.Errorf("invalid sheet name %s", string(runes[k:end]))
+					}
+					k = end + 1
+					hasSheet = true
+				}
+			}
+
+			cellStart := k
+			k = readWord(k)
+			word := string(runes[cellStart:k])
+
+			if !hasSheet && k < len(runes) && runes[k] == '(' {
+				if strings.Contains(word, "$") {
+					return tokens, fmt.Errorf("invalid function name %s", word)
+				}
+				tokens = append(tokens, formulaToken{Kind: formulaTokenName, Text: word, Start: offsets[start], End: offsets[k]})
+				continue
+			}
+
+			// whole columns like A:C and rows like Sheet1!3:5
+			if (columnReferenceRegex.MatchString(word) || rowReferenceRegex.MatchString(word)) && k < len(runes) && runes[k] == ':' {
+				rangeEnd := readWord(k + 1)
+				end := string(runes[k+1 : rangeEnd])
+				if columnReferenceRegex.MatchString(word) != columnReferenceRegex.MatchString(end) || !(columnReferenceRegex.MatchString(end) || rowReferenceRegex.MatchString(end)) {
+					return tokens, fmt.Errorf("invalid range %s", string(runes[start:rangeEnd]))
+				}
+				k = rangeEnd
+				tokens = append(tokens, formulaToken{Kind: formulaTokenWholeRange, Text: string(runes[start:k]), Start: offsets[start], End: offsets[k]})
+				continue
+			}
+
+			if !cellReferenceRegex.MatchString(word) {
+
+				if !hasSheet && (strings.ToUpper(word) == "TRUE" || strings.ToUpper(word) == "FALSE") {
+					tokens = append(tokens, formulaToken{Kind: formulaTokenBool, Text: word, Bool: strings.ToUpper(word) == "TRUE", Start: offsets[start], End: offsets[k]})
+					continue
+				}
+
+				if hasSheet {
+					return tokens, fmt.Errorf("invalid reference %s", string(runes[start:k]))
+				}
+				if !definedNameRegex.MatchString(word) {
+					return tokens, fmt.Errorf("invalid name %s", word)
+				}
+
+				tokens = append(tokens, formulaToken{Kind: formulaTokenName, Text: word, Start: offsets[start], End: offsets[k]})
+				continue
+			}
+
+			kind := formulaTokenReference
+
+			if k < len(runes) && runes[k] == ':' {
+				rangeEnd := readWord(k + 1)
+				if !cellReferenceRegex.MatchString(string(runes[k+1 : rangeEnd])) {
+					return tokens, fmt.Errorf("invalid range %s", string(runes[start:rangeEnd]))
+				}
+				k = rangeEnd
+				kind = formulaTokenRange
+			}
+
+			tokens = append(tokens, formulaToken{Kind: kind, Text: string(runes[start:k]), Start: offsets[start], End: offsets[k]})
+
+		case r == '#':
+
+			// error literals such as #N/A
+			errorCode := ""
+			for _, code := range errorCodes {
+				if strings.HasPrefix(string(runes[k:]), code) {
+					errorCode = code
+					break
+				}
+			}
+			if errorCode == "" {
+				return tokens, fmt.Errorf("unknown error literal at position %d", start)
+			}
+
+			k += len([]rune(errorCode))
+			tokens = append(tokens, formulaToken{Kind: formulaTokenError, Text: errorCode, Start: offsets[start], End: offsets[k]})
+
+		case r == '(':
+			k++
+			tokens = append(tokens, formulaToken{Kind: formulaTokenOpenParen, Text: "(", Start: offsets[start], End: offsets[k]})
+
+		case r == ')':
+			k++
+			tokens = append(tokens, formulaToken{Kind: formulaTokenCloseParen, Text: ")", Start: offsets[start], End: offsets[k]})
+
+		case r == ',':
+			k++
+			tokens = append(tokens, formulaToken{Kind: formulaTokenComma, Text: ",", Start: offsets[start], End: offsets[k]})
+
+		default:
+
+			// try two character operators first
+			operator := ""
+			if k+1 < len(runes) {
+				if _, ok := binaryOperatorPrecedence[string(runes[k:k+2])]; ok {
+					operator = string(runes[k : k+2])
+				}
+			}
+			if operator == "" {
+				if _, ok := binaryOperatorPrecedence[string(r)]; ok {
+					operator = string(r)
+				}
+			}
+			if operator == "" {
+				return tokens, fmt.Errorf("unexpected character %s at position %d", string(r), start)
+			}
+
+			k += len([]rune(operator))
+			tokens = append(tokens, formulaToken{Kind: formulaTokenOperator, Text: operator, Start: offsets[start], End: offsets[k]})
+		}
+	}
+
+	tokens = append(tokens, formulaToken{Kind: formulaTokenEnd, Start: offsets[len(runes)], End: offsets[len(runes)]})
+
+	return tokens, nil
+}
+
+type formulaParser struct {
+	tokens   []formulaToken
+	position int
+}
+
+func (p *formulaParser) peek() formulaToken {
+	return p.tokens[p.position]
+}
+
+func (p *formulaParser) next() formulaToken {
+	token := p.tokens[p.position]
+	if token.Kind != formulaTokenEnd {
+		p.position++
+	}
+	return token
+}
+
+// precedence climbing: parse operands and every binary operator that binds at least as strong as minPrecedence
+func (p *formulaParser) parseExpression(minPrecedence int) (*formulaNode, error) {
+
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		if token.Kind != formulaTokenOperator {
+			return lhs, nil
+		}
+
+		precedence := binaryOperatorPrecedence[token.Text]
+		if precedence < minPrecedence {
+			return lhs, nil
+		}
+		p.next()
+
+		rhs, err := p.parseExpression(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		lhs = &formulaNode{Kind: formulaNodeBinary, Text: token.Text, Children: []*formulaNode{lhs, rhs}}
+	}
+}
+
+func (p *formulaParser) parseUnary() (*formulaNode, error) {
+
+	token := p.peek()
+
+	if token.Kind == formulaTokenOperator && token.Text == "-" {
+		p.next()
+
+		// a single minus sign negates the operand, stacked signs are rejected
+		if p.peek().Kind == formulaTokenOperator {
+			return nil, fmt.Errorf("unexpected operator %s", p.peek().Text)
+		}
+
+		operand, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &formulaNode{Kind: formulaNodeUnary, Text: "-", Children: []*formulaNode{operand}}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *formulaParser) parsePrimary() (*formulaNode, error) {
+
+	token := p.next()
+
+	switch token.Kind {
+	case formulaTokenNumber:
+		return &formulaNode{Kind: formulaNodeNumber, Number: token.Number, Text: token.Text}, nil
+	case formulaTokenString:
+		return &formulaNode{Kind: formulaNodeString, Text: token.Text}, nil
+	case formulaTokenBool:
+		return &formulaNode{Kind: formulaNodeBool, Bool: token.Bool, Text: token.Text}, nil
+	case formulaTokenReference:
+		return &formulaNode{Kind: formulaNodeReference, Text: token.Text}, nil
+	case formulaTokenRange, formulaTokenWholeRange:
+		return &formulaNode{Kind: formulaNodeRange, Text: token.Text}, nil
+	case formulaTokenError:
+		return &formulaNode{Kind: formulaNodeError, Text: token.Text}, nil
+	case formulaTokenOpenParen:
+
+		node, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.next().Kind != formulaTokenCloseParen {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		return node, nil
+
+	case formulaTokenName:
+
+		// names that aren't function calls refer to defined names
+		if p.peek().Kind != formulaTokenOpenParen {
+			return &formulaNode{Kind: formulaNodeName, Text: token.Text, Start: token.Start, End: token.End}, nil
+		}
+		p.next()
+
+		node := &formulaNode{Kind: formulaNodeFunction, Text: token.Text, Children: []*formulaNode{}, Start: token.Start, End: token.End}
+
+		if p.peek().Kind == formulaTokenCloseParen {
+			p.next()
+			return node, nil
+		}
+
+		for {
+			argument, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, argument)
+
+			separator := p.next()
+			if separator.Kind == formulaTokenCloseParen {
+				return node, nil
+			}
+			if separator.Kind != formulaTokenComma {
+				return nil, fmt.Errorf("expected , or ) in arguments of %s", token.Text)
+			}
+		}
+
+	case formulaTokenEnd:
+		return nil, errors.New("unexpected end of formula")
+	}
+
+	return nil, fmt.Errorf("unexpected %s", token.Text)
+}
+
+func compileFormula(formula string) (*formulaNode, error) {
+
+	tokens, err := tokenizeFormula(formula)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := formulaParser{tokens: tokens}
+
+	root, err := parser.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.peek().Kind != formulaTokenEnd {
+		return nil, fmt.Errorf("unexpected %s", parser.peek().Text)
+	}
+
+	return root, nil
+}
+
+// getCompiledFormula returns the cached AST for the formula of dv, compiling it when the formula changed
+func getCompiledFormula(dv *DynamicValue) *compiledFormula {
+	if dv.compiled == nil || dv.compiled.formula != dv.DataFormula {
+		root, err := compileFormula(dv.DataFormula)
+		dv.compiled = &compiledFormula{formula: dv.DataFormula, root: root, err: err}
+	}
+	return dv.compiled
+}
+
+// formulaStringLiteral turns a raw string into a quoted formula string literal
+func formulaStringLiteral(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return "\"" + value + "\""
+}
+
+// valueFormula returns a formula that evaluates to a value
+func valueFormula(dv *DynamicValue) string {
+
+	switch dv.ValueType {
+	case DynamicValueTypeString:
+		return formulaStringLiteral(dv.DataString)
+	case DynamicValueTypeError:
+		// error codes are valid formula literals
+		return dv.DataString
+	case DynamicValueTypeDate:
+		return dateFormula(dv.DataFloat)
+	case DynamicValueTypeFloat:
+		return strconv.FormatFloat(dv.DataFloat, 'f', -1, 64)
+	}
+
+	if dv.DataBool {
+		return "TRUE"
+	}
+	return "FALSE"
+}
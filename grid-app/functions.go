@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"./functions"
+)
+
+// Functions are kept in the registry of the functions package, see there for how to add them. The
+// functions of the spreadsheet itself register a Native implementation that works on DynamicValues
+// and the grid, other packages register a Call on plain functions.Values and are included with a
+// blank import.
+
+type functionCall struct {
+	Name string
+	Node *formulaNode
+
+	// evaluated arguments, lazy arguments are nil and are read from Node.Children
+	Arguments []*DynamicValue
+
+	Grid      *Grid
+	TargetRef Reference
+	NameDepth int // the names and LAMBDAs being evaluated around the call
+}
+
+// callFunction checks and evaluates the arguments of a call to a registered function before calling it
+func callFunction(definition *functions.Definition, node *formulaNode, grid *Grid, targetRef Reference, nameDepth int) *DynamicValue {
+
+	if !definition.AcceptsArgumentCount(len(node.Children)) {
+		errorDv := makeErrorDv(ErrorCodeValue, definition.ArityMessage())
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	arguments := []*DynamicValue{}
+
+	for index, argumentNode := range node.Children {
+
+		kind := definition.ArgumentKind(index)
+
+		if kind == functions.Lazy {
+			arguments = append(arguments, nil)
+			continue
+		}
+
+		dv := evaluateNode(argumentNode, grid, targetRef, nameDepth)
+
+		if kind == functions.Scalar && dv.ValueType == DynamicValueTypeReference {
+			dv = makeErrorDv(ErrorCodeValue, definition.Name+" requires a single value as argument "+strconv.Itoa(index+1)+", not the range "+dv.DataString)
+		}
+
+		// error values in arguments propagate, except for functions that handle errors themselves
+		if dv.ValueType == DynamicValueTypeError && !definition.HandlesErrors {
+			return dv
+		}
+
+		arguments = append(arguments, dv)
+	}
+
+	if native, ok := definition.Native.(func(call *functionCall) *DynamicValue); ok {
+		return native(&functionCall{Name: definition.Name, Node: node, Arguments: arguments, Grid: grid, TargetRef: targetRef, NameDepth: nameDepth})
+	}
+
+	values := []functions.Value{}
+	for _, dv := range arguments {
+		values = append(values, toFunctionValue(dv, grid))
+	}
+
+	result := fromFunctionValue(definition.Call(&functions.Call{Name: definition.Name, Arguments: values}))
+	result.SheetIndex = targetRef.SheetIndex
+
+	return result
+}
+
+// toFunctionValue converts an argument for a function registered by another package, ranges become arrays
+func toFunctionValue(dv *DynamicValue, grid *Grid) functions.Value {
+
+	if dv.ValueType == DynamicValueTypeReference || dv.ValueType == DynamicValueTypeArray {
+
+		rows, errorDv := arrayArgument(dv, grid)
+		if errorDv != nil {
+			return toFunctionValue(errorDv, grid)
+		}
+
+		valueRows := [][]functions.Value{}
+		for _, row := range rows {
+			valueRow := []functions.Value{}
+			for _, element := range row {
+				valueRow = append(valueRow, toFunctionValue(element, grid))
+			}
+			valueRows = append(valueRows, valueRow)
+		}
+
+		return functions.NewArray(valueRows)
+	}
+
+	switch dv.ValueType {
+	case DynamicValueTypeFloat, DynamicValueTypeDate:
+		return functions.NewNumber(dv.DataFloat)
+	case DynamicValueTypeBool:
+		return functions.NewBool(dv.DataBool)
+	case DynamicValueTypeError:
+		return functions.NewError(dv.DataString, dv.ErrorMessage)
+	}
+
+	return functions.NewText(dv.DataString)
+}
+
+// fromFunctionValue converts the result of a function registered by another package
+func fromFunctionValue(value functions.Value) *DynamicValue {
+
+	switch value.Type {
+	case functions.NumberType:
+		return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value.Number}
+	case functions.BoolType:
+		return &DynamicValue{ValueType: DynamicValueTypeBool, DataBool: value.Bool}
+	case functions.ErrorType:
+		return makeErrorDv(value.Text, value.Message)
+	case functions.ArrayType:
+
+		if len(value.Array) == 0 || len(value.Array[0]) == 0 {
+			return makeErrorDv(ErrorCodeCalc, "Empty array")
+		}
+
+		rows := [][]*DynamicValue{}
+		for _, valueRow := range value.Array {
+			row := []*DynamicValue{}
+			for _, element := range valueRow {
+				row = append(row, fromFunctionValue(element))
+			}
+			rows = append(rows, row)
+		}
+
+		return makeArrayDv(rows)
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: value.Text}
+}
+
+// sendFunctions sends the name, syntax and description of the functions for autocomplete
+func sendFunctions(c *Client) {
+
+	jsonData := []string{"FUNCTIONS"}
+	for _, name := range functions.Names() {
+		definition := functions.Lookup(name)
+		jsonData = append(jsonData, definition.Name, definition.Syntax, definition.Description)
+	}
+
+	json, _ := json.Marshal(jsonData)
+	c.send <- json
+}
+
+// the functions implemented in parse.go
+func init() {
+
+	scalar := functions.Scalar
+	ranges := functions.Range
+
+	// aggregations
+
+	functions.Register(&functions.Definition{Name: "SUM", MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "SUM(value1, [value2], ...)", Description: "Adds numbers and the numbers in ranges",
+		Native: func(call *functionCall) *DynamicValue { return sum(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "AVERAGE", MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "AVERAGE(value1, [value2], ...)", Description: "Averages numbers and the numbers in ranges",
+		Native: func(call *functionCall) *DynamicValue { return average(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "COUNT", MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges}, HandlesErrors: true,
+		Syntax: "COUNT(value1, [value2], ...)", Description: "Counts the numbers in values and ranges",
+		Native: func(call *functionCall) *DynamicValue { return count(call.Arguments, call.Grid) }})
+
+	// statistics
+
+	functions.RegisterNames([]string{"MIN", "MAX"}, functions.Definition{MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "MIN(value1, [value2], ...)", Description: "Returns the smallest or largest number",
+		Native: func(call *functionCall) *DynamicValue { return minMax(call.Name, call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "MEDIAN", MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "MEDIAN(value1, [value2], ...)", Description: "Returns the middle number",
+		Native: func(call *functionCall) *DynamicValue { return median(call.Arguments, call.Grid) }})
+
+	functions.RegisterNames([]string{"STDEV", "STDEV.S", "STDEV.P", "STDEVP"}, functions.Definition{MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "STDEV(value1, [value2], ...)", Description: "Returns the standard deviation of a sample, or of the population for the .P variants",
+		Native: func(call *functionCall) *DynamicValue { return varianceFunc(call.Name, call.Arguments, call.Grid) }})
+
+	functions.RegisterNames([]string{"VAR", "VAR.S", "VAR.P", "VARP"}, functions.Definition{MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "VAR(value1, [value2], ...)", Description: "Returns the variance of a sample, or of the population for the .P variants",
+		Native: func(call *functionCall) *DynamicValue { return varianceFunc(call.Name, call.Arguments, call.Grid) }})
+
+	functions.RegisterNames([]string{"PERCENTILE", "PERCENTILE.INC"}, functions.Definition{MinimumArguments: 2, MaximumArguments: 2, ArgumentKinds: []functions.ArgumentKind{ranges, scalar},
+		Syntax: "PERCENTILE(range, k)", Description: "Returns the k-th percentile, k is between 0 and 1",
+		Native: func(call *functionCall) *DynamicValue { return percentile(call.Name, call.Arguments, call.Grid) }})
+
+	functions.RegisterNames([]string{"QUARTILE", "QUARTILE.INC"}, functions.Definition{MinimumArguments: 2, MaximumArguments: 2, ArgumentKinds: []functions.ArgumentKind{ranges, scalar},
+		Syntax: "QUARTILE(range, quart)", Description: "Returns a quartile, quart is 0 to 4",
+		Native: func(call *functionCall) *DynamicValue { return percentile(call.Name, call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "CORREL", MinimumArguments: 2, MaximumArguments: 2, ArgumentKinds: []functions.ArgumentKind{ranges, ranges},
+		Syntax: "CORREL(range1, range2)", Description: "Returns the correlation coefficient of two ranges",
+		Native: func(call *functionCall) *DynamicValue { return correl(call.Arguments, call.Grid) }})
+
+	functions.RegisterNames([]string{"RANK", "RANK.EQ"}, functions.Definition{MinimumArguments: 2, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{scalar, ranges, scalar},
+		Syntax: "RANK(number, range, [order])", Description: "Returns the rank of a number in a range, descending unless order isn't 0",
+		Native: func(call *functionCall) *DynamicValue { return rank(call.Arguments, call.Grid) }})
+
+	// logical
+
+	functions.Register(&functions.Definition{Name: "IF", MinimumArguments: 3, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{scalar, ranges, ranges}, HandlesErrors: true,
+		Syntax: "IF(condition, value_if_true, value_if_false)", Description: "Returns one of two values depending on a condition",
+		Native: func(call *functionCall) *DynamicValue { return ifFunc(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "IFERROR", MinimumArguments: 2, MaximumArguments: 2, ArgumentKinds: []functions.ArgumentKind{ranges, ranges}, HandlesErrors: true,
+		Syntax: "IFERROR(value, value_if_error)", Description: "Returns the value, or value_if_error when it's an error",
+		Native: func(call *functionCall) *DynamicValue { return ifError(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "ISERROR", MinimumArguments: 1, MaximumArguments: 1, ArgumentKinds: []functions.ArgumentKind{ranges}, HandlesErrors: true,
+		Syntax: "ISERROR(value)", Description: "Checks whether a value is an error",
+		Native: func(call *functionCall) *DynamicValue { return isError(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "ISNA", MinimumArguments: 1, MaximumArguments: 1, ArgumentKinds: []functions.ArgumentKind{ranges}, HandlesErrors: true,
+		Syntax: "ISNA(value)", Description: "Checks whether a value is the #N/A error",
+		Native: func(call *functionCall) *DynamicValue { return isNotAvailable(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "NA", MinimumArguments: 0, MaximumArguments: 0,
+		Syntax: "NA()", Description: "Returns the #N/A error",
+		Native: func(call *functionCall) *DynamicValue {
+			return makeErrorDv(ErrorCodeNotAvailable, "Value not available")
+		}})
+
+	// math
+
+	functions.Register(&functions.Definition{Name: "MATHC", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "MATHC(name)", Description: "Returns the constant e or pi",
+		Native: func(call *functionCall) *DynamicValue { return mathConstant(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "SQRT", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "SQRT(number)", Description: "Returns the square root of a number",
+		Native: func(call *functionCall) *DynamicValue { return sqrt(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "NUMBER", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "NUMBER(value)", Description: "Converts a value to a number",
+		Native: func(call *functionCall) *DynamicValue { return number(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "FLOOR", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "FLOOR(number)", Description: "Rounds a number down",
+		Native: func(call *functionCall) *DynamicValue { return floor(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "CEIL", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "CEIL(number)", Description: "Rounds a number up",
+		Native: func(call *functionCall) *DynamicValue { return ceil(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "ABS", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "ABS(number)", Description: "Returns the absolute value of a number",
+		Native: func(call *functionCall) *DynamicValue { return abs(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "RAND", MinimumArguments: 0, MaximumArguments: 0, IsVolatile: true,
+		Syntax: "RAND()", Description: "Returns a random number between 0 and 1",
+		Native: func(call *functionCall) *DynamicValue { return random() }})
+
+	// text
+
+	functions.RegisterNames([]string{"CONCATENATE", "CONCAT"}, functions.Definition{MinimumArguments: 1, MaximumArguments: functions.AnyArguments,
+		Syntax: "CONCATENATE(text1, [text2], ...)", Description: "Joins texts together",
+		Native: func(call *functionCall) *DynamicValue { return concatenate(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "LEN", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "LEN(text)", Description: "Returns the number of characters in a text",
+		Native: func(call *functionCall) *DynamicValue { return length(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "LEFT", MinimumArguments: 1, MaximumArguments: 2,
+		Syntax: "LEFT(text, [count])", Description: "Returns the first characters of a text",
+		Native: func(call *functionCall) *DynamicValue { return leftRight(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "RIGHT", MinimumArguments: 1, MaximumArguments: 2,
+		Syntax: "RIGHT(text, [count])", Description: "Returns the last characters of a text",
+		Native: func(call *functionCall) *DynamicValue { return leftRight(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "MID", MinimumArguments: 3, MaximumArguments: 3,
+		Syntax: "MID(text, start, count)", Description: "Returns count characters of a text from start",
+		Native: func(call *functionCall) *DynamicValue { return mid(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "FIND", MinimumArguments: 2, MaximumArguments: 3,
+		Syntax: "FIND(search_for, text, [start])", Description: "Returns the position of a text in another text, case sensitive",
+		Native: func(call *functionCall) *DynamicValue { return findText(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "SEARCH", MinimumArguments: 2, MaximumArguments: 3,
+		Syntax: "SEARCH(search_for, text, [start])", Description: "Returns the position of a text in another text, ignores case and supports wildcards",
+		Native: func(call *functionCall) *DynamicValue { return findText(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "SUBSTITUTE", MinimumArguments: 3, MaximumArguments: 4,
+		Syntax: "SUBSTITUTE(text, old_text, new_text, [occurrence])", Description: "Replaces old_text by new_text, every occurrence or only the given one",
+		Native: func(call *functionCall) *DynamicValue { return substitute(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "TRIM", MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "TRIM(text)", Description: "Removes the spaces around a text and repeated spaces inside it",
+		Native: func(call *functionCall) *DynamicValue { return trim(call.Arguments) }})
+
+	functions.RegisterNames([]string{"UPPER", "LOWER"}, functions.Definition{MinimumArguments: 1, MaximumArguments: 1,
+		Syntax: "UPPER(text)", Description: "Converts a text to upper or lower case",
+		Native: func(call *functionCall) *DynamicValue { return changeCase(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "TEXT", MinimumArguments: 2, MaximumArguments: 2,
+		Syntax: "TEXT(value, format)", Description: "Formats a number or date as text",
+		Native: func(call *functionCall) *DynamicValue { return textFunc(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "SPLIT", MinimumArguments: 2, MaximumArguments: 4,
+		Syntax: "SPLIT(text, delimiter, [split_by_each], [remove_empty])", Description: "Splits a text into columns",
+		Native: func(call *functionCall) *DynamicValue { return split(call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "REGEXMATCH", MinimumArguments: 2, MaximumArguments: 2,
+		Syntax: "REGEXMATCH(text, pattern)", Description: "Checks whether a text matches a regular expression",
+		Native: func(call *functionCall) *DynamicValue { return regexFunction(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "REGEXEXTRACT", MinimumArguments: 2, MaximumArguments: 2,
+		Syntax: "REGEXEXTRACT(text, pattern)", Description: "Returns the first match of a regular expression",
+		Native: func(call *functionCall) *DynamicValue { return regexFunction(call.Name, call.Arguments) }})
+
+	functions.Register(&functions.Definition{Name: "REGEXREPLACE", MinimumArguments: 3, MaximumArguments: 3,
+		Syntax: "REGEXREPLACE(text, pattern, replacement)", Description: "Replaces the matches of a regular expression",
+		Native: func(call *functionCall) *DynamicValue { return regexFunction(call.Name, call.Arguments) }})
+
+	// explosive
+
+	functions.Register(&functions.Definition{Name: "OLS", MinimumArguments: 2, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "OLS(y_range, x_range1, [x_range2], ...)", Description: "Writes an ordinary least squares regression below and to the right of the cell",
+		Native: func(call *functionCall) *DynamicValue { return olsExplosive(call.Arguments, call.Grid, call.TargetRef) }})
+}
@@ -0,0 +1,176 @@
+// Package functions is the registry of the functions formulas can call. A function declares its
+// arity and the kind of its arguments, the spreadsheet checks those before calling it, so functions
+// don't have to. Functions register themselves from an init() in the package that implements them,
+// a package with domain specific functions only needs its own init() and a blank import in the
+// spreadsheet:
+//
+//	func init() {
+//		functions.Register(&functions.Definition{Name: "DOUBLE", MinimumArguments: 1, MaximumArguments: 1,
+//			Syntax: "DOUBLE(number)", Description: "Doubles a number",
+//			Call: func(call *functions.Call) functions.Value {
+//				return functions.NewNumber(call.Arguments[0].Number * 2)
+//			}})
+//	}
+//
+// Names that aren't registered (or defined as a LAMBDA) are sent to Python. The registry is only
+// changed by init(), formulas read it concurrently afterwards.
+package functions
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ArgumentKind int8
+
+const (
+	// Scalar arguments are single values, a range passed as one gives #VALUE!
+	Scalar ArgumentKind = iota
+
+	// Range arguments are single values, ranges or arrays
+	Range
+
+	// Lazy arguments aren't evaluated, only functions of the spreadsheet itself can take them
+	Lazy
+)
+
+// AnyArguments is the MaximumArguments of functions taking any number of arguments
+const AnyArguments = -1
+
+type Definition struct {
+	Name             string
+	MinimumArguments int
+	MaximumArguments int
+
+	// the kind of every argument, arguments beyond the list repeat its last RepeatedArguments kinds
+	// (the last kind when RepeatedArguments is 0), no kinds means every argument is a scalar
+	ArgumentKinds     []ArgumentKind
+	RepeatedArguments int
+
+	// volatile functions give a different result without their arguments changing, like RAND
+	IsVolatile bool
+
+	// errors in arguments are passed on before calling the function, unless it handles them itself
+	HandlesErrors bool
+
+	Syntax      string
+	Description string
+
+	// Call computes the result from the evaluated arguments
+	Call func(call *Call) Value
+
+	// Native is set instead of Call by the functions of the spreadsheet itself, they work on its
+	// own values and can read the grid
+	Native interface{}
+}
+
+type Call struct {
+	Name      string
+	Arguments []Value
+}
+
+var registry = make(map[string]*Definition)
+
+// Register adds a function, names are matched exactly so register them in upper case
+func Register(definition *Definition) {
+
+	if _, ok := registry[definition.Name]; ok {
+		panic("function " + definition.Name + " is registered twice")
+	}
+
+	if (definition.Call == nil) == (definition.Native == nil) {
+		panic("function " + definition.Name + " should have either Call or Native")
+	}
+
+	if definition.Call != nil {
+		for _, kind := range definition.ArgumentKinds {
+			if kind == Lazy {
+				panic("function " + definition.Name + " can't take lazy arguments without being Native")
+			}
+		}
+	}
+
+	registry[definition.Name] = definition
+}
+
+// RegisterNames registers functions that share their implementation and only differ in name, the
+// syntax is given for the first name
+func RegisterNames(names []string, definition Definition) {
+	for _, name := range names {
+		namedDefinition := definition
+		namedDefinition.Name = name
+		namedDefinition.Syntax = name + strings.TrimPrefix(definition.Syntax, names[0])
+		Register(&namedDefinition)
+	}
+}
+
+// Lookup returns the definition of a function, nil when it isn't registered
+func Lookup(name string) *Definition {
+	return registry[name]
+}
+
+// Names returns the names of the registered functions in alphabetical order
+func Names() []string {
+
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ArgumentKind returns the kind of the argument at index
+func (definition *Definition) ArgumentKind(index int) ArgumentKind {
+
+	if len(definition.ArgumentKinds) == 0 {
+		return Scalar
+	}
+
+	if index < len(definition.ArgumentKinds) {
+		return definition.ArgumentKinds[index]
+	}
+
+	repeated := definition.RepeatedArguments
+	if repeated == 0 {
+		repeated = 1
+	}
+
+	first := len(definition.ArgumentKinds) - repeated
+	return definition.ArgumentKinds[first+(index-first)%repeated]
+}
+
+// AcceptsArgumentCount checks whether the function can be called with count arguments
+func (definition *Definition) AcceptsArgumentCount(count int) bool {
+	return count >= definition.MinimumArguments && (definition.MaximumArguments == AnyArguments || count <= definition.MaximumArguments)
+}
+
+// ArityMessage describes the arguments a function takes, e.g. "IRR requires 1 or 2 arguments"
+func (definition *Definition) ArityMessage() string {
+
+	minimum := strconv.Itoa(definition.MinimumArguments)
+	maximum := strconv.Itoa(definition.MaximumArguments)
+
+	var arity string
+
+	switch {
+	case definition.MaximumArguments == AnyArguments:
+		arity = "at least " + minimum
+	case definition.MinimumArguments == definition.MaximumArguments:
+		arity = minimum
+	case definition.MinimumArguments+1 == definition.MaximumArguments:
+		arity = minimum + " or " + maximum
+	default:
+		arity = minimum + " to " + maximum
+	}
+
+	if arity == "1" {
+		return definition.Name + " requires 1 argument"
+	}
+	if definition.MaximumArguments == 0 {
+		return definition.Name + " doesn't take arguments"
+	}
+	return definition.Name + " requires " + arity + " arguments"
+}
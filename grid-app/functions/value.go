@@ -0,0 +1,71 @@
+package functions
+
+// Value is an argument or the result of a function. Dates are numbers, the days since 1899-12-30,
+// and empty cells are empty text.
+type Value struct {
+	Type    ValueType
+	Number  float64
+	Text    string // the text, or the code of an error like #VALUE!
+	Bool    bool
+	Message string    // what went wrong, for errors
+	Array   [][]Value // the rows of ranges and arrays
+}
+
+type ValueType int8
+
+const (
+	NumberType ValueType = iota
+	TextType
+	BoolType
+	ErrorType
+	ArrayType
+)
+
+// the codes of error values
+const (
+	ErrorNull           = "#NULL!"
+	ErrorDivisionByZero = "#DIV/0!"
+	ErrorValue          = "#VALUE!"
+	ErrorReference      = "#REF!"
+	ErrorName           = "#NAME?"
+	ErrorNumber         = "#NUM!"
+	ErrorNotAvailable   = "#N/A"
+	ErrorCalc           = "#CALC!"
+)
+
+func NewNumber(number float64) Value {
+	return Value{Type: NumberType, Number: number}
+}
+
+func NewText(text string) Value {
+	return Value{Type: TextType, Text: text}
+}
+
+func NewBool(value bool) Value {
+	return Value{Type: BoolType, Bool: value}
+}
+
+// NewError returns an error value, code is one of the error codes like ErrorValue
+func NewError(code string, message string) Value {
+	return Value{Type: ErrorType, Text: code, Message: message}
+}
+
+// NewArray returns an array value, results that are arrays spill into the cells next to the formula
+func NewArray(rows [][]Value) Value {
+	return Value{Type: ArrayType, Array: rows}
+}
+
+// Values flattens an array row by row, single values are returned on their own
+func (value Value) Values() []Value {
+
+	if value.Type != ArrayType {
+		return []Value{value}
+	}
+
+	values := []Value{}
+	for _, row := range value.Array {
+		values = append(values, row...)
+	}
+
+	return values
+}
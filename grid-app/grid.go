@@ -5,6 +5,7 @@ import (
 	"encoding/csv"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,19 +15,18 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/csimplestring/go-csv/detector"
 )
 
 type Reference struct {
 	String     string
-	SheetIndex int8
+	SheetIndex SheetID
 }
 
 type ReferenceRange struct {
 	String     string
-	SheetIndex int8
+	SheetIndex SheetID
 }
 
 type SheetSize struct {
@@ -35,30 +35,49 @@ type SheetSize struct {
 }
 
 type Grid struct {
-	Data                map[string]*DynamicValue
-	DirtyCells          map[string]bool
-	ActiveSheet         int8
-	SheetNames          map[string]int8
+	Data                map[CellKey]*DynamicValue
+	DirtyCells          map[CellKey]bool
+	ActiveSheet         SheetID
+	SheetNames          map[string]SheetID
 	PerformanceCounting map[string]int
 	SheetList           []string
 	SheetSizes          []SheetSize
+	NextSheetID         SheetID
+	DefinedNames        map[string]*DefinedName
+	SpillAnchors        map[CellKey]SpillArea
+	RangeDependents     map[string]map[CellKey]bool
+	VolatileCells       map[CellKey]bool
+	VolatileFunctions   map[string]bool
+	Iteration           IterationSettings
+	Styles              []CellStyle
+	ConditionalFormats  []ConditionalFormat
+	ValidationRules     []ValidationRule
 	PythonResultChannel chan string
 	PythonClient        chan string
+	history             *undoHistory
+	conditionalStyles   map[CellKey]conditionalStyle
+	conditionalResults  map[ConditionalFormat]map[CellKey]conditionalStyle // the cells of each rule
 }
 
-func copyToDirty(index string, grid *Grid) {
+func copyToDirty(index CellKey, grid *Grid) {
 
 	// only add
 	if _, ok := grid.DirtyCells[index]; !ok {
 		grid.DirtyCells[index] = true
 
-		for ref, inSet := range getDataByNormalRef(index, grid).DependOut {
+		for ref, inSet := range getDataByCellKey(index, grid).DependOut {
 			if inSet {
 				copyToDirty(ref, grid)
 			}
 		}
+
+		for _, ref := range wholeRangeDependents(index, grid) {
+			if _, isDirty := grid.DirtyCells[ref]; !isDirty {
+				copyToDirty(ref, grid)
+			}
+		}
 	} else {
-		fmt.Println("Notice: tried to add to dirty twice (" + index + ")")
+		fmt.Println("Notice: tried to add to dirty twice (" + index.String() + ")")
 	}
 
 }
@@ -81,35 +100,15 @@ func gridInstance(c *Client) {
 		sheetSizes := []SheetSize{SheetSize{RowCount: rowCount, ColumnCount: columnCount}, SheetSize{RowCount: rowCount, ColumnCount: columnCount}}
 
 		// For now make this a two way mapping for ordered loops and O(1) access times -- aware of redundancy of state which could cause problems
-		sheetNames := make(map[string]int8)
+		sheetNames := make(map[string]SheetID)
 		sheetNames["Sheet1"] = 0
 		sheetNames["Sheet2"] = 1
 
 		sheetList := []string{"Sheet1", "Sheet2"}
 
-		grid = Grid{Data: make(map[string]*DynamicValue), PerformanceCounting: make(map[string]int), DirtyCells: make(map[string]bool), ActiveSheet: 0, SheetNames: sheetNames, SheetList: sheetList, SheetSizes: sheetSizes}
-
-		cellCount := 1
+		grid = Grid{Data: make(map[CellKey]*DynamicValue), PerformanceCounting: make(map[string]int), DirtyCells: make(map[CellKey]bool), ActiveSheet: 0, SheetNames: sheetNames, SheetList: sheetList, SheetSizes: sheetSizes, NextSheetID: 2, DefinedNames: make(map[string]*DefinedName), SpillAnchors: make(map[CellKey]SpillArea), RangeDependents: make(map[string]map[CellKey]bool), VolatileCells: make(map[CellKey]bool), VolatileFunctions: make(map[string]bool), Iteration: defaultIterationSettings(), Styles: defaultStyles()}
 
-		for sheet := 0; sheet <= len(sheetList); sheet++ {
-			for x := 1; x <= columnCount; x++ {
-				for y := 1; y <= rowCount; y++ {
-					dv := makeDv("")
-					dv.SheetIndex = int8(sheet)
-
-					// DEBUG: fill with incrementing numbers
-					// dv.ValueType = DynamicValueTypeInteger
-					// dv.DataInteger = int32(cellCount)
-					// dv.DataFormula = strconv.Itoa(cellCount)
-
-					grid.Data[strconv.Itoa(sheet)+"!"+indexToLetters(x)+strconv.Itoa(y)] = dv
-
-					cellCount++
-				}
-			}
-		}
-
-		fmt.Printf("Initialized client with grid of length: %d\n", len(grid.Data))
+		fmt.Printf("Initialized client with %d sheets\n", len(grid.SheetList))
 
 	} else {
 
@@ -119,11 +118,47 @@ func gridInstance(c *Client) {
 		}
 		grid = FromGOB64(gridData)
 
+		// sheets saved before defined names, spilling, whole ranges, volatile cells, iterative calculation, styles and sheet IDs existed
+		if grid.DefinedNames == nil {
+			grid.DefinedNames = make(map[string]*DefinedName)
+		}
+		if grid.SpillAnchors == nil {
+			grid.SpillAnchors = make(map[CellKey]SpillArea)
+		}
+		if grid.RangeDependents == nil {
+			grid.RangeDependents = make(map[string]map[CellKey]bool)
+		}
+		if grid.VolatileCells == nil {
+			grid.VolatileCells = make(map[CellKey]bool)
+		}
+		if grid.VolatileFunctions == nil {
+			grid.VolatileFunctions = make(map[string]bool)
+		}
+		if grid.Iteration.MaximumIterations == 0 {
+			grid.Iteration = defaultIterationSettings()
+		}
+		if len(grid.Styles) == 0 {
+			grid.Styles = defaultStyles()
+		}
+		if grid.NextSheetID < firstUnusedSheetID(&grid) {
+			grid.NextSheetID = firstUnusedSheetID(&grid)
+		}
+
+		// sheets used to be stored with every cell
+		removeUnusedCells(&grid)
+
 		fmt.Println("Loaded Grid struct from sheet.serialized")
 
 	}
 
+	grid.history = newUndoHistory(&grid)
+	evaluateConditionalFormats(&grid)
+
 	sendSheets(c, &grid)
+	sendNames(c, &grid)
+	sendFunctions(c)
+	sendIterationSettings(c, &grid)
+	sendStyles(c, &grid)
 
 	grid.PythonResultChannel = make(chan string, 256)
 	grid.PythonClient = c.commands
@@ -169,7 +204,7 @@ func gridInstance(c *Client) {
 
 				// 3. then single call to computeDirty cells
 
-				references := cellRangeToCells(ReferenceRange{String: parsed[2], SheetIndex: getIndexFromString(parsed[3])})
+				references := cellRangeToCells(ReferenceRange{String: parsed[2], SheetIndex: getSheetIDFromString(parsed[3], &grid)})
 
 				switch parsed[1] {
 				case "SETSINGLE":
@@ -196,15 +231,16 @@ func gridInstance(c *Client) {
 
 						thisReference := ref
 
+						// input that a validation rule rejects isn't stored
+						if !checkInput(thisReference, "="+formula, &grid, c) {
+							continue
+						}
+
 						dv := getDataFromRef(thisReference, &grid)
 
-						if !isValidFormula(formula) {
-							dv.ValueType = DynamicValueTypeString
-							dv.DataFormula = "\"Error in formula: " + formula + "\""
-						} else {
-							dv.ValueType = DynamicValueTypeFormula
-							dv.DataFormula = formula
-						}
+						// invalid formulas are kept as is, they evaluate to an error value
+						dv.ValueType = DynamicValueTypeFormula
+						dv.DataFormula = formula
 
 						newDvs[ref] = dv
 						incrementAmount++
@@ -240,19 +276,17 @@ func gridInstance(c *Client) {
 
 					for _, ref := range references {
 
-						if checkDataPresenceFromRef(ref, &grid) {
-							dv := getDataFromRef(ref, &grid)
+						if checkIfRefExists(ref, &grid) {
 
-							if !isValidFormula(values[valuesIndex]) {
-								dv.ValueType = DynamicValueTypeString
-								dv.DataFormula = "\"Error in formula: " + values[valuesIndex] + "\""
-							} else {
+							// input that a validation rule rejects isn't stored
+							if checkInput(ref, "="+values[valuesIndex], &grid, c) {
+								dv := getDataFromRef(ref, &grid)
 
 								dv.ValueType = DynamicValueTypeFormula
 								dv.DataFormula = values[valuesIndex]
-							}
 
-							newDvs[ref] = dv
+								newDvs[ref] = dv
+							}
 
 							valuesIndex++
 							if valuesIndex > len(values)-1 {
@@ -260,7 +294,7 @@ func gridInstance(c *Client) {
 							}
 
 						} else {
-							fmt.Println("Tried writing to cell: " + getMapIndexFromReference(ref) + " which doesn't exist.")
+							fmt.Println("Tried writing to cell: " + getCellKeyFromReference(ref).String() + " which doesn't exist.")
 						}
 
 					}
@@ -289,24 +323,24 @@ func gridInstance(c *Client) {
 
 			case "GET":
 
-				sendCellsInRange(ReferenceRange{String: parsed[1], SheetIndex: getIndexFromString(parsed[2])}, &grid, c)
+				sendCellsInRange(ReferenceRange{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[2], &grid)}, &grid, c)
 
 			case "SWITCHSHEET":
 
-				grid.ActiveSheet = getIndexFromString(parsed[1])
+				grid.ActiveSheet = getSheetIDFromString(parsed[1], &grid)
 
 			case "JUMPCELL":
 
 				currentCell := parsed[1]
 				direction := parsed[2]
-				sheetIndex := getIndexFromString(parsed[3])
+				sheetIndex := getSheetIDFromString(parsed[3], &grid)
 
 				findJumpCell(Reference{String: currentCell, SheetIndex: sheetIndex}, direction, &grid, c)
 
 			case "MAXCOLUMNWIDTH":
 
 				columnIndex := getIntFromString(parsed[1])
-				sheetIndex := getIndexFromString(parsed[2])
+				sheetIndex := getSheetIDFromString(parsed[2], &grid)
 
 				findMaxColumnWidth(columnIndex, sheetIndex, &grid, c)
 
@@ -324,24 +358,49 @@ func gridInstance(c *Client) {
 
 			case "ADDSHEET":
 
-				sheetName := parsed[1]
+				if _, err := addSheet(parsed[1], SheetSize{RowCount: defaultRowCount, ColumnCount: defaultColumnCount}, &grid); err != nil {
+					sendConsoleError(err, c)
+				} else {
+					sendSheets(c, &grid)
+				}
 
-				sheetIndex := int8(len(grid.SheetList))
+			case "DEFINE-NAME":
 
-				grid.SheetNames[sheetName] = int8(sheetIndex)
-				grid.SheetList = append(grid.SheetList, sheetName)
-				grid.SheetSizes = append(grid.SheetSizes, SheetSize{RowCount: defaultRowCount, ColumnCount: defaultColumnCount})
+				// define or redefine a name, unqualified references are relative to the sheet passed
+				err := defineName(parsed[1], parsed[2], getSheetIDFromString(parsed[3], &grid), &grid)
+				if err != nil {
+					sendConsoleError(err, c)
+				}
 
-				// populate new sheet
-				for x := 1; x <= defaultColumnCount; x++ {
-					for y := 1; y <= defaultRowCount; y++ {
-						dv := makeDv("")
-						dv.SheetIndex = sheetIndex
-						grid.Data[strconv.Itoa(int(sheetIndex))+"!"+indexToLetters(x)+strconv.Itoa(y)] = dv
-					}
+				changedCells := computeDirtyCells(&grid, c)
+				sendDirtyOrInvalidate(changedCells, &grid, c)
+				sendNames(c, &grid)
+
+			case "RENAME-NAME":
+
+				err := renameName(parsed[1], parsed[2], &grid)
+				if err != nil {
+					sendConsoleError(err, c)
 				}
 
-				sendSheets(c, &grid)
+				changedCells := computeDirtyCells(&grid, c)
+				sendDirtyOrInvalidate(changedCells, &grid, c)
+				sendNames(c, &grid)
+
+			case "DELETE-NAME":
+
+				err := deleteName(parsed[1], &grid)
+				if err != nil {
+					sendConsoleError(err, c)
+				}
+
+				changedCells := computeDirtyCells(&grid, c)
+				sendDirtyOrInvalidate(changedCells, &grid, c)
+				sendNames(c, &grid)
+
+			case "GET-NAMES":
+
+				sendNames(c, &grid)
 
 			case "TESTCALLBACK-PING":
 
@@ -351,7 +410,7 @@ func gridInstance(c *Client) {
 
 			case "REMOVESHEET":
 
-				sheetIndex := getIndexFromString(parsed[1])
+				sheetIndex := getSheetIDFromString(parsed[1], &grid)
 				removeSheet(sheetIndex, &grid)
 				sendSheets(c, &grid)
 
@@ -359,8 +418,8 @@ func gridInstance(c *Client) {
 
 				start := time.Now() // debug
 
-				sourceRange := ReferenceRange{parsed[1], getIndexFromString(parsed[2])}
-				destinationRange := ReferenceRange{parsed[3], getIndexFromString(parsed[4])}
+				sourceRange := ReferenceRange{parsed[1], getSheetIDFromString(parsed[2], &grid)}
+				destinationRange := ReferenceRange{parsed[3], getSheetIDFromString(parsed[4], &grid)}
 
 				copySourceToDestination(sourceRange, destinationRange, &grid, false)
 
@@ -378,8 +437,8 @@ func gridInstance(c *Client) {
 
 			case "COPYASVALUE":
 
-				sourceRange := ReferenceRange{parsed[1], getIndexFromString(parsed[2])}
-				destinationRange := ReferenceRange{parsed[3], getIndexFromString(parsed[4])}
+				sourceRange := ReferenceRange{parsed[1], getSheetIDFromString(parsed[2], &grid)}
+				destinationRange := ReferenceRange{parsed[3], getSheetIDFromString(parsed[4], &grid)}
 
 				copyByValue(sourceRange, destinationRange, &grid)
 
@@ -388,8 +447,8 @@ func gridInstance(c *Client) {
 
 			case "CUTASVALUE":
 
-				sourceRange := ReferenceRange{parsed[1], getIndexFromString(parsed[2])}
-				destinationRange := ReferenceRange{parsed[3], getIndexFromString(parsed[4])}
+				sourceRange := ReferenceRange{parsed[1], getSheetIDFromString(parsed[2], &grid)}
+				destinationRange := ReferenceRange{parsed[3], getSheetIDFromString(parsed[4], &grid)}
 
 				cutByValue(sourceRange, destinationRange, &grid)
 
@@ -413,18 +472,25 @@ func gridInstance(c *Client) {
 				rowIndex := getReferenceRowIndex(referenceString)
 				// columnIndex := getReferenceColumnIndex(referenceString)
 
-				cutFromRangeString := indexesToReferenceString(rowIndex+1, 1) + ":" + indexesToReferenceString(grid.SheetSizes[grid.ActiveSheet].RowCount, grid.SheetSizes[grid.ActiveSheet].ColumnCount)
+				// only the part of the sheet with content moves
+				maximumRow, maximumColumn := determineMovedRectangle(rowIndex+1, 1, grid.ActiveSheet, &grid)
+
+				cutFromRangeString := indexesToReferenceString(rowIndex+1, 1) + ":" + indexesToReferenceString(maximumRow, maximumColumn)
 
 				cutToRangeString := indexesToReferenceString(rowIndex, 1) + ":" + indexesToReferenceString(rowIndex, 1)
 
 				cutFromRange := ReferenceRange{String: cutFromRangeString, SheetIndex: grid.ActiveSheet}
 				cutToRange := ReferenceRange{String: cutToRangeString, SheetIndex: grid.ActiveSheet}
 
-				// clear everything in row of reference
-				clearCells := cellRangeToCells(ReferenceRange{String: indexesToReferenceString(rowIndex, 1) + ":" + indexesToReferenceString(rowIndex, grid.SheetSizes[grid.ActiveSheet].ColumnCount)})
+				shiftWholeRanges(grid.ActiveSheet, false, rowIndex, -1, &grid)
+				shiftConditionalFormats(grid.ActiveSheet, false, rowIndex, -1, &grid)
+				shiftValidationRules(grid.ActiveSheet, false, rowIndex, -1, &grid)
 
-				for _, k := range clearCells {
-					clearCell(k, &grid)
+				// clear everything in row of reference
+				for _, cell := range sheetCells(grid.ActiveSheet, &grid) {
+					if cell.row == rowIndex {
+						removeCell(getReferenceFromCellKey(cell.index), &grid)
+					}
 				}
 
 				// move everything below reference up
@@ -439,18 +505,25 @@ func gridInstance(c *Client) {
 				// rowIndex := getReferenceRowIndex(referenceString)
 				columnIndex := getReferenceColumnIndex(referenceString)
 
-				cutFromRangeString := indexesToReferenceString(1, columnIndex+1) + ":" + indexesToReferenceString(grid.SheetSizes[grid.ActiveSheet].RowCount, grid.SheetSizes[grid.ActiveSheet].ColumnCount)
+				// only the part of the sheet with content moves
+				maximumRow, maximumColumn := determineMovedRectangle(1, columnIndex+1, grid.ActiveSheet, &grid)
+
+				cutFromRangeString := indexesToReferenceString(1, columnIndex+1) + ":" + indexesToReferenceString(maximumRow, maximumColumn)
 
 				cutToRangeString := indexesToReferenceString(1, columnIndex) + ":" + indexesToReferenceString(1, columnIndex)
 
 				cutFromRange := ReferenceRange{String: cutFromRangeString, SheetIndex: grid.ActiveSheet}
 				cutToRange := ReferenceRange{String: cutToRangeString, SheetIndex: grid.ActiveSheet}
 
-				// clear everything in row of reference
-				clearCells := cellRangeToCells(ReferenceRange{String: indexesToReferenceString(1, columnIndex) + ":" + indexesToReferenceString(grid.SheetSizes[grid.ActiveSheet].RowCount, columnIndex)})
+				shiftWholeRanges(grid.ActiveSheet, true, columnIndex, -1, &grid)
+				shiftConditionalFormats(grid.ActiveSheet, true, columnIndex, -1, &grid)
+				shiftValidationRules(grid.ActiveSheet, true, columnIndex, -1, &grid)
 
-				for _, k := range clearCells {
-					clearCell(k, &grid)
+				// clear everything in column of reference
+				for _, cell := range sheetCells(grid.ActiveSheet, &grid) {
+					if cell.column == columnIndex {
+						removeCell(getReferenceFromCellKey(cell.index), &grid)
+					}
 				}
 
 				// move everything below reference up
@@ -461,18 +534,10 @@ func gridInstance(c *Client) {
 			case "CUT":
 
 				sourceRange := parsed[1]
-				sourceRangeSheetInt, err := strconv.Atoi(parsed[2])
-				if err != nil {
-					log.Fatal(err)
-				}
-				sourceRangeSheetIndex := int8(sourceRangeSheetInt)
+				sourceRangeSheetIndex := getSheetIDFromString(parsed[2], &grid)
 
 				destinationRange := parsed[3]
-				destinationRangeSheetInt, err := strconv.Atoi(parsed[4])
-				if err != nil {
-					log.Fatal(err)
-				}
-				destinationRangeSheetIndex := int8(destinationRangeSheetInt)
+				destinationRangeSheetIndex := getSheetIDFromString(parsed[4], &grid)
 
 				// clear difference between sourceRange and destinationRange
 				changedCells := cutCells(
@@ -483,113 +548,242 @@ func gridInstance(c *Client) {
 
 			case "SET":
 
-				// check if formula or normal entry
-				if len(parsed[2]) > 0 && parsed[2][0:1] == "=" {
+				// input that a validation rule rejects isn't stored
+				inputReference := Reference{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[3], &grid)}
+				if checkInput(inputReference, parsed[2], &grid, c) {
 
-					// TODO: regex check if input is legal
+					// check if formula or normal entry
+					if len(parsed[2]) > 0 && parsed[2][0:1] == "=" {
 
-					// for SET commands with formula values update formula to uppercase any references
-					formula := parsed[2][1:]
-					// formula = referencesToUpperCase(formula)
+						// TODO: regex check if input is legal
 
-					if !isValidFormula(formula) {
+						// for SET commands with formula values update formula to uppercase any references
+						formula := parsed[2][1:]
+						// formula = referencesToUpperCase(formula)
 
-						sheetIndex := getIndexFromString(parsed[3])
-						reference := Reference{String: parsed[1], SheetIndex: sheetIndex}
+						if !isValidFormula(formula) {
 
-						dv := getDataFromRef(reference, &grid)
-						dv.ValueType = DynamicValueTypeString
-						dv.DataFormula = "\"Error in formula: " + formula + "\""
+							sheetIndex := getSheetIDFromString(parsed[3], &grid)
+							reference := Reference{String: parsed[1], SheetIndex: sheetIndex}
+
+							// keep the formula as entered, evaluating it yields an error value
+							dv := getDataFromRef(reference, &grid)
+							dv.ValueType = DynamicValueTypeFormula
+							dv.DataFormula = formula
 
-						dv.DependIn = make(map[string]bool) // new dependin (new formula)
+							dv.DependIn = make(map[CellKey]bool) // new dependin (new formula)
 
-						setDataByRef(reference, setDependencies(reference, dv, &grid), &grid)
+							setDataByRef(reference, setDependencies(reference, dv, &grid), &grid)
 
-					} else {
+						} else {
 
-						// check for explosive formulas
-						isExplosive := isExplosiveFormula(formula)
+							// check for explosive formulas
+							isExplosive := isExplosiveFormula(formula)
 
-						if isExplosive {
+							if isExplosive {
 
-							// original Dependends can stay on
-							reference := Reference{String: parsed[1], SheetIndex: getIndexFromString(parsed[3])}
-							dv := getDataFromRef(reference, &grid)
+								// original Dependends can stay on
+								reference := Reference{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[3], &grid)}
+								dv := getDataFromRef(reference, &grid)
 
-							dv.ValueType = DynamicValueTypeExplosiveFormula
-							dv.DataFormula = formula
+								dv.ValueType = DynamicValueTypeExplosiveFormula
+								dv.DataFormula = formula
 
-							// Dependencies are not required, since this cell won't depend on anything given that it's explosive
+								// Dependencies are not required, since this cell won't depend on anything given that it's explosive
 
-							// parse explosive formula (also, explosive formulas cannot be nested)
-							newDv := parse(dv, &grid, reference)
+								// parse explosive formula (also, explosive formulas cannot be nested)
+								newDv := parse(dv, &grid, reference)
 
-							// don't need dependend information for parsing, hence assign after parse
-							newDv.DependIn = make(map[string]bool)             // new dependin (new formula)
-							newDv.DependOut = dv.DependOut                     // dependout remain
-							newDv.ValueType = DynamicValueTypeExplosiveFormula // shouldn't be necessary, is return type of olsExplosive()
-							newDv.DataFormula = formula                        // re-assigning of formula is usually saved for computeDirty but this will be skipped there
+								// don't need dependend information for parsing, hence assign after parse
+								newDv.DependIn = make(map[CellKey]bool)            // new dependin (new formula)
+								newDv.DependOut = dv.DependOut                     // dependout remain
+								newDv.ValueType = DynamicValueTypeExplosiveFormula // shouldn't be necessary, is return type of olsExplosive()
+								newDv.DataFormula = formula                        // re-assigning of formula is usually saved for computeDirty but this will be skipped there
 
-							// add OLS cell to dirty (which needs DependInTemp etc)
-							setDataByRef(reference, setDependencies(reference, newDv, &grid), &grid)
+								// add OLS cell to dirty (which needs DependInTemp etc)
+								setDataByRef(reference, setDependencies(reference, newDv, &grid), &grid)
 
-							// dependencies will be fulfilled for all cells created by explosion
+								// dependencies will be fulfilled for all cells created by explosion
 
-						} else {
-							// set value for cells
-							// cut off = for parsing
+							} else {
+								// set value for cells
+								// cut off = for parsing
 
-							// original Dependends
-							thisReference := Reference{String: parsed[1], SheetIndex: getIndexFromString(parsed[3])}
+								// original Dependends
+								thisReference := Reference{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[3], &grid)}
 
-							dv := getDataFromRef(thisReference, &grid)
+								dv := getDataFromRef(thisReference, &grid)
 
-							dv.ValueType = DynamicValueTypeFormula
-							dv.DataFormula = formula
+								dv.ValueType = DynamicValueTypeFormula
+								dv.DataFormula = formula
+
+								setDataByRef(thisReference, setDependencies(thisReference, dv, &grid), &grid)
+							}
 
-							setDataByRef(thisReference, setDependencies(thisReference, dv, &grid), &grid)
 						}
 
+					} else {
+
+						// else enter as string
+						// if user enters non string value, client is reponsible for adding the equals sign.
+						// Anything without it won't be parsed as formula.
+						reference := Reference{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[3], &grid)}
+
+						dv := getDataFromRef(reference, &grid)
+
+						dv.ValueType = DynamicValueTypeString
+						dv.DataString = parsed[2]
+						dv.DataFormula = formulaStringLiteral(parsed[2])
+
+						// if input is empty string, set formula to empty string without quotes
+						if len(parsed[2]) == 0 {
+							dv.DataFormula = ""
+						}
+
+						newDv := setDependencies(reference, dv, &grid)
+						newDv.ValueType = DynamicValueTypeString
+
+						setDataByRef(reference, newDv, &grid)
+
 					}
 
-				} else {
+					changedCells := computeDirtyCells(&grid, c)
+					sendDirtyOrInvalidate(changedCells, &grid, c)
+				}
+
+			case "SET-FORMAT":
 
-					// else enter as string
-					// if user enters non string value, client is reponsible for adding the equals sign.
-					// Anything without it won't be parsed as formula.
-					reference := Reference{String: parsed[1], SheetIndex: getIndexFromString(parsed[3])}
+				// number format of a range, like "#,##0.00" or "0%"
+				cellRange := ReferenceRange{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[2], &grid)}
+				references := setCellFormat(cellRange, parsed[3], &grid)
 
-					dv := getDataFromRef(reference, &grid)
+				sendCellsByRefs(references, &grid, c)
 
-					// escape double quotes
-					formulaString := strings.Replace(parsed[2], "\"", "\\\"", -1)
+			case "SET-STYLE":
 
-					dv.ValueType = DynamicValueTypeString
-					dv.DataString = parsed[2]
-					dv.DataFormula = "\"" + formulaString + "\""
+				// one style property of a range, like bold or the fill colour
+				cellRange := ReferenceRange{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[2], &grid)}
+				styleCount := len(grid.Styles)
 
-					// if input is empty string, set formula to empty string without quotes
-					if len(parsed[2]) == 0 {
-						dv.DataFormula = ""
+				references, err := setCellStyle(cellRange, parsed[3], parsed[4], &grid)
+				if err != nil {
+					sendConsoleError(err, c)
+				} else {
+
+					// new styles are sent before the cells that use them
+					if len(grid.Styles) != styleCount {
+						sendStyles(c, &grid)
 					}
+					sendCellsByRefs(references, &grid, c)
+				}
 
-					newDv := setDependencies(reference, dv, &grid)
-					newDv.ValueType = DynamicValueTypeString
+			case "ADD-CONDITIONAL-FORMAT":
 
-					setDataByRef(reference, newDv, &grid)
+				// range, sheet, type, operator, value, second value and pairs of style properties and values
+				cellRange := ReferenceRange{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[2], &grid)}
 
+				format, err := newConditionalFormat(cellRange, parsed[3], parsed[4], parsed[5], parsed[6], parsed[7:], &grid)
+				if err != nil {
+					sendConsoleError(err, c)
+				} else {
+					grid.ConditionalFormats = append(grid.ConditionalFormats, format)
+					sendDirtyOrInvalidate(evaluateConditionalFormats(&grid), &grid, c)
 				}
 
-				changedCells := computeDirtyCells(&grid, c)
-				sendDirtyOrInvalidate(changedCells, &grid, c)
+			case "DELETE-CONDITIONAL-FORMATS":
+
+				// the rules overlapping a range
+				cellRange := ReferenceRange{String: parsed[1], SheetIndex: getSheetIDFromString(parsed[2], &grid)}
+
+				if deleteConditionalFormats(cellRange, &grid) > 0 {
+					sendDirtyOrInvalidate(evaluateConditionalFormats(&grid), &grid, c)
+				}
+
+			case "ADD-VALIDATION":
+
+				// range, sheet, type, operator, value, second value, whether to reject invalid input and the message
+				if err := checkArgumentCount(parsed, 8); err != nil {
+					sendConsoleError(err, c)
+				} else if sheetIndex, err := parseSheetPosition(parsed[2], &grid); err != nil {
+					sendConsoleError(err, c)
+				} else if rule, err := newValidationRule(ReferenceRange{String: parsed[1], SheetIndex: sheetIndex}, parsed[3], parsed[4], parsed[5], parsed[6], parsed[7] == "true", parsed[8], &grid); err != nil {
+					sendConsoleError(err, c)
+				} else {
+
+					// the cells that break the rule get flagged
+					grid.ValidationRules = append(grid.ValidationRules, rule)
+					invalidateView(&grid, c)
+				}
+
+			case "DELETE-VALIDATIONS":
+
+				// the rules overlapping a range
+				if err := checkArgumentCount(parsed, 2); err != nil {
+					sendConsoleError(err, c)
+				} else if sheetIndex, err := parseSheetPosition(parsed[2], &grid); err != nil {
+					sendConsoleError(err, c)
+				} else if deleteValidationRules(ReferenceRange{String: parsed[1], SheetIndex: sheetIndex}, &grid) > 0 {
+					invalidateView(&grid, c)
+				}
+
+			case "GET-VALIDATION-OPTIONS":
+
+				// the items of the dropdown of a cell with a list rule
+				if err := checkArgumentCount(parsed, 2); err != nil {
+					sendConsoleError(err, c)
+				} else if sheetIndex, err := parseSheetPosition(parsed[2], &grid); err != nil {
+					sendConsoleError(err, c)
+				} else {
+					sendValidationOptions(Reference{String: parsed[1], SheetIndex: sheetIndex}, &grid, c)
+				}
 
 			case "SETSIZE":
 
 				newRowCount, _ := strconv.Atoi(parsed[1])
 				newColumnCount, _ := strconv.Atoi(parsed[2])
-				sheetIndex := getIndexFromString(parsed[3])
+				sheetIndex := getSheetIDFromString(parsed[3], &grid)
+
+				if err := changeSheetSize(newRowCount, newColumnCount, sheetIndex, c, &grid); err != nil {
+					sendConsoleError(err, c)
+				} else {
+					changedCells := computeDirtyCells(&grid, c)
+					sendDirtyOrInvalidate(changedCells, &grid, c)
+				}
+
+			case "RECALCULATE":
+
+				markAllDirty(-1, &grid)
+
+				changedCells := computeDirtyCells(&grid, c)
+				sendDirtyOrInvalidate(changedCells, &grid, c)
+
+			case "RECALCULATE-SHEET":
 
-				changeSheetSize(newRowCount, newColumnCount, sheetIndex, c, &grid)
+				markAllDirty(getSheetIDFromString(parsed[1], &grid), &grid)
+
+				changedCells := computeDirtyCells(&grid, c)
+				sendDirtyOrInvalidate(changedCells, &grid, c)
+
+			case "SET-ITERATION":
+
+				err := setIterationSettings(parsed[1], parsed[2], parsed[3], &grid)
+				if err != nil {
+					sendConsoleError(err, c)
+				} else {
+
+					// circular references become errors or get iterated
+					markAllDirty(-1, &grid)
+
+					changedCells := computeDirtyCells(&grid, c)
+					sendDirtyOrInvalidate(changedCells, &grid, c)
+				}
+
+				sendIterationSettings(c, &grid)
+
+			case "VOLATILE-FUNCTION":
+
+				// sent by the @volatile decorator in Python
+				registerVolatileFunction(parsed[1], &grid)
 
 			case "CSV":
 				fmt.Println("Received CSV! Size: " + strconv.Itoa(len(parsed[1])))
@@ -648,17 +842,33 @@ func gridInstance(c *Client) {
 
 				minRowSize := lineCount
 
-				newRowCount := grid.SheetSizes[grid.ActiveSheet].RowCount
-				newColumnCount := grid.SheetSizes[grid.ActiveSheet].ColumnCount
+				newRowCount := getSheetSize(grid.ActiveSheet, &grid).RowCount
+				newColumnCount := getSheetSize(grid.ActiveSheet, &grid).ColumnCount
 
-				if minRowSize > grid.SheetSizes[grid.ActiveSheet].RowCount {
+				if minRowSize > getSheetSize(grid.ActiveSheet, &grid).RowCount {
 					newRowCount = minRowSize
 				}
-				if minColumnSize > grid.SheetSizes[grid.ActiveSheet].ColumnCount {
+				if minColumnSize > getSheetSize(grid.ActiveSheet, &grid).ColumnCount {
 					newColumnCount = minColumnSize
 				}
 
-				changeSheetSize(newRowCount, newColumnCount, grid.ActiveSheet, c, &grid)
+				// nothing is imported when the sheet can't hold the file
+				if err := changeSheetSize(newRowCount, newColumnCount, grid.ActiveSheet, c, &grid); err != nil {
+					sendConsoleError(err, c)
+					lines = [][]string{}
+				}
+
+				// numeric dates are read day first per column when one of them can only be read that way
+				dayFirstColumns := make([]bool, minColumnSize)
+				for i := range dayFirstColumns {
+					columnValues := []string{}
+					for _, line := range lines {
+						if i < len(line) {
+							columnValues = append(columnValues, line[i])
+						}
+					}
+					dayFirstColumns[i] = detectDayFirst(columnValues)
+				}
 
 				lineCount = 0
 				for _, line := range lines {
@@ -674,14 +884,19 @@ func gridInstance(c *Client) {
 
 						newDv := getDataFromRef(reference, &grid)
 
-						// if not number, escape with quotes
-						if !numberOnlyFilter.MatchString(inputString) {
+						serial, isDate := parseDateString(inputString, dayFirstColumns[i])
+
+						if isDate && !numberOnlyFilter.MatchString(inputString) {
+							newDv.ValueType = DynamicValueTypeDate
+							newDv.DataFloat = serial
+							newDv.DataFormula = dateFormula(serial)
+
+						} else if !numberOnlyFilter.MatchString(inputString) {
+							// if not number, escape with quotes
 							newDv.ValueType = DynamicValueTypeString
 							newDv.DataString = inputString
 
-							escapedStringValue := strings.Replace(inputString, "\"", "\\\"", -1)
-
-							newDv.DataFormula = "\"" + escapedStringValue + "\""
+							newDv.DataFormula = formulaStringLiteral(inputString)
 
 						} else {
 							newDv.ValueType = DynamicValueTypeFloat
@@ -715,7 +930,10 @@ func gridInstance(c *Client) {
 
 				fmt.Println("Generating CSV...")
 
-				csvString := generateCSV(&grid)
+				// values are exported raw unless they're asked for as displayed
+				formatted := len(parsed) > 1 && parsed[1] == "FORMATTED"
+
+				csvString := generateCSV(formatted, &grid)
 
 				fmt.Println("Generating of CSV completed.")
 
@@ -732,6 +950,7 @@ func gridInstance(c *Client) {
 			case "SAVE":
 				fmt.Println("Saving workspace...")
 
+				removeUnusedCells(&grid)
 				serializedGrid := ToGOB64(grid)
 
 				err := ioutil.WriteFile(c.hub.rootDirectory+"sheetdata/sheet.serialized", serializedGrid, 0644)
@@ -745,363 +964,88 @@ func gridInstance(c *Client) {
 				sortRange(parsed[1], parsed[2], parsed[3], &grid) // direction (ASC,DESC), range ("A1:B20"), column ("B")
 				computeDirtyCells(&grid, c)
 				invalidateView(&grid, c)
-			}
-		}
-	}
-
-}
-
-func isValidFormula(formula string) bool {
-	currentOperator := ""
-	operatorsFound := []string{}
-
-	parenDepth := 0
-	quoteDepth := 0
-	singleQuoteDepth := 0
-	skipNextChar := false
-	previousChar := ""
-
-	// inFunction := false
-	inReference := false
-	dollarInColumn := false
-	dollarInRow := false
-	referenceFoundRange := false
-	validReference := false
-	inDecimal := false
-	inNumber := false
-	validDecimal := false
-	foundReferenceMark := false
-	inOperator := false
-	inFunction := false
-	operatorAllowed := false
-
-	var buffer bytes.Buffer
-
-	// skipCharacters := 0
-	formulaRunes := []rune{}
-
-	for _, r := range formula {
-		formulaRunes = append(formulaRunes, r)
-	}
-
-	for k := range formulaRunes {
-
-		if skipNextChar {
-			skipNextChar = false
-			continue
-		}
-
-		// fmt.Println("char index: " + strconv.Itoa(k))
-		r := formulaRunes[k]
-
-		nextR := ' '
-
-		if len(formulaRunes) > k+1 {
-			nextR = formulaRunes[k+1]
-		}
-
-		c := string(r)
-
-		// check for quotes
-		if c == "\"" && quoteDepth == 0 && previousChar != "\\" {
-
-			quoteDepth++
-			continue
-
-		} else if c == "\"" && quoteDepth == 1 && previousChar != "\\" {
-
-			quoteDepth--
-			continue
-		}
-
-		if quoteDepth == 0 {
-			if c == "'" && singleQuoteDepth == 0 {
 
-				singleQuoteDepth++
+			case "UNDO", "REDO":
 
-				continue
-
-			} else if c == "'" && singleQuoteDepth == 1 {
-
-				singleQuoteDepth--
-
-				// should be followed by dollar or letter
-				if nextR != '!' {
-					return false
+				var step *undoStep
+				if parsed[0] == "UNDO" {
+					step = undo(&grid)
 				} else {
-					inReference = true
-
-					// skip next char !
-					// skipNextChar = true
-				}
-
-				continue
-			}
-		}
-
-		if quoteDepth == 0 && singleQuoteDepth == 0 {
-
-			if c == "(" {
-
-				parenDepth++
-
-				operatorAllowed = false
-
-				inOperator = false
-
-				operatorsFound = append(operatorsFound, currentOperator)
-				currentOperator = ""
-
-			} else if c == ")" {
-
-				parenDepth--
-
-				if parenDepth < 0 {
-					return false
+					step = redo(&grid)
 				}
 
-			}
-
-			/* reference checking */
-			if inReference && r == '!' && !foundReferenceMark {
-				foundReferenceMark = true
-				validReference = false
-				inReference = false
-				continue
-			}
-
-			if r == '!' && foundReferenceMark {
-				return false
-			}
-
-			if !inReference && unicode.IsLetter(r) {
-				inReference = true
-			}
-
-			if !inReference && dollarInColumn && r == '$' {
-				return false
-			}
+				if step != nil {
 
-			if !inReference && r == '$' {
-				dollarInColumn = true
-			}
-
-			if dollarInRow && inReference && r == '$' {
-				return false
-			}
-
-			if inReference && r == '$' && dollarInRow {
-				return false
-			}
-
-			if inReference && !dollarInRow && r == '$' {
-				dollarInRow = true
-			}
-
-			if inReference && (r == ':' && []rune(previousChar)[0] != ':') {
-				inReference = false
-				validReference = false
-				referenceFoundRange = true
-				foundReferenceMark = false
-				dollarInColumn = false
-				dollarInRow = false
-			}
-
-			if inReference && validReference && unicode.IsLetter(r) {
-				return false
-			}
-
-			/* function checking */
-			if inReference && !validReference && r == '(' {
-				inFunction = true
-				inReference = false
-				foundReferenceMark = false
-			}
-
-			if inFunction && r == ')' {
-				inFunction = false
-				operatorAllowed = true
-			}
-
-			if referenceFoundRange && !inReference && unicode.IsLetter(r) {
-				inReference = true
-			}
-
-			if referenceFoundRange && !inReference && unicode.IsDigit(r) {
-				return false
-			}
-
-			if inReference && unicode.IsDigit(r) {
-				validReference = true
-			}
-
-			if inReference && referenceFoundRange && !(unicode.IsDigit(r) || unicode.IsLetter(r) || r == '$') {
-
-				if !validReference {
-					return false
-				}
-
-				inReference = false
-				foundReferenceMark = false
-				dollarInColumn = false
-				dollarInRow = false
-				validReference = false
-				referenceFoundRange = false
-			}
-
-			if inReference && !referenceFoundRange && !(unicode.IsDigit(r) || unicode.IsLetter(r) || r == ':' || r == '$') {
-
-				if !validReference {
-					return false
-				}
-
-				inReference = false
-				foundReferenceMark = false
-				validReference = false
-				dollarInColumn = false
-				dollarInRow = false
-				operatorAllowed = true
-			}
-
-			if !inReference && !inDecimal && unicode.IsDigit(r) {
-				inNumber = true
-
-				operatorsFound = append(operatorsFound, currentOperator)
-				currentOperator = ""
-
-				if inOperator {
-					inOperator = false
-					operatorAllowed = false
-				}
-			}
-
-			/* decimal checking */
-			if !inReference && inNumber && r == '.' && unicode.IsDigit([]rune(previousChar)[0]) {
-				inDecimal = true
-			} else if inDecimal && !(unicode.IsDigit(r) || unicode.IsLetter(r)) && !validDecimal {
-				return false
-			} else if inDecimal && unicode.IsDigit(r) {
-				validDecimal = true
-			} else if inDecimal && unicode.IsLetter(r) {
-				return false
-			} else if !inDecimal && r == '.' {
-				return false
-			}
-
-			if (inNumber || inDecimal) && !(unicode.IsLetter(r) || unicode.IsDigit(r)) && r != '.' {
-				inNumber = false
-				inDecimal = false
-
-				// number end
-				operatorAllowed = true
-			}
-
-			if !inNumber && r == '-' && unicode.IsDigit(nextR) {
-				inNumber = true
-
-				operatorsFound = append(operatorsFound, currentOperator)
-				currentOperator = ""
-
-				if inOperator {
-					inOperator = false
-				}
-
-			} else if inOperator && r == '-' && currentOperator == "-" {
-				return false
-			} else if !inReference && r == '-' && !inNumber && !inOperator && !unicode.IsDigit(nextR) {
-				currentOperator += c
-				inOperator = true
-
-				if !operatorAllowed {
-					return false
-				}
+					changedCells := computeDirtyCells(&grid, c)
 
-			} else if !inReference && !inFunction && !inDecimal && !(unicode.IsDigit(r) || unicode.IsLetter(r)) && r != ' ' && r != '(' && r != ')' && r != ',' && r != '$' {
-				// if not in reference and operator is not space
-				currentOperator += c
-				inOperator = true
+					if step.sheetsBefore != nil {
+						sendSheets(c, &grid)
+					}
+					if step.namesBefore != nil {
+						sendNames(c, &grid)
+					}
 
-				if !operatorAllowed {
-					return false
+					// other cells can be flagged by the validation rules now
+					if step.validationsBefore != nil {
+						invalidateView(&grid, c)
+					} else {
+						sendDirtyOrInvalidate(changedCells, &grid, c)
+					}
 				}
 			}
 
-			if inOperator && (unicode.IsDigit(r) || unicode.IsLetter(r) || r == ' ') {
-				inOperator = false
-				operatorAllowed = false
-				operatorsFound = append(operatorsFound, currentOperator)
-				currentOperator = ""
+			// actions that change the content of the grid can be undone
+			if undoableActions[parsed[0]] {
+				recordUndoStep(&grid)
 			}
-
 		}
-
-		buffer.WriteString(c)
-
-		previousChar = c
-
-	}
-
-	for _, operator := range operatorsFound {
-		if !contains(availableOperators, operator) && operator != "" {
-			return false
-		}
-	}
-
-	if parenDepth != 0 {
-		return false
-	}
-	if quoteDepth != 0 {
-		return false
 	}
 
-	if inReference && !validReference {
-		return false
-	}
-
-	return true
 }
 
-func getReferenceRangeFromMapIndex(standardRangeReference string) ReferenceRange {
-
-	referenceParts := strings.Split(standardRangeReference, "!")
-	sheetIndex, err := strconv.Atoi(referenceParts[0])
+func isValidFormula(formula string) bool {
 
-	if err != nil {
-		log.Fatal(err)
+	// an empty formula clears the cell
+	if len(formula) == 0 {
+		return true
 	}
 
-	return ReferenceRange{String: referenceParts[1], SheetIndex: int8(sheetIndex)}
+	_, err := compileFormula(formula)
+	return err == nil
 }
 
-func getReferenceFromMapIndex(standardReference string) Reference {
-
-	referenceParts := strings.Split(standardReference, "!")
-	sheetIndex, err := strconv.Atoi(referenceParts[0])
+// getReferenceRangeFromMapIndex returns the range of a Python data request like "0!A1:B2", the
+// sheet is given by its position
+func getReferenceRangeFromMapIndex(standardRangeReference string, grid *Grid) ReferenceRange {
 
-	if err != nil {
-		log.Fatal(err)
-	}
+	referenceParts := strings.Split(standardRangeReference, "!")
 
-	return Reference{String: referenceParts[1], SheetIndex: int8(sheetIndex)}
+	return ReferenceRange{String: referenceParts[1], SheetIndex: getSheetIDFromString(referenceParts[0], grid)}
 }
 
-func getMapIndexFromReference(reference Reference) string {
-	stringRef := strings.Replace(reference.String, "$", "", -1)
+func computeDirtyCells(grid *Grid, c *Client) []CellKey {
 
-	splittedString := strings.Split(stringRef, "!")
-	lastPart := splittedString[len(splittedString)-1]
+	// names are compiled before the cells using them are computed concurrently
+	compileDefinitions(grid)
 
-	stringRef = strconv.Itoa(int(reference.SheetIndex)) + "!" + lastPart
+	// volatile cells are recomputed on every recalculation
+	markVolatileCellsDirty(grid)
 
-	return stringRef
+	changedCells := computeDirtyCellsPass(grid, c)
+
+	// conditional formats follow the computed values
+	return append(changedCells, evaluateChangedConditionalFormats(changedCells, grid)...)
 }
 
-func computeDirtyCells(grid *Grid, c *Client) []Reference {
+// computeDirtyCellsPass computes the dirty cells in the order of their dependencies
+func computeDirtyCellsPass(grid *Grid, c *Client) []CellKey {
 
-	changedRefs := []Reference{}
+	changedRefs := []CellKey{}
+	spilledRefs := []CellKey{}
 
 	indicateProgress := false
 	progressTotal := len(grid.DirtyCells)
+	progressSent := progressTotal + 1000
 	// communicate long computations (at arbitrary boundry 1000):
 	if progressTotal > 1000 {
 		indicateProgress = true
@@ -1110,10 +1054,10 @@ func computeDirtyCells(grid *Grid, c *Client) []Reference {
 	/// initialize DependInTemp and DependOutTemp for resolving
 	for key, _ := range grid.DirtyCells {
 
-		thisDv := getDataByNormalRef(key, grid)
+		thisDv := getDataByCellKey(key, grid)
 
-		thisDv.DependInTemp = make(map[string]bool)
-		thisDv.DependOutTemp = make(map[string]bool)
+		thisDv.DependInTemp = make(map[CellKey]bool)
+		thisDv.DependOutTemp = make(map[CellKey]bool)
 
 		for ref, inSet := range thisDv.DependIn {
 			thisDv.DependInTemp[ref] = inSet
@@ -1124,15 +1068,35 @@ func computeDirtyCells(grid *Grid, c *Client) []Reference {
 
 	}
 
+	// cells using whole columns or rows wait for the dirty cells inside those ranges
+	for key, dependents := range grid.RangeDependents {
+
+		dependedRange := wholeRangeFromKey(key)
+
+		for dependent := range dependents {
+
+			if _, isDirty := grid.DirtyCells[dependent]; !isDirty {
+				continue
+			}
+
+			for dirtyIndex := range grid.DirtyCells {
+				if dependedRange.contains(dirtyIndex) {
+					getDataByCellKey(dependent, grid).DependInTemp[dirtyIndex] = true
+					getDataByCellKey(dirtyIndex, grid).DependOutTemp[dependent] = true
+				}
+			}
+		}
+	}
+
 	// for every DV in dirtyCells clean up the DependInTemp list with refs not in DirtyCells
 
 	// When a cell is not in DirtyCells but IS in the DependInTemp of a cell, it needs to be removed from it since it needs to have zero DependInTemp before it can be evaluated
 
-	noDependInDirtyCells := make(map[string]bool)
+	noDependInDirtyCells := make(map[CellKey]bool)
 
 	for stringRef, _ := range grid.DirtyCells {
 
-		thisDv := getDataByNormalRef(stringRef, grid)
+		thisDv := getDataByCellKey(stringRef, grid)
 
 		for stringRefInner := range thisDv.DependInTemp {
 
@@ -1152,13 +1116,13 @@ func computeDirtyCells(grid *Grid, c *Client) []Reference {
 
 	for len((grid.DirtyCells)) != 0 {
 
-		var dv *DynamicValue
-		var index string
+		var index CellKey
 
-		// send progress indicator
+		// send progress indicator, cells computed in parallel can skip past the boundaries
 		if indicateProgress {
 
-			if len(grid.DirtyCells)%1000 == 0 || len(grid.DirtyCells) == 1 {
+			if progressSent-len(grid.DirtyCells) >= 1000 || len(grid.DirtyCells) == 1 {
+				progressSent = len(grid.DirtyCells)
 				progress := float64(progressTotal-len(grid.DirtyCells)+1) / float64(progressTotal)
 				c.send <- []byte("[\"PROGRESSINDICATOR\", " + strconv.FormatFloat(progress, 'E', -1, 64) + "]")
 			}
@@ -1169,96 +1133,191 @@ func computeDirtyCells(grid *Grid, c *Client) []Reference {
 		// This step is done in computeDirtyCells because at this point
 		// we are certain whether cells are dirty or not
 
+		// every dirty cell waits on another one, so there is a cycle
 		if len(noDependInDirtyCells) == 0 {
-			fmt.Println("Error: should have an element in noDependInDirtyCells when DirtyCells is not empty")
-
-			// circular dependency error in all dirty cells
-			for key, _ := range grid.DirtyCells {
-				thisDv := getDataByNormalRef(key, grid)
-				thisDv.DataString = "\"Circular reference: " + thisDv.DataFormula + "\""
-				thisDv.ValueType = DynamicValueTypeString
-				changedRefs = append(changedRefs, getReferenceFromMapIndex(key))
+
+			cycle := findDirtyCycle(grid)
+			resolved := cycle
+
+			if grid.Iteration.IsEnabled {
+				resolved = dirtyCycleComponent(cycle[0], grid)
+
+				iteratedRefs, iteratedSpilledRefs := iterateCells(resolved, grid)
+				changedRefs = append(changedRefs, iteratedRefs...)
+				spilledRefs = append(spilledRefs, iteratedSpilledRefs...)
+			} else {
+				setCircularReferenceErrors(cycle, grid)
+
+				for _, key := range cycle {
+					changedRefs = append(changedRefs, key)
+				}
 			}
 
-			break
+			// the cells waiting on the cycle can continue, with an error when it's a circular reference
+			for _, key := range resolved {
+				delete(grid.DirtyCells, key)
+			}
+			for _, key := range resolved {
+				releaseDependents(key, grid, noDependInDirtyCells)
+			}
+
+			continue
+		}
+
+		// enough cells are ready to be worth evaluating them concurrently
+		if len(noDependInDirtyCells) >= parallelComputeThreshold {
+
+			ready := []CellKey{}
+			for key := range noDependInDirtyCells {
+				ready = append(ready, key)
+			}
+
+			evaluated := evaluateCellsConcurrently(ready, grid)
+
+			for position, key := range ready {
+
+				releaseDependents(key, grid, noDependInDirtyCells)
+
+				if evaluated[position] != nil {
+					spilledRefs = append(spilledRefs, storeComputedCell(key, getDataByCellKey(key, grid), evaluated[position], grid)...)
+					changedRefs = append(changedRefs, key)
+				} else if isComputed, spilled := computeCell(key, grid); isComputed {
+					changedRefs = append(changedRefs, key)
+					spilledRefs = append(spilledRefs, spilled...)
+				}
+
+				delete(grid.DirtyCells, key)
+				delete(noDependInDirtyCells, key)
+			}
+
+			continue
 		}
 
 		// take first element in noDependInDirtyCells
 		for k := range noDependInDirtyCells {
 			index = k
-			dv = getDataByNormalRef(index, grid)
 			break
 		}
 
-		// compute thisDv and update all DependOn values
-		if dv.DependOutTemp != nil {
-			for ref, inSet := range dv.DependOutTemp {
-				if inSet {
+		releaseDependents(index, grid, noDependInDirtyCells)
+
+		if isComputed, spilled := computeCell(index, grid); isComputed {
+			changedRefs = append(changedRefs, index)
+			spilledRefs = append(spilledRefs, spilled...)
+		}
+
+		delete(grid.DirtyCells, index)
+		delete(noDependInDirtyCells, index)
 
-					// only delete dirty dependencies for cells marked in dirtycells
-					if _, ok := (grid.DirtyCells)[ref]; ok {
-						delete(getDataByNormalRef(ref, grid).DependInTemp, index)
+	}
 
-						if len(getDataByNormalRef(ref, grid).DependInTemp) == 0 {
+	// cells that started to receive spilled values weren't dirty, their dependents are computed in another pass
+	if len(spilledRefs) > 0 {
 
-							// TO VALIDATE: is the below a problem?
-							// check to see if every time when trying to add to noDependInDirtyCells it is not contained in it
-							// log.Fatal("while removing DependInTemp " + ref + " was already in noDependInDirtyCells")
-							noDependInDirtyCells[ref] = true
-						}
-					}
+		changedRefs = append(changedRefs, spilledRefs...)
 
+		for _, spilledIndex := range spilledRefs {
+			for ref := range getDataByCellKey(spilledIndex, grid).DependOut {
+				if _, isDirty := grid.DirtyCells[ref]; !isDirty {
+					copyToDirty(ref, grid)
+				}
+			}
+			for _, ref := range wholeRangeDependents(spilledIndex, grid) {
+				if _, isDirty := grid.DirtyCells[ref]; !isDirty {
+					copyToDirty(ref, grid)
 				}
 			}
 		}
 
-		// NOTE!!! for now compare, check later if computationally feasible
+		changedRefs = append(changedRefs, computeDirtyCellsPass(grid, c)...)
+	}
+
+	return changedRefs
+}
 
-		// DO COMPUTE HERE
-		// stringBefore := convertToString((*grid)[index])
+// releaseDependents removes a computed cell from what its dirty dependents wait on, dependents that
+// no longer wait on anything are ready to be computed
+func releaseDependents(index CellKey, grid *Grid, noDependInDirtyCells map[CellKey]bool) {
 
-		originalDv := getDataByNormalRef(index, grid)
+	dv := getDataByCellKey(index, grid)
 
-		// originalIsString := false
-		// if originalDv.ValueType == DynamicValueTypeString {
-		// originalIsString = true
-		// }
+	for ref, inSet := range dv.DependOutTemp {
+		if inSet {
 
-		newDv := originalDv
+			// only delete dirty dependencies for cells marked in dirtycells
+			if _, ok := (grid.DirtyCells)[ref]; ok {
+				delete(getDataByCellKey(ref, grid).DependInTemp, index)
 
-		// re-compute only non explosive formulas and not marked for non-recompute
-		if originalDv.ValueType != DynamicValueTypeExplosiveFormula {
+				if len(getDataByCellKey(ref, grid).DependInTemp) == 0 {
+					noDependInDirtyCells[ref] = true
+				}
+			}
 
-			originalDv.ValueType = DynamicValueTypeFormula
-			currentReference := getReferenceFromMapIndex(index)
-			newDv = parse(originalDv, grid, currentReference)
+		}
+	}
+}
 
-			newDv.DataFormula = originalDv.DataFormula
-			newDv.DependIn = originalDv.DependIn
-			newDv.DependOut = originalDv.DependOut
-			newDv.SheetIndex = originalDv.SheetIndex
+// computeCell evaluates the formula of a cell, it returns whether the cell was computed (explosive
+// formulas aren't) and the cells its array result spilled into
+func computeCell(index CellKey, grid *Grid) (bool, []CellKey) {
 
-			setDataByRef(currentReference, newDv, grid)
+	originalDv := getDataByCellKey(index, grid)
 
-			changedRefs = append(changedRefs, currentReference)
+	// re-compute only non explosive formulas and not marked for non-recompute
+	if originalDv.ValueType == DynamicValueTypeExplosiveFormula {
+		return false, nil
+	}
 
-		}
+	newDv := originalDv
 
-		delete(grid.DirtyCells, index)
-		delete(noDependInDirtyCells, index)
+	originalDv.ValueType = DynamicValueTypeFormula
+	currentReference := getReferenceFromCellKey(index)
 
+	if originalDv.SpillFrom != noCellKey {
+		newDv = spilledValue(currentReference, originalDv, grid)
+	} else {
+		newDv = parse(originalDv, grid, currentReference)
 	}
 
-	return changedRefs
+	return true, storeComputedCell(index, originalDv, newDv, grid)
+}
+
+// storeComputedCell replaces a cell by its computed value, it returns the cells its array result spilled into
+func storeComputedCell(index CellKey, originalDv *DynamicValue, newDv *DynamicValue, grid *Grid) []CellKey {
+
+	currentReference := getReferenceFromCellKey(index)
+
+	newDv.DataFormula = originalDv.DataFormula
+	newDv.compiled = originalDv.compiled
+	newDv.DependIn = originalDv.DependIn
+	newDv.DependOut = originalDv.DependOut
+	newDv.SheetIndex = originalDv.SheetIndex
+	newDv.Format = originalDv.Format
+	newDv.StyleID = originalDv.StyleID
+
+	// keep the state of the computation, cycles are computed again when iterating
+	newDv.DependInTemp = originalDv.DependInTemp
+	newDv.DependOutTemp = originalDv.DependOutTemp
+
+	setDataByRef(currentReference, newDv, grid)
+
+	// array results spill into the neighbouring cells
+	if newDv.SpillFrom == noCellKey {
+		return spillArray(currentReference, newDv, grid)
+	}
+
+	return nil
 }
 
 func sendCells(cellsToSend *[][]string, c *Client) {
 
 	jsonData := []string{"SET"}
 
-	// send all dirty cells
+	// send all dirty cells, each as reference, value, formula, sheet, error message, the value as
+	// displayed with its number format, the ID of its style, what conditional formats do to it and the
+	// message of the validation rule it breaks
 	for _, e := range *cellsToSend {
-		jsonData = append(jsonData, e[0], e[1], e[2], e[3])
+		jsonData = append(jsonData, e[0], e[1], e[2], e[3], e[4], e[5], e[6], e[7], e[8])
 	}
 
 	json, _ := json.Marshal(jsonData)
@@ -1266,6 +1325,22 @@ func sendCells(cellsToSend *[][]string, c *Client) {
 
 }
 
+// sendConsoleError shows an error in the console of the client
+func sendConsoleError(err error, c *Client) {
+	json, _ := json.Marshal([]string{"INTERPRETER", "[error]" + err.Error() + "\n"})
+	c.send <- json
+}
+
+// checkArgumentCount returns an error when an action from the client has fewer arguments than it needs
+func checkArgumentCount(parsed []string, count int) error {
+
+	if len(parsed) < count+1 {
+		return errors.New(parsed[0] + " requires " + strconv.Itoa(count) + " arguments, got " + strconv.Itoa(len(parsed)-1))
+	}
+
+	return nil
+}
+
 func sendSheets(c *Client, grid *Grid) {
 	jsonData := []string{"SETSHEETS"}
 
@@ -1279,16 +1354,23 @@ func sendSheets(c *Client, grid *Grid) {
 	c.send <- json
 }
 
-func sendSheetSize(c *Client, sheetIndex int8, grid *Grid) {
-	jsonData := []string{"SHEETSIZE", strconv.Itoa(grid.SheetSizes[sheetIndex].RowCount), strconv.Itoa(grid.SheetSizes[sheetIndex].ColumnCount), strconv.Itoa(int(sheetIndex))}
+func sendSheetSize(c *Client, sheetIndex SheetID, grid *Grid) {
+	sheetSize := getSheetSize(sheetIndex, grid)
+	jsonData := []string{"SHEETSIZE", strconv.Itoa(sheetSize.RowCount), strconv.Itoa(sheetSize.ColumnCount), getSheetPositionString(sheetIndex, grid)}
 	json, _ := json.Marshal(jsonData)
 	c.send <- json
 }
 
-func sendDirtyOrInvalidate(changedCells []Reference, grid *Grid, c *Client) {
+func sendDirtyOrInvalidate(changedCells []CellKey, grid *Grid, c *Client) {
 	// magic number to speed up cell updating
 	if len(changedCells) < 100 {
-		sendCellsByRefs(changedCells, grid, c)
+
+		references := []Reference{}
+		for _, key := range changedCells {
+			references = append(references, getReferenceFromCellKey(key))
+		}
+
+		sendCellsByRefs(references, grid, c)
 	} else {
 		invalidateView(grid, c)
 	}
@@ -1313,7 +1395,7 @@ func sendCellsInRange(cellRange ReferenceRange, grid *Grid, c *Client) {
 
 		if dv != nil {
 			stringAfter := convertToString(dv)
-			cellsToSend = append(cellsToSend, []string{relativeReferenceString(reference), stringAfter.DataString, "=" + dv.DataFormula, strconv.Itoa(int(dv.SheetIndex))})
+			cellsToSend = append(cellsToSend, []string{relativeReferenceString(reference), stringAfter.DataString, "=" + dv.DataFormula, getSheetPositionString(dv.SheetIndex, grid), dv.ErrorMessage, formatCellValue(dv), strconv.Itoa(int(dv.StyleID)), getConditionalStyleString(getCellKeyFromReference(reference), grid), getValidationMessage(reference, grid)})
 		}
 
 		// cell to string
@@ -1338,7 +1420,7 @@ func sendCellsByRefs(refs []Reference, grid *Grid, c *Client) {
 		dv := getDataFromRef(reference, grid)
 		// cell to string
 		stringAfter := convertToString(dv)
-		cellsToSend = append(cellsToSend, []string{relativeReferenceString(reference), stringAfter.DataString, "=" + dv.DataFormula, strconv.Itoa(int(dv.SheetIndex))})
+		cellsToSend = append(cellsToSend, []string{relativeReferenceString(reference), stringAfter.DataString, "=" + dv.DataFormula, getSheetPositionString(dv.SheetIndex, grid), dv.ErrorMessage, formatCellValue(dv), strconv.Itoa(int(dv.StyleID)), getConditionalStyleString(getCellKeyFromReference(reference), grid), getValidationMessage(reference, grid)})
 	}
 
 	sendCells(&cellsToSend, c)
@@ -1362,38 +1444,71 @@ func FromGOB64(binary []byte) Grid {
 	d := gob.NewDecoder(r)
 	err := d.Decode(&grid)
 	if err != nil {
-		fmt.Println(`failed gob Decode`, err)
+
+		// sheets saved before cell keys address cells by strings like "0!A1"
+		legacy := legacyGrid{}
+		legacyErr := gob.NewDecoder(bytes.NewReader(binary)).Decode(&legacy)
+		if legacyErr != nil {
+			fmt.Println(`failed gob Decode`, err)
+			return grid
+		}
+
+		return convertLegacyGrid(legacy)
 	}
 	return grid
 }
 
-func determineMinimumRectangle(startRow int, startColumn int, sheetIndex int8, grid *Grid) (int, int) {
+func determineMinimumRectangle(startRow int, startColumn int, sheetIndex SheetID, grid *Grid) (int, int) {
 
 	maximumRow := startRow
 	maximumColumn := startColumn
 
-	for r := startRow; r <= grid.SheetSizes[sheetIndex].RowCount; r++ {
-		for c := startColumn; c <= grid.SheetSizes[sheetIndex].ColumnCount; c++ {
+	for _, cell := range sheetCells(sheetIndex, grid) {
+
+		if cell.row < startRow || cell.column < startColumn {
+			continue
+		}
 
-			cell := getDataFromRef(Reference{String: indexesToReferenceString(r, c), SheetIndex: sheetIndex}, grid)
+		cellFormula := strings.Replace(cell.dv.DataFormula, "\"", "", -1)
 
-			cellFormula := cell.DataFormula
+		if len(cellFormula) != 0 && cell.column >= maximumColumn {
+			maximumColumn = cell.column
+		}
 
-			cellFormula = strings.Replace(cellFormula, "\"", "", -1)
+		if len(cellFormula) != 0 && cell.row >= maximumRow {
+			maximumRow = cell.row
+		}
+	}
+	return maximumRow, maximumColumn
+}
 
-			if len(cellFormula) != 0 && c >= maximumColumn {
-				maximumColumn = c
-			}
+// determineMovedRectangle is like determineMinimumRectangle, but also includes the cells that only
+// have a number format or style, they move along when rows and columns are inserted or deleted
+func determineMovedRectangle(startRow int, startColumn int, sheetIndex SheetID, grid *Grid) (int, int) {
 
-			if len(cellFormula) != 0 && r >= maximumRow {
-				maximumRow = r
-			}
+	maximumRow, maximumColumn := determineMinimumRectangle(startRow, startColumn, sheetIndex, grid)
+
+	for _, cell := range sheetCells(sheetIndex, grid) {
+
+		if cell.row < startRow || cell.column < startColumn {
+			continue
+		}
+
+		if len(cell.dv.Format) == 0 && cell.dv.StyleID == defaultStyle {
+			continue
+		}
+
+		if cell.column > maximumColumn {
+			maximumColumn = cell.column
+		}
+		if cell.row > maximumRow {
+			maximumRow = cell.row
 		}
 	}
 	return maximumRow, maximumColumn
 }
 
-func generateCSV(grid *Grid) string {
+func generateCSV(formatted bool, grid *Grid) string {
 
 	// determine number of columns
 	numberOfRows, numberOfColumns := determineMinimumRectangle(1, 1, grid.ActiveSheet, grid)
@@ -1415,6 +1530,11 @@ func generateCSV(grid *Grid) string {
 			// fmt.Println("Ref: " + doubleIndexToStringRef(r, c))
 			// fmt.Println("cell.DataFormula: " + cell.DataFormula)
 
+			if formatted {
+				record = append(record, formatCellValue(cell))
+				continue
+			}
+
 			stringDv := convertToString(cell)
 
 			// fmt.Println("stringDv.DataString: " + stringDv.DataString)
@@ -1467,7 +1587,19 @@ func cellRangeBoundaries(cellRange string) (int, int, int, int) {
 	return lowerRow, lowerColumn, upperRow, upperColumn
 }
 
+// dates compare as their serial number, spilling formulas as their first value
+func dateAsFloat(dv *DynamicValue) *DynamicValue {
+	if dv.ValueType == DynamicValueTypeArray {
+		dv = arrayFirstValue(dv)
+	}
+	if dv.ValueType == DynamicValueTypeDate {
+		return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: dv.DataFloat}
+	}
+	return dv
+}
+
 func compareDvsBigger(dv1 *DynamicValue, dv2 *DynamicValue) bool {
+	dv1, dv2 = dateAsFloat(dv1), dateAsFloat(dv2)
 	if dv1.ValueType == DynamicValueTypeString && dv2.ValueType == DynamicValueTypeString {
 		return dv1.DataString > dv2.DataString
 	} else if dv1.ValueType == DynamicValueTypeString && dv2.ValueType == DynamicValueTypeFloat {
@@ -1484,6 +1616,7 @@ func compareDvsBigger(dv1 *DynamicValue, dv2 *DynamicValue) bool {
 }
 
 func compareDvsSmaller(dv1 *DynamicValue, dv2 *DynamicValue) bool {
+	dv1, dv2 = dateAsFloat(dv1), dateAsFloat(dv2)
 	if dv1.ValueType == DynamicValueTypeString && dv2.ValueType == DynamicValueTypeString {
 		return dv1.DataString < dv2.DataString
 	} else if dv1.ValueType == DynamicValueTypeString && dv2.ValueType == DynamicValueTypeFloat {
@@ -1508,6 +1641,15 @@ func sortRange(direction string, cellRange string, sortColumn string, grid *Grid
 
 	sortColumnIndex := getReferenceColumnIndex(sortColumn)
 
+	// rows below the last one with content are empty, they stay where they are
+	lastRow := lowerRow - 1
+	for _, cell := range sheetCells(grid.ActiveSheet, grid) {
+		if cell.row >= lowerRow && cell.row <= upperRow && cell.column >= lowerColumn && cell.column <= upperColumn && !isCellEmpty(cell.dv) {
+			lastRow = cell.row
+		}
+	}
+	upperRow = lastRow
+
 	nonSortingColumns := []int{}
 
 	for c := lowerColumn; c <= upperColumn; c++ {
@@ -1610,7 +1752,7 @@ func sortRange(direction string, cellRange string, sortColumn string, grid *Grid
 
 }
 
-func changeReferenceIndex(reference Reference, rowDifference int, columnDifference int, targetSheetIndex int8, grid *Grid) (Reference, bool) {
+func changeReferenceIndex(reference Reference, rowDifference int, columnDifference int, targetSheetIndex SheetID, grid *Grid) (Reference, bool) {
 
 	crossedBounds := false
 
@@ -1638,8 +1780,8 @@ func changeReferenceIndex(reference Reference, rowDifference int, columnDifferen
 		refRow = 1
 		crossedBounds = true
 	}
-	if refRow > grid.SheetSizes[grid.ActiveSheet].RowCount {
-		refRow = grid.SheetSizes[grid.ActiveSheet].RowCount
+	if refRow > getSheetSize(grid.ActiveSheet, grid).RowCount {
+		refRow = getSheetSize(grid.ActiveSheet, grid).RowCount
 		crossedBounds = true
 	}
 
@@ -1647,15 +1789,15 @@ func changeReferenceIndex(reference Reference, rowDifference int, columnDifferen
 		refColumn = 1
 		crossedBounds = true
 	}
-	if refColumn > grid.SheetSizes[grid.ActiveSheet].ColumnCount {
-		refColumn = grid.SheetSizes[grid.ActiveSheet].ColumnCount
+	if refColumn > getSheetSize(grid.ActiveSheet, grid).ColumnCount {
+		refColumn = getSheetSize(grid.ActiveSheet, grid).ColumnCount
 		crossedBounds = true
 	}
 
 	return Reference{String: indexesToReferenceWithFixed(refRow, refColumn, fixedRow, fixedColumn), SheetIndex: targetSheetIndex}, crossedBounds
 }
 
-func changeRangeReference(rangeReference ReferenceRange, rowDifference int, columnDifference int, targetSheetIndex int8, grid *Grid) ReferenceRange {
+func changeRangeReference(rangeReference ReferenceRange, rowDifference int, columnDifference int, targetSheetIndex SheetID, grid *Grid) ReferenceRange {
 
 	rangeReferenceString := rangeReference.String
 	rangeReferences := strings.Split(rangeReferenceString, ":")
@@ -1739,40 +1881,13 @@ func incrementFormula(sourceFormula string, sourceRef Reference, destinationRef
 		newFormula = replaceReferenceRangesInFormula(newFormula, sourceRef.SheetIndex, destinationRef.SheetIndex, referenceRangeMapping, grid)
 	}
 
-	return newFormula
-}
-
-func removeSheet(sheetIndex int8, grid *Grid) {
-
-	for currentSheetIndex := int(sheetIndex + 1); currentSheetIndex < len(grid.SheetList); currentSheetIndex++ {
-
-		for column := 1; column < grid.SheetSizes[currentSheetIndex].ColumnCount; column++ {
-
-			for row := 1; row < grid.SheetSizes[currentSheetIndex].RowCount; row++ {
-
-				indexString := strconv.Itoa(currentSheetIndex) + "!" + indexesToReferenceString(row, column)
-				newIndexString := strconv.Itoa(currentSheetIndex-1) + "!" + indexesToReferenceString(row, column)
-
-				toBeMovedDv := grid.Data[indexString]
-				toBeMovedDv.SheetIndex = int8(currentSheetIndex - 1)
-				grid.Data[newIndexString] = toBeMovedDv
-
-			}
-
-		}
+	// whole columns and rows move along with copies, like regular ranges
+	if !isCut {
+		rowDifference, columnDifference := getReferenceStringDifference(destinationRef.String, sourceRef.String)
+		newFormula = moveWholeRanges(newFormula, rowDifference, columnDifference)
 	}
 
-	// change grid.SheetList, grid.SheetNames, grid.SheetSizes
-	delete(grid.SheetNames, grid.SheetList[sheetIndex])
-
-	grid.SheetList = append(grid.SheetList[0:sheetIndex], grid.SheetList[sheetIndex+1:]...)
-	grid.SheetSizes = append(grid.SheetSizes[0:sheetIndex], grid.SheetSizes[sheetIndex+1:]...)
-
-	index := 0
-	for _, sheetName := range grid.SheetList {
-		grid.SheetNames[sheetName] = int8(index)
-		index++
-	}
+	return newFormula
 }
 
 func sourceToDestinationMapping(sourceRange ReferenceRange, destinationRange ReferenceRange, grid *Grid) ([]Reference, []Reference, []Reference) {
@@ -1830,7 +1945,7 @@ func sourceToDestinationMapping(sourceRange ReferenceRange, destinationRange Ref
 				destinationRef := Reference{String: indexesToReferenceString(dRow, dColumn), SheetIndex: destinationRange.SheetIndex}
 				sourceRef := Reference{String: indexesToReferenceString(sRow, sColumn), SheetIndex: sourceRange.SheetIndex}
 
-				if !(dRow > grid.SheetSizes[destinationRange.SheetIndex].RowCount || dColumn > grid.SheetSizes[destinationRange.SheetIndex].ColumnCount) {
+				if !(dRow > getSheetSize(destinationRange.SheetIndex, grid).RowCount || dColumn > getSheetSize(destinationRange.SheetIndex, grid).ColumnCount) {
 					destinationMapping = append(destinationMapping, destinationRef)
 					destinationMapping = append(destinationMapping, sourceRef)
 				}
@@ -1863,7 +1978,7 @@ func sourceToDestinationMapping(sourceRange ReferenceRange, destinationRange Ref
 				destinationRef := Reference{String: indexesToReferenceString(dRow, dColumn), SheetIndex: destinationRange.SheetIndex}
 				sourceRef := Reference{String: indexesToReferenceString(sRow, sColumn), SheetIndex: sourceRange.SheetIndex}
 
-				if !(dRow > grid.SheetSizes[destinationRange.SheetIndex].RowCount || dColumn > grid.SheetSizes[destinationRange.SheetIndex].ColumnCount) {
+				if !(dRow > getSheetSize(destinationRange.SheetIndex, grid).RowCount || dColumn > getSheetSize(destinationRange.SheetIndex, grid).ColumnCount) {
 					destinationMapping = append(destinationMapping, destinationRef)
 					destinationMapping = append(destinationMapping, sourceRef)
 				}
@@ -1901,7 +2016,7 @@ func copyByValue(sourceRange ReferenceRange, destinationRange ReferenceRange, gr
 
 	destinationMapping, _, destinationCells := sourceToDestinationMapping(sourceRange, destinationRange, grid)
 
-	newDvs := make(map[Reference]*DynamicValue)
+	newDvs := make(map[CellKey]*DynamicValue)
 
 	k := 0
 	for k < len(destinationMapping) {
@@ -1911,28 +2026,26 @@ func copyByValue(sourceRange ReferenceRange, destinationRange ReferenceRange, gr
 		sourceDv := getDataFromRef(sourceRef, grid)
 		destinationDv := getDataFromRef(destinationRef, grid)
 
+		// spilling formulas are copied as the value they show
+		if sourceDv.ValueType == DynamicValueTypeArray {
+			sourceDv = arrayFirstValue(sourceDv)
+		}
+
 		destinationDv.ValueType = sourceDv.ValueType
 		destinationDv.DataBool = sourceDv.DataBool
 		destinationDv.DataFloat = sourceDv.DataFloat
 		destinationDv.DataString = sourceDv.DataString
+		destinationDv.ErrorMessage = sourceDv.ErrorMessage
 
-		if destinationDv.ValueType == DynamicValueTypeString {
-			destinationDv.DataFormula = "\"" + sourceDv.DataString + "\""
-		} else if destinationDv.ValueType == DynamicValueTypeFloat {
-			destinationDv.DataFormula = strconv.FormatFloat(sourceDv.DataFloat, 'f', -1, 64)
-		} else {
-			destinationDv.DataFormula = "TRUE"
-			if !sourceDv.DataBool {
-				destinationDv.DataFormula = "FALSE"
-			}
-		}
+		destinationDv.DataFormula = valueFormula(sourceDv)
 
-		newDvs[destinationRef] = destinationDv
+		newDvs[getCellKeyFromReference(destinationRef)] = destinationDv
 
 		k += 2
 	}
 
-	for reference, dv := range newDvs {
+	for index, dv := range newDvs {
+		reference := getReferenceFromCellKey(index)
 		setDataByRef(reference, setDependencies(reference, dv, grid), grid)
 	}
 
@@ -1944,15 +2057,15 @@ func copySourceToDestination(sourceRange ReferenceRange, destinationRange Refere
 	destinationMapping, sourceCells, _ := sourceToDestinationMapping(sourceRange, destinationRange, grid)
 
 	finalDestinationCells := []Reference{}
-	newDvs := make(map[Reference]*DynamicValue)
-	requiresUpdates := make(map[Reference]*DynamicValue)
+	newDvs := make(map[CellKey]*DynamicValue)
+	requiresUpdates := make(map[CellKey]*DynamicValue)
 
 	rangesToCheck := make(map[Reference][]ReferenceRange)
 
 	var operationRowDifference int
 	var operationColumnDifference int
-	var operationSourceSheet int8
-	var operationTargetSheet int8
+	var operationSourceSheet SheetID
+	var operationTargetSheet SheetID
 
 	haveOperationDifference := false
 
@@ -1979,15 +2092,17 @@ func copySourceToDestination(sourceRange ReferenceRange, destinationRange Refere
 		previousDv := getDataFromRef(destinationRef, grid)
 		destinationDv := makeDv(newFormula)
 		destinationDv.DependOut = previousDv.DependOut
+		destinationDv.Format = sourceDv.Format
+		destinationDv.StyleID = sourceDv.StyleID
 
-		newDvs[destinationRef] = destinationDv
+		newDvs[getCellKeyFromReference(destinationRef)] = destinationDv
 
 		if isCut {
 
 			// when cutting cells, make sure that refences in DependOut are also appropriately incremented
 			for ref := range getDataFromRef(sourceRef, grid).DependOut {
 
-				thisReference := getReferenceFromMapIndex(ref)
+				thisReference := getReferenceFromCellKey(ref)
 
 				originalDv := getDvAndRefForCopyModify(thisReference, operationRowDifference, operationColumnDifference, operationSourceSheet, operationTargetSheet, newDvs, grid)
 
@@ -2015,6 +2130,8 @@ func copySourceToDestination(sourceRange ReferenceRange, destinationRange Refere
 
 				newDependOutDv := makeDv(newFormula)
 				newDependOutDv.DependOut = originalDv.DependOut
+				newDependOutDv.Format = originalDv.Format
+				newDependOutDv.StyleID = originalDv.StyleID
 				putDvForCopyModify(thisReference, newDependOutDv, operationRowDifference, operationColumnDifference, operationSourceSheet, operationTargetSheet, newDvs, requiresUpdates, grid)
 
 			}
@@ -2068,6 +2185,8 @@ func copySourceToDestination(sourceRange ReferenceRange, destinationRange Refere
 
 			newDv := makeDv(outgoingRefFormula)
 			newDv.DependOut = outgoingRefDv.DependOut
+			newDv.Format = outgoingRefDv.Format
+			newDv.StyleID = outgoingRefDv.StyleID
 
 			putDvForCopyModify(outgoingReference, newDv, 0, 0, operationSourceSheet, outgoingRef.SheetIndex, newDvs, requiresUpdates, grid)
 
@@ -2075,11 +2194,13 @@ func copySourceToDestination(sourceRange ReferenceRange, destinationRange Refere
 
 	}
 
-	for reference, dv := range newDvs {
+	for index, dv := range newDvs {
+		reference := getReferenceFromCellKey(index)
 		setDataByRef(reference, setDependencies(reference, dv, grid), grid)
 	}
 
-	for reference, _ := range requiresUpdates {
+	for index := range requiresUpdates {
+		reference := getReferenceFromCellKey(index)
 		setDataByRef(reference, setDependencies(reference, getDataFromRef(reference, grid), grid), grid)
 	}
 
@@ -2090,25 +2211,27 @@ func copySourceToDestination(sourceRange ReferenceRange, destinationRange Refere
 
 }
 
-func getDvAndRefForCopyModify(reference Reference, diffRow int, diffCol int, operationSourceSheet int8, operationTargetSheet int8, newDvs map[Reference]*DynamicValue, grid *Grid) *DynamicValue {
+func getDvAndRefForCopyModify(reference Reference, diffRow int, diffCol int, operationSourceSheet SheetID, operationTargetSheet SheetID, newDvs map[CellKey]*DynamicValue, grid *Grid) *DynamicValue {
 
 	newlyMappedRef, crossedBounds := changeReferenceIndex(reference, diffRow, diffCol, operationTargetSheet, grid)
+	newlyMappedIndex := getCellKeyFromReference(newlyMappedRef)
 
-	if _, ok := newDvs[newlyMappedRef]; ok && !crossedBounds && reference.SheetIndex == operationSourceSheet {
-		return newDvs[newlyMappedRef]
+	if _, ok := newDvs[newlyMappedIndex]; ok && !crossedBounds && reference.SheetIndex == operationSourceSheet {
+		return newDvs[newlyMappedIndex]
 	} else {
 		return getDataFromRef(reference, grid)
 	}
 }
 
-func putDvForCopyModify(reference Reference, dv *DynamicValue, diffRow int, diffCol int, operationSourceSheet int8, operationTargetSheet int8, newDvs map[Reference]*DynamicValue, requiresUpdates map[Reference]*DynamicValue, grid *Grid) {
+func putDvForCopyModify(reference Reference, dv *DynamicValue, diffRow int, diffCol int, operationSourceSheet SheetID, operationTargetSheet SheetID, newDvs map[CellKey]*DynamicValue, requiresUpdates map[CellKey]*DynamicValue, grid *Grid) {
 	newlyMappedRef, crossedBounds := changeReferenceIndex(reference, diffRow, diffCol, operationTargetSheet, grid)
+	newlyMappedIndex := getCellKeyFromReference(newlyMappedRef)
 
-	if _, ok := newDvs[newlyMappedRef]; ok && !crossedBounds && reference.SheetIndex == operationSourceSheet {
-		newDvs[newlyMappedRef] = dv
+	if _, ok := newDvs[newlyMappedIndex]; ok && !crossedBounds && reference.SheetIndex == operationSourceSheet {
+		newDvs[newlyMappedIndex] = dv
 	} else {
 		setDataByRef(reference, dv, grid)
-		requiresUpdates[reference] = dv
+		requiresUpdates[getCellKeyFromReference(reference)] = dv
 	}
 }
 
@@ -2145,36 +2268,32 @@ func getReferenceStringDifference(reference string, sourceReference string) (int
 	return rowDifference, columnDifference
 }
 
-func findMaxColumnWidth(columnIndex int, sheetIndex int8, grid *Grid, c *Client) {
-
-	maxRow := grid.SheetSizes[sheetIndex].RowCount
-	currentRowIndex := 1
+func findMaxColumnWidth(columnIndex int, sheetIndex SheetID, grid *Grid, c *Client) {
 
-	maxLengthFound := -1
-	maxIndexNormalRef := ""
+	// cells that were never set are empty, the first row is used when the whole column is
+	maxLengthFound := 0
+	maxIndex := makeCellKey(sheetIndex, 1, columnIndex)
 	maxRowIndex := 1
 
-	for {
-		normalRef := strconv.Itoa(int(sheetIndex)) + "!" + indexesToReferenceString(currentRowIndex, columnIndex)
-		dv := convertToString(getDataByNormalRef(normalRef, grid))
+	for _, cell := range sheetCells(sheetIndex, grid) {
 
-		if len(dv.DataString) > maxLengthFound {
-			maxLengthFound = len(dv.DataString)
-			maxIndexNormalRef = normalRef
-			maxRowIndex = currentRowIndex
+		if cell.column != columnIndex {
+			continue
 		}
 
-		currentRowIndex += 1
+		dv := convertToString(cell.dv)
 
-		if currentRowIndex > maxRow {
-			break
+		if len(dv.DataString) > maxLengthFound {
+			maxLengthFound = len(dv.DataString)
+			maxIndex = cell.index
+			maxRowIndex = cell.row
 		}
 	}
 
 	// make sure client has maxlen ref
-	sendCellsByRefs([]Reference{getReferenceFromMapIndex(maxIndexNormalRef)}, grid, c)
+	sendCellsByRefs([]Reference{getReferenceFromCellKey(maxIndex)}, grid, c)
 
-	jsonData := []string{"MAXCOLUMNWIDTH", strconv.Itoa(maxRowIndex), strconv.Itoa(columnIndex), strconv.Itoa(int(sheetIndex)), strconv.Itoa(maxLengthFound)}
+	jsonData := []string{"MAXCOLUMNWIDTH", strconv.Itoa(maxRowIndex), strconv.Itoa(columnIndex), getSheetPositionString(sheetIndex, grid), strconv.Itoa(maxLengthFound)}
 
 	json, err := json.Marshal(jsonData)
 
@@ -2187,6 +2306,23 @@ func findMaxColumnWidth(columnIndex int, sheetIndex int8, grid *Grid, c *Client)
 }
 func findJumpCell(startCell Reference, direction string, grid *Grid, c *Client) {
 
+	newCell := jumpCellReference(startCell, direction, grid)
+
+	jsonData := []string{"JUMPCELL", relativeReferenceString(startCell), direction, newCell}
+
+	json, err := json.Marshal(jsonData)
+
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	c.send <- json
+}
+
+// jumpCellReference returns the cell a jump from startCell in direction ends at, the end of a block
+// of cells with content or the start of the next one
+func jumpCellReference(startCell Reference, direction string, grid *Grid) string {
+
 	// find jump cell based on startCell
 	startCellRow := getReferenceRowIndex(startCell.String)
 	startCellColumn := getReferenceColumnIndex(startCell.String)
@@ -2207,59 +2343,70 @@ func findJumpCell(startCell Reference, direction string, grid *Grid, c *Client)
 		horizontalIncrement = 1
 	}
 
-	currentCellRow := startCellRow
-	currentCellColumn := startCellColumn
+	// only the cells with content on the row or column of the start cell matter
+	nonEmptyCells := make(map[[2]int]bool)
+	for _, cell := range sheetCells(startCell.SheetIndex, grid) {
+		if (cell.row == startCellRow || cell.column == startCellColumn) && !isCellEmpty(cell.dv) {
+			nonEmptyCells[[2]int{cell.row, cell.column}] = true
+		}
+	}
+
+	isInside := func(row int, column int) bool {
+		return row >= 1 && column >= 1 && row <= getSheetSize(startCell.SheetIndex, grid).RowCount && column <= getSheetSize(startCell.SheetIndex, grid).ColumnCount
+	}
 
-	isFirstCellCheck := true
+	currentCellRow := startCellRow + verticalIncrement
+	currentCellColumn := startCellColumn + horizontalIncrement
 
-	for {
-		currentCellRow += verticalIncrement
-		currentCellColumn += horizontalIncrement
+	// the cell next to a non-empty start cell decides between the end of this block and the start of the next one
+	if isInside(currentCellRow, currentCellColumn) && nonEmptyCells[[2]int{currentCellRow, currentCellColumn}] && !startCellEmpty {
 
-		if currentCellRow > grid.SheetSizes[grid.ActiveSheet].RowCount || currentCellRow < 1 {
-			break
-		}
-		if currentCellColumn > grid.SheetSizes[grid.ActiveSheet].ColumnCount || currentCellColumn < 1 {
-			break
+		for isInside(currentCellRow, currentCellColumn) && nonEmptyCells[[2]int{currentCellRow, currentCellColumn}] {
+			currentCellRow += verticalIncrement
+			currentCellColumn += horizontalIncrement
 		}
 
-		thisCellEmpty := isCellEmpty(getDataFromRef(Reference{String: indexesToReferenceString(currentCellRow, currentCellColumn), SheetIndex: startCell.SheetIndex}, grid))
+	} else if isInside(currentCellRow, currentCellColumn) {
 
-		if isFirstCellCheck && thisCellEmpty && !startCellEmpty {
-			// if first cell check is empty cell and this cell is non-empty find first non-empty cell
-			startCellEmpty = !startCellEmpty
-		}
+		// the closest non-empty cell, or the edge of the sheet
+		closest := -1
+		for cell := range nonEmptyCells {
 
-		if !startCellEmpty && thisCellEmpty {
+			distance := (cell[0]-startCellRow)*verticalIncrement + (cell[1]-startCellColumn)*horizontalIncrement
+			isOnLine := (verticalIncrement != 0 && cell[1] == startCellColumn) || (horizontalIncrement != 0 && cell[0] == startCellRow)
 
-			break
+			if isOnLine && distance > 0 && (closest == -1 || distance < closest) {
+				closest = distance
+			}
 		}
-		if startCellEmpty && !thisCellEmpty {
 
-			currentCellRow += verticalIncrement
-			currentCellColumn += horizontalIncrement
+		if closest == -1 {
 
-			break
-		}
+			lastRow, lastColumn := startCellRow, startCellColumn
+			if verticalIncrement == 1 {
+				lastRow = getSheetSize(startCell.SheetIndex, grid).RowCount
+			} else if verticalIncrement == -1 {
+				lastRow = 1
+			}
+			if horizontalIncrement == 1 {
+				lastColumn = getSheetSize(startCell.SheetIndex, grid).ColumnCount
+			} else if horizontalIncrement == -1 {
+				lastColumn = 1
+			}
 
-		isFirstCellCheck = false
+			currentCellRow = lastRow + verticalIncrement
+			currentCellColumn = lastColumn + horizontalIncrement
+		} else {
+			currentCellRow = startCellRow + closest*verticalIncrement + verticalIncrement
+			currentCellColumn = startCellColumn + closest*horizontalIncrement + horizontalIncrement
+		}
 	}
 
 	// reverse one step
 	currentCellRow -= verticalIncrement
 	currentCellColumn -= horizontalIncrement
 
-	newCell := indexesToReferenceString(currentCellRow, currentCellColumn)
-
-	jsonData := []string{"JUMPCELL", relativeReferenceString(startCell), direction, newCell}
-
-	json, err := json.Marshal(jsonData)
-
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	c.send <- json
+	return indexesToReferenceString(currentCellRow, currentCellColumn)
 }
 
 func getIntFromString(intString string) int {
@@ -2270,17 +2417,12 @@ func getIntFromString(intString string) int {
 	return intValue
 }
 
-func getIndexFromString(sheetIndexString string) int8 {
-	sheetIndexInt, err := strconv.Atoi(sheetIndexString)
-	sheetIndex := int8(sheetIndexInt)
+func clearCell(ref Reference, grid *Grid) {
 
-	if err != nil {
-		log.Fatal(err)
+	// cells that were never set are empty already
+	if _, ok := grid.Data[getCellKeyFromReference(ref)]; !ok {
+		return
 	}
-	return sheetIndex
-}
-
-func clearCell(ref Reference, grid *Grid) {
 
 	dv := getDataFromRef(ref, grid)
 
@@ -2291,127 +2433,47 @@ func clearCell(ref Reference, grid *Grid) {
 	setDataByRef(ref, setDependencies(ref, dv, grid), grid)
 }
 
+// removeCell clears a cell with its format and style, for cells that are deleted or moved elsewhere
+func removeCell(ref Reference, grid *Grid) {
+
+	clearCell(ref, grid)
+
+	if dv, ok := grid.Data[getCellKeyFromReference(ref)]; ok {
+		dv.Format = ""
+		dv.StyleID = defaultStyle
+	}
+}
+
 func replaceReferenceStringInFormula(formula string, referenceMap map[string]string) string {
-	// take into account replacements that elongate the string while in the loop
-	// e.g. A9 => A10, after replacing the index should be incremented by one (use IsDigit from unicode package)
 
 	// check for empty referenceMap inputs
 	if len(referenceMap) == 0 {
 		return formula
 	}
 
-	// loop through formula string and only replace references in the map that are
-	index := 0
-
-	referenceStartIndex := 0
-	referenceEndIndex := 0
-	haveValidReference := false
-	inQuoteSection := false
-	inSingleQuote := false
-
-	for {
-
-		// set default characters
-		character := ' '
-
-		// get character
-		if index < len(formula) {
-			character = rune(formula[index])
-		}
-
-		if inQuoteSection {
-
-			if character == '"' && formula[index-1] != '\\' {
-				// exit quote section
-				inQuoteSection = false
-				referenceStartIndex = index + 1
-				referenceEndIndex = index + 1
-			}
-
-		} else if inSingleQuote {
-
-			if character == '\'' {
-				// exit quote section
-				inSingleQuote = false
-			}
-			referenceEndIndex = index
-
-		} else if character == '"' {
-			inQuoteSection = true
-		} else if haveValidReference {
-
-			if character == ':' || character == '!' || character == '\'' {
-
-				referenceEndIndex = index
-				haveValidReference = false
-
-			} else if unicode.IsDigit(character) {
-				// append digit to valid reference
-				referenceEndIndex = index
-			} else {
-				// replace reference
-				leftSubstring := formula[:referenceStartIndex]
-				rightSubstring := formula[referenceEndIndex+1:]
-
-				reference := formula[referenceStartIndex : referenceEndIndex+1]
-
-				newReference := reference
-
-				// if reference is not in referenceMap, use existing
-				if _, ok := referenceMap[reference]; ok {
-					//do something here
-					newReference = referenceMap[reference]
-				}
-
-				sizeDifference := len(newReference) - len(reference)
-
-				index += sizeDifference
-
-				// replace
-				formula = leftSubstring + newReference + rightSubstring
-
-				haveValidReference = false
-				referenceStartIndex = index + 1
-				referenceEndIndex = index + 1
-			}
-
-		} else if unicode.IsLetter(character) || character == '$' || character == ':' || character == '!' || character == '\'' {
-
-			if character == '\'' {
-				inSingleQuote = true
-			}
-
-			referenceEndIndex = index + 1
-
-		} else if unicode.IsDigit(character) {
+	// formulas that can't be tokenized are left untouched
+	tokens, err := tokenizeFormula(formula)
+	if err != nil {
+		return formula
+	}
 
-			// check if next character is digit or :
-			if referenceEndIndex-referenceStartIndex > 0 {
-				// non zero reference is built up, append digit
-				referenceEndIndex = index
-				haveValidReference = true
+	// replace back to front so token offsets stay valid when replacements change the length
+	for k := len(tokens) - 1; k >= 0; k-- {
+		token := tokens[k]
 
-			} else {
-				referenceStartIndex = index + 1
-				referenceEndIndex = index + 1
-				haveValidReference = false
-			}
-		} else {
-			referenceStartIndex = index + 1
-			referenceEndIndex = index + 1
-			haveValidReference = false
+		if token.Kind != formulaTokenReference && token.Kind != formulaTokenRange && token.Kind != formulaTokenWholeRange {
+			continue
 		}
 
-		index++
-		if index >= len(formula) && !haveValidReference {
-			break
+		if newReference, ok := referenceMap[token.Text]; ok {
+			formula = formula[:token.Start] + newReference + formula[token.End:]
 		}
 	}
 
 	return formula
 }
 
-func replaceReferencesInFormula(formula string, sourceIndex int8, targetIndex int8, referenceMap map[Reference]Reference, grid *Grid) string {
+func replaceReferencesInFormula(formula string, sourceIndex SheetID, targetIndex SheetID, referenceMap map[Reference]Reference, grid *Grid) string {
 	referenceStrings := findReferenceStrings(formula)
 
 	stringReferenceMap := make(map[string]string)
@@ -2426,7 +2488,7 @@ func replaceReferencesInFormula(formula string, sourceIndex int8, targetIndex in
 	return replaceReferenceStringInFormula(formula, stringReferenceMap)
 }
 
-func replaceReferenceRangesInFormula(formula string, sourceIndex int8, targetIndex int8, referenceRangeMap map[ReferenceRange]ReferenceRange, grid *Grid) string {
+func replaceReferenceRangesInFormula(formula string, sourceIndex SheetID, targetIndex SheetID, referenceRangeMap map[ReferenceRange]ReferenceRange, grid *Grid) string {
 	referenceStrings := findReferenceStrings(formula)
 
 	stringReferenceMap := make(map[string]string)
@@ -2441,36 +2503,37 @@ func replaceReferenceRangesInFormula(formula string, sourceIndex int8, targetInd
 	return replaceReferenceStringInFormula(formula, stringReferenceMap)
 }
 
-func changeSheetSize(newRowCount int, newColumnCount int, sheetIndex int8, c *Client, grid *Grid) {
-
-	if newRowCount > grid.SheetSizes[sheetIndex].RowCount || newColumnCount > grid.SheetSizes[sheetIndex].ColumnCount {
+func changeSheetSize(newRowCount int, newColumnCount int, sheetIndex SheetID, c *Client, grid *Grid) error {
 
-		// add missing row/column cells
-		for currentColumn := 0; currentColumn <= newColumnCount; currentColumn++ {
-			for currentRow := 0; currentRow <= newRowCount; currentRow++ {
-				if currentColumn > grid.SheetSizes[sheetIndex].ColumnCount || currentRow > grid.SheetSizes[sheetIndex].RowCount {
-
-					reference := Reference{String: indexesToReferenceString(currentRow, currentColumn), SheetIndex: sheetIndex}
+	position := getSheetPosition(sheetIndex, grid)
+	if position == noSheet {
+		return nil
+	}
 
-					if !checkDataPresenceFromRef(reference, grid) {
-						setDataByRef(reference, makeEmptyDv(), grid)
-					}
-				}
-			}
-		}
+	if err := checkSheetSize(SheetSize{RowCount: newRowCount, ColumnCount: newColumnCount}); err != nil {
+		return err
 	}
 
-	grid.SheetSizes[sheetIndex].RowCount = newRowCount
-	grid.SheetSizes[sheetIndex].ColumnCount = newColumnCount
+	// cells are stored when they're set, the size only bounds the sheet
+	grid.SheetSizes[position].RowCount = newRowCount
+	grid.SheetSizes[position].ColumnCount = newColumnCount
+
+	// whole columns and rows now cover a different number of cells
+	markWholeRangeDependentsDirty(sheetIndex, grid)
 
 	sendSheetSize(c, sheetIndex, grid)
+
+	return nil
 }
 
 func insertRowColumn(insertType string, direction string, reference string, c *Client, grid *Grid) {
 
 	if insertType == "COLUMN" {
 
-		changeSheetSize(grid.SheetSizes[grid.ActiveSheet].RowCount, grid.SheetSizes[grid.ActiveSheet].ColumnCount+1, grid.ActiveSheet, c, grid)
+		if err := changeSheetSize(getSheetSize(grid.ActiveSheet, grid).RowCount, getSheetSize(grid.ActiveSheet, grid).ColumnCount+1, grid.ActiveSheet, c, grid); err != nil {
+			sendConsoleError(err, c)
+			return
+		}
 
 		baseColumn := getReferenceColumnIndex(reference)
 
@@ -2478,7 +2541,11 @@ func insertRowColumn(insertType string, direction string, reference string, c *C
 			baseColumn++
 		}
 
-		maximumRow, maximumColumn := determineMinimumRectangle(1, baseColumn, grid.ActiveSheet, grid)
+		shiftWholeRanges(grid.ActiveSheet, true, baseColumn, 1, grid)
+		shiftConditionalFormats(grid.ActiveSheet, true, baseColumn, 1, grid)
+		shiftValidationRules(grid.ActiveSheet, true, baseColumn, 1, grid)
+
+		maximumRow, maximumColumn := determineMovedRectangle(1, baseColumn, grid.ActiveSheet, grid)
 
 		topLeftRef := indexesToReferenceString(1, baseColumn)
 		bottomRightRef := indexesToReferenceString(maximumRow, maximumColumn)
@@ -2491,7 +2558,10 @@ func insertRowColumn(insertType string, direction string, reference string, c *C
 
 	} else if insertType == "ROW" {
 
-		changeSheetSize(grid.SheetSizes[grid.ActiveSheet].RowCount+1, grid.SheetSizes[grid.ActiveSheet].ColumnCount, grid.ActiveSheet, c, grid)
+		if err := changeSheetSize(getSheetSize(grid.ActiveSheet, grid).RowCount+1, getSheetSize(grid.ActiveSheet, grid).ColumnCount, grid.ActiveSheet, c, grid); err != nil {
+			sendConsoleError(err, c)
+			return
+		}
 
 		baseRow := getReferenceRowIndex(reference)
 
@@ -2499,7 +2569,11 @@ func insertRowColumn(insertType string, direction string, reference string, c *C
 			baseRow++
 		}
 
-		maximumRow, maximumColumn := determineMinimumRectangle(baseRow, 1, grid.ActiveSheet, grid)
+		shiftWholeRanges(grid.ActiveSheet, false, baseRow, 1, grid)
+		shiftConditionalFormats(grid.ActiveSheet, false, baseRow, 1, grid)
+		shiftValidationRules(grid.ActiveSheet, false, baseRow, 1, grid)
+
+		maximumRow, maximumColumn := determineMovedRectangle(baseRow, 1, grid.ActiveSheet, grid)
 
 		topLeftRef := indexesToReferenceString(baseRow, 1)
 		bottomRightRef := indexesToReferenceString(maximumRow, maximumColumn)
@@ -2514,19 +2588,21 @@ func insertRowColumn(insertType string, direction string, reference string, c *C
 
 }
 
-func cutCells(sourceRange ReferenceRange, destinationRange ReferenceRange, grid *Grid, c *Client) []Reference {
+func cutCells(sourceRange ReferenceRange, destinationRange ReferenceRange, grid *Grid, c *Client) []CellKey {
 
 	sourceCells := cellRangeToCells(sourceRange)
 	destinationCells := copySourceToDestination(sourceRange, destinationRange, grid, true)
 
-	// clear sourceCells that are not in destination
+	// clear sourceCells that are not in destination, their format and style moved along
 	for _, ref := range sourceCells {
 		if !containsReferences(destinationCells, ref) {
-			// clear cell
-			clearCell(ref, grid)
+			removeCell(ref, grid)
 		}
 	}
 
+	// names pointing into the source range move along with the cells
+	moveDefinedNames(sourceRange, destinationRange, grid)
+
 	changedCells := computeDirtyCells(grid, c)
 
 	return changedCells
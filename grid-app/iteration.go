@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Circular references are errors, unless iterative calculation is turned on for the workbook. The
+// cells of a cycle are then computed over and over, starting from their current values, until no
+// value changes more than the tolerance or the maximum number of iterations is reached.
+
+const defaultMaximumIterations = 100
+const defaultIterationTolerance = 0.001
+
+type IterationSettings struct {
+	IsEnabled         bool
+	MaximumIterations int
+	Tolerance         float64
+}
+
+func defaultIterationSettings() IterationSettings {
+	return IterationSettings{IsEnabled: false, MaximumIterations: defaultMaximumIterations, Tolerance: defaultIterationTolerance}
+}
+
+// sortedDirtyKeys returns the keys of cells that are dirty in sorted order, so cycles are found and
+// iterated the same way every time
+func sortedDirtyKeys(keys map[CellKey]bool, grid *Grid) []CellKey {
+
+	sortedKeys := []CellKey{}
+	for key, inSet := range keys {
+		if _, isDirty := grid.DirtyCells[key]; inSet && isDirty {
+			sortedKeys = append(sortedKeys, key)
+		}
+	}
+	sort.Slice(sortedKeys, func(i, j int) bool { return sortedKeys[i] < sortedKeys[j] })
+
+	return sortedKeys
+}
+
+// findDirtyCycle returns a cycle among the dirty cells, for when every dirty cell waits on another
+// dirty cell. Every cell in the cycle uses the next one, the last one uses the first.
+func findDirtyCycle(grid *Grid) []CellKey {
+
+	index := sortedDirtyKeys(grid.DirtyCells, grid)[0]
+
+	path := []CellKey{}
+	positions := make(map[CellKey]int)
+
+	for {
+		if position, ok := positions[index]; ok {
+			return path[position:]
+		}
+
+		positions[index] = len(path)
+		path = append(path, index)
+
+		index = sortedDirtyKeys(getDataByCellKey(index, grid).DependInTemp, grid)[0]
+	}
+}
+
+// reachableDirtyCells returns the dirty cells reachable from index following the edges given by next
+func reachableDirtyCells(index CellKey, next func(dv *DynamicValue) map[CellKey]bool, grid *Grid) map[CellKey]bool {
+
+	reachable := map[CellKey]bool{index: true}
+	queue := []CellKey{index}
+
+	for len(queue) > 0 {
+
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, key := range sortedDirtyKeys(next(getDataByCellKey(current, grid)), grid) {
+			if !reachable[key] {
+				reachable[key] = true
+				queue = append(queue, key)
+			}
+		}
+	}
+
+	return reachable
+}
+
+// dirtyCycleComponent returns the dirty cells that are part of a cycle with index, these are
+// iterated together
+func dirtyCycleComponent(index CellKey, grid *Grid) []CellKey {
+
+	used := reachableDirtyCells(index, func(dv *DynamicValue) map[CellKey]bool { return dv.DependInTemp }, grid)
+	using := reachableDirtyCells(index, func(dv *DynamicValue) map[CellKey]bool { return dv.DependOutTemp }, grid)
+
+	component := make(map[CellKey]bool)
+	for key := range used {
+		if using[key] {
+			component[key] = true
+		}
+	}
+
+	return sortedDirtyKeys(component, grid)
+}
+
+// setCircularReferenceErrors gives the cells of a cycle a #REF! error naming the cycle, starting
+// at the cell itself
+func setCircularReferenceErrors(cycle []CellKey, grid *Grid) {
+
+	for position, key := range cycle {
+
+		dv := getDataByCellKey(key, grid)
+
+		steps := []string{}
+		for step := 0; step <= len(cycle); step++ {
+			reference := getReferenceFromCellKey(cycle[(position+step)%len(cycle)])
+			steps = append(steps, referenceToRelativeString(reference, dv.SheetIndex, grid))
+		}
+
+		dv.DataString = ErrorCodeReference
+		dv.ErrorMessage = "Circular reference: " + strings.Join(steps, " -> ")
+		dv.ValueType = DynamicValueTypeError
+	}
+}
+
+// iterationChange returns how much a value changed in an iteration, values that aren't numbers
+// either didn't change or changed infinitely much
+func iterationChange(before *DynamicValue, after *DynamicValue) float64 {
+
+	isNumber := func(dv *DynamicValue) bool {
+		return dv.ValueType == DynamicValueTypeFloat || dv.ValueType == DynamicValueTypeDate
+	}
+
+	if isNumber(before) && isNumber(after) {
+		return math.Abs(after.DataFloat - before.DataFloat)
+	}
+
+	if before.ValueType == after.ValueType && convertToString(copyDv(before)).DataString == convertToString(copyDv(after)).DataString {
+		return 0
+	}
+
+	return math.Inf(1)
+}
+
+// iterateCells computes the cells of a cycle until they converge, it returns the cells that changed
+// and the cells that their arrays spilled into
+func iterateCells(cells []CellKey, grid *Grid) ([]CellKey, []CellKey) {
+
+	spilledRefs := []CellKey{}
+
+	// errors never converge, like the ones from before iterative calculation was turned on
+	for _, key := range cells {
+		dv := getDataByCellKey(key, grid)
+		if dv.ValueType == DynamicValueTypeError {
+			dv.ValueType = DynamicValueTypeFloat
+			dv.DataFloat = 0
+		}
+	}
+
+	for iteration := 0; iteration < grid.Iteration.MaximumIterations; iteration++ {
+
+		largestChange := 0.0
+
+		for _, key := range cells {
+
+			before := copyDv(getDataByCellKey(key, grid))
+
+			isComputed, spilled := computeCell(key, grid)
+			if !isComputed {
+				continue
+			}
+			spilledRefs = append(spilledRefs, spilled...)
+
+			largestChange = math.Max(largestChange, iterationChange(before, getDataByCellKey(key, grid)))
+		}
+
+		if largestChange <= grid.Iteration.Tolerance {
+			break
+		}
+	}
+
+	return cells, spilledRefs
+}
+
+// setIterationSettings changes the iterative calculation settings, the workbook is recomputed
+// with them by the caller
+func setIterationSettings(isEnabled string, maximumIterations string, tolerance string, grid *Grid) error {
+
+	maximum, err := strconv.Atoi(maximumIterations)
+	if err != nil || maximum < 1 {
+		return errors.New("the maximum number of iterations should be a whole number of at least 1")
+	}
+
+	toleranceValue, err := strconv.ParseFloat(tolerance, 64)
+	if err != nil || toleranceValue < 0 {
+		return errors.New("the tolerance should be a number of at least 0")
+	}
+
+	grid.Iteration = IterationSettings{IsEnabled: isEnabled == "true", MaximumIterations: maximum, Tolerance: toleranceValue}
+
+	return nil
+}
+
+func sendIterationSettings(c *Client, grid *Grid) {
+
+	jsonData := []string{"ITERATION", strconv.FormatBool(grid.Iteration.IsEnabled), strconv.Itoa(grid.Iteration.MaximumIterations), strconv.FormatFloat(grid.Iteration.Tolerance, 'f', -1, 64)}
+
+	json, _ := json.Marshal(jsonData)
+	c.send <- json
+}
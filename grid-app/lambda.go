@@ -0,0 +1,231 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"./functions"
+)
+
+// LET(name1, value1, [name2, value2, ...], calculation) binds names to values inside the calculation.
+// LAMBDA(parameter1, [parameter2, ...], calculation) defined as a name, e.g. Double = LAMBDA(x, x * 2),
+// can be called like a function: Double(A1). Bound names are substituted in the AST by value nodes.
+
+// isBindingName checks whether the child at index of a LET or LAMBDA call is a name being bound
+func isBindingName(node *formulaNode, index int) bool {
+
+	if node.Kind != formulaNodeFunction || index == len(node.Children)-1 || node.Children[index].Kind != formulaNodeName {
+		return false
+	}
+
+	switch strings.ToUpper(node.Text) {
+	case "LET":
+		return index%2 == 0
+	case "LAMBDA":
+		return true
+	}
+
+	return false
+}
+
+// bindNames returns a copy of node in which the bound names are replaced by their value
+func bindNames(node *formulaNode, bindings map[string]*formulaNode) *formulaNode {
+
+	if len(bindings) == 0 {
+		return node
+	}
+
+	if node.Kind == formulaNodeName {
+		if bound, ok := bindings[strings.ToUpper(node.Text)]; ok {
+			return bound
+		}
+		return node
+	}
+
+	if len(node.Children) == 0 {
+		return node
+	}
+
+	boundNode := &formulaNode{Kind: node.Kind, Number: node.Number, Bool: node.Bool, Text: node.Text, Value: node.Value}
+	innerBindings := bindings
+
+	for index, child := range node.Children {
+
+		// a nested LET or LAMBDA that binds the same name hides the outer value from there on
+		if isBindingName(node, index) {
+
+			if _, ok := innerBindings[strings.ToUpper(child.Text)]; ok {
+				hiddenBindings := make(map[string]*formulaNode)
+				for name, bound := range innerBindings {
+					if name != strings.ToUpper(child.Text) {
+						hiddenBindings[name] = bound
+					}
+				}
+				innerBindings = hiddenBindings
+			}
+
+			boundNode.Children = append(boundNode.Children, child)
+			continue
+		}
+
+		boundNode.Children = append(boundNode.Children, bindNames(child, innerBindings))
+	}
+
+	return boundNode
+}
+
+// nameUse is a name or function call in a formula that isn't bound by a LET or LAMBDA around it,
+// with the names that are bound where it's used
+type nameUse struct {
+	node  *formulaNode
+	bound map[string]bool
+}
+
+// freeNameUses collects the names and function calls of a formula that can refer to defined names,
+// names bound by a LET or LAMBDA around them are skipped. A LET value only sees the names bound
+// before it, like evaluateLet.
+func freeNameUses(node *formulaNode, bound map[string]bool, uses *[]nameUse) {
+
+	switch node.Kind {
+	case formulaNodeName:
+		if !bound[strings.ToUpper(node.Text)] {
+			*uses = append(*uses, nameUse{node: node, bound: bound})
+		}
+		return
+	case formulaNodeFunction:
+		*uses = append(*uses, nameUse{node: node, bound: bound})
+	}
+
+	innerBound := bound
+	pendingName := ""
+
+	for index, child := range node.Children {
+
+		if isBindingName(node, index) {
+			pendingName = strings.ToUpper(child.Text)
+			if strings.ToUpper(node.Text) == "LAMBDA" {
+				innerBound = withBoundName(innerBound, pendingName)
+				pendingName = ""
+			}
+			continue
+		}
+
+		freeNameUses(child, innerBound, uses)
+
+		if len(pendingName) > 0 {
+			innerBound = withBoundName(innerBound, pendingName)
+			pendingName = ""
+		}
+	}
+}
+
+func withBoundName(bound map[string]bool, name string) map[string]bool {
+
+	newBound := map[string]bool{name: true}
+	for boundName := range bound {
+		newBound[boundName] = true
+	}
+
+	return newBound
+}
+
+func init() {
+
+	// LET and LAMBDA bind names, so their arguments aren't evaluated up front
+	functions.Register(&functions.Definition{Name: "LET", MinimumArguments: 3, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{functions.Lazy},
+		Syntax: "LET(name1, value1, [name2, value2, ...], calculation)", Description: "Binds names to values inside a calculation",
+		Native: func(call *functionCall) *DynamicValue {
+			return evaluateLet(call.Node, call.Grid, call.TargetRef, call.NameDepth)
+		}})
+
+	functions.Register(&functions.Definition{Name: "LAMBDA", MinimumArguments: 1, MaximumArguments: functions.AnyArguments, ArgumentKinds: []functions.ArgumentKind{functions.Lazy},
+		Syntax: "LAMBDA([parameter1, ...], calculation)", Description: "Defines a function, call it by defining it as a name",
+		Native: func(call *functionCall) *DynamicValue {
+			errorDv := makeErrorDv(ErrorCodeCalc, "A LAMBDA needs to be defined as a name to be called")
+			errorDv.SheetIndex = call.TargetRef.SheetIndex
+			return errorDv
+		}})
+}
+
+func evaluateLet(node *formulaNode, grid *Grid, targetRef Reference, nameDepth int) *DynamicValue {
+
+	if len(node.Children)%2 == 0 {
+		errorDv := makeErrorDv(ErrorCodeValue, "LET requires pairs of names and values followed by a calculation")
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	bindings := make(map[string]*formulaNode)
+
+	for index := 0; index < len(node.Children)-1; index += 2 {
+
+		if !isBindingName(node, index) {
+			errorDv := makeErrorDv(ErrorCodeValue, "LET argument "+strconv.Itoa(index+1)+" should be a name")
+			errorDv.SheetIndex = targetRef.SheetIndex
+			return errorDv
+		}
+
+		// values can use the names bound before them
+		value := evaluateNode(bindNames(node.Children[index+1], bindings), grid, targetRef, nameDepth)
+
+		bindings[strings.ToUpper(node.Children[index].Text)] = &formulaNode{Kind: formulaNodeValue, Value: value}
+	}
+
+	return evaluateNode(bindNames(node.Children[len(node.Children)-1], bindings), grid, targetRef, nameDepth)
+}
+
+// getLambda returns the LAMBDA a name is defined as, or nil when it isn't defined as a LAMBDA
+func getLambda(name string, grid *Grid) *formulaNode {
+
+	definition := getDefinedName(name, grid)
+	if definition == nil {
+		return nil
+	}
+
+	compiled := compiledDefinition(definition)
+
+	if compiled.err != nil || compiled.root.Kind != formulaNodeFunction || strings.ToUpper(compiled.root.Text) != "LAMBDA" {
+		return nil
+	}
+
+	return compiled.root
+}
+
+// callLambda evaluates the arguments of a call to a name defined as a LAMBDA and binds them to its parameters
+func callLambda(node *formulaNode, lambda *formulaNode, grid *Grid, targetRef Reference, nameDepth int) *DynamicValue {
+
+	if len(lambda.Children) == 0 {
+		errorDv := makeErrorDv(ErrorCodeValue, "The LAMBDA of "+node.Text+" has no calculation")
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	parameters := lambda.Children[:len(lambda.Children)-1]
+
+	for index := range parameters {
+		if !isBindingName(lambda, index) {
+			errorDv := makeErrorDv(ErrorCodeValue, "The parameters of the LAMBDA of "+node.Text+" should be names")
+			errorDv.SheetIndex = targetRef.SheetIndex
+			return errorDv
+		}
+	}
+
+	if len(node.Children) != len(parameters) {
+		errorDv := makeErrorDv(ErrorCodeValue, node.Text+" requires "+strconv.Itoa(len(parameters))+" arguments")
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	if nameDepth >= maxNameDepth {
+		return nameDepthError(node.Text, targetRef)
+	}
+
+	bindings := make(map[string]*formulaNode)
+
+	for index, parameter := range parameters {
+		value := evaluateNode(node.Children[index], grid, targetRef, nameDepth)
+		bindings[strings.ToUpper(parameter.Text)] = &formulaNode{Kind: formulaNodeValue, Value: value}
+	}
+
+	return evaluateNode(bindNames(lambda.Children[len(lambda.Children)-1], bindings), grid, targetRef, nameDepth+1)
+}
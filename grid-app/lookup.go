@@ -0,0 +1,589 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"./functions"
+)
+
+// match modes for lookups, the values match the XLOOKUP match_mode argument
+const lookupMatchExact int = 0
+const lookupMatchNextSmaller int = -1
+const lookupMatchNextLarger int = 1
+const lookupMatchWildcard int = 2
+
+func init() {
+
+	ranges := functions.Range
+	scalar := functions.Scalar
+
+	functions.Register(&functions.Definition{Name: "VLOOKUP", MinimumArguments: 3, MaximumArguments: 4, ArgumentKinds: []functions.ArgumentKind{scalar, ranges, scalar, scalar},
+		Syntax: "VLOOKUP(value, range, column, [is_sorted])", Description: "Looks up a value in the first column of a range and returns the value in the given column",
+		Native: func(call *functionCall) *DynamicValue { return vlookup(call.Arguments, call.Grid, call.TargetRef) }})
+
+	functions.Register(&functions.Definition{Name: "HLOOKUP", MinimumArguments: 3, MaximumArguments: 4, ArgumentKinds: []functions.ArgumentKind{scalar, ranges, scalar, scalar},
+		Syntax: "HLOOKUP(value, range, row, [is_sorted])", Description: "Looks up a value in the first row of a range and returns the value in the given row",
+		Native: func(call *functionCall) *DynamicValue { return hlookup(call.Arguments, call.Grid, call.TargetRef) }})
+
+	functions.Register(&functions.Definition{Name: "XLOOKUP", MinimumArguments: 3, MaximumArguments: 6, ArgumentKinds: []functions.ArgumentKind{scalar, ranges, ranges, ranges, scalar, scalar},
+		Syntax: "XLOOKUP(value, lookup_range, return_range, [if_not_found], [match_mode], [search_mode])", Description: "Looks up a value in a range and returns the matching value of another range",
+		Native: func(call *functionCall) *DynamicValue { return xlookup(call.Arguments, call.Grid, call.TargetRef) }})
+
+	functions.Register(&functions.Definition{Name: "MATCH", MinimumArguments: 2, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{scalar, ranges, scalar},
+		Syntax: "MATCH(value, range, [match_type])", Description: "Returns the position of a value in a range",
+		Native: func(call *functionCall) *DynamicValue { return match(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "INDEX", MinimumArguments: 2, MaximumArguments: 3, ArgumentKinds: []functions.ArgumentKind{ranges, scalar, scalar},
+		Syntax: "INDEX(range, row, [column])", Description: "Returns the value at a row and column of a range",
+		Native: func(call *functionCall) *DynamicValue { return indexFunc(call.Arguments, call.Grid, call.TargetRef) }})
+}
+
+// lookupRange is a rectangular range argument of a lookup function, cells are stored
+// in the column major order of getDvsFromReferenceRange
+type lookupRange struct {
+	SheetIndex  SheetID
+	StartRow    int
+	StartColumn int
+	Rows        int
+	Columns     int
+	Dvs         []*DynamicValue
+}
+
+// getRangeArgument returns the range of an argument that should be a range
+func getRangeArgument(dv *DynamicValue, grid *Grid) (ReferenceRange, *DynamicValue) {
+
+	if dv.ValueType != DynamicValueTypeReference || !strings.Contains(dv.DataString, ":") {
+		return ReferenceRange{}, makeErrorDv(ErrorCodeValue, "Expected a range instead of "+convertToString(dv).DataString)
+	}
+
+	if !sheetExistsForReferenceString(dv.DataString, grid) {
+		return ReferenceRange{}, makeErrorDv(ErrorCodeReference, "Invalid reference: "+dv.DataString)
+	}
+
+	return getRangeReferenceFromString(dv.DataString, dv.SheetIndex, grid), nil
+}
+
+func getLookupRange(dv *DynamicValue, grid *Grid) (lookupRange, *DynamicValue) {
+
+	referenceRange, errorDv := getRangeArgument(dv, grid)
+	if errorDv != nil {
+		return lookupRange{}, errorDv
+	}
+
+	cells := strings.Split(referenceRange.String, ":")
+
+	row1, row2 := getReferenceRowIndex(cells[0]), getReferenceRowIndex(cells[1])
+	column1, column2 := getReferenceColumnIndex(cells[0]), getReferenceColumnIndex(cells[1])
+
+	// allow ranges written bottom right to top left
+	if row2 < row1 {
+		row1, row2 = row2, row1
+	}
+	if column2 < column1 {
+		column1, column2 = column2, column1
+	}
+
+	normalizedRange := ReferenceRange{String: indexesToReferenceString(row1, column1) + ":" + indexesToReferenceString(row2, column2), SheetIndex: referenceRange.SheetIndex}
+
+	return lookupRange{
+		SheetIndex:  referenceRange.SheetIndex,
+		StartRow:    row1,
+		StartColumn: column1,
+		Rows:        row2 - row1 + 1,
+		Columns:     column2 - column1 + 1,
+		Dvs:         getDvsFromReferenceRange(normalizedRange, grid),
+	}, nil
+}
+
+// cell returns the value at the zero based row and column offset in the range
+func (r lookupRange) cell(row int, column int) *DynamicValue {
+
+	dv := r.Dvs[column*r.Rows+row]
+
+	// cells outside of the sheet
+	if dv == nil {
+		return makeErrorDv(ErrorCodeReference, "Invalid reference: "+indexesToReferenceString(r.StartRow+row, r.StartColumn+column))
+	}
+
+	return copyCellValue(dv)
+}
+
+func (r lookupRange) row(row int) []*DynamicValue {
+	dvs := []*DynamicValue{}
+	for column := 0; column < r.Columns; column++ {
+		dvs = append(dvs, r.cell(row, column))
+	}
+	return dvs
+}
+
+func (r lookupRange) column(column int) []*DynamicValue {
+	dvs := []*DynamicValue{}
+	for row := 0; row < r.Rows; row++ {
+		dvs = append(dvs, r.cell(row, column))
+	}
+	return dvs
+}
+
+// cells returns the values of all cells in the range in column major order
+func (r lookupRange) cells() []*DynamicValue {
+	dvs := []*DynamicValue{}
+	for column := 0; column < r.Columns; column++ {
+		dvs = append(dvs, r.column(column)...)
+	}
+	return dvs
+}
+
+func (r lookupRange) isVector() bool {
+	return r.Rows == 1 || r.Columns == 1
+}
+
+// vector returns the cells of a single row or single column range in order
+func (r lookupRange) vector() []*DynamicValue {
+	if r.Columns == 1 {
+		return r.column(0)
+	}
+	return r.row(0)
+}
+
+// subRange returns a range value for part of the range, used when a lookup returns more than one cell
+func (r lookupRange) subRange(row int, column int, rows int, columns int, sheetIndex SheetID, grid *Grid) *DynamicValue {
+
+	rangeReference := ReferenceRange{
+		String:     indexesToReferenceString(r.StartRow+row, r.StartColumn+column) + ":" + indexesToReferenceString(r.StartRow+row+rows-1, r.StartColumn+column+columns-1),
+		SheetIndex: r.SheetIndex,
+	}
+
+	return &DynamicValue{SheetIndex: sheetIndex, ValueType: DynamicValueTypeReference, DataString: referenceRangeToRelativeString(rangeReference, sheetIndex, grid)}
+}
+
+func isEmptyLookupValue(dv *DynamicValue) bool {
+	return dv.ValueType == DynamicValueTypeString && len(dv.DataString) == 0
+}
+
+// lookupTypeOrder sorts numbers before text and text before booleans
+func lookupTypeOrder(dv *DynamicValue) int {
+	switch dv.ValueType {
+	case DynamicValueTypeFloat, DynamicValueTypeDate:
+		return 0
+	case DynamicValueTypeString:
+		return 1
+	case DynamicValueTypeBool:
+		return 2
+	}
+	return 3
+}
+
+// compareLookupValues returns -1, 0 or 1, text is compared case insensitive
+func compareLookupValues(dv1 *DynamicValue, dv2 *DynamicValue) int {
+
+	order1 := lookupTypeOrder(dv1)
+	order2 := lookupTypeOrder(dv2)
+
+	if order1 != order2 {
+		if order1 < order2 {
+			return -1
+		}
+		return 1
+	}
+
+	switch dv1.ValueType {
+	case DynamicValueTypeFloat, DynamicValueTypeDate:
+		if dv1.DataFloat < dv2.DataFloat {
+			return -1
+		} else if dv1.DataFloat > dv2.DataFloat {
+			return 1
+		}
+	case DynamicValueTypeString:
+		return strings.Compare(strings.ToLower(dv1.DataString), strings.ToLower(dv2.DataString))
+	case DynamicValueTypeBool:
+		if dv1.DataBool == dv2.DataBool {
+			return 0
+		} else if dv2.DataBool {
+			return -1
+		}
+		return 1
+	}
+
+	return 0
+}
+
+func lookupValuesEqual(dv1 *DynamicValue, dv2 *DynamicValue) bool {
+
+	if dv1.ValueType == DynamicValueTypeError || dv2.ValueType == DynamicValueTypeError {
+		return false
+	}
+
+	// numbers stored as text still match numbers
+	if (dv1.ValueType == DynamicValueTypeFloat && dv2.ValueType == DynamicValueTypeString) ||
+		(dv1.ValueType == DynamicValueTypeString && dv2.ValueType == DynamicValueTypeFloat) {
+		return strings.EqualFold(convertToString(copyDv(dv1)).DataString, convertToString(copyDv(dv2)).DataString)
+	}
+
+	return compareLookupValues(dv1, dv2) == 0
+}
+
+// wildcardMatch matches text against a pattern where * matches any sequence,
+// ? matches a single character and ~ escapes the next character
+func wildcardMatch(pattern string, text string) bool {
+
+	patternRunes := []rune(strings.ToLower(pattern))
+	textRunes := []rune(strings.ToLower(text))
+
+	p, t := 0, 0
+	starPattern, starText := -1, 0
+
+	for t < len(textRunes) {
+		if p < len(patternRunes) && patternRunes[p] == '~' && p+1 < len(patternRunes) && patternRunes[p+1] == textRunes[t] {
+			p += 2
+			t++
+		} else if p < len(patternRunes) && patternRunes[p] != '~' && (patternRunes[p] == '?' || (patternRunes[p] != '*' && patternRunes[p] == textRunes[t])) {
+			p++
+			t++
+		} else if p < len(patternRunes) && patternRunes[p] == '*' {
+			starPattern = p
+			starText = t
+			p++
+		} else if starPattern != -1 {
+			// backtrack, let the last star consume one more character
+			p = starPattern + 1
+			starText++
+			t = starText
+		} else {
+			return false
+		}
+	}
+
+	for p < len(patternRunes) && patternRunes[p] == '*' {
+		p++
+	}
+
+	return p == len(patternRunes)
+}
+
+// findLookupIndex returns the index of the matching value in dvs, or -1 when nothing matches.
+// Values are visited last to first when reverse is set.
+func findLookupIndex(lookupValue *DynamicValue, dvs []*DynamicValue, matchMode int, reverse bool) int {
+
+	bestIndex := -1
+
+	for i := range dvs {
+
+		index := i
+		if reverse {
+			index = len(dvs) - 1 - i
+		}
+
+		dv := dvs[index]
+
+		if dv.ValueType == DynamicValueTypeError || isEmptyLookupValue(dv) {
+			continue
+		}
+
+		if matchMode == lookupMatchWildcard && lookupValue.ValueType == DynamicValueTypeString && dv.ValueType == DynamicValueTypeString {
+			if wildcardMatch(lookupValue.DataString, dv.DataString) {
+				return index
+			}
+			continue
+		}
+
+		if lookupValuesEqual(dv, lookupValue) {
+			return index
+		}
+
+		// approximate matches only consider values of the same type
+		if lookupTypeOrder(dv) != lookupTypeOrder(lookupValue) {
+			continue
+		}
+
+		comparison := compareLookupValues(dv, lookupValue)
+
+		if matchMode == lookupMatchNextSmaller && comparison < 0 {
+			if bestIndex == -1 || compareLookupValues(dv, dvs[bestIndex]) > 0 {
+				bestIndex = index
+			}
+		}
+
+		if matchMode == lookupMatchNextLarger && comparison > 0 {
+			if bestIndex == -1 || compareLookupValues(dv, dvs[bestIndex]) < 0 {
+				bestIndex = index
+			}
+		}
+	}
+
+	return bestIndex
+}
+
+// findSortedLookupIndex returns the position of the last value that is not past lookupValue
+// in a sorted list, like the approximate match of VLOOKUP and MATCH. Returns -1 when
+// lookupValue comes before the first value.
+func findSortedLookupIndex(lookupValue *DynamicValue, dvs []*DynamicValue, descending bool) int {
+
+	bestIndex := -1
+
+	for index, dv := range dvs {
+
+		if dv.ValueType == DynamicValueTypeError || isEmptyLookupValue(dv) || lookupTypeOrder(dv) != lookupTypeOrder(lookupValue) {
+			continue
+		}
+
+		comparison := compareLookupValues(dv, lookupValue)
+		if descending {
+			comparison = -comparison
+		}
+
+		if comparison > 0 {
+			break
+		}
+
+		bestIndex = index
+	}
+
+	return bestIndex
+}
+
+func integerArgument(dv *DynamicValue) (int, *DynamicValue) {
+	floatDv := convertToFloat(dv)
+	if floatDv.ValueType == DynamicValueTypeError {
+		return 0, floatDv
+	}
+	return int(floatDv.DataFloat), nil
+}
+
+func notFoundError(function string, lookupValue *DynamicValue) *DynamicValue {
+	return makeErrorDv(ErrorCodeNotAvailable, function+" couldn't find "+convertToString(copyDv(lookupValue)).DataString)
+}
+
+func vlookup(arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
+	return tableLookup("VLOOKUP", false, arguments, grid, targetRef)
+}
+
+func hlookup(arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
+	return tableLookup("HLOOKUP", true, arguments, grid, targetRef)
+}
+
+// tableLookup implements VLOOKUP and HLOOKUP, the optional 4th argument enables approximate
+// matching on a sorted first column (or row). Without it the match is exact.
+func tableLookup(function string, horizontal bool, arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
+
+	table, errorDv := getLookupRange(arguments[1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	returnIndex, errorDv := integerArgument(arguments[2])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	isSorted := false
+	if len(arguments) == 4 {
+		isSorted = convertToBool(arguments[3]).DataBool
+	}
+
+	searchDvs := table.column(0)
+	returnCount := table.Columns
+	if horizontal {
+		searchDvs = table.row(0)
+		returnCount = table.Rows
+	}
+
+	if returnIndex < 1 {
+		return makeErrorDv(ErrorCodeValue, function+" index must be at least 1")
+	}
+	if returnIndex > returnCount {
+		return makeErrorDv(ErrorCodeReference, function+" index "+strconv.Itoa(returnIndex)+" is outside of the range")
+	}
+
+	var index int
+	if isSorted {
+		index = findSortedLookupIndex(arguments[0], searchDvs, false)
+	} else {
+		index = findLookupIndex(arguments[0], searchDvs, lookupMatchWildcard, false)
+	}
+
+	if index == -1 {
+		return notFoundError(function, arguments[0])
+	}
+
+	if horizontal {
+		return table.cell(returnIndex-1, index)
+	}
+	return table.cell(index, returnIndex-1)
+}
+
+// MATCH(lookup_value, lookup_range, [match_type]) returns the 1 based position of the value
+func match(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	searchRange, errorDv := getLookupRange(arguments[1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+	if !searchRange.isVector() {
+		return makeErrorDv(ErrorCodeValue, "MATCH requires a single row or column")
+	}
+
+	matchType := 1
+	if len(arguments) == 3 {
+		matchType, errorDv = integerArgument(arguments[2])
+		if errorDv != nil {
+			return errorDv
+		}
+	}
+
+	var index int
+	switch {
+	case matchType == 0:
+		index = findLookupIndex(arguments[0], searchRange.vector(), lookupMatchWildcard, false)
+	case matchType > 0:
+		index = findSortedLookupIndex(arguments[0], searchRange.vector(), false)
+	default:
+		index = findSortedLookupIndex(arguments[0], searchRange.vector(), true)
+	}
+
+	if index == -1 {
+		return notFoundError("MATCH", arguments[0])
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(index + 1)}
+}
+
+// INDEX(range, row, [column]), a row or column of 0 returns the whole column or row
+func indexFunc(arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
+
+	// arrays, like the result of LINEST, are indexed the same way as ranges
+	isArray := arguments[0].ValueType == DynamicValueTypeArray && len(arguments[0].DataArray) > 0
+
+	var indexRange lookupRange
+	var errorDv *DynamicValue
+
+	if isArray {
+		indexRange = lookupRange{Rows: len(arguments[0].DataArray), Columns: len(arguments[0].DataArray[0])}
+	} else {
+		indexRange, errorDv = getLookupRange(arguments[0], grid)
+		if errorDv != nil {
+			return errorDv
+		}
+	}
+
+	row, errorDv := integerArgument(arguments[1])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	column := 1
+	if len(arguments) == 3 {
+		column, errorDv = integerArgument(arguments[2])
+		if errorDv != nil {
+			return errorDv
+		}
+	} else if indexRange.Rows == 1 {
+		// a single index into a row selects the column
+		row, column = 1, row
+	}
+
+	if row < 0 || column < 0 {
+		return makeErrorDv(ErrorCodeValue, "INDEX requires positive indexes")
+	}
+	if row > indexRange.Rows || column > indexRange.Columns {
+		return makeErrorDv(ErrorCodeReference, "INDEX is outside of the range")
+	}
+
+	if isArray {
+		return indexArray(arguments[0].DataArray, row, column)
+	}
+
+	if row == 0 && column == 0 {
+		return indexRange.subRange(0, 0, indexRange.Rows, indexRange.Columns, targetRef.SheetIndex, grid)
+	} else if row == 0 {
+		return indexRange.subRange(0, column-1, indexRange.Rows, 1, targetRef.SheetIndex, grid)
+	} else if column == 0 {
+		return indexRange.subRange(row-1, 0, 1, indexRange.Columns, targetRef.SheetIndex, grid)
+	}
+
+	return indexRange.cell(row-1, column-1)
+}
+
+// indexArray selects a value, or a whole row or column when row or column is 0, from an array
+func indexArray(rows [][]*DynamicValue, row int, column int) *DynamicValue {
+
+	if row == 0 && column == 0 {
+		return makeArrayDv(rows)
+	} else if row == 0 {
+		return makeArrayDv(transposeRows(transposeRows(rows)[column-1 : column]))
+	} else if column == 0 {
+		return makeArrayDv(rows[row-1 : row])
+	}
+
+	return copyDv(rows[row-1][column-1])
+}
+
+// XLOOKUP(lookup_value, lookup_range, return_range, [if_not_found], [match_mode], [search_mode])
+func xlookup(arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
+
+	searchRange, errorDv := getLookupRange(arguments[1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+	if !searchRange.isVector() {
+		return makeErrorDv(ErrorCodeValue, "XLOOKUP requires a single row or column to search in")
+	}
+
+	returnRange, errorDv := getLookupRange(arguments[2], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	// the return range has to line up with the search range
+	vertical := searchRange.Columns == 1 && searchRange.Rows > 1
+	if vertical && returnRange.Rows != searchRange.Rows {
+		return makeErrorDv(ErrorCodeValue, "XLOOKUP ranges need the same number of rows")
+	}
+	if !vertical && returnRange.Columns != searchRange.Columns {
+		return makeErrorDv(ErrorCodeValue, "XLOOKUP ranges need the same number of columns")
+	}
+
+	matchMode := lookupMatchExact
+	if len(arguments) > 4 {
+		matchMode, errorDv = integerArgument(arguments[4])
+		if errorDv != nil {
+			return errorDv
+		}
+		if matchMode < -1 || matchMode > 2 {
+			return makeErrorDv(ErrorCodeValue, "XLOOKUP match_mode must be -1, 0, 1 or 2")
+		}
+	}
+
+	searchMode := 1
+	if len(arguments) > 5 {
+		searchMode, errorDv = integerArgument(arguments[5])
+		if errorDv != nil {
+			return errorDv
+		}
+		if searchMode != 1 && searchMode != -1 && searchMode != 2 && searchMode != -2 {
+			return makeErrorDv(ErrorCodeValue, "XLOOKUP search_mode must be 1, -1, 2 or -2")
+		}
+	}
+
+	// the binary search modes (2 and -2) give the same result as a linear search on sorted data
+	index := findLookupIndex(arguments[0], searchRange.vector(), matchMode, searchMode == -1)
+
+	if index == -1 {
+		if len(arguments) > 3 {
+			return arguments[3]
+		}
+		return notFoundError("XLOOKUP", arguments[0])
+	}
+
+	if vertical {
+		if returnRange.Columns == 1 {
+			return returnRange.cell(index, 0)
+		}
+		return returnRange.subRange(index, 0, 1, returnRange.Columns, targetRef.SheetIndex, grid)
+	}
+
+	if returnRange.Rows == 1 {
+		return returnRange.cell(0, index)
+	}
+	return returnRange.subRange(0, index, returnRange.Rows, 1, targetRef.SheetIndex, grid)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"math"
+
+	matrix "github.com/skelterjohn/go.matrix"
+
+	"./functions"
+)
+
+// matrices whose inverse doesn't give back the identity within this tolerance are treated as singular
+const singularTolerance = 1e-9
+
+// numericMatrix reads a range or array of numbers, every cell needs to hold a number
+func init() {
+
+	ranges := functions.Range
+	scalar := functions.Scalar
+
+	functions.Register(&functions.Definition{Name: "MMULT", MinimumArguments: 2, MaximumArguments: 2, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "MMULT(array1, array2)", Description: "Returns the matrix product of two arrays",
+		Native: func(call *functionCall) *DynamicValue { return mmult(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "MINVERSE", MinimumArguments: 1, MaximumArguments: 1, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "MINVERSE(array)", Description: "Returns the inverse of a square matrix",
+		Native: func(call *functionCall) *DynamicValue { return minverse(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "MDETERM", MinimumArguments: 1, MaximumArguments: 1, ArgumentKinds: []functions.ArgumentKind{ranges},
+		Syntax: "MDETERM(array)", Description: "Returns the determinant of a square matrix",
+		Native: func(call *functionCall) *DynamicValue { return mdeterm(call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "LINEST", MinimumArguments: 1, MaximumArguments: 4, ArgumentKinds: []functions.ArgumentKind{ranges, ranges, scalar, scalar},
+		Syntax: "LINEST(known_ys, [known_xs], [const], [stats])", Description: "Fits a line with least squares",
+		Native: func(call *functionCall) *DynamicValue { return linest(call.Name, call.Arguments, call.Grid) }})
+
+	functions.Register(&functions.Definition{Name: "LOGEST", MinimumArguments: 1, MaximumArguments: 4, ArgumentKinds: []functions.ArgumentKind{ranges, ranges, scalar, scalar},
+		Syntax: "LOGEST(known_ys, [known_xs], [const], [stats])", Description: "Fits an exponential curve with least squares",
+		Native: func(call *functionCall) *DynamicValue { return linest(call.Name, call.Arguments, call.Grid) }})
+}
+
+func numericMatrix(function string, dv *DynamicValue, grid *Grid) ([][]float64, *DynamicValue) {
+
+	rows, errorDv := arrayArgument(dv, grid)
+	if errorDv != nil {
+		return nil, errorDv
+	}
+
+	values := [][]float64{}
+
+	for _, row := range rows {
+
+		rowValues, errorDv := numericValues(row)
+		if errorDv != nil {
+			return nil, errorDv
+		}
+		if len(rowValues) != len(row) {
+			return nil, makeErrorDv(ErrorCodeValue, function+" requires every cell to hold a number")
+		}
+
+		values = append(values, rowValues)
+	}
+
+	return values, nil
+}
+
+func matrixToArrayDv(m matrix.MatrixRO) *DynamicValue {
+
+	rows := [][]*DynamicValue{}
+
+	for row := 0; row < m.Rows(); row++ {
+		values := []*DynamicValue{}
+		for column := 0; column < m.Cols(); column++ {
+			values = append(values, &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: m.Get(row, column)})
+		}
+		rows = append(rows, values)
+	}
+
+	return makeArrayDv(rows)
+}
+
+// invertMatrix returns false for singular matrices, including nearly singular ones whose inverse is
+// dominated by rounding errors
+func invertMatrix(m *matrix.DenseMatrix) (*matrix.DenseMatrix, bool) {
+
+	inverse, err := m.Inverse()
+	if err != nil || inverse == nil {
+		return nil, false
+	}
+
+	product, err := m.Times(inverse)
+	if err != nil {
+		return nil, false
+	}
+
+	for row := 0; row < product.Rows(); row++ {
+		for column := 0; column < product.Cols(); column++ {
+
+			expected := 0.0
+			if row == column {
+				expected = 1
+			}
+
+			if value := product.Get(row, column); math.IsNaN(value) || math.Abs(value-expected) > singularTolerance {
+				return nil, false
+			}
+		}
+	}
+
+	return inverse, true
+}
+
+// MMULT(array1, array2)
+func mmult(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	a, errorDv := numericMatrix("MMULT", arguments[0], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+	b, errorDv := numericMatrix("MMULT", arguments[1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	if len(a[0]) != len(b) {
+		return makeErrorDv(ErrorCodeValue, "MMULT requires the columns of the first array to match the rows of the second")
+	}
+
+	product, err := matrix.MakeDenseMatrixStacked(a).Times(matrix.MakeDenseMatrixStacked(b))
+	if err != nil {
+		return makeErrorDv(ErrorCodeValue, "MMULT failed: "+err.Error())
+	}
+
+	return matrixToArrayDv(product)
+}
+
+// squareMatrix reads the argument of MINVERSE and MDETERM
+func squareMatrix(function string, arguments []*DynamicValue, grid *Grid) (*matrix.DenseMatrix, *DynamicValue) {
+
+	values, errorDv := numericMatrix(function, arguments[0], grid)
+	if errorDv != nil {
+		return nil, errorDv
+	}
+
+	if len(values) != len(values[0]) {
+		return nil, makeErrorDv(ErrorCodeValue, function+" requires a square matrix")
+	}
+
+	return matrix.MakeDenseMatrixStacked(values), nil
+}
+
+func minverse(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	m, errorDv := squareMatrix("MINVERSE", arguments, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	inverse, ok := invertMatrix(m)
+	if !ok {
+		return makeErrorDv(ErrorCodeNumber, "MINVERSE can't invert a singular matrix")
+	}
+
+	return matrixToArrayDv(inverse)
+}
+
+func mdeterm(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	m, errorDv := squareMatrix("MDETERM", arguments, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: m.Det()}
+}
+
+// regressionObservations reads the y values and the x values per observation. Ys in a column
+// take the columns of the xs as variables, ys in a row take the rows. Observations with a
+// missing (or non numeric) value are left out.
+func regressionObservations(function string, arguments []*DynamicValue, grid *Grid) ([]float64, [][]float64, *DynamicValue) {
+
+	yRows, errorDv := arrayArgument(arguments[0], grid)
+	if errorDv != nil {
+		return nil, nil, errorDv
+	}
+
+	isColumn := len(yRows[0]) == 1
+
+	yCells := []*DynamicValue{}
+	for _, row := range yRows {
+		yCells = append(yCells, row...)
+	}
+
+	// without known xs the xs are 1, 2, 3, ...
+	xCells := [][]*DynamicValue{}
+
+	if len(arguments) > 1 && !isEmptyLookupValue(arguments[1]) {
+
+		xRows, errorDv := arrayArgument(arguments[1], grid)
+		if errorDv != nil {
+			return nil, nil, errorDv
+		}
+
+		if !isColumn {
+			xRows = transposeRows(xRows)
+		}
+
+		if len(xRows) != len(yCells) {
+			return nil, nil, makeErrorDv(ErrorCodeReference, function+" requires as many xs as ys")
+		}
+
+		xCells = xRows
+
+	} else {
+		for index := range yCells {
+			xCells = append(xCells, []*DynamicValue{{ValueType: DynamicValueTypeFloat, DataFloat: float64(index + 1)}})
+		}
+	}
+
+	ys := []float64{}
+	xs := [][]float64{}
+
+	for index, yCell := range yCells {
+
+		values, errorDv := numericValues(append([]*DynamicValue{yCell}, xCells[index]...))
+		if errorDv != nil {
+			return nil, nil, errorDv
+		}
+
+		if len(values) == len(xCells[index])+1 {
+			ys = append(ys, values[0])
+			xs = append(xs, values[1:])
+		}
+	}
+
+	return ys, xs, nil
+}
+
+// LINEST(known_ys, [known_xs], [const], [stats]) fits y = m1*x1 + m2*x2 + ... + b with least squares,
+// LOGEST fits y = b * m1^x1 * m2^x2 * ... Like in other spreadsheets the coefficients are returned in
+// reverse order: mn, ..., m1, b. With stats four rows follow: the standard errors of the coefficients,
+// R² and the standard error of y, the F statistic and the degrees of freedom, and the regression and
+// residual sums of squares.
+func linest(function string, arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	ys, xs, errorDv := regressionObservations(function, arguments, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	hasConstant := true
+	if len(arguments) > 2 && !isEmptyLookupValue(arguments[2]) {
+		hasConstant, errorDv = booleanArgument(arguments, 2)
+		if errorDv != nil {
+			return errorDv
+		}
+	}
+
+	hasStats, errorDv := booleanArgument(arguments, 3)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	isLogarithmic := function == "LOGEST"
+
+	if isLogarithmic {
+		for index, y := range ys {
+			if y <= 0 {
+				return makeErrorDv(ErrorCodeNumber, "LOGEST requires positive ys")
+			}
+			ys[index] = math.Log(y)
+		}
+	}
+
+	if len(ys) == 0 {
+		return makeErrorDv(ErrorCodeValue, function+" requires at least one observation")
+	}
+
+	variables := len(xs[0])
+	coefficients := variables
+	if hasConstant {
+		coefficients++
+	}
+
+	// the design matrix has the constant in the last column
+	design := [][]float64{}
+	for _, x := range xs {
+		row := append([]float64{}, x...)
+		if hasConstant {
+			row = append(row, 1)
+		}
+		design = append(design, row)
+	}
+
+	X := matrix.MakeDenseMatrixStacked(design)
+	Y := matrix.MakeDenseMatrixStacked([][]float64{ys}).Transpose()
+	Xt := X.Transpose()
+
+	XtX, _ := Xt.Times(X)
+	XtY, _ := Xt.Times(Y)
+
+	XtXi, ok := invertMatrix(XtX.DenseMatrix())
+	if !ok {
+		return makeErrorDv(ErrorCodeNumber, function+" can't fit the data, the xs are collinear")
+	}
+
+	B, _ := XtXi.Times(XtY)
+
+	beta := []float64{}
+	for index := 0; index < coefficients; index++ {
+		beta = append(beta, B.Get(index, 0))
+	}
+	if !hasConstant {
+		beta = append(beta, 0)
+	}
+
+	// coefficients are returned as mn, ..., m1, b while beta holds m1, ..., mn, b
+	coefficientRow := []*DynamicValue{}
+	for index := variables - 1; index >= -1; index-- {
+
+		value := beta[variables]
+		if index >= 0 {
+			value = beta[index]
+		}
+		if isLogarithmic {
+			value = math.Exp(value)
+		}
+
+		coefficientRow = append(coefficientRow, &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value})
+	}
+
+	if !hasStats {
+		return makeArrayDv([][]*DynamicValue{coefficientRow})
+	}
+
+	mean := 0.0
+	for _, y := range ys {
+		mean += y
+	}
+	mean /= float64(len(ys))
+
+	residualSquares, totalSquares := 0.0, 0.0
+	for index, x := range xs {
+
+		predicted := beta[variables]
+		for variable, value := range x {
+			predicted += beta[variable] * value
+		}
+
+		residualSquares += (ys[index] - predicted) * (ys[index] - predicted)
+
+		// without a constant the total sum of squares isn't centered
+		if hasConstant {
+			totalSquares += (ys[index] - mean) * (ys[index] - mean)
+		} else {
+			totalSquares += ys[index] * ys[index]
+		}
+	}
+
+	degreesOfFreedom := len(ys) - coefficients
+	regressionSquares := totalSquares - residualSquares
+
+	statistic := func(value float64, isDefined bool) *DynamicValue {
+		if !isDefined || math.IsNaN(value) || math.IsInf(value, 0) {
+			return makeErrorDv(ErrorCodeNumber, function+" statistic is undefined for this data")
+		}
+		return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value}
+	}
+	notAvailable := func() *DynamicValue {
+		return makeErrorDv(ErrorCodeNotAvailable, "Value not available")
+	}
+
+	residualVariance := residualSquares / float64(degreesOfFreedom)
+
+	standardErrorRow := []*DynamicValue{}
+	for index := 0; index < variables; index++ {
+		variable := variables - 1 - index
+		standardErrorRow = append(standardErrorRow, statistic(math.Sqrt(XtXi.Get(variable, variable)*residualVariance), degreesOfFreedom > 0))
+	}
+	if hasConstant {
+		standardErrorRow = append(standardErrorRow, statistic(math.Sqrt(XtXi.Get(variables, variables)*residualVariance), degreesOfFreedom > 0))
+	} else {
+		standardErrorRow = append(standardErrorRow, notAvailable())
+	}
+
+	fitRow := []*DynamicValue{statistic(regressionSquares/totalSquares, totalSquares > 0), statistic(math.Sqrt(residualVariance), degreesOfFreedom > 0)}
+	testRow := []*DynamicValue{statistic(regressionSquares/float64(variables)/residualVariance, degreesOfFreedom > 0 && residualSquares > 0), statistic(float64(degreesOfFreedom), true)}
+	squaresRow := []*DynamicValue{statistic(regressionSquares, true), statistic(residualSquares, true)}
+
+	rows := [][]*DynamicValue{coefficientRow, standardErrorRow, fitRow, testRow, squaresRow}
+
+	// the statistics rows only use the first two columns
+	for index := 2; index < len(rows); index++ {
+		for len(rows[index]) < variables+1 {
+			rows[index] = append(rows[index], notAvailable())
+		}
+	}
+
+	return makeArrayDv(rows)
+}
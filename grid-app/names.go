@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// DefinedName is a workbook level name for a reference, a range or a constant formula, e.g.
+// TaxRate = 0.21 or Sales = Sheet1!$A$1:$A$500. References in Formula always include their sheet.
+type DefinedName struct {
+	Name     string
+	Formula  string
+	compiled *compiledFormula
+}
+
+func getDefinedName(name string, grid *Grid) *DefinedName {
+	return grid.DefinedNames[strings.ToUpper(name)]
+}
+
+func validateDefinedName(name string) error {
+
+	upperName := strings.ToUpper(name)
+
+	if !definedNameRegex.MatchString(name) {
+		return errors.New("names contain only letters, digits, underscores and periods and start with a letter or underscore")
+	}
+	if cellReferenceRegex.MatchString(upperName) {
+		return errors.New("names can't look like a cell reference")
+	}
+	if upperName == "TRUE" || upperName == "FALSE" {
+		return errors.New("TRUE and FALSE can't be used as names")
+	}
+
+	return nil
+}
+
+// namesInFormula returns the upper cased names a formula uses, including function calls since
+// those can call a name defined as a LAMBDA
+func namesInFormula(formula string) []string {
+
+	names := []string{}
+
+	for _, use := range formulaNameUses(formula) {
+		names = append(names, strings.ToUpper(use.node.Text))
+	}
+
+	return names
+}
+
+// formulaNameUses returns the names and function calls of a formula that aren't bound by a LET or
+// LAMBDA, formulas that don't compile use all their names
+func formulaNameUses(formula string) []nameUse {
+
+	uses := []nameUse{}
+
+	root, err := compileFormula(formula)
+	if err == nil {
+		freeNameUses(root, map[string]bool{}, &uses)
+		return uses
+	}
+
+	tokens, err := tokenizeFormula(formula)
+	if err != nil {
+		return uses
+	}
+
+	for _, token := range tokens {
+		if token.Kind == formulaTokenName {
+			uses = append(uses, nameUse{node: &formulaNode{Kind: formulaNodeName, Text: token.Text, Start: token.Start, End: token.End}})
+		}
+	}
+
+	return uses
+}
+
+// qualifyFormulaReferences adds the sheet to references without one, so definitions don't depend
+// on the sheet they're used on
+func qualifyFormulaReferences(formula string, sheetIndex SheetID, grid *Grid) string {
+
+	referenceMap := make(map[string]string)
+
+	for _, referenceString := range append(findReferenceStrings(formula), findWholeRangeStrings(formula)...) {
+		if !strings.Contains(referenceString, "!") {
+			referenceMap[referenceString] = getPrefixFromSheetName(getSheetName(sheetIndex, grid)) + "!" + referenceString
+		}
+	}
+
+	return replaceReferenceStringInFormula(formula, referenceMap)
+}
+
+// nameUsesName checks whether the definition of name refers to target, directly or through other names
+func nameUsesName(name string, target string, grid *Grid, visited map[string]bool) bool {
+
+	definition := getDefinedName(name, grid)
+	if definition == nil || visited[strings.ToUpper(name)] {
+		return false
+	}
+	visited[strings.ToUpper(name)] = true
+
+	for _, usedName := range namesInFormula(definition.Formula) {
+		if usedName == strings.ToUpper(target) || nameUsesName(usedName, target, grid, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usedDefinitions returns the definitions of the names a formula uses, directly or through other names
+func usedDefinitions(formula string, grid *Grid) []*DefinedName {
+
+	definitions := []*DefinedName{}
+	addUsedDefinitions(formula, grid, &definitions, make(map[string]bool))
+
+	return definitions
+}
+
+func addUsedDefinitions(formula string, grid *Grid, definitions *[]*DefinedName, visited map[string]bool) {
+
+	for _, name := range namesInFormula(formula) {
+
+		definition := getDefinedName(name, grid)
+		if definition == nil || visited[name] {
+			continue
+		}
+		visited[name] = true
+
+		*definitions = append(*definitions, definition)
+		addUsedDefinitions(definition.Formula, grid, definitions, visited)
+	}
+}
+
+// findNameReferences returns the cells that the names in a formula refer to, for dependency tracking
+func findNameReferences(formula string, grid *Grid) map[Reference]bool {
+
+	references := make(map[Reference]bool)
+
+	for _, definition := range usedDefinitions(formula, grid) {
+		// definitions are qualified, so the sheet index passed is never used
+		for reference := range findReferences(definition.Formula, 0, true, grid) {
+			references[reference] = true
+		}
+	}
+
+	return references
+}
+
+// Names and LAMBDAs evaluate other names, the evaluation passes down how deeply they're nested so a
+// cycle or a LAMBDA that never stops calling itself ends in an error instead of overflowing the stack.
+const maxNameDepth = 256
+
+func nameDepthError(name string, targetRef Reference) *DynamicValue {
+	errorDv := makeErrorDv(ErrorCodeCalc, "Names nested too deeply in "+name+", it may refer to itself")
+	errorDv.SheetIndex = targetRef.SheetIndex
+	return errorDv
+}
+
+// evaluateDefinedName evaluates the definition of a name used in a formula
+func evaluateDefinedName(name string, grid *Grid, targetRef Reference, nameDepth int) *DynamicValue {
+
+	definition := getDefinedName(name, grid)
+
+	if definition == nil {
+		errorDv := makeErrorDv(ErrorCodeName, "Unknown name: "+name)
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	if nameDepth >= maxNameDepth {
+		return nameDepthError(definition.Name, targetRef)
+	}
+
+	compiled := compiledDefinition(definition)
+
+	if compiled.err != nil {
+		errorDv := makeErrorDv(ErrorCodeFormula, "Error in definition of "+definition.Name+": "+compiled.err.Error())
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	return evaluateNode(compiled.root, grid, targetRef, nameDepth+1)
+}
+
+// compiledDefinition returns the AST of a definition. Cells using the same name are computed
+// concurrently, so the cache is only filled by compileDefinitions before computing, definitions
+// changed since then are compiled without being cached.
+func compiledDefinition(definition *DefinedName) *compiledFormula {
+
+	if definition.compiled == nil || definition.compiled.formula != definition.Formula {
+		root, err := compileFormula(definition.Formula)
+		return &compiledFormula{formula: definition.Formula, root: root, err: err}
+	}
+
+	return definition.compiled
+}
+
+// compileDefinitions caches the AST of the definitions that changed since they were compiled
+func compileDefinitions(grid *Grid) {
+	for _, definition := range grid.DefinedNames {
+		definition.compiled = compiledDefinition(definition)
+	}
+}
+
+// defineName creates or redefines a name, references in formula without a sheet refer to sheetIndex
+func defineName(name string, formula string, sheetIndex SheetID, grid *Grid) error {
+
+	if err := validateDefinedName(name); err != nil {
+		return err
+	}
+
+	formula = strings.TrimPrefix(strings.TrimSpace(formula), "=")
+
+	if len(formula) == 0 {
+		return errors.New("the definition of " + name + " is empty")
+	}
+	if _, err := compileFormula(formula); err != nil {
+		return errors.New("error in definition of " + name + ": " + err.Error())
+	}
+
+	formula = qualifyFormulaReferences(formula, sheetIndex, grid)
+
+	// names can't be defined in terms of themselves
+	for _, usedName := range namesInFormula(formula) {
+		if usedName == strings.ToUpper(name) || nameUsesName(usedName, name, grid, make(map[string]bool)) {
+			return errors.New("the definition of " + name + " refers to itself")
+		}
+	}
+
+	grid.DefinedNames[strings.ToUpper(name)] = &DefinedName{Name: name, Formula: formula}
+
+	refreshNameDependents([]string{name}, grid)
+
+	return nil
+}
+
+func renameName(oldName string, newName string, grid *Grid) error {
+
+	definition := getDefinedName(oldName, grid)
+	if definition == nil {
+		return errors.New("there is no name " + oldName)
+	}
+
+	if err := validateDefinedName(newName); err != nil {
+		return err
+	}
+
+	if existing := getDefinedName(newName, grid); existing != nil && existing != definition {
+		return errors.New("the name " + newName + " already exists")
+	}
+
+	// definitions that used the new name before it existed would make the renamed name refer to itself
+	for _, usedName := range namesInFormula(definition.Formula) {
+		if usedName == strings.ToUpper(newName) || nameUsesName(usedName, newName, grid, make(map[string]bool)) {
+			return errors.New("renaming " + oldName + " to " + newName + " makes its definition refer to itself")
+		}
+	}
+
+	// a LET or LAMBDA binding the new name would take over the uses of the name inside it
+	for key, dv := range grid.Data {
+		if isNameCaptured(dv.DataFormula, oldName, newName) {
+			return errors.New("renaming " + oldName + " to " + newName + " would make the LET or LAMBDA in " + key.String() + " use its own " + newName)
+		}
+	}
+	for _, otherDefinition := range grid.DefinedNames {
+		if isNameCaptured(otherDefinition.Formula, oldName, newName) {
+			return errors.New("renaming " + oldName + " to " + newName + " would make the LET or LAMBDA in " + otherDefinition.Name + " use its own " + newName)
+		}
+	}
+
+	delete(grid.DefinedNames, strings.ToUpper(oldName))
+	definition.Name = newName
+	grid.DefinedNames[strings.ToUpper(newName)] = definition
+
+	// rewrite the cells and definitions that use the name
+	for key, dv := range grid.Data {
+		if containsString(namesInFormula(dv.DataFormula), strings.ToUpper(oldName)) {
+			dv.DataFormula = renameNameInFormula(dv.DataFormula, oldName, newName)
+			setDataByRef(getReferenceFromCellKey(key), setDependencies(getReferenceFromCellKey(key), dv, grid), grid)
+		}
+	}
+	for _, otherDefinition := range grid.DefinedNames {
+		otherDefinition.Formula = renameNameInFormula(otherDefinition.Formula, oldName, newName)
+	}
+
+	// formulas that already used the new name now resolve
+	refreshNameDependents([]string{newName}, grid)
+
+	return nil
+}
+
+func deleteName(name string, grid *Grid) error {
+
+	if getDefinedName(name, grid) == nil {
+		return errors.New("there is no name " + name)
+	}
+
+	// dependents are collected before deleting, afterwards they evaluate to #NAME?
+	dependents := nameDependents([]string{name}, grid)
+
+	delete(grid.DefinedNames, strings.ToUpper(name))
+
+	for _, reference := range dependents {
+		setDataByRef(reference, setDependencies(reference, getDataFromRef(reference, grid), grid), grid)
+	}
+
+	return nil
+}
+
+// renameNameInFormula replaces the uses of a name, names bound by a LET or LAMBDA aren't the name
+func renameNameInFormula(formula string, oldName string, newName string) string {
+
+	uses := formulaNameUses(formula)
+
+	// replace back to front so the offsets stay valid
+	sort.Slice(uses, func(i, j int) bool {
+		return uses[i].node.Start > uses[j].node.Start
+	})
+
+	for _, use := range uses {
+		if strings.EqualFold(use.node.Text, oldName) {
+			formula = formula[:use.node.Start] + newName + formula[use.node.End:]
+		}
+	}
+
+	return formula
+}
+
+// isNameCaptured checks whether a use of oldName in a formula is inside a LET or LAMBDA that binds
+// newName, renaming would make it use the bound value instead
+func isNameCaptured(formula string, oldName string, newName string) bool {
+
+	for _, use := range formulaNameUses(formula) {
+		if strings.EqualFold(use.node.Text, oldName) && use.bound[strings.ToUpper(newName)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nameDependents returns the cells that use any of names, directly or through other names
+func nameDependents(names []string, grid *Grid) []Reference {
+
+	affectedNames := make(map[string]bool)
+	for _, name := range names {
+		affectedNames[strings.ToUpper(name)] = true
+	}
+
+	for definitionKey := range grid.DefinedNames {
+		for _, name := range names {
+			if nameUsesName(definitionKey, name, grid, make(map[string]bool)) {
+				affectedNames[definitionKey] = true
+			}
+		}
+	}
+
+	dependents := []Reference{}
+
+	for key, dv := range grid.Data {
+		for _, usedName := range namesInFormula(dv.DataFormula) {
+			if affectedNames[usedName] {
+				dependents = append(dependents, getReferenceFromCellKey(key))
+				break
+			}
+		}
+	}
+
+	return dependents
+}
+
+// refreshNameDependents recomputes the dependencies of cells using names whose definition changed
+// and marks them dirty
+func refreshNameDependents(names []string, grid *Grid) {
+	for _, reference := range nameDependents(names, grid) {
+		setDataByRef(reference, setDependencies(reference, getDataFromRef(reference, grid), grid), grid)
+	}
+}
+
+// moveDefinedNames updates definitions that point into a range that is cut and pasted elsewhere.
+// References and ranges entirely inside the source move along, regardless of $ signs.
+func moveDefinedNames(sourceRange ReferenceRange, destinationRange ReferenceRange, grid *Grid) {
+
+	sourceCells := strings.Split(sourceRange.String, ":")
+	lowerRow, lowerColumn, upperRow, upperColumn := cellRangeBoundaries(sourceCells[0] + ":" + sourceCells[len(sourceCells)-1])
+
+	destinationTopLeft := strings.Split(destinationRange.String, ":")[0]
+	rowDifference := getReferenceRowIndex(destinationTopLeft) - lowerRow
+	columnDifference := getReferenceColumnIndex(destinationTopLeft) - lowerColumn
+
+	isInside := func(reference Reference) bool {
+		row := getReferenceRowIndex(reference.String)
+		column := getReferenceColumnIndex(reference.String)
+		return reference.SheetIndex == sourceRange.SheetIndex && row >= lowerRow && row <= upperRow && column >= lowerColumn && column <= upperColumn
+	}
+
+	moveReference := func(referenceString string) string {
+		fixedRow, fixedColumn := getReferenceFixedBools(referenceString)
+		row := getReferenceRowIndex(referenceString) + rowDifference
+		column := getReferenceColumnIndex(referenceString) + columnDifference
+		return indexesToReferenceWithFixed(row, column, fixedRow, fixedColumn)
+	}
+
+	movedNames := []string{}
+
+	for _, definition := range grid.DefinedNames {
+
+		referenceMap := make(map[string]string)
+
+		for _, referenceString := range findReferenceStrings(definition.Formula) {
+
+			parts := strings.Split(referenceString, "!")
+			cells := strings.Split(parts[len(parts)-1], ":")
+
+			allInside := true
+			for _, cell := range cells {
+				if !isInside(getReferenceFromString(parts[0]+"!"+cell, 0, grid)) {
+					allInside = false
+				}
+			}
+
+			if !allInside {
+				continue
+			}
+
+			movedCells := []string{}
+			for _, cell := range cells {
+				movedCells = append(movedCells, moveReference(cell))
+			}
+
+			referenceMap[referenceString] = getPrefixFromSheetName(getSheetName(destinationRange.SheetIndex, grid)) + "!" + strings.Join(movedCells, ":")
+		}
+
+		if len(referenceMap) > 0 {
+			definition.Formula = replaceReferenceStringInFormula(definition.Formula, referenceMap)
+			movedNames = append(movedNames, definition.Name)
+		}
+	}
+
+	refreshNameDependents(movedNames, grid)
+}
+
+func containsString(values []string, value string) bool {
+	for _, e := range values {
+		if e == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sendNames(c *Client, grid *Grid) {
+
+	keys := []string{}
+	for key := range grid.DefinedNames {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	jsonData := []string{"NAMES"}
+	for _, key := range keys {
+		jsonData = append(jsonData, grid.DefinedNames[key].Name, "="+grid.DefinedNames[key].Formula)
+	}
+
+	json, _ := json.Marshal(jsonData)
+	c.send <- json
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// formatNumber formats a value with a spreadsheet number format like "#,##0.00" or "0.0%".
+// Supported are the placeholders 0, # and ?, thousands separators, decimals, percentages,
+// scientific notation, quoted or escaped literals and sections for positive;negative;zero values.
+func formatNumber(value float64, format string) string {
+
+	if len(format) == 0 || strings.EqualFold(format, "General") {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	sections := splitFormatSections(format)
+
+	section := sections[0]
+	sign := ""
+
+	if value < 0 {
+		// the negative section carries its own sign, e.g. (0.00)
+		if len(sections) > 1 && len(sections[1]) > 0 {
+			section = sections[1]
+		} else {
+			sign = "-"
+		}
+		value = -value
+	} else if value == 0 && len(sections) > 2 && len(sections[2]) > 0 {
+		section = sections[2]
+	}
+
+	formatted, isZero := formatNumberSection(value, section)
+
+	// don't show -0 when the value rounds to zero
+	if isZero {
+		sign = ""
+	}
+
+	return sign + formatted
+}
+
+// splitFormatSections splits a format on semicolons that are not part of a literal
+func splitFormatSections(format string) []string {
+
+	sections := []string{}
+
+	var buff bytes.Buffer
+	inQuotes := false
+	escaped := false
+
+	for _, c := range format {
+		if escaped {
+			escaped = false
+		} else if c == '\\' {
+			escaped = true
+		} else if c == '"' {
+			inQuotes = !inQuotes
+		} else if c == ';' && !inQuotes {
+			sections = append(sections, buff.String())
+			buff.Reset()
+			continue
+		}
+		buff.WriteRune(c)
+	}
+
+	return append(sections, buff.String())
+}
+
+func formatNumberSection(value float64, section string) (string, bool) {
+
+	var prefix, suffix, pattern bytes.Buffer
+
+	isPercentage := false
+	runes := []rune(section)
+
+	for i := 0; i < len(runes); i++ {
+
+		c := runes[i]
+
+		// literals go before the number when no placeholder has been seen yet
+		literal := &prefix
+		if pattern.Len() > 0 {
+			literal = &suffix
+		}
+
+		switch {
+		case c == '"':
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				literal.WriteRune(runes[i])
+			}
+		case c == '\\':
+			if i+1 < len(runes) {
+				i++
+				literal.WriteRune(runes[i])
+			}
+		case c == '_':
+			// padding the width of the next character
+			i++
+			literal.WriteRune(' ')
+		case c == '*':
+			// repeat fill characters aren't supported, skip them
+			i++
+		case c == '[':
+			// colors and conditions
+			for i < len(runes) && runes[i] != ']' {
+				i++
+			}
+		case c == '%':
+			isPercentage = true
+			literal.WriteRune(c)
+		case strings.ContainsRune("0#?", c), (c == '.' || c == ',') && suffix.Len() == 0:
+			pattern.WriteRune(c)
+		case (c == 'E' || c == 'e') && pattern.Len() > 0 && i+1 < len(runes) && (runes[i+1] == '+' || runes[i+1] == '-'):
+			pattern.WriteRune('E')
+			pattern.WriteRune(runes[i+1])
+			i++
+		default:
+			literal.WriteRune(c)
+		}
+	}
+
+	if pattern.Len() == 0 {
+		return prefix.String() + suffix.String(), value == 0
+	}
+
+	if isPercentage {
+		value *= 100
+	}
+
+	numberPattern := pattern.String()
+	exponentPattern := ""
+
+	if index := strings.Index(numberPattern, "E"); index != -1 {
+		exponentPattern = numberPattern[index+1:]
+		numberPattern = numberPattern[:index]
+	}
+
+	integerPattern := numberPattern
+	fractionPattern := ""
+	hasDecimalPoint := false
+
+	if index := strings.Index(numberPattern, "."); index != -1 {
+		integerPattern = numberPattern[:index]
+		fractionPattern = strings.Replace(numberPattern[index+1:], ",", "", -1)
+		hasDecimalPoint = true
+	}
+
+	// trailing commas scale by thousands
+	for strings.HasSuffix(integerPattern, ",") {
+		integerPattern = integerPattern[:len(integerPattern)-1]
+		value /= 1000
+	}
+
+	useThousands := strings.Contains(integerPattern, ",")
+	minimumIntegerDigits := strings.Count(integerPattern, "0")
+	decimals := len(fractionPattern) - strings.Count(fractionPattern, ".")
+	minimumDecimals := strings.Count(fractionPattern, "0") + strings.Count(fractionPattern, "?")
+
+	exponent := 0
+	if len(exponentPattern) > 0 && value != 0 {
+		exponent = int(math.Floor(math.Log10(value)))
+		value = value / math.Pow(10, float64(exponent))
+
+		// rounding can push the mantissa to 10
+		if rounded, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'f', decimals, 64), 64); rounded >= 10 {
+			value /= 10
+			exponent++
+		}
+	}
+
+	formatted := strconv.FormatFloat(value, 'f', decimals, 64)
+
+	isZero := true
+	for _, c := range formatted {
+		if c >= '1' && c <= '9' {
+			isZero = false
+		}
+	}
+
+	integerDigits := formatted
+	fractionDigits := ""
+	if index := strings.Index(formatted, "."); index != -1 {
+		integerDigits = formatted[:index]
+		fractionDigits = formatted[index+1:]
+	}
+
+	for len(fractionDigits) > minimumDecimals && strings.HasSuffix(fractionDigits, "0") {
+		fractionDigits = fractionDigits[:len(fractionDigits)-1]
+	}
+
+	if integerDigits == "0" && minimumIntegerDigits == 0 {
+		integerDigits = ""
+	}
+	for len(integerDigits) < minimumIntegerDigits {
+		integerDigits = "0" + integerDigits
+	}
+
+	if useThousands {
+		integerDigits = groupThousands(integerDigits)
+	}
+
+	var result bytes.Buffer
+	result.WriteString(prefix.String())
+	result.WriteString(integerDigits)
+
+	if hasDecimalPoint {
+		result.WriteString(".")
+		result.WriteString(fractionDigits)
+	}
+
+	if len(exponentPattern) > 0 {
+		result.WriteString("E")
+
+		if exponent < 0 {
+			result.WriteString("-")
+			exponent = -exponent
+		} else if strings.HasPrefix(exponentPattern, "+") {
+			result.WriteString("+")
+		}
+
+		exponentDigits := strconv.Itoa(exponent)
+		for len(exponentDigits) < strings.Count(exponentPattern, "0") {
+			exponentDigits = "0" + exponentDigits
+		}
+		result.WriteString(exponentDigits)
+	}
+
+	result.WriteString(suffix.String())
+
+	return result.String(), isZero
+}
+
+func groupThousands(digits string) string {
+
+	var buff bytes.Buffer
+
+	for i, c := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			buff.WriteRune(',')
+		}
+		buff.WriteRune(c)
+	}
+
+	return buff.String()
+}
+
+// formatCellValue returns a cell's value the way it's displayed, with the number format of the cell
+// applied to numbers and dates
+func formatCellValue(dv *DynamicValue) string {
+
+	value := dv
+	if value.ValueType == DynamicValueTypeArray {
+		value = arrayFirstValue(dv)
+	}
+
+	if len(dv.Format) == 0 || (value.ValueType != DynamicValueTypeFloat && value.ValueType != DynamicValueTypeDate) {
+		return convertToString(value).DataString
+	}
+
+	// a date shown with a number format shows its serial
+	if value.ValueType == DynamicValueTypeDate && !isDateFormat(dv.Format) {
+		return formatNumber(value.DataFloat, dv.Format)
+	}
+
+	return formatValue(value, dv.Format).DataString
+}
+
+// setCellFormat sets the number format of the cells in a range, General or an empty format removes it
+func setCellFormat(cellRange ReferenceRange, format string, grid *Grid) []Reference {
+
+	if strings.EqualFold(format, "General") {
+		format = ""
+	}
+
+	references := []Reference{}
+
+	for _, reference := range cellRangeToCells(cellRange) {
+
+		if !isWithinSheet(reference, grid) {
+			continue
+		}
+
+		// cells that were never set only need to be stored when they get a format
+		if _, ok := grid.Data[getCellKeyFromReference(reference)]; !ok && len(format) == 0 {
+			continue
+		}
+
+		getStoredDataFromRef(reference, grid).Format = format
+		references = append(references, reference)
+	}
+
+	return references
+}
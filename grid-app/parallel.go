@@ -0,0 +1,59 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Dirty cells whose dependencies are all computed don't depend on each other, so they're evaluated
+// concurrently by a pool of workers. Storing the results changes the grid, that's done one cell at
+// a time afterwards. Calls to Python are serialized since there is a single interpreter.
+
+// below this the goroutines cost more than they save
+const parallelComputeThreshold = 16
+
+// evaluateCellsConcurrently evaluates the formulas of cells that are ready to be computed, cells that
+// can't be evaluated without changing the grid (explosive formulas and spilled cells) are left nil
+func evaluateCellsConcurrently(indexes []CellKey, grid *Grid) []*DynamicValue {
+
+	evaluated := make([]*DynamicValue, len(indexes))
+
+	// formulas compute from their formula, not the value from the previous computation
+	for _, index := range indexes {
+		dv := getDataByCellKey(index, grid)
+		if dv.ValueType != DynamicValueTypeExplosiveFormula && dv.SpillFrom == noCellKey {
+			dv.ValueType = DynamicValueTypeFormula
+		}
+	}
+
+	positions := make(chan int, len(indexes))
+	for position := range indexes {
+		positions <- position
+	}
+	close(positions)
+
+	var workers sync.WaitGroup
+
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for position := range positions {
+
+				dv := getDataByCellKey(indexes[position], grid)
+				if dv.ValueType != DynamicValueTypeFormula {
+					continue
+				}
+
+				evaluated[position] = parse(dv, grid, getReferenceFromCellKey(indexes[position]))
+			}
+		}()
+	}
+
+	workers.Wait()
+
+	return evaluated
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"math"
 	"math/rand"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"unicode"
+	"sync"
+	"unicode/utf8"
 
 	matrix "github.com/skelterjohn/go.matrix"
+
+	"./functions"
 )
 
 const DynamicValueTypeFormula int8 = 0
@@ -20,7 +23,23 @@ const DynamicValueTypeFloat int8 = 3
 const DynamicValueTypeString int8 = 4
 const DynamicValueTypeBool int8 = 5
 const DynamicValueTypeExplosiveFormula int8 = 6
-const DynamicValueTypeOperator int8 = 7
+const DynamicValueTypeError int8 = 7
+const DynamicValueTypeArray int8 = 8
+const DynamicValueTypeDate int8 = 9
+
+// error codes stored in DataString of DynamicValueTypeError values
+const ErrorCodeNull = "#NULL!"
+const ErrorCodeDivisionByZero = "#DIV/0!"
+const ErrorCodeValue = "#VALUE!"
+const ErrorCodeReference = "#REF!"
+const ErrorCodeName = "#NAME?"
+const ErrorCodeNumber = "#NUM!"
+const ErrorCodeNotAvailable = "#N/A"
+const ErrorCodeFormula = "#ERROR!"
+const ErrorCodeSpill = "#SPILL!"
+const ErrorCodeCalc = "#CALC!"
+
+var errorCodes = []string{ErrorCodeNull, ErrorCodeDivisionByZero, ErrorCodeValue, ErrorCodeReference, ErrorCodeName, ErrorCodeNumber, ErrorCodeNotAvailable, ErrorCodeFormula, ErrorCodeSpill, ErrorCodeCalc}
 
 type DynamicValue struct {
 	ValueType     int8
@@ -28,26 +47,29 @@ type DynamicValue struct {
 	DataString    string
 	DataBool      bool
 	DataFormula   string
-	SheetIndex    int8
-	DependIn      map[string]bool
-	DependOut     map[string]bool
-	DependInTemp  map[string]bool
-	DependOutTemp map[string]bool
+	ErrorMessage  string
+	DataArray     [][]*DynamicValue
+	SpillFrom     CellKey // the formula this cell's value is spilled from
+	SheetIndex    SheetID
+	Format        string // number format the value is displayed with, empty for General
+	StyleID       StyleID
+	DependIn      map[CellKey]bool
+	DependOut     map[CellKey]bool
+	DependInTemp  map[CellKey]bool
+	DependOutTemp map[CellKey]bool
+	compiled      *compiledFormula
 }
 
 var numberOnlyReg *regexp.Regexp
 var numberOnlyFilter *regexp.Regexp
 
-var availableOperators []string
-var maxOperatorSize int
-var operatorsBroken []map[string]int
 var breakChars []string
 
 func makeEmptyDv() *DynamicValue {
 	dv := DynamicValue{}
 
-	dv.DependIn = make(map[string]bool)
-	dv.DependOut = make(map[string]bool)
+	dv.DependIn = make(map[CellKey]bool)
+	dv.DependOut = make(map[CellKey]bool)
 
 	return &dv
 }
@@ -55,59 +77,48 @@ func makeEmptyDv() *DynamicValue {
 func makeDv(formula string) *DynamicValue {
 	dv := DynamicValue{ValueType: DynamicValueTypeFormula, DataFormula: formula}
 
-	dv.DependIn = make(map[string]bool)
-	dv.DependOut = make(map[string]bool)
+	dv.DependIn = make(map[CellKey]bool)
+	dv.DependOut = make(map[CellKey]bool)
 
 	return &dv
 }
 
-func parseInit() {
-
-	availableOperators = []string{"^", "*", "/", "+", "-", ">", "<", ">=", "<=", "==", "<>", "!="}
-	breakChars = []string{" ", ")", ",", "*", "/", "+", "-", ">", "<", "=", "^"}
-
-	// loop over availableOperators twice: once to find maxOperatorSize to initialize hashmaps, once to fill hashmaps
-	for _, e := range availableOperators {
-		if len(e) > maxOperatorSize {
-			maxOperatorSize = len(e)
-		}
-	}
+func makeErrorDv(errorCode string, message string) *DynamicValue {
+	return &DynamicValue{ValueType: DynamicValueTypeError, DataString: errorCode, ErrorMessage: message}
+}
 
-	// create empty hashmap array
-	operatorsBroken = []map[string]int{}
+// makeArrayDv creates an array value from rows of values
+func makeArrayDv(rows [][]*DynamicValue) *DynamicValue {
+	return &DynamicValue{ValueType: DynamicValueTypeArray, DataArray: rows}
+}
 
-	// initialize hashmaps
-	for i := 0; i < maxOperatorSize; i++ {
-		operatorsBroken = append(operatorsBroken, make(map[string]int))
+// arrayFirstValue is used where an array ends up in a place that takes a single value
+func arrayFirstValue(dv *DynamicValue) *DynamicValue {
+	if len(dv.DataArray) == 0 || len(dv.DataArray[0]) == 0 {
+		return &DynamicValue{ValueType: DynamicValueTypeString, SheetIndex: dv.SheetIndex}
 	}
+	return copyDv(dv.DataArray[0][0])
+}
 
-	for _, e := range availableOperators {
-
-		// determine target hashmap
-		index := len(e)
-
-		// assign hashmap value
-		operatorsBroken[index-1][e] = 1
+func parseInit() {
 
-	}
+	breakChars = []string{" ", ")", ",", "*", "/", "+", "-", ">", "<", "=", "^"}
 
 	numberOnlyReg, _ = regexp.Compile("[^0-9]+")
 	numberOnlyFilter, _ = regexp.Compile(`^-?[0-9]\d*(\.\d+)?$`)
-}
 
-func getData(ref1 DynamicValue, grid *Grid) *DynamicValue {
-	return (grid.Data)[ref1.DataString]
+	formulaInit()
 }
 
+// getDataFromRef returns the cell at reference, cells that were never set read as empty without being stored
 func getDataFromRef(reference Reference, grid *Grid) *DynamicValue {
-	return grid.Data[getMapIndexFromReference(reference)]
-}
-func checkDataPresenceFromRef(reference Reference, grid *Grid) bool {
-	_, ok := grid.Data[getMapIndexFromReference(reference)]
-	return ok
+	if dv, ok := grid.Data[getCellKeyFromReference(reference)]; ok {
+		return dv
+	}
+	return makeEmptyCell(reference.SheetIndex)
 }
 
-func getReferenceFromString(formula string, sheetIndex int8, grid *Grid) Reference {
+func getReferenceFromString(formula string, sheetIndex SheetID, grid *Grid) Reference {
 	if !strings.Contains(formula, "!") {
 		return Reference{String: formula, SheetIndex: sheetIndex}
 	} else {
@@ -116,7 +127,7 @@ func getReferenceFromString(formula string, sheetIndex int8, grid *Grid) Referen
 		return Reference{String: splittedFormula[1], SheetIndex: grid.SheetNames[sheetName]}
 	}
 }
-func getRangeReferenceFromString(formula string, sheetIndex int8, grid *Grid) ReferenceRange {
+func getRangeReferenceFromString(formula string, sheetIndex SheetID, grid *Grid) ReferenceRange {
 	if !strings.Contains(formula, "!") {
 		return ReferenceRange{String: formula, SheetIndex: sheetIndex}
 	} else {
@@ -126,19 +137,19 @@ func getRangeReferenceFromString(formula string, sheetIndex int8, grid *Grid) Re
 	}
 }
 
-func referenceRangeToRelativeString(referenceRange ReferenceRange, sheetIndex int8, grid *Grid) string {
+func referenceRangeToRelativeString(referenceRange ReferenceRange, sheetIndex SheetID, grid *Grid) string {
 	if referenceRange.SheetIndex == sheetIndex {
 		return referenceRange.String
 	} else {
-		return getPrefixFromSheetName(grid.SheetList[referenceRange.SheetIndex]) + "!" + referenceRange.String
+		return getPrefixFromSheetName(getSheetName(referenceRange.SheetIndex, grid)) + "!" + referenceRange.String
 	}
 }
 
-func referenceToRelativeString(reference Reference, sheetIndex int8, grid *Grid) string {
+func referenceToRelativeString(reference Reference, sheetIndex SheetID, grid *Grid) string {
 	if reference.SheetIndex == sheetIndex {
 		return reference.String
 	} else {
-		return getPrefixFromSheetName(grid.SheetList[reference.SheetIndex]) + "!" + reference.String
+		return getPrefixFromSheetName(getSheetName(reference.SheetIndex, grid)) + "!" + reference.String
 	}
 }
 
@@ -151,19 +162,23 @@ func getPrefixFromSheetName(sheetName string) string {
 }
 
 func checkIfRefExists(reference Reference, grid *Grid) bool {
-	if _, ok := grid.Data[getMapIndexFromReference(reference)]; ok {
-		return true
-	}
-	return false
+	return isWithinSheet(reference, grid)
 }
 
-func getDataByNormalRef(ref string, grid *Grid) *DynamicValue {
-	return grid.Data[ref]
+func getDataByCellKey(key CellKey, grid *Grid) *DynamicValue {
+	if dv, ok := grid.Data[key]; ok {
+		return dv
+	}
+	return makeEmptyCell(key.SheetIndex())
 }
 
 func setDataByRef(reference Reference, dv *DynamicValue, grid *Grid) {
 	dv.SheetIndex = reference.SheetIndex
-	mapIndex := getMapIndexFromReference(reference)
+	mapIndex := getCellKeyFromReference(reference)
+	if mapIndex == noCellKey {
+		return
+	}
+	markCellChanged(mapIndex, grid)
 	grid.Data[mapIndex] = dv
 }
 
@@ -195,91 +210,19 @@ func findReferenceStrings(formula string) []string {
 
 	references := []string{}
 
-	// loop over string, if double quote is found, ignore input for references,
-	quoteLevel := 0
-	singleQuoteLevel := 0
-	previousChar := ""
-
-	var buf bytes.Buffer
-
-	for _, c := range formula {
-		char := string(c)
-
-		if char == "\"" && previousChar != "\\" {
-			if quoteLevel == 0 {
-				quoteLevel++
-			} else {
-				buf.Reset()
-				quoteLevel--
-				continue
-			}
-		}
-
-		if c == '\'' && singleQuoteLevel == 0 {
-			singleQuoteLevel++
-		} else if c == '\'' && singleQuoteLevel == 1 {
-			singleQuoteLevel--
-		}
-
-		if quoteLevel == 0 && singleQuoteLevel == 1 {
-			buf.WriteString(char)
-		}
-
-		if quoteLevel == 0 && singleQuoteLevel == 0 {
-
-			// assume everything not in quotes is a reference
-			// if we find open brace it must be a function name
-			if char == "(" {
-				buf.Reset()
-				continue
-			} else if contains(breakChars, char) {
-
-				if buf.Len() > 0 {
-					// found space, previous is references
-					references = append(references, buf.String())
-					buf.Reset()
-				}
-				// never add break char to reference
-				continue
-			}
-
-			// edge case for number, if first char of buffer is number, can't be reference
-			if buf.Len() == 0 {
-
-				if unicode.IsDigit(c) || char == "." { // check for both numbers and . character
-
-					// found number can't be reference
-					buf.Reset()
-					continue
-				}
-			}
-
-			buf.WriteString(char)
-
-		}
-
-		previousChar = char
-
-	}
-
-	// at the end also add as reference
-	if buf.Len() > 0 {
-		references = append(references, buf.String())
-	}
+	// references are the reference and range tokens of the formula, on invalid input the tokens found so far are used
+	tokens, _ := tokenizeFormula(formula)
 
-	// filter references for known keywords such as TRUE/FALSE
-	for k, reference := range references {
-		if len(references) > 0 {
-			if reference == "TRUE" || reference == "FALSE" {
-				references = append(references[:k], references[k+1:]...)
-			}
+	for _, token := range tokens {
+		if token.Kind == formulaTokenReference || token.Kind == formulaTokenRange {
+			references = append(references, token.Text)
 		}
 	}
 
 	return references
 }
 
-func findRanges(formula string, sheetIndex int8, grid *Grid) []ReferenceRange {
+func findRanges(formula string, sheetIndex SheetID, grid *Grid) []ReferenceRange {
 
 	rangeReferences := []ReferenceRange{}
 	referenceStrings := findReferenceStrings(formula)
@@ -294,7 +237,7 @@ func findRanges(formula string, sheetIndex int8, grid *Grid) []ReferenceRange {
 	return rangeReferences
 }
 
-func findReferences(formula string, sheetIndex int8, includeRanges bool, grid *Grid) map[Reference]bool {
+func findReferences(formula string, sheetIndex SheetID, includeRanges bool, grid *Grid) map[Reference]bool {
 
 	referenceStrings := findReferenceStrings(formula)
 
@@ -425,33 +368,53 @@ func cellRangeToCells(referenceRange ReferenceRange) []Reference {
 
 func setDependencies(reference Reference, dv *DynamicValue, grid *Grid) *DynamicValue {
 
-	standardIndex := getMapIndexFromReference(reference)
+	standardIndex := getCellKeyFromReference(reference)
 	var references map[Reference]bool
 	// explosiveFormulas never have dependencies
 	if dv.ValueType == DynamicValueTypeExplosiveFormula {
 		references = make(map[Reference]bool)
 	} else {
 		references = findReferences(dv.DataFormula, reference.SheetIndex, true, grid)
+
+		// cells referred to through defined names are dependencies too
+		for nameReference := range findNameReferences(dv.DataFormula, grid) {
+			references[nameReference] = true
+		}
 	}
 
 	// every cell that this depended on needs to get removed
 	referenceDv := getDataFromRef(reference, grid)
 
 	for ref := range referenceDv.DependIn {
-		delete(getDataByNormalRef(ref, grid).DependOut, standardIndex)
+		delete(getDataByCellKey(ref, grid).DependOut, standardIndex)
 	}
 
 	// always clear incoming references, if they still exist
-	dv.DependIn = make(map[string]bool)
+	dv.DependIn = make(map[CellKey]bool)
+
+	// a value entered in a spilled cell replaces the spilled value (and blocks the spill)
+	dv.SpillFrom = noCellKey
+	markSpillAnchorsDirty(reference, grid)
+
+	// whole columns and rows are tracked per range instead of per cell
+	setRangeDependencies(reference, dv, grid)
+
+	setVolatile(reference, dv, grid)
 
 	for thisRef, inSet := range references {
 
-		// when findReferences is called and a reference is not in grid.Data[] the reference is invalid
+		// when findReferences is called and a reference is outside of the sheet the reference is invalid,
+		// evaluating the formula then results in a #REF! error
 		if checkIfRefExists(thisRef, grid) {
-			thisDv := getDataFromRef(thisRef, grid)
 
 			// for dependency checking get rid of dollar signs in references
-			thisDvStandardRef := getMapIndexFromReference(thisRef)
+			thisDvStandardRef := getCellKeyFromReference(thisRef)
+
+			// cells referred to are stored to keep track of their dependents
+			thisDv := dv
+			if thisDvStandardRef != standardIndex {
+				thisDv = getStoredDataFromRef(thisRef, grid)
+			}
 
 			if inSet {
 				// if thisRef == reference {
@@ -470,8 +433,6 @@ func setDependencies(reference Reference, dv *DynamicValue, grid *Grid) *Dynamic
 				// copyToDirty(thisDvStandardRef, grid)
 			}
 
-		} else {
-			dv.DataFormula = "\"#REF: " + referenceToRelativeString(thisRef, reference.SheetIndex, grid) + "\""
 		}
 
 	}
@@ -515,11 +476,31 @@ func copyDv(dv *DynamicValue) *DynamicValue {
 	newDv.DataFloat = dv.DataFloat
 	newDv.DataString = dv.DataString
 	newDv.DataFormula = dv.DataFormula
+	newDv.ErrorMessage = dv.ErrorMessage
+	newDv.DataArray = dv.DataArray
 	newDv.SheetIndex = dv.SheetIndex
 	newDv.ValueType = dv.ValueType
 	return &newDv
 }
 
+func copyCellValue(dv *DynamicValue) *DynamicValue {
+
+	// the formula cell of a spilled array holds the first value
+	if dv.ValueType == DynamicValueTypeArray {
+		return arrayFirstValue(dv)
+	}
+
+	newDv := copyDv(dv)
+
+	// cells that were never computed are empty
+	if newDv.ValueType == DynamicValueTypeFormula {
+		newDv.ValueType = DynamicValueTypeString
+		newDv.DataString = ""
+	}
+
+	return newDv
+}
+
 // func copyToDv(sourceDv *DynamicValue, targetDv *DynamicValue) {
 // 	// note: DependOut and DependIn are unmodified - need to be done by setDependencies
 // 	targetDv.DataBool = sourceDv.DataBool
@@ -541,348 +522,194 @@ func parse(formula *DynamicValue, grid *Grid, targetRef Reference) *DynamicValue
 		return formula
 	}
 
-	elements := []*DynamicValue{}
-	operatorsFound := []string{}
-	parenDepth := 0
-	quoteDepth := 0
-	previousChar := ""
-	var buffer bytes.Buffer
-
-	// TODO: instead of writing to buffer keep track of indexes for efficiency
-	skipCharacters := 0
-
-	for k, r := range formula.DataFormula {
-
-		c := string(r)
-
-		if skipCharacters > 0 {
-
-			skipCharacters--
-			continue
-
-		} else {
-
-			// check for quotes
-
-			if c == "\"" && quoteDepth == 0 && previousChar != "\\" {
-
-				quoteDepth++
-
-			} else if c == "\"" && quoteDepth == 1 && previousChar != "\\" {
-
-				quoteDepth--
-
-			}
-
-			if quoteDepth == 0 {
-
-				if c == "(" {
-
-					parenDepth++
-
-				} else if c == ")" {
-
-					parenDepth--
-
-					if parenDepth < 0 {
-						log.Fatal("Invalid input string")
-					}
-
-				} else if parenDepth == 0 {
-
-					identifiedOperator := ""
-
-					// never check first operator (could be minus sign)
+	compiled := getCompiledFormula(formula)
 
-					currentTrimmedBuffer := strings.TrimSpace(buffer.String())
-					// first char and equals - or previous element is operator and this is minus
+	if compiled.err != nil {
 
-					// first check is for first character equals minus sign,
-					// second check is for a minus sign directly after an operator to indicate that the following term is negative
-					if !((k == 0 && c == "-") ||
-						(c == "-" && len(elements) > 0 &&
-							elements[len(elements)-1].ValueType == DynamicValueTypeOperator &&
-							len(currentTrimmedBuffer) == 0)) {
-
-						for i := 0; i < maxOperatorSize; i++ {
+		errorDv := makeErrorDv(ErrorCodeFormula, "Error in formula: "+compiled.err.Error())
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
 
-							// condition 1: never check beyond length of original formula
-							// condition 2: identfy whether operator is in hashmapped operator data structure for high performance
+	return evaluateNode(compiled.root, grid, targetRef, 0)
+}
 
-							// first check for operators of size 1, then for operators of size 2, etc
-							if (k+i+1) <= len(formula.DataFormula)-1 && operatorsBroken[i][formula.DataFormula[k:k+i+1]] == 1 {
-								identifiedOperator = formula.DataFormula[k : k+i+1]
-							}
+// evaluateNode evaluates a node of a formula for the cell at targetRef, nameDepth is the number of names
+// and LAMBDAs being evaluated around it
+func evaluateNode(node *formulaNode, grid *Grid, targetRef Reference, nameDepth int) *DynamicValue {
 
-						}
+	// always return fresh DynamicValues, callers are free to modify the result
+	switch node.Kind {
+	case formulaNodeNumber:
 
-						if len(identifiedOperator) > 0 {
+		return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeFloat, DataFloat: node.Number}
 
-							// add to elements everything in buffer before operator
-							newDv := DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeFormula, DataFormula: strings.TrimSpace(buffer.String())}
-							elements = append(elements, &newDv)
+	case formulaNodeString:
 
-							newDv2 := DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeOperator, DataFormula: identifiedOperator}
-							// add operator to elements
-							elements = append(elements, &newDv2)
+		return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeString, DataString: node.Text}
 
-							skipCharacters = len(identifiedOperator) - 1
+	case formulaNodeBool:
 
-							// append operator to found operators, if not already in there
-							if !contains(operatorsFound, identifiedOperator) {
-								operatorsFound = append(operatorsFound, identifiedOperator)
-							}
+		return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeBool, DataBool: node.Bool}
 
-							// reset buffer
-							buffer.Reset()
+	case formulaNodeError:
 
-							continue
+		errorDv := makeErrorDv(node.Text, node.Text)
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
 
-						}
-					}
-				}
-			}
+	case formulaNodeRange:
 
-			buffer.WriteString(c)
+		if isWholeRangeString(node.Text) {
+			return evaluateWholeRange(node.Text, grid, targetRef)
 		}
 
-		previousChar = c
-
-	}
-
-	newDv := DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeFormula, DataFormula: strings.TrimSpace(buffer.String())}
-	elements = append(elements, &newDv)
-
-	// if first and last element in elements are parens, remove parens
-	for k, e := range elements {
-		if e.ValueType == DynamicValueTypeFormula {
-			if len(e.DataFormula) > 0 {
-				if e.DataFormula[0:1] == "(" && e.DataFormula[len(e.DataFormula)-1:len(e.DataFormula)] == ")" {
-					e.DataFormula = e.DataFormula[1 : len(e.DataFormula)-1]
-					elements[k] = e
-
-					// after remove braces, parse this element
-					elements[k] = parse(e, grid, targetRef)
-
-					// for single elements return at this point
-					if len(elements) == 1 {
-						return elements[k]
-					}
-				}
-			}
+		// ranges with ends that don't fit in a cell key would alias cells on other sheets
+		if !rangeFitsKeys(node.Text) {
+			errorDv := makeErrorDv(ErrorCodeReference, "Invalid reference: "+node.Text)
+			errorDv.SheetIndex = targetRef.SheetIndex
+			return errorDv
 		}
-	}
-
-	if len(elements) == 1 {
-
-		singleElement := elements[0]
-
-		if isFunction(singleElement.DataFormula) {
-
-			parenIndex := strings.Index(singleElement.DataFormula, "(")
-			command := singleElement.DataFormula[0:parenIndex]
-
-			// modify arguments function
-			argumentString := singleElement.DataFormula[parenIndex+1 : len(singleElement.DataFormula)-1]
-			var arguments []string
-
-			level := 0
-			quoteLevel := 0
-			var buffer bytes.Buffer
-
-			for _, r := range argumentString {
-
-				c := string(r)
-
-				// valid delimeters
-				// go down level: " (
-				// go up level: " )
-
-				if c == "(" {
-					level++
-				} else if c == ")" {
-					level--
-				} else if c == "\"" && quoteLevel == 0 {
-					level++
-					quoteLevel++
-				} else if c == "\"" && quoteLevel == 1 {
-					level--
-					quoteLevel--
-				}
-
-				if level == 0 {
-					if c == "," {
-						arguments = append(arguments, strings.TrimSpace(buffer.String()))
-						buffer.Reset()
-						continue
-					}
-				}
-
-				buffer.WriteString(c)
-
-			}
-
-			bufferRemainder := strings.TrimSpace(buffer.String())
-			if len(bufferRemainder) > 0 {
-				arguments = append(arguments, bufferRemainder)
-			}
 
-			argumentFormulas := []*DynamicValue{}
+		// ranges are passed to functions unresolved, functions expand them with getRangeReferenceFromString
+		return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeReference, DataString: node.Text}
 
-			for _, e := range arguments {
-				newDv := DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeFormula, DataFormula: e}
-				argumentFormulas = append(argumentFormulas, parse(&newDv, grid, targetRef))
-			}
-
-			return executeCommand(command, argumentFormulas, grid, targetRef)
-
-		} else {
-
-			if singleElement.DataFormula[0:1] == "\"" && singleElement.DataFormula[len(singleElement.DataFormula)-1:len(singleElement.DataFormula)] == "\"" {
-
-				stringValue := singleElement.DataFormula[1 : len(singleElement.DataFormula)-1]
-
-				// unescape double quote
-				stringValue = strings.Replace(stringValue, "\\\"", "\"", -1)
-
-				return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeString, DataString: stringValue}
+	case formulaNodeReference:
 
-			} else if strings.Index(singleElement.DataFormula, ":") != -1 {
+		reference := getReferenceFromString(node.Text, targetRef.SheetIndex, grid)
 
-				cells := strings.Split(singleElement.DataFormula, ":")
-
-				if !((numberOnlyFilter.MatchString(cells[0]) && numberOnlyFilter.MatchString(cells[1])) ||
-					(!numberOnlyFilter.MatchString(cells[0]) && !numberOnlyFilter.MatchString(cells[1]))) {
-
-					log.Fatal("Wrong reference specifier")
-
-				} else {
-					return &DynamicValue{ValueType: DynamicValueTypeReference, SheetIndex: targetRef.SheetIndex, DataString: singleElement.DataFormula}
-				}
-
-			} else if numberOnlyFilter.MatchString(singleElement.DataFormula) {
+		if !checkIfRefExists(reference, grid) || !sheetExistsForReferenceString(node.Text, grid) {
+			errorDv := makeErrorDv(ErrorCodeReference, "Invalid reference: "+node.Text)
+			errorDv.SheetIndex = targetRef.SheetIndex
+			return errorDv
+		}
 
-				floatValue, err := strconv.ParseFloat(singleElement.DataFormula, 64)
-				if err != nil {
-					log.Fatal(err)
-				}
+		dv := copyCellValue(getCellValue(getCellKeyFromReference(reference), grid))
+		dv.SheetIndex = reference.SheetIndex
+		return dv
 
-				return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeFloat, DataFloat: float64(floatValue)}
+	case formulaNodeName:
 
-			} else if singleElement.DataFormula == "FALSE" || singleElement.DataFormula == "TRUE" {
-				newDv := DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeBool, DataBool: false}
-				if singleElement.DataFormula == "TRUE" {
-					newDv.DataBool = true
-				}
-				return &newDv
-			} else {
+		return evaluateDefinedName(node.Text, grid, targetRef, nameDepth)
 
-				// when references contain dollar signs, remove them here
-				newDv := copyDv(getDataFromRef(getReferenceFromString(singleElement.DataFormula, targetRef.SheetIndex, grid), grid))
-				return newDv
+	case formulaNodeUnary:
 
-			}
+		operand := convertToFloat(evaluateNode(node.Children[0], grid, targetRef, nameDepth))
 
+		if operand.ValueType == DynamicValueTypeError {
+			return operand
 		}
 
-	} else {
-
-		// parse operators until top elements per formula reduced to 1
-		var operatorSets [][]string
-
-		operatorSets = [][]string{{"^"}, {"*", "/"}, {"+", "-"}, {">", "<", ">=", "<=", "==", "<>", "!="}}
+		return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeFloat, DataFloat: -operand.DataFloat}
 
-		for _, operatorSet := range operatorSets {
+	case formulaNodeBinary:
 
-			// more efficient would be to compare each element in operatorsFound to elements in operatorSet
-			operatorInSet := anyOperatorsInOperatorSet(operatorSet, operatorsFound)
+		LHS := evaluateNode(node.Children[0], grid, targetRef, nameDepth)
+		RHS := evaluateNode(node.Children[1], grid, targetRef, nameDepth)
 
-			if operatorInSet {
-				operatorLocation := findFirstOperatorOccurence(elements, operatorSet)
-
-				if operatorLocation == 0 {
-					log.Fatal("Operator can never be the first input in an array")
-				}
+		// operators on ranges and arrays apply to each element, e.g. A1:A3*2
+		if isArrayOperand(LHS) || isArrayOperand(RHS) {
+			return arrayOperation(node.Text, LHS, RHS, grid, targetRef)
+		}
 
-				for operatorLocation != -1 {
+		return binaryOperation(node.Text, LHS, RHS, targetRef)
 
-					LHS := parse(elements[operatorLocation-1], grid, targetRef)
-					RHS := parse(elements[operatorLocation+1], grid, targetRef)
+	case formulaNodeValue:
 
-					var result DynamicValue
+		return copyDv(node.Value)
 
-					// todo implement operators for all possible data type combinations
+	case formulaNodeFunction:
 
-					// for now implement int and float as all float (* might actually be necessary for good performance (should compare int and float multiplication for large n in Golang))
+		// names defined as a LAMBDA come first, then native functions, the rest is up to Python
+		if lambda := getLambda(node.Text, grid); lambda != nil {
+			return callLambda(node, lambda, grid, targetRef, nameDepth)
+		}
 
-					operator := elements[operatorLocation].DataFormula
+		if definition := functions.Lookup(node.Text); definition != nil {
+			return callFunction(definition, node, grid, targetRef, nameDepth)
+		}
 
-					// if boolean operatorSet run boolean_compare
-					if contains(operatorSet, "<") {
-						result = booleanCompare(LHS, RHS, elements[operatorLocation].DataFormula)
-					} else {
-						// otherwise run numeric operator evaluation
-						if LHS.ValueType == DynamicValueTypeFloat && RHS.ValueType == DynamicValueTypeFloat {
+		arguments := []*DynamicValue{}
 
-							// convert LHS and RHS to float
-							LHS = convertToFloat(LHS)
-							RHS = convertToFloat(RHS)
+		for _, argumentNode := range node.Children {
+			arguments = append(arguments, evaluateNode(argumentNode, grid, targetRef, nameDepth))
+		}
 
-							result = DynamicValue{ValueType: DynamicValueTypeFloat}
+		return callPython(node.Text, arguments, grid, targetRef)
+	}
 
-							switch operator {
-							case "*":
-								result.DataFloat = LHS.DataFloat * RHS.DataFloat
-							case "/":
-								result.DataFloat = LHS.DataFloat / RHS.DataFloat
-							case "+":
-								result.DataFloat = LHS.DataFloat + RHS.DataFloat
-							case "-":
-								result.DataFloat = LHS.DataFloat - RHS.DataFloat
-							case "^":
-								result.DataFloat = float64(math.Pow(float64(LHS.DataFloat), float64(RHS.DataFloat)))
-							}
+	return makeErrorDv(ErrorCodeFormula, "Error in formula")
+}
 
-						}
-					}
+// binaryOperation applies an operator to two single values
+func binaryOperation(operator string, LHS *DynamicValue, RHS *DynamicValue, targetRef Reference) *DynamicValue {
 
-					arrayEnd := elements[operatorLocation+2:]
-					elements = append(elements[:operatorLocation-1], &result)
-					elements = append(elements, arrayEnd...)
+	// errors propagate through operators, the leftmost error wins
+	if LHS.ValueType == DynamicValueTypeError {
+		return LHS
+	}
+	if RHS.ValueType == DynamicValueTypeError {
+		return RHS
+	}
 
-					operatorLocation = findFirstOperatorOccurence(elements, operatorSet)
+	if binaryOperatorPrecedence[operator] == binaryOperatorPrecedence["=="] {
+		result := booleanCompare(LHS, RHS, operator)
+		result.SheetIndex = targetRef.SheetIndex
+		return &result
+	}
 
-				}
+	// date arithmetic: adding to a date (or time) and subtracting days gives a date, date - date is a number of days
+	isDateResult := false
+	if operator == "+" {
+		isDateResult = LHS.ValueType == DynamicValueTypeDate || RHS.ValueType == DynamicValueTypeDate
+	} else if operator == "-" {
+		isDateResult = LHS.ValueType == DynamicValueTypeDate && RHS.ValueType != DynamicValueTypeDate
+	}
 
-			}
+	LHS = convertToFloat(LHS)
+	if LHS.ValueType == DynamicValueTypeError {
+		return LHS
+	}
+	RHS = convertToFloat(RHS)
+	if RHS.ValueType == DynamicValueTypeError {
+		return RHS
+	}
 
-		}
+	result := DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeFloat}
 
-		if len(elements) != 1 {
-			log.Fatal("Elements should be fully merged to 1 element")
+	switch operator {
+	case "*":
+		result.DataFloat = LHS.DataFloat * RHS.DataFloat
+	case "/":
+		if RHS.DataFloat == 0 {
+			errorDv := makeErrorDv(ErrorCodeDivisionByZero, "Division by zero")
+			errorDv.SheetIndex = targetRef.SheetIndex
+			return errorDv
 		}
+		result.DataFloat = LHS.DataFloat / RHS.DataFloat
+	case "+":
+		result.DataFloat = LHS.DataFloat + RHS.DataFloat
+	case "-":
+		result.DataFloat = LHS.DataFloat - RHS.DataFloat
+	case "^":
+		result.DataFloat = math.Pow(LHS.DataFloat, RHS.DataFloat)
+	}
 
-		return elements[0]
-
+	if isDateResult {
+		result.ValueType = DynamicValueTypeDate
 	}
 
-	return formula
+	return &result
 }
 
-func anyOperatorsInOperatorSet(operatorSet []string, operatorsFound []string) bool {
-
-	// if no operators were found it can never be in the set
-	if len(operatorsFound) == 0 {
-		return false
-	}
-	for _, operatorInSet := range operatorSet {
-		for _, operatorFound := range operatorsFound {
-			if operatorInSet == operatorFound {
-				return true
-			}
-		}
+// sheetExistsForReferenceString checks the sheet prefix of a reference, references without prefix always have a sheet
+func sheetExistsForReferenceString(referenceString string, grid *Grid) bool {
+	if !strings.Contains(referenceString, "!") {
+		return true
 	}
-	return false
+	sheetName := strings.Replace(strings.Split(referenceString, "!")[0], "'", "", -1)
+	_, ok := grid.SheetNames[sheetName]
+	return ok
 }
 
 func dynamicToBool(A DynamicValue) bool {
@@ -975,34 +802,6 @@ func intersections(section1, section2 []string) (intersection []string) {
 	return
 }
 
-func indexOfOperator(ds []*DynamicValue, s string) int {
-	for k, e := range ds {
-		if e.DataFormula == s {
-			return k
-		}
-	}
-	return -1
-}
-
-func findFirstOperatorOccurence(elements []*DynamicValue, operatorSet []string) int {
-
-	operatorLocation := math.MaxInt32
-
-	for d := 0; d < len(operatorSet); d++ {
-
-		index := indexOfOperator(elements, operatorSet[d])
-		if index != -1 && index < operatorLocation {
-			operatorLocation = index
-		}
-	}
-
-	if operatorLocation == math.MaxInt32 {
-		return -1
-	}
-
-	return operatorLocation
-}
-
 func stringToInteger(s string) int32 {
 
 	numberString := numberOnlyReg.ReplaceAllString(s, "")
@@ -1012,29 +811,6 @@ func stringToInteger(s string) int32 {
 	return int32(number)
 }
 
-func isFunction(formulaString string) bool {
-
-	for k, s := range formulaString {
-
-		char := string(s)
-
-		if char == "(" {
-
-			if k > 0 {
-				if formulaString[len(formulaString)-1] == ')' {
-					return true
-				}
-			}
-		}
-
-		if !(s >= 65 && s <= 90 || s >= 97 && s <= 122) {
-			return false
-		}
-	}
-
-	return false
-}
-
 func toChar(i int) rune {
 	return rune('A' - 1 + i)
 }
@@ -1111,7 +887,7 @@ func convertToBool(dv *DynamicValue) *DynamicValue {
 
 	if dv.ValueType == DynamicValueTypeBool {
 		return dv
-	} else if dv.ValueType == DynamicValueTypeFloat {
+	} else if dv.ValueType == DynamicValueTypeFloat || dv.ValueType == DynamicValueTypeDate {
 		if dv.DataFloat != 0 {
 			boolDv.DataBool = true
 		}
@@ -1132,6 +908,10 @@ func convertToString(dv *DynamicValue) *DynamicValue {
 		if dv.DataBool {
 			dv.DataString = "TRUE"
 		}
+	} else if dv.ValueType == DynamicValueTypeArray {
+		dv.DataString = convertToString(arrayFirstValue(dv)).DataString
+	} else if dv.ValueType == DynamicValueTypeDate {
+		dv.DataString = formatDate(dv.DataFloat)
 	} else if dv.ValueType == DynamicValueTypeFloat {
 		dv.DataString = strconv.FormatFloat(float64(dv.DataFloat), 'f', -1, 64)
 
@@ -1151,6 +931,24 @@ func isCellEmpty(dv *DynamicValue) bool {
 
 func convertToFloat(dv *DynamicValue) *DynamicValue {
 
+	// errors are passed on as is, their DataFloat is always 0
+	if dv.ValueType == DynamicValueTypeError {
+		return dv
+	}
+
+	if dv.ValueType == DynamicValueTypeReference {
+		return makeErrorDv(ErrorCodeValue, "Can't make number from range "+dv.DataString)
+	}
+
+	if dv.ValueType == DynamicValueTypeArray {
+		return convertToFloat(arrayFirstValue(dv))
+	}
+
+	// dates are their serial number, return a new value since dv can be a cell in the grid
+	if dv.ValueType == DynamicValueTypeDate {
+		return &DynamicValue{SheetIndex: dv.SheetIndex, ValueType: DynamicValueTypeFloat, DataFloat: dv.DataFloat}
+	}
+
 	if !(dv.ValueType == DynamicValueTypeBool ||
 		dv.ValueType == DynamicValueTypeFloat ||
 		dv.ValueType == DynamicValueTypeString) {
@@ -1165,11 +963,14 @@ func convertToFloat(dv *DynamicValue) *DynamicValue {
 		// first remove all whitespace from string
 		strippedString := strings.TrimSpace(dv.DataString)
 
+		// empty cells count as zero
+		if len(strippedString) == 0 {
+			return &DynamicValue{ValueType: DynamicValueTypeFloat}
+		}
+
 		value, err := strconv.ParseFloat(strippedString, 64)
 		if err != nil {
-			fmt.Println("Can't make number from " + dv.DataString)
-
-			return &DynamicValue{ValueType: DynamicValueTypeFloat}
+			return makeErrorDv(ErrorCodeValue, "Can't make number from "+dv.DataString)
 		}
 		dv.DataFloat = value
 	}
@@ -1193,10 +994,27 @@ func average(arguments []*DynamicValue, grid *Grid) *DynamicValue {
 
 		// check if argument is range
 		if dv.ValueType == DynamicValueTypeReference {
-			dvs := getDvsFromReferenceRange(getRangeReferenceFromString(dv.DataString, dv.SheetIndex, grid), grid)
-			dv = average(dvs, grid)
-		} else {
-			dv = convertToFloat(dv)
+
+			// the average of the cells of the range, empty cells count as zero
+			rangeRef := getRangeReferenceFromString(dv.DataString, dv.SheetIndex, grid)
+			dv = sum(storedRangeCells(rangeRef, grid), grid)
+			if dv.ValueType != DynamicValueTypeError {
+				dv.DataFloat /= float64(rangeCellCount(rangeRef))
+			}
+
+		} else if dv.ValueType == DynamicValueTypeArray {
+			dv = average(arrayValues(dv), grid)
+		} else if dv.ValueType != DynamicValueTypeError {
+			dv = convertToFloat(dv)
+
+			// text that isn't a number counts as zero
+			if dv.ValueType == DynamicValueTypeError {
+				continue
+			}
+		}
+
+		if dv.ValueType == DynamicValueTypeError {
+			return dv
 		}
 
 		total += dv.DataFloat
@@ -1205,49 +1023,37 @@ func average(arguments []*DynamicValue, grid *Grid) *DynamicValue {
 	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: total / float64(len(arguments))}
 }
 
+// getDvsFromReferenceRange returns the values of the cells in a range in column major order, cells that
+// were never set are the shared emptyCell
 func getDvsFromReferenceRange(referenceRange ReferenceRange, grid *Grid) []*DynamicValue {
 
-	references := getReferencesFromRange(referenceRange)
+	lowerRow, lowerColumn, upperRow, upperColumn := cellRangeBoundaries(referenceRange.String)
 
 	dvs := []*DynamicValue{}
 
-	for _, ref := range references {
-		dvs = append(dvs, getDataFromRef(ref, grid))
-	}
+	for column := lowerColumn; column <= upperColumn; column++ {
+		for row := lowerRow; row <= upperRow; row++ {
 
-	return dvs
-}
+			dv := getCellValue(makeCellKey(referenceRange.SheetIndex, row, column), grid)
 
-func getReferencesFromRange(referenceRange ReferenceRange) []Reference {
-
-	// get range
-	cells := strings.Split(referenceRange.String, ":")
-
-	column1 := getReferenceColumnIndex(cells[0])
-	row1 := getReferenceRowIndex(cells[0])
-
-	column2 := getReferenceColumnIndex(cells[1])
-	row2 := getReferenceRowIndex(cells[1])
-
-	references := []Reference{}
+			// the formula cell of a spilled array holds the first value
+			if dv.ValueType == DynamicValueTypeArray {
+				dv = arrayFirstValue(dv)
+			}
 
-	for x := column1; x <= column2; x++ {
-		for y := row1; y <= row2; y++ {
-			references = append(references, Reference{String: indexToLetters(x) + strconv.Itoa(y), SheetIndex: referenceRange.SheetIndex})
+			dvs = append(dvs, dv)
 		}
 	}
 
-	return references
-
+	return dvs
 }
 
 func getReferenceColumnIndex(ref string) int {
-	ref = strings.Replace(ref, "$", "", -1)
-	return lettersToIndex(numberOnlyReg.FindAllString(ref, -1)[0])
+	_, column := parseCellString(ref)
+	return column
 }
 func getReferenceRowIndex(ref string) int {
-	ref = strings.Replace(ref, "$", "", -1)
-	row, _ := strconv.Atoi(numberOnlyReg.ReplaceAllString(ref, ""))
+	row, _ := parseCellString(ref)
 	return row
 }
 
@@ -1258,9 +1064,15 @@ func count(arguments []*DynamicValue, grid *Grid) *DynamicValue {
 
 		// check if argument is range
 		if dv.ValueType == DynamicValueTypeReference {
-			dvs := getDvsFromReferenceRange(getRangeReferenceFromString(dv.DataString, dv.SheetIndex, grid), grid)
+			dvs := storedRangeCells(getRangeReferenceFromString(dv.DataString, dv.SheetIndex, grid), grid)
 			dv = count(dvs, grid)
 			countValue += dv.DataFloat
+		} else if dv.ValueType == DynamicValueTypeArray {
+			dv = count(arrayValues(dv), grid)
+			countValue += dv.DataFloat
+		} else if dv.ValueType == DynamicValueTypeError {
+			// errors are not counted
+			continue
 		} else {
 			dv = convertToString(dv)
 		}
@@ -1285,15 +1097,26 @@ func sum(arguments []*DynamicValue, grid *Grid) *DynamicValue {
 
 			if strings.Contains(dv.DataString, ":") {
 				rangeRef := getRangeReferenceFromString(dv.DataString, dv.SheetIndex, grid)
-				dvs = getDvsFromReferenceRange(rangeRef, grid)
+				dvs = storedRangeCells(rangeRef, grid)
 			} else {
-				dvs = []*DynamicValue{getDataFromRef(getReferenceFromString(dv.DataString, dv.SheetIndex, grid), grid)}
+				dvs = []*DynamicValue{getCellValue(getCellKeyFromReference(getReferenceFromString(dv.DataString, dv.SheetIndex, grid)), grid)}
 			}
 
 			dv = sum(dvs, grid)
 
-		} else {
+		} else if dv.ValueType == DynamicValueTypeArray {
+			dv = sum(arrayValues(dv), grid)
+		} else if dv.ValueType != DynamicValueTypeError {
 			dv = convertToFloat(dv)
+
+			// text that isn't a number counts as zero
+			if dv.ValueType == DynamicValueTypeError {
+				continue
+			}
+		}
+
+		if dv.ValueType == DynamicValueTypeError {
+			return dv
 		}
 
 		total += dv.DataFloat
@@ -1302,11 +1125,307 @@ func sum(arguments []*DynamicValue, grid *Grid) *DynamicValue {
 	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: total}
 }
 
+// statisticCells returns the cells of a range or array argument, other arguments are a single cell
+func statisticCells(dv *DynamicValue, grid *Grid) ([]*DynamicValue, *DynamicValue) {
+
+	if dv.ValueType == DynamicValueTypeReference {
+		lookup, errorDv := getLookupRange(dv, grid)
+		if errorDv != nil {
+			return nil, errorDv
+		}
+		return lookup.Dvs, nil
+	}
+
+	if dv.ValueType == DynamicValueTypeArray {
+		return arrayValues(dv), nil
+	}
+
+	return []*DynamicValue{dv}, nil
+}
+
+// statisticValues collects the numbers of the arguments. Like count() empty cells are skipped, as
+// are text and booleans in ranges. Text given directly that isn't a number is a #VALUE! error.
+func statisticValues(function string, arguments []*DynamicValue, grid *Grid) ([]float64, *DynamicValue) {
+
+	values := []float64{}
+
+	for _, dv := range arguments {
+
+		if dv.ValueType == DynamicValueTypeReference || dv.ValueType == DynamicValueTypeArray {
+
+			// only the stored cells of ranges, empty cells are skipped anyway
+			var cells []*DynamicValue
+			if dv.ValueType == DynamicValueTypeReference {
+				referenceRange, errorDv := getRangeArgument(dv, grid)
+				if errorDv != nil {
+					return nil, errorDv
+				}
+				cells = storedRangeCells(referenceRange, grid)
+			} else {
+				cells = arrayValues(dv)
+			}
+
+			cellValues, errorDv := numericValues(cells)
+			if errorDv != nil {
+				return nil, errorDv
+			}
+
+			values = append(values, cellValues...)
+			continue
+		}
+
+		if dv.ValueType == DynamicValueTypeError {
+			return nil, dv
+		}
+
+		if dv.ValueType == DynamicValueTypeString && len(strings.TrimSpace(dv.DataString)) == 0 {
+			continue
+		}
+
+		floatDv := convertToFloat(dv)
+		if floatDv.ValueType == DynamicValueTypeError {
+			return nil, makeErrorDv(ErrorCodeValue, function+" can't use "+dv.DataString+" as a number")
+		}
+
+		values = append(values, floatDv.DataFloat)
+	}
+
+	return values, nil
+}
+
+func minMax(function string, arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	values, errorDv := statisticValues(function, arguments, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	// without numbers the result is 0
+	result := 0.0
+
+	for index, value := range values {
+		if index == 0 || (function == "MAX" && value > result) || (function == "MIN" && value < result) {
+			result = value
+		}
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: result}
+}
+
+// percentileOfSorted interpolates between the closest ranks, k is between 0 and 1
+func percentileOfSorted(values []float64, k float64) float64 {
+
+	position := k * float64(len(values)-1)
+	lower := int(math.Floor(position))
+
+	if lower+1 >= len(values) {
+		return values[len(values)-1]
+	}
+
+	return values[lower] + (position-float64(lower))*(values[lower+1]-values[lower])
+}
+
+func median(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	values, errorDv := statisticValues("MEDIAN", arguments, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	if len(values) == 0 {
+		return makeErrorDv(ErrorCodeNumber, "MEDIAN requires at least one number")
+	}
+
+	sort.Float64s(values)
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: percentileOfSorted(values, 0.5)}
+}
+
+// variance is the sample variance, or the population variance when isPopulation is set
+func variance(values []float64, isPopulation bool) float64 {
+
+	mean := 0.0
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+
+	squares := 0.0
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+
+	if isPopulation {
+		return squares / float64(len(values))
+	}
+	return squares / float64(len(values)-1)
+}
+
+// VAR and STDEV use a sample, VAR.P and STDEV.P the whole population
+func varianceFunc(function string, arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	values, errorDv := statisticValues(function, arguments, grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	isPopulation := strings.HasSuffix(function, "P")
+
+	if len(values) == 0 || (!isPopulation && len(values) == 1) {
+		return makeErrorDv(ErrorCodeDivisionByZero, function+" doesn't have enough numbers")
+	}
+
+	result := variance(values, isPopulation)
+	if strings.HasPrefix(function, "STDEV") {
+		result = math.Sqrt(result)
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: result}
+}
+
+// PERCENTILE(range, k) with k between 0 and 1 and QUARTILE(range, quart) with quart from 0 to 4
+func percentile(function string, arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	values, errorDv := statisticValues(function, arguments[0:1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	kDv := convertToFloat(arguments[1])
+	if kDv.ValueType == DynamicValueTypeError {
+		return kDv
+	}
+	k := kDv.DataFloat
+
+	if strings.HasPrefix(function, "QUARTILE") {
+		if k < 0 || k > 4 {
+			return makeErrorDv(ErrorCodeNumber, function+" requires a quartile from 0 to 4")
+		}
+		k = math.Floor(k) / 4
+	}
+
+	if k < 0 || k > 1 {
+		return makeErrorDv(ErrorCodeNumber, function+" requires k to be between 0 and 1")
+	}
+	if len(values) == 0 {
+		return makeErrorDv(ErrorCodeNumber, function+" requires at least one number")
+	}
+
+	sort.Float64s(values)
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: percentileOfSorted(values, k)}
+}
+
+// CORREL(range1, range2) uses the pairs of cells that both hold a number
+func correl(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	xCells, errorDv := statisticCells(arguments[0], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+	yCells, errorDv := statisticCells(arguments[1], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	if len(xCells) != len(yCells) {
+		return makeErrorDv(ErrorCodeNotAvailable, "CORREL ranges need to be the same size")
+	}
+
+	xValues := []float64{}
+	yValues := []float64{}
+
+	for index := range xCells {
+
+		pair, errorDv := numericValues([]*DynamicValue{xCells[index], yCells[index]})
+		if errorDv != nil {
+			return errorDv
+		}
+
+		if len(pair) == 2 {
+			xValues = append(xValues, pair[0])
+			yValues = append(yValues, pair[1])
+		}
+	}
+
+	if len(xValues) < 2 {
+		return makeErrorDv(ErrorCodeDivisionByZero, "CORREL requires at least two pairs of numbers")
+	}
+
+	xMean, yMean := 0.0, 0.0
+	for index := range xValues {
+		xMean += xValues[index]
+		yMean += yValues[index]
+	}
+	xMean /= float64(len(xValues))
+	yMean /= float64(len(yValues))
+
+	covariance, xSquares, ySquares := 0.0, 0.0, 0.0
+	for index := range xValues {
+		covariance += (xValues[index] - xMean) * (yValues[index] - yMean)
+		xSquares += (xValues[index] - xMean) * (xValues[index] - xMean)
+		ySquares += (yValues[index] - yMean) * (yValues[index] - yMean)
+	}
+
+	if xSquares == 0 || ySquares == 0 {
+		return makeErrorDv(ErrorCodeDivisionByZero, "CORREL is undefined when a range doesn't vary")
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: covariance / math.Sqrt(xSquares*ySquares)}
+}
+
+// RANK(number, range, [order]) ranks descending by default, an order other than 0 ranks ascending.
+// Equal numbers get the same rank.
+func rank(arguments []*DynamicValue, grid *Grid) *DynamicValue {
+
+	numberDv := convertToFloat(arguments[0])
+	if numberDv.ValueType == DynamicValueTypeError {
+		return numberDv
+	}
+
+	if arguments[1].ValueType != DynamicValueTypeReference && arguments[1].ValueType != DynamicValueTypeArray {
+		return makeErrorDv(ErrorCodeValue, "RANK requires a range to rank in")
+	}
+
+	values, errorDv := statisticValues("RANK", arguments[1:2], grid)
+	if errorDv != nil {
+		return errorDv
+	}
+
+	isAscending := false
+	if len(arguments) == 3 {
+		order, errorDv := integerArgument(arguments[2])
+		if errorDv != nil {
+			return errorDv
+		}
+		isAscending = order != 0
+	}
+
+	position := 1
+	isFound := false
+
+	for _, value := range values {
+		if value == numberDv.DataFloat {
+			isFound = true
+		} else if (isAscending && value < numberDv.DataFloat) || (!isAscending && value > numberDv.DataFloat) {
+			position++
+		}
+	}
+
+	if !isFound {
+		return makeErrorDv(ErrorCodeNotAvailable, "RANK couldn't find "+convertToString(numberDv).DataString+" in the range")
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(position)}
+}
+
 func ifFunc(arguments []*DynamicValue) *DynamicValue {
 
-	if len(arguments) != 3 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "IF requires 3 params"}
+	// only the branch that is taken can make the result an error
+	if arguments[0].ValueType == DynamicValueTypeError {
+		return arguments[0]
 	}
+
 	if arguments[0].ValueType != DynamicValueTypeBool {
 		arguments[0] = convertToBool(arguments[0])
 	}
@@ -1319,11 +1438,27 @@ func ifFunc(arguments []*DynamicValue) *DynamicValue {
 
 }
 
-func mathConstant(arguments []*DynamicValue) *DynamicValue {
+func ifError(arguments []*DynamicValue) *DynamicValue {
 
-	if len(arguments) != 1 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "MATH.C only takes one argument"}
+	if arguments[0].ValueType == DynamicValueTypeError {
+		return arguments[1]
 	}
+	return arguments[0]
+}
+
+func isError(arguments []*DynamicValue) *DynamicValue {
+
+	return &DynamicValue{ValueType: DynamicValueTypeBool, DataBool: arguments[0].ValueType == DynamicValueTypeError}
+}
+
+func isNotAvailable(arguments []*DynamicValue) *DynamicValue {
+
+	dv := arguments[0]
+
+	return &DynamicValue{ValueType: DynamicValueTypeBool, DataBool: dv.ValueType == DynamicValueTypeError && dv.DataString == ErrorCodeNotAvailable}
+}
+
+func mathConstant(arguments []*DynamicValue) *DynamicValue {
 
 	switch constant := arguments[0].DataString; constant {
 	case "e", "E":
@@ -1333,16 +1468,20 @@ func mathConstant(arguments []*DynamicValue) *DynamicValue {
 	}
 
 	// couldn't find constant (didn't return before)
-	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "constant requested not found: " + arguments[0].DataString}
+	return makeErrorDv(ErrorCodeValue, "constant requested not found: "+arguments[0].DataString)
 
 }
 
 func sqrt(arguments []*DynamicValue) *DynamicValue {
-	if len(arguments) != 1 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "SQRT only takes one argument"}
-	}
 
 	floatDv := convertToFloat(arguments[0])
+	if floatDv.ValueType == DynamicValueTypeError {
+		return floatDv
+	}
+
+	if floatDv.DataFloat < 0 {
+		return makeErrorDv(ErrorCodeNumber, "SQRT of a negative number")
+	}
 
 	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: math.Sqrt(floatDv.DataFloat)}
 }
@@ -1360,20 +1499,15 @@ func concatenate(arguments []*DynamicValue) *DynamicValue {
 }
 func number(arguments []*DynamicValue) *DynamicValue {
 
-	if len(arguments) != 1 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "NUMBER only supports one argument"}
-	}
-
 	return convertToFloat(arguments[0])
 }
 
 func floor(arguments []*DynamicValue) *DynamicValue {
 
-	if len(arguments) != 1 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "FLOOR only supports one argument"}
-	}
-
 	dv := convertToFloat(arguments[0])
+	if dv.ValueType == DynamicValueTypeError {
+		return dv
+	}
 
 	dv.DataFloat = math.Floor(dv.DataFloat)
 	dv.ValueType = DynamicValueTypeFloat
@@ -1383,11 +1517,10 @@ func floor(arguments []*DynamicValue) *DynamicValue {
 
 func ceil(arguments []*DynamicValue) *DynamicValue {
 
-	if len(arguments) != 1 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "CEIL only supports one argument"}
-	}
-
 	dv := convertToFloat(arguments[0])
+	if dv.ValueType == DynamicValueTypeError {
+		return dv
+	}
 
 	dv.DataFloat = math.Ceil(dv.DataFloat)
 	return dv
@@ -1395,13 +1528,344 @@ func ceil(arguments []*DynamicValue) *DynamicValue {
 
 func length(arguments []*DynamicValue) *DynamicValue {
 
-	if len(arguments) != 1 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "LEN only supports one argument"}
+	stringValue := convertToString(arguments[0]).DataString
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(utf8.RuneCountInString(stringValue))}
+}
+
+// text functions work on characters (runes), not bytes
+
+func textArgument(dv *DynamicValue) string {
+	return convertToString(dv).DataString
+}
+
+// LEFT(text, [count]) and RIGHT(text, [count])
+func leftRight(function string, arguments []*DynamicValue) *DynamicValue {
+
+	runes := []rune(textArgument(arguments[0]))
+
+	count := 1
+	if len(arguments) == 2 {
+		var errorDv *DynamicValue
+		count, errorDv = integerArgument(arguments[1])
+		if errorDv != nil {
+			return errorDv
+		}
 	}
 
-	stringValue := convertToString(arguments[0]).DataString
+	if count < 0 {
+		return makeErrorDv(ErrorCodeValue, function+" count can't be negative")
+	}
+	if count > len(runes) {
+		count = len(runes)
+	}
+
+	if function == "LEFT" {
+		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: string(runes[:count])}
+	}
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: string(runes[len(runes)-count:])}
+}
+
+// MID(text, start, count)
+func mid(arguments []*DynamicValue) *DynamicValue {
+
+	runes := []rune(textArgument(arguments[0]))
+
+	start, errorDv := integerArgument(arguments[1])
+	if errorDv != nil {
+		return errorDv
+	}
+	count, errorDv := integerArgument(arguments[2])
+	if errorDv != nil {
+		return errorDv
+	}
+
+	if start < 1 || count < 0 {
+		return makeErrorDv(ErrorCodeValue, "MID requires a start of at least 1 and a positive count")
+	}
+
+	if start > len(runes) {
+		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: ""}
+	}
+
+	end := start - 1 + count
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: string(runes[start-1 : end])}
+}
+
+// FIND(search, text, [start]) is case sensitive, SEARCH(search, text, [start]) is
+// case insensitive and supports wildcards. Both return the 1 based character position.
+func findText(function string, arguments []*DynamicValue) *DynamicValue {
+
+	search := textArgument(arguments[0])
+	runes := []rune(textArgument(arguments[1]))
+
+	start := 1
+	if len(arguments) == 3 {
+		var errorDv *DynamicValue
+		start, errorDv = integerArgument(arguments[2])
+		if errorDv != nil {
+			return errorDv
+		}
+	}
+
+	if start < 1 || start > len(runes)+1 {
+		return makeErrorDv(ErrorCodeValue, function+" start is outside of the text")
+	}
+
+	text := string(runes[start-1:])
+
+	byteIndex := -1
+	if function == "FIND" {
+		byteIndex = strings.Index(text, search)
+	} else {
+		searchRegex, err := regexp.Compile("(?is)" + wildcardToRegex(search))
+		if err == nil {
+			if location := searchRegex.FindStringIndex(text); location != nil {
+				byteIndex = location[0]
+			}
+		}
+	}
+
+	if byteIndex == -1 {
+		return makeErrorDv(ErrorCodeValue, function+" couldn't find "+search)
+	}
+
+	position := start + utf8.RuneCountInString(text[:byteIndex])
+
+	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(position)}
+}
+
+// wildcardToRegex converts a pattern with *, ? and ~ escapes to a regular expression
+func wildcardToRegex(pattern string) string {
+
+	var buff bytes.Buffer
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			buff.WriteString(".*?")
+		case '?':
+			buff.WriteString(".")
+		case '~':
+			if i+1 < len(runes) {
+				i++
+			}
+			buff.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			buff.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+
+	return buff.String()
+}
+
+// SUBSTITUTE(text, old, new, [instance]) replaces all occurrences, or only the given one
+func substitute(arguments []*DynamicValue) *DynamicValue {
+
+	text := textArgument(arguments[0])
+	oldText := textArgument(arguments[1])
+	newText := textArgument(arguments[2])
+
+	if len(oldText) == 0 {
+		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: text}
+	}
+
+	if len(arguments) == 3 {
+		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: strings.Replace(text, oldText, newText, -1)}
+	}
+
+	instance, errorDv := integerArgument(arguments[3])
+	if errorDv != nil {
+		return errorDv
+	}
+	if instance < 1 {
+		return makeErrorDv(ErrorCodeValue, "SUBSTITUTE instance must be at least 1")
+	}
+
+	offset := 0
+	for i := 1; ; i++ {
+		index := strings.Index(text[offset:], oldText)
+		if index == -1 {
+			break
+		}
+		if i == instance {
+			text = text[:offset+index] + newText + text[offset+index+len(oldText):]
+			break
+		}
+		offset += index + len(oldText)
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: text}
+}
+
+// TRIM removes leading and trailing spaces and collapses repeated spaces
+func trim(arguments []*DynamicValue) *DynamicValue {
+
+	words := []string{}
+	for _, word := range strings.Split(textArgument(arguments[0]), " ") {
+		if len(word) > 0 {
+			words = append(words, word)
+		}
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: strings.Join(words, " ")}
+}
+
+func changeCase(function string, arguments []*DynamicValue) *DynamicValue {
+
+	text := textArgument(arguments[0])
+	if function == "UPPER" {
+		text = strings.ToUpper(text)
+	} else {
+		text = strings.ToLower(text)
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: text}
+}
 
-	return &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64(len(stringValue))}
+// TEXT(value, format) formats a number with a number format like "#,##0.00"
+func textFunc(arguments []*DynamicValue) *DynamicValue {
+	return formatValue(arguments[0], textArgument(arguments[1]))
+}
+
+// formatValue formats a number or date with a number format, text that isn't a number is returned as is
+func formatValue(value *DynamicValue, format string) *DynamicValue {
+
+	if value.ValueType == DynamicValueTypeDate || (value.ValueType == DynamicValueTypeFloat && isDateFormat(format)) {
+		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: formatDateWithPattern(value.DataFloat, format)}
+	}
+
+	// text that isn't a number is returned as is
+	if value.ValueType == DynamicValueTypeString {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(value.DataString), 64); err != nil {
+			return value
+		}
+	}
+
+	floatDv := convertToFloat(value)
+	if floatDv.ValueType == DynamicValueTypeError {
+		return floatDv
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: formatNumber(floatDv.DataFloat, format)}
+}
+
+// SPLIT(text, delimiter, [split_by_each], [remove_empty]) returns a row of parts. By default
+// every character of delimiter splits the text and empty parts are removed.
+func split(arguments []*DynamicValue) *DynamicValue {
+
+	text := textArgument(arguments[0])
+	delimiter := textArgument(arguments[1])
+
+	if len(delimiter) == 0 {
+		return makeErrorDv(ErrorCodeValue, "SPLIT requires a delimiter")
+	}
+
+	splitByEach := true
+	if len(arguments) > 2 {
+		splitByEach = convertToBool(arguments[2]).DataBool
+	}
+	removeEmpty := true
+	if len(arguments) > 3 {
+		removeEmpty = convertToBool(arguments[3]).DataBool
+	}
+
+	var parts []string
+	if splitByEach {
+		parts = strings.FieldsFunc(text, func(r rune) bool {
+			return strings.ContainsRune(delimiter, r)
+		})
+
+		// FieldsFunc drops empty parts, split manually when they should be kept
+		if !removeEmpty {
+			parts = []string{}
+			start := 0
+			for index, r := range text {
+				if strings.ContainsRune(delimiter, r) {
+					parts = append(parts, text[start:index])
+					start = index + utf8.RuneLen(r)
+				}
+			}
+			parts = append(parts, text[start:])
+		}
+	} else {
+		parts = strings.Split(text, delimiter)
+	}
+
+	row := []*DynamicValue{}
+	for _, part := range parts {
+		if removeEmpty && len(part) == 0 {
+			continue
+		}
+		row = append(row, &DynamicValue{ValueType: DynamicValueTypeString, DataString: part})
+	}
+
+	if len(row) == 0 {
+		return makeErrorDv(ErrorCodeValue, "SPLIT has no parts")
+	}
+
+	return makeArrayDv([][]*DynamicValue{row})
+}
+
+var regexCache = make(map[string]*regexp.Regexp)
+var regexCacheMutex sync.Mutex
+
+// compileRegex caches compiled expressions since the same pattern is usually used on many rows
+func compileRegex(function string, pattern string) (*regexp.Regexp, *DynamicValue) {
+
+	regexCacheMutex.Lock()
+	defer regexCacheMutex.Unlock()
+
+	if compiled, ok := regexCache[pattern]; ok {
+		return compiled, nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, makeErrorDv(ErrorCodeValue, function+" invalid regular expression: "+err.Error())
+	}
+
+	// arbitrary bound to keep the cache small
+	if len(regexCache) > 1000 {
+		regexCache = make(map[string]*regexp.Regexp)
+	}
+	regexCache[pattern] = compiled
+
+	return compiled, nil
+}
+
+// REGEXMATCH(text, regex), REGEXEXTRACT(text, regex) and REGEXREPLACE(text, regex, replacement)
+func regexFunction(function string, arguments []*DynamicValue) *DynamicValue {
+
+	text := textArgument(arguments[0])
+
+	compiled, errorDv := compileRegex(function, textArgument(arguments[1]))
+	if errorDv != nil {
+		return errorDv
+	}
+
+	switch function {
+	case "REGEXMATCH":
+		return &DynamicValue{ValueType: DynamicValueTypeBool, DataBool: compiled.MatchString(text)}
+	case "REGEXEXTRACT":
+		match := compiled.FindStringSubmatch(text)
+		if match == nil {
+			return makeErrorDv(ErrorCodeNotAvailable, "REGEXEXTRACT found no match")
+		}
+
+		// return the first capture group when there is one
+		if len(match) > 1 {
+			return &DynamicValue{ValueType: DynamicValueTypeString, DataString: match[1]}
+		}
+		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: match[0]}
+	default:
+		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: compiled.ReplaceAllString(text, textArgument(arguments[2]))}
+	}
 }
 
 func random() *DynamicValue {
@@ -1553,12 +2017,12 @@ func explosionSetValue(ref Reference, dataDv *DynamicValue, grid *Grid) {
 
 	OriginalDependOut := getDataFromRef(ref, grid).DependOut
 
-	dataDv.DependIn = make(map[string]bool) // new dependin (new formula)
-	dataDv.DependOut = OriginalDependOut    // dependout remain
+	dataDv.DependIn = make(map[CellKey]bool) // new dependin (new formula)
+	dataDv.DependOut = OriginalDependOut     // dependout remain
 
 	// TODO for now add formula so re-compute succeeds: later optimize for performance
 	if dataDv.ValueType == DynamicValueTypeString {
-		dataDv.DataFormula = "\"" + dataDv.DataString + "\""
+		dataDv.DataFormula = formulaStringLiteral(dataDv.DataString)
 	} else if dataDv.ValueType == DynamicValueTypeFloat {
 		dataDv.DataFormula = strconv.FormatFloat(dataDv.DataFloat, 'f', -1, 64)
 	} else if dataDv.ValueType == DynamicValueTypeBool {
@@ -1571,114 +2035,70 @@ func explosionSetValue(ref Reference, dataDv *DynamicValue, grid *Grid) {
 	setDataByRef(ref, setDependencies(ref, dataDv, grid), grid)
 }
 
-func vlookup(arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
-	if len(arguments) != 3 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "VLOOKUP only supports 3 arguments"}
+func abs(arguments []*DynamicValue) *DynamicValue {
+	dv := arguments[0]
+	dv = convertToFloat(dv)
+	if dv.ValueType == DynamicValueTypeError {
+		return dv
 	}
+	dv.DataFloat = math.Abs(dv.DataFloat)
+	return dv
+}
 
-	stringSearchValue := convertToString(arguments[0])
-
-	vlookupRange := getRangeReferenceFromString(arguments[1].DataString, targetRef.SheetIndex, grid)
-
-	// now take only the first column
-	rangeReferences := strings.Split(vlookupRange.String, ":")
-	firstReference := rangeReferences[0]
-	secondReference := rangeReferences[1]
-
-	searchRangeColumn := getReferenceColumnIndex(firstReference)
-	searchRangeStartRow := getReferenceRowIndex(firstReference)
-	searchRangeEndRow := getReferenceRowIndex(secondReference)
-
-	searchRange := ReferenceRange{String: indexesToReferenceString(searchRangeStartRow, searchRangeColumn) + ":" + indexesToReferenceString(searchRangeEndRow, searchRangeColumn), SheetIndex: vlookupRange.SheetIndex}
+// callPython evaluates a function that isn't native with Python
+func callPython(command string, arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
 
-	rangeDvs := getDvsFromReferenceRange(searchRange, grid)
+	// error values in arguments propagate
+	for _, dv := range arguments {
+		if dv.ValueType == DynamicValueTypeError {
+			return dv
+		}
+	}
 
-	returnColumnIndex := int(arguments[2].DataFloat) - 1
+	argumentStrings := []string{}
 
-	for index, dv := range rangeDvs {
-		checkStringValue := convertToString(dv)
+	for _, dv := range arguments {
+		stringDv := convertToString(dv)
+		argumentStrings = append(argumentStrings, stringDv.DataString)
+	}
 
-		if checkStringValue.DataString == stringSearchValue.DataString {
+	// there is a single interpreter, so one call at a time even when cells are computed concurrently
+	pythonResult := pythonCall(command, argumentStrings, grid)
 
-			stringMapReference := strconv.Itoa(int(vlookupRange.SheetIndex)) + "!" + indexesToReferenceString(searchRangeStartRow+index, searchRangeColumn+returnColumnIndex)
+	// fmt.Println("Received message from Python to return parse()")
+	newDv := DynamicValue{ValueType: DynamicValueTypeFormula, DataFormula: pythonResult}
 
-			return copyDv(getDataByNormalRef(stringMapReference, grid))
-		}
+	// lists spill like other array results
+	if strings.HasPrefix(pythonResult, pythonArrayPrefix) {
+		arrayDv := pythonArrayResult(pythonResult)
+		arrayDv.SheetIndex = targetRef.SheetIndex
+		return arrayDv
 	}
-	notFoundDv := makeEmptyDv()
-	notFoundDv.DataString = "#NOTFOUND"
-	return notFoundDv
-}
 
-func abs(arguments []*DynamicValue) *DynamicValue {
-	if len(arguments) != 1 {
-		return &DynamicValue{ValueType: DynamicValueTypeString, DataString: "ABS only supports one argument"}
+	// Python doesn't escape quotes in returned strings, take those over verbatim
+	if !isValidFormula(pythonResult) && len(pythonResult) > 1 && strings.HasPrefix(pythonResult, "\"") && strings.HasSuffix(pythonResult, "\"") {
+		return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeString, DataString: pythonResult[1 : len(pythonResult)-1]}
 	}
-	dv := arguments[0]
-	dv = convertToFloat(dv)
-	dv.DataFloat = math.Abs(dv.DataFloat)
-	return dv
+
+	return parse(&newDv, grid, targetRef)
 }
-func executeCommand(command string, arguments []*DynamicValue, grid *Grid, targetRef Reference) *DynamicValue {
-
-	switch command := command; command {
-	case "SUM":
-		return sum(arguments, grid)
-	case "AVERAGE":
-		return average(arguments, grid)
-	case "IF":
-		return ifFunc(arguments)
-	case "MATHC":
-		return mathConstant(arguments)
-	case "SQRT":
-		return sqrt(arguments)
-	case "CONCATENATE", "CONCAT":
-		return concatenate(arguments)
-	case "NUMBER":
-		return number(arguments)
-	case "LEN":
-		return length(arguments)
-	case "COUNT":
-		return count(arguments, grid)
-	case "RAND":
-		return random()
-	case "FLOOR":
-		return floor(arguments)
-	case "CEIL":
-		return ceil(arguments)
-	case "ABS":
-		return abs(arguments)
-	case "VLOOKUP":
-		return vlookup(arguments, grid, targetRef)
-	case "OLS":
-		return olsExplosive(arguments, grid, targetRef)
-	default:
 
-		argumentStrings := []string{}
+var pythonCallMutex sync.Mutex
 
-		for _, dv := range arguments {
-			stringDv := convertToString(dv)
-			argumentStrings = append(argumentStrings, stringDv.DataString)
-		}
+// pythonCall sends a function call to the Python interpreter and waits for its result
+func pythonCall(command string, argumentStrings []string, grid *Grid) string {
 
-		// send command to Python
-		if len(arguments) != 0 {
-			grid.PythonClient <- "parseCall(\"" + command + "\", \"" + strings.Join(argumentStrings, "\",\"") + "\")"
-		} else {
-			grid.PythonClient <- "parseCall(\"" + command + "\")"
-		}
-		// fmt.Println("Posted message to Python CMD")
-
-		// loop until result is back
-		for {
-			select {
-			case pythonResult := <-grid.PythonResultChannel:
-				// fmt.Println("Received message from Python to return parse()")
-				newDv := DynamicValue{ValueType: DynamicValueTypeFormula, DataFormula: pythonResult}
-				return parse(&newDv, grid, targetRef)
-			}
-		}
+	pythonCallMutex.Lock()
+	defer pythonCallMutex.Unlock()
 
+	// send command to Python
+	if len(argumentStrings) != 0 {
+		grid.PythonClient <- "parseCall(\"" + command + "\", \"" + strings.Join(argumentStrings, "\",\"") + "\")"
+	} else {
+		grid.PythonClient <- "parseCall(\"" + command + "\")"
 	}
+	// fmt.Println("Posted message to Python CMD")
 
+	// wait until result is back
+	return <-grid.PythonResultChannel
 }
@@ -185,20 +185,28 @@ func parsePythonOutput(bufferHolder bytes.Buffer, pythonIn io.WriteCloser, c *Cl
 					// data receive request
 					cellRangeString := newString[6:]
 
-					cells := cellRangeToCells(getReferenceRangeFromMapIndex(cellRangeString))
+					cells := cellRangeToCells(getReferenceRangeFromMapIndex(cellRangeString, c.grid))
 
 					var commandBuf bytes.Buffer
 
 					for _, e := range cells {
 
 						valueDv := getDataFromRef(e, c.grid)
+						// cells that don't fit in a key would be read from another sheet
+						if getCellKeyFromReference(e) == noCellKey {
+							valueDv = makeErrorDv(ErrorCodeReference, "Invalid reference: "+e.String)
+						}
+						if valueDv.ValueType == DynamicValueTypeArray {
+							valueDv = arrayFirstValue(valueDv)
+						}
 						value := convertToString(valueDv).DataString
 						// for each cell get data
 						commandBuf.WriteString("sheet_data[\"")
-						commandBuf.WriteString(getMapIndexFromReference(e))
+						commandBuf.WriteString(getSheetPositionString(e.SheetIndex, c.grid) + "!" + e.String)
 						commandBuf.WriteString("\"] = ")
 
-						if valueDv.ValueType == DynamicValueTypeString {
+						// error values are passed to Python as their error code and dates as ISO 8601 strings
+						if valueDv.ValueType == DynamicValueTypeString || valueDv.ValueType == DynamicValueTypeError || valueDv.ValueType == DynamicValueTypeDate {
 							commandBuf.WriteString("\"")
 
 							escapedStringValue := strings.Replace(value, "\"", "\\\"", -1)
@@ -38,16 +38,54 @@ def parseCall(*arg):
         else:
             eval_result = eval(arg[0] + "()")
 
-        if isinstance(eval_result, numbers.Number) and not isinstance(eval_result, bool):
+        if isinstance(eval_result, (list, tuple, np.ndarray, pd.Series, pd.DataFrame)):
+            # lists spill into the cells next to the formula
+            result = "#ARRAY#" + json.dumps(array_rows(eval_result))
+        elif isinstance(eval_result, numbers.Number) and not isinstance(eval_result, bool):
             result = str(eval_result)
         else:
             result = "\"" + str(eval_result) + "\""
         
-    except (RuntimeError, TypeError, NameError):
-        result = "\"" + "Unexpected error:" + str(sys.exc_info()) + "\""
+    except NameError:
+        # unknown function
+        traceback.print_exc()
+        result = "#NAME?"
+    except Exception:
+        traceback.print_exc()
+        result = "#VALUE!"
         
     real_print("#PYTHONFUNCTION#"+result+"#ENDPARSE#", flush=True, end='')
 
+def volatile(function):
+    # cells calling a volatile function are recalculated on every recalculation, like RAND()
+    data = {'arguments': ['VOLATILE-FUNCTION', function.__name__]}
+    real_print(''.join(['#PARSE#', json.dumps(data), '#ENDPARSE#']), flush=True, end='')
+    return function
+
+def array_value(value):
+    if isinstance(value, np.generic):
+        value = value.item()
+    if value is None or (isinstance(value, float) and np.isnan(value)):
+        return ""
+    if isinstance(value, (bool, int, float, str)):
+        return value
+    return str(value)
+
+def array_rows(value):
+    # a flat list is a column, nested lists are rows
+    if isinstance(value, pd.DataFrame):
+        value = value.values.tolist()
+    elif isinstance(value, (np.ndarray, pd.Series)):
+        value = value.tolist()
+
+    rows = []
+    for row in value:
+        if isinstance(row, (list, tuple, np.ndarray)):
+            rows.append([array_value(v) for v in row])
+        else:
+            rows.append([array_value(row)])
+    return rows
+
 def cell(cell, value = None):
     if value is not None:
         # set value
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Whole columns (A:C) and whole rows (3:5) are resolved against the size of their sheet when
+// they're evaluated. They aren't expanded into cells for dependency tracking: the cells using
+// them are kept per range in grid.RangeDependents, keyed like "0!A:C", and a cell that becomes
+// dirty makes the dependents of the whole ranges containing it dirty too.
+
+type wholeRange struct {
+	SheetIndex SheetID
+	IsColumn   bool
+	Lower      int
+	Upper      int
+}
+
+// splitWholeRange splits a whole range like Sheet1!$A:C into its sheet prefix (including the !) and its ends
+func splitWholeRange(rangeString string) (string, []string) {
+
+	prefix := ""
+
+	if index := strings.LastIndex(rangeString, "!"); index != -1 {
+		prefix = rangeString[:index+1]
+		rangeString = rangeString[index+1:]
+	}
+
+	return prefix, strings.Split(rangeString, ":")
+}
+
+func isWholeRangeString(rangeString string) bool {
+
+	_, ends := splitWholeRange(rangeString)
+	if len(ends) != 2 {
+		return false
+	}
+
+	isColumn := columnReferenceRegex.MatchString(ends[0]) && columnReferenceRegex.MatchString(ends[1])
+	isRow := rowReferenceRegex.MatchString(ends[0]) && rowReferenceRegex.MatchString(ends[1])
+
+	return isColumn || isRow
+}
+
+func wholeRangeIndex(end string, isColumn bool) int {
+
+	end = strings.Replace(end, "$", "", -1)
+
+	if isColumn {
+		return lettersToIndex(end)
+	}
+
+	index, _ := strconv.Atoi(end)
+	return index
+}
+
+func makeWholeRange(ends []string, sheetIndex SheetID) wholeRange {
+
+	r := wholeRange{SheetIndex: sheetIndex, IsColumn: columnReferenceRegex.MatchString(ends[0])}
+	r.Lower = wholeRangeIndex(ends[0], r.IsColumn)
+	r.Upper = wholeRangeIndex(ends[1], r.IsColumn)
+
+	// C:A is the same range as A:C
+	if r.Lower > r.Upper {
+		r.Lower, r.Upper = r.Upper, r.Lower
+	}
+
+	return r
+}
+
+// parseWholeRange parses a whole range from a formula, sheetIndex is used when it has no sheet
+func parseWholeRange(rangeString string, sheetIndex SheetID, grid *Grid) wholeRange {
+
+	prefix, ends := splitWholeRange(rangeString)
+
+	if len(prefix) > 0 {
+		sheetIndex = grid.SheetNames[strings.Replace(strings.TrimSuffix(prefix, "!"), "'", "", -1)]
+	}
+
+	return makeWholeRange(ends, sheetIndex)
+}
+
+func wholeRangeFromKey(key string) wholeRange {
+
+	prefix, ends := splitWholeRange(key)
+	sheetIndex, _ := strconv.Atoi(strings.TrimSuffix(prefix, "!"))
+
+	return makeWholeRange(ends, SheetID(sheetIndex))
+}
+
+func formatWholeRangeEnd(index int, isColumn bool, isFixed bool) string {
+
+	end := strconv.Itoa(index)
+	if isColumn {
+		end = indexToLetters(index)
+	}
+
+	if isFixed {
+		return "$" + end
+	}
+	return end
+}
+
+func (r wholeRange) key() string {
+	return strconv.Itoa(int(r.SheetIndex)) + "!" + formatWholeRangeEnd(r.Lower, r.IsColumn, false) + ":" + formatWholeRangeEnd(r.Upper, r.IsColumn, false)
+}
+
+func (r wholeRange) contains(key CellKey) bool {
+
+	if key.SheetIndex() != r.SheetIndex {
+		return false
+	}
+
+	index := key.Row()
+	if r.IsColumn {
+		index = key.Column()
+	}
+
+	return index >= r.Lower && index <= r.Upper
+}
+
+// fits checks whether the range lies within the current size of its sheet
+func (r wholeRange) fits(grid *Grid) bool {
+
+	sheetSize := getSheetSize(r.SheetIndex, grid)
+
+	if r.IsColumn {
+		return r.Lower >= 1 && r.Upper <= sheetSize.ColumnCount
+	}
+	return r.Lower >= 1 && r.Upper <= sheetSize.RowCount
+}
+
+// boundedString returns the range as a regular range up to the edge of the sheet, e.g. A1:C1000
+func (r wholeRange) boundedString(grid *Grid) string {
+
+	sheetSize := getSheetSize(r.SheetIndex, grid)
+
+	if r.IsColumn {
+		return indexesToReferenceString(1, r.Lower) + ":" + indexesToReferenceString(sheetSize.RowCount, r.Upper)
+	}
+	return indexesToReferenceString(r.Lower, 1) + ":" + indexesToReferenceString(r.Upper, sheetSize.ColumnCount)
+}
+
+// evaluateWholeRange resolves a whole range to a range reference for functions to expand
+func evaluateWholeRange(rangeString string, grid *Grid, targetRef Reference) *DynamicValue {
+
+	if !sheetExistsForReferenceString(rangeString, grid) {
+		errorDv := makeErrorDv(ErrorCodeReference, "Invalid reference: "+rangeString)
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	r := parseWholeRange(rangeString, targetRef.SheetIndex, grid)
+
+	if !r.fits(grid) {
+		errorDv := makeErrorDv(ErrorCodeReference, "Range is outside of the sheet: "+rangeString)
+		errorDv.SheetIndex = targetRef.SheetIndex
+		return errorDv
+	}
+
+	boundedRange := ReferenceRange{String: r.boundedString(grid), SheetIndex: r.SheetIndex}
+
+	return &DynamicValue{SheetIndex: targetRef.SheetIndex, ValueType: DynamicValueTypeReference, DataString: referenceRangeToRelativeString(boundedRange, targetRef.SheetIndex, grid)}
+}
+
+func findWholeRangeStrings(formula string) []string {
+
+	rangeStrings := []string{}
+
+	tokens, err := tokenizeFormula(formula)
+	if err != nil {
+		return rangeStrings
+	}
+
+	for _, token := range tokens {
+		if token.Kind == formulaTokenWholeRange {
+			rangeStrings = append(rangeStrings, token.Text)
+		}
+	}
+
+	return rangeStrings
+}
+
+// findWholeRanges returns the keys of the whole ranges a formula uses, directly or through defined names
+func findWholeRanges(formula string, sheetIndex SheetID, grid *Grid) map[string]bool {
+
+	keys := make(map[string]bool)
+
+	formulas := []string{formula}
+	for _, definition := range usedDefinitions(formula, grid) {
+		formulas = append(formulas, definition.Formula)
+	}
+
+	for _, usedFormula := range formulas {
+		for _, rangeString := range findWholeRangeStrings(usedFormula) {
+			if sheetExistsForReferenceString(rangeString, grid) {
+				keys[parseWholeRange(rangeString, sheetIndex, grid).key()] = true
+			}
+		}
+	}
+
+	return keys
+}
+
+// setRangeDependencies registers the cell at reference as a dependent of the whole ranges its formula uses
+func setRangeDependencies(reference Reference, dv *DynamicValue, grid *Grid) {
+
+	index := getCellKeyFromReference(reference)
+
+	for key, dependents := range grid.RangeDependents {
+		delete(dependents, index)
+		if len(dependents) == 0 {
+			delete(grid.RangeDependents, key)
+		}
+	}
+
+	// explosiveFormulas never have dependencies
+	if dv.ValueType == DynamicValueTypeExplosiveFormula {
+		return
+	}
+
+	for key := range findWholeRanges(dv.DataFormula, reference.SheetIndex, grid) {
+		if _, ok := grid.RangeDependents[key]; !ok {
+			grid.RangeDependents[key] = make(map[CellKey]bool)
+		}
+		grid.RangeDependents[key][index] = true
+	}
+}
+
+// wholeRangeDependents returns the cells that use a whole range containing the cell at index
+func wholeRangeDependents(index CellKey, grid *Grid) []CellKey {
+
+	dependents := []CellKey{}
+
+	for key, rangeDependents := range grid.RangeDependents {
+		if wholeRangeFromKey(key).contains(index) {
+			for dependent := range rangeDependents {
+				dependents = append(dependents, dependent)
+			}
+		}
+	}
+
+	return dependents
+}
+
+// markWholeRangeDependentsDirty recomputes the cells using whole ranges of a sheet, for when its size changes
+func markWholeRangeDependentsDirty(sheetIndex SheetID, grid *Grid) {
+	for key, dependents := range grid.RangeDependents {
+		if wholeRangeFromKey(key).SheetIndex == sheetIndex {
+			for dependent := range dependents {
+				if _, isDirty := grid.DirtyCells[dependent]; !isDirty {
+					copyToDirty(dependent, grid)
+				}
+			}
+		}
+	}
+}
+
+// rewriteWholeRanges replaces every whole range in formula by the result of rewrite
+func rewriteWholeRanges(formula string, rewrite func(rangeString string) string) string {
+
+	tokens, err := tokenizeFormula(formula)
+	if err != nil {
+		return formula
+	}
+
+	// replace back to front so the offsets stay valid
+	for index := len(tokens) - 1; index >= 0; index-- {
+		token := tokens[index]
+		if token.Kind == formulaTokenWholeRange {
+			formula = formula[:token.Start] + rewrite(token.Text) + formula[token.End:]
+		}
+	}
+
+	return formula
+}
+
+// shiftWholeRangeString moves the ends of a whole range, shift returns the new index of an end.
+// Ends that end up before the first row or column give #REF!.
+func shiftWholeRangeString(rangeString string, shift func(end string, index int, isLower bool) int) string {
+
+	prefix, ends := splitWholeRange(rangeString)
+	isColumn := columnReferenceRegex.MatchString(ends[0])
+
+	newEnds := []string{}
+
+	for position, end := range ends {
+
+		index := wholeRangeIndex(end, isColumn)
+		otherIndex := wholeRangeIndex(ends[1-position], isColumn)
+
+		newIndex := shift(end, index, index < otherIndex || (index == otherIndex && position == 0))
+		if newIndex < 1 {
+			return ErrorCodeReference
+		}
+
+		newEnds = append(newEnds, formatWholeRangeEnd(newIndex, isColumn, strings.HasPrefix(end, "$")))
+	}
+
+	return prefix + strings.Join(newEnds, ":")
+}
+
+// shiftWholeRanges updates the whole ranges on a sheet when rows or columns are inserted (amount 1)
+// or deleted (amount -1) at index. The formulas of the dependents and the defined names are rewritten.
+func shiftWholeRanges(sheetIndex SheetID, isColumn bool, index int, amount int, grid *Grid) {
+
+	shift := func(end string, endIndex int, isLower bool) int {
+		if amount > 0 && endIndex >= index {
+			return endIndex + amount
+		}
+		// deleting moves the lower end only when it's after the deleted row or column
+		if amount < 0 && (endIndex > index || (endIndex == index && !isLower)) {
+			return endIndex + amount
+		}
+		return endIndex
+	}
+
+	shiftFormula := func(formula string, formulaSheetIndex SheetID) string {
+		return rewriteWholeRanges(formula, func(rangeString string) string {
+			if !sheetExistsForReferenceString(rangeString, grid) {
+				return rangeString
+			}
+			r := parseWholeRange(rangeString, formulaSheetIndex, grid)
+			if r.SheetIndex != sheetIndex || r.IsColumn != isColumn {
+				return rangeString
+			}
+			if amount < 0 && r.Lower == index && r.Upper == index {
+				return ErrorCodeReference
+			}
+			return shiftWholeRangeString(rangeString, shift)
+		})
+	}
+
+	dependents := make(map[CellKey]bool)
+	for _, rangeDependents := range grid.RangeDependents {
+		for dependent := range rangeDependents {
+			dependents[dependent] = true
+		}
+	}
+
+	for dependent := range dependents {
+
+		reference := getReferenceFromCellKey(dependent)
+		dv := getDataFromRef(reference, grid)
+
+		newFormula := shiftFormula(dv.DataFormula, reference.SheetIndex)
+		if newFormula != dv.DataFormula {
+			dv.DataFormula = newFormula
+			setDataByRef(reference, setDependencies(reference, dv, grid), grid)
+		}
+	}
+
+	changedNames := []string{}
+	for _, definition := range grid.DefinedNames {
+		// definitions are qualified, so the sheet index passed is never used
+		newFormula := shiftFormula(definition.Formula, 0)
+		if newFormula != definition.Formula {
+			definition.Formula = newFormula
+			changedNames = append(changedNames, definition.Name)
+		}
+	}
+
+	refreshNameDependents(changedNames, grid)
+}
+
+// rangesOverlap checks whether two ranges like "A1:B5" or "C3" share cells
+func rangesOverlap(a ReferenceRange, b ReferenceRange) bool {
+
+	if a.SheetIndex != b.SheetIndex {
+		return false
+	}
+
+	bounds := func(rangeString string) (int, int, int, int) {
+		if !strings.Contains(rangeString, ":") {
+			rangeString = rangeString + ":" + rangeString
+		}
+		return cellRangeBoundaries(rangeString)
+	}
+
+	aLowerRow, aLowerColumn, aUpperRow, aUpperColumn := bounds(a.String)
+	bLowerRow, bLowerColumn, bUpperRow, bUpperColumn := bounds(b.String)
+
+	return aLowerRow <= bUpperRow && aUpperRow >= bLowerRow && aLowerColumn <= bUpperColumn && aUpperColumn >= bLowerColumn
+}
+
+// shiftRangeString shifts a range like "A1:B5" for rows or columns inserted (amount 1) or deleted
+// (amount -1) at index. Inserting inside the range grows it, deleting inside it shrinks it, false is
+// returned when all of its cells are deleted.
+func shiftRangeString(rangeString string, isColumn bool, index int, amount int) (string, bool) {
+
+	lowerRow, lowerColumn, upperRow, upperColumn := cellRangeBoundaries(rangeString)
+
+	lower, upper := lowerRow, upperRow
+	if isColumn {
+		lower, upper = lowerColumn, upperColumn
+	}
+
+	if lower > index || (amount > 0 && lower == index) {
+		lower += amount
+	}
+	if upper >= index {
+		upper += amount
+	}
+
+	if upper < lower {
+		return rangeString, false
+	}
+
+	if isColumn {
+		lowerColumn, upperColumn = lower, upper
+	} else {
+		lowerRow, upperRow = lower, upper
+	}
+
+	return indexesToReferenceString(lowerRow, lowerColumn) + ":" + indexesToReferenceString(upperRow, upperColumn), true
+}
+
+// moveWholeRanges shifts the relative ends of whole ranges in a formula that is copied to another cell
+func moveWholeRanges(formula string, rowDifference int, columnDifference int) string {
+	return rewriteWholeRanges(formula, func(rangeString string) string {
+		return shiftWholeRangeString(rangeString, func(end string, index int, isLower bool) int {
+			if strings.HasPrefix(end, "$") {
+				return index
+			}
+			if columnReferenceRegex.MatchString(end) {
+				return index + columnDifference
+			}
+			return index + rowDifference
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import "./functions"
+
+// Cells calling a volatile function (like RAND or NOW) are kept in grid.VolatileCells and are
+// recomputed on every recalculation, together with the cells depending on them. Python functions
+// are volatile when they're decorated with @volatile, which registers them in grid.VolatileFunctions.
+
+// isVolatileFormula checks whether a formula calls a volatile function, directly or through defined names
+func isVolatileFormula(formula string, grid *Grid) bool {
+
+	formulas := []string{formula}
+	for _, definition := range usedDefinitions(formula, grid) {
+		formulas = append(formulas, definition.Formula)
+	}
+
+	for _, usedFormula := range formulas {
+
+		tokens, err := tokenizeFormula(usedFormula)
+		if err != nil {
+			continue
+		}
+
+		for index, token := range tokens {
+
+			// only calls, a name that isn't followed by ( isn't a function
+			if token.Kind != formulaTokenName || index+1 >= len(tokens) || tokens[index+1].Kind != formulaTokenOpenParen {
+				continue
+			}
+
+			if definition := functions.Lookup(token.Text); definition != nil && definition.IsVolatile {
+				return true
+			}
+			if grid.VolatileFunctions[token.Text] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// setVolatile keeps track of whether the cell at reference calls a volatile function
+func setVolatile(reference Reference, dv *DynamicValue, grid *Grid) {
+
+	index := getCellKeyFromReference(reference)
+
+	if dv.ValueType != DynamicValueTypeExplosiveFormula && isVolatileFormula(dv.DataFormula, grid) {
+		grid.VolatileCells[index] = true
+	} else {
+		delete(grid.VolatileCells, index)
+	}
+}
+
+// markVolatileCellsDirty makes the volatile cells and their dependents dirty, it's called at the
+// start of every recalculation
+func markVolatileCellsDirty(grid *Grid) {
+
+	for index := range grid.VolatileCells {
+
+		// cells of removed sheets or rows and columns that were cut off
+		if _, ok := grid.Data[index]; !ok || !checkIfRefExists(getReferenceFromCellKey(index), grid) {
+			delete(grid.VolatileCells, index)
+			continue
+		}
+
+		if _, isDirty := grid.DirtyCells[index]; !isDirty {
+			copyToDirty(index, grid)
+		}
+	}
+}
+
+// registerVolatileFunction marks a Python function as volatile and updates the cells calling it
+func registerVolatileFunction(name string, grid *Grid) {
+
+	if grid.VolatileFunctions[name] {
+		return
+	}
+	grid.VolatileFunctions[name] = true
+
+	for index, dv := range grid.Data {
+		if len(dv.DataFormula) > 0 && !grid.VolatileCells[index] {
+			setVolatile(getReferenceFromCellKey(index), dv, grid)
+		}
+	}
+}
+
+// markAllDirty makes every formula of a sheet dirty, or of all sheets when sheetIndex is -1, to
+// force a full recalculation. The cells on other sheets depending on them become dirty too.
+func markAllDirty(sheetIndex SheetID, grid *Grid) {
+
+	for index, dv := range grid.Data {
+
+		// spilled cells become dirty with their anchor
+		if len(dv.DataFormula) == 0 || (sheetIndex != -1 && index.SheetIndex() != sheetIndex) {
+			continue
+		}
+
+		if _, isDirty := grid.DirtyCells[index]; !isDirty {
+			copyToDirty(index, grid)
+		}
+	}
+}
+
+// refreshAllDependencies sets the dependencies of every formula again, for when sheets came back or
+// went away
+func refreshAllDependencies(grid *Grid) {
+
+	indexes := []CellKey{}
+	for index, dv := range grid.Data {
+		if len(dv.DataFormula) > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+
+	for _, index := range indexes {
+		reference := getReferenceFromCellKey(index)
+		setDataByRef(reference, setDependencies(reference, getDataByCellKey(index, grid), grid), grid)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// SheetID identifies a sheet for as long as it exists, independent of where it's shown in the sheet
+// tabs. The SheetIndex of references, ranges and cells holds it. grid.SheetList and grid.SheetSizes
+// are ordered like the tabs, grid.SheetNames maps each name to its ID. The client and Python address
+// sheets by their position in the tabs, positions are converted at the edges.
+type SheetID int32
+
+// noSheet is the position of a sheet that doesn't exist
+const noSheet = -1
+
+// getSheetPosition returns where the sheet is shown in the tabs, noSheet if it doesn't exist
+func getSheetPosition(sheetIndex SheetID, grid *Grid) int {
+
+	// unless sheets were removed, IDs are the positions
+	if sheetIndex >= 0 && int(sheetIndex) < len(grid.SheetList) && grid.SheetNames[grid.SheetList[sheetIndex]] == sheetIndex {
+		return int(sheetIndex)
+	}
+
+	for position, sheetName := range grid.SheetList {
+		if grid.SheetNames[sheetName] == sheetIndex {
+			return position
+		}
+	}
+
+	return noSheet
+}
+
+func sheetExists(sheetIndex SheetID, grid *Grid) bool {
+	return getSheetPosition(sheetIndex, grid) != noSheet
+}
+
+func getSheetName(sheetIndex SheetID, grid *Grid) string {
+
+	position := getSheetPosition(sheetIndex, grid)
+	if position == noSheet {
+		return ""
+	}
+
+	return grid.SheetList[position]
+}
+
+// getSheetSize returns the size of a sheet, an empty size if it doesn't exist
+func getSheetSize(sheetIndex SheetID, grid *Grid) SheetSize {
+
+	position := getSheetPosition(sheetIndex, grid)
+	if position == noSheet {
+		return SheetSize{}
+	}
+
+	return grid.SheetSizes[position]
+}
+
+// newSheetID returns an ID no sheet has had before, IDs of removed sheets aren't reused so
+// references to them (like the ones in the undo history) never reach a new sheet
+func newSheetID(grid *Grid) SheetID {
+
+	sheetIndex := grid.NextSheetID
+	grid.NextSheetID++
+
+	return sheetIndex
+}
+
+// firstUnusedSheetID returns the ID after the largest one of the existing sheets
+func firstUnusedSheetID(grid *Grid) SheetID {
+
+	nextSheetID := SheetID(0)
+	for _, sheetIndex := range grid.SheetNames {
+		if sheetIndex >= nextSheetID {
+			nextSheetID = sheetIndex + 1
+		}
+	}
+
+	return nextSheetID
+}
+
+// getSheetIDFromString returns the ID of the sheet at a position sent by the client or Python
+func getSheetIDFromString(positionString string, grid *Grid) SheetID {
+
+	position, err := strconv.Atoi(positionString)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if position < 0 || position >= len(grid.SheetList) {
+		return SheetID(noSheet)
+	}
+
+	return grid.SheetNames[grid.SheetList[position]]
+}
+
+// parseSheetPosition returns the ID of the sheet at a position sent by the client like
+// getSheetIDFromString, with an error instead of exiting when it isn't the position of a sheet
+func parseSheetPosition(positionString string, grid *Grid) (SheetID, error) {
+
+	position, err := strconv.Atoi(positionString)
+	if err != nil || position < 0 || position >= len(grid.SheetList) {
+		return SheetID(noSheet), errors.New("there is no sheet at position " + positionString)
+	}
+
+	return grid.SheetNames[grid.SheetList[position]], nil
+}
+
+// getSheetPositionString returns the position of a sheet the way the client and Python address it
+func getSheetPositionString(sheetIndex SheetID, grid *Grid) string {
+	return strconv.Itoa(getSheetPosition(sheetIndex, grid))
+}
+
+// addSheet adds a sheet after the existing ones
+func addSheet(sheetName string, sheetSize SheetSize, grid *Grid) (SheetID, error) {
+
+	if err := checkSheetSize(sheetSize); err != nil {
+		return SheetID(noSheet), err
+	}
+
+	if grid.NextSheetID > maximumSheetID {
+		return SheetID(noSheet), errors.New("the workbook has run out of sheet IDs, at most " + strconv.Itoa(maximumSheetID+1) + " sheets can be added")
+	}
+
+	sheetIndex := newSheetID(grid)
+
+	grid.SheetNames[sheetName] = sheetIndex
+	grid.SheetList = append(grid.SheetList, sheetName)
+	grid.SheetSizes = append(grid.SheetSizes, sheetSize)
+
+	return sheetIndex, nil
+}
+
+// removeSheet removes a sheet with its cells, conditional formats and validation rules, the cells of
+// the other sheets keep their keys
+func removeSheet(sheetIndex SheetID, grid *Grid) {
+
+	position := getSheetPosition(sheetIndex, grid)
+	if position == noSheet {
+		return
+	}
+
+	for index := range grid.Data {
+		if index.SheetIndex() == sheetIndex {
+			markCellChanged(index, grid)
+			delete(grid.Data, index)
+			delete(grid.DirtyCells, index)
+			delete(grid.VolatileCells, index)
+			delete(grid.SpillAnchors, index)
+		}
+	}
+
+	// the conditional formats and validation rules on the sheet go with it
+	formats := []ConditionalFormat{}
+	for _, format := range grid.ConditionalFormats {
+		if format.Range.SheetIndex != sheetIndex {
+			formats = append(formats, format)
+		}
+	}
+	grid.ConditionalFormats = formats
+
+	rules := []ValidationRule{}
+	for _, rule := range grid.ValidationRules {
+		if rule.Range.SheetIndex != sheetIndex {
+			rules = append(rules, rule)
+		}
+	}
+	grid.ValidationRules = rules
+
+	delete(grid.SheetNames, grid.SheetList[position])
+
+	grid.SheetList = append(grid.SheetList[0:position], grid.SheetList[position+1:]...)
+	grid.SheetSizes = append(grid.SheetSizes[0:position], grid.SheetSizes[position+1:]...)
+}
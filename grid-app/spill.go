@@ -0,0 +1,185 @@
+package main
+
+// Formulas that result in an array (or a range, like =A1:B3) spill: the formula cell, the
+// anchor, shows the first value and the other values are written into the cells to the
+// right and below it. Spilled cells keep the map index of their anchor in SpillFrom and
+// depend on the anchor, so they're recomputed whenever the anchor is.
+
+// SpillArea is the number of rows and columns an anchor's array result covers
+type SpillArea struct {
+	Rows    int
+	Columns int
+}
+
+// arrayRows returns the rows of an array result, ranges are turned into arrays of their values
+func arrayRows(dv *DynamicValue, grid *Grid) ([][]*DynamicValue, bool) {
+
+	if dv.ValueType == DynamicValueTypeArray {
+		return dv.DataArray, len(dv.DataArray) > 0 && len(dv.DataArray[0]) > 0
+	}
+
+	if dv.ValueType == DynamicValueTypeReference {
+
+		lookup, errorDv := getLookupRange(dv, grid)
+		if errorDv != nil {
+			return nil, false
+		}
+
+		rows := [][]*DynamicValue{}
+		for row := 0; row < lookup.Rows; row++ {
+			rows = append(rows, lookup.row(row))
+		}
+		return rows, true
+	}
+
+	return nil, false
+}
+
+// spillArray writes the array result of the anchor into the cells next to it. When those
+// cells aren't empty, or the array doesn't fit on the sheet, the anchor becomes a #SPILL!
+// error instead. The cells newly covered by the spill are returned.
+func spillArray(reference Reference, dv *DynamicValue, grid *Grid) []CellKey {
+
+	anchorIndex := getCellKeyFromReference(reference)
+
+	rows, isArray := arrayRows(dv, grid)
+	if !isArray {
+		delete(grid.SpillAnchors, anchorIndex)
+		return []CellKey{}
+	}
+
+	dv.ValueType = DynamicValueTypeArray
+	dv.DataArray = rows
+
+	grid.SpillAnchors[anchorIndex] = SpillArea{Rows: len(rows), Columns: len(rows[0])}
+
+	anchorRow := getReferenceRowIndex(reference.String)
+	anchorColumn := getReferenceColumnIndex(reference.String)
+	sheetSize := getSheetSize(reference.SheetIndex, grid)
+
+	if anchorRow+len(rows)-1 > sheetSize.RowCount || anchorColumn+len(rows[0])-1 > sheetSize.ColumnCount {
+		setSpillError(dv, "Spill range doesn't fit on the sheet")
+		return []CellKey{}
+	}
+
+	targets := []Reference{}
+
+	for row := 0; row < len(rows); row++ {
+		for column := 0; column < len(rows[0]); column++ {
+
+			if row == 0 && column == 0 {
+				continue
+			}
+
+			target := Reference{String: indexesToReferenceString(anchorRow+row, anchorColumn+column), SheetIndex: reference.SheetIndex}
+			targetDv := getDataFromRef(target, grid)
+
+			// cells with content or spilled from another formula block the spill
+			if targetDv.SpillFrom != anchorIndex && (targetDv.SpillFrom != noCellKey || len(targetDv.DataFormula) > 0) {
+				setSpillError(dv, "Spill range isn't blank, "+target.String+" has content")
+				return []CellKey{}
+			}
+
+			targets = append(targets, target)
+		}
+	}
+
+	claimedCells := []CellKey{}
+
+	for _, target := range targets {
+
+		targetIndex := getCellKeyFromReference(target)
+		targetDv := getDataFromRef(target, grid)
+
+		// cells that were already spilled from this anchor are recomputed as its dependents
+		if targetDv.SpillFrom == anchorIndex {
+			continue
+		}
+
+		targetDv.SpillFrom = anchorIndex
+		targetDv.DependIn[anchorIndex] = true
+		dv.DependOut[targetIndex] = true
+
+		setDataByRef(target, spilledValue(target, targetDv, grid), grid)
+		claimedCells = append(claimedCells, targetIndex)
+	}
+
+	return claimedCells
+}
+
+func setSpillError(dv *DynamicValue, message string) {
+	dv.ValueType = DynamicValueTypeError
+	dv.DataString = ErrorCodeSpill
+	dv.ErrorMessage = message
+	dv.DataArray = nil
+}
+
+// spilledValue returns the value the anchor of a spilled cell has for it, keeping the cell's
+// dependencies. Cells the anchor no longer covers are released and become empty.
+func spilledValue(reference Reference, dv *DynamicValue, grid *Grid) *DynamicValue {
+
+	value := &DynamicValue{ValueType: DynamicValueTypeString}
+
+	anchor, ok := grid.Data[dv.SpillFrom]
+
+	if ok && anchor.ValueType == DynamicValueTypeArray {
+
+		anchorReference := getReferenceFromCellKey(dv.SpillFrom)
+		row := getReferenceRowIndex(reference.String) - getReferenceRowIndex(anchorReference.String)
+		column := getReferenceColumnIndex(reference.String) - getReferenceColumnIndex(anchorReference.String)
+
+		if row >= 0 && column >= 0 && row < len(anchor.DataArray) && column < len(anchor.DataArray[row]) {
+			value = copyDv(anchor.DataArray[row][column])
+		} else {
+			releaseSpilledCell(reference, dv, grid)
+		}
+
+	} else {
+		releaseSpilledCell(reference, dv, grid)
+	}
+
+	value.SheetIndex = reference.SheetIndex
+	value.SpillFrom = dv.SpillFrom
+	value.DependIn = dv.DependIn
+	value.DependOut = dv.DependOut
+
+	return value
+}
+
+// releaseSpilledCell removes the link between a spilled cell and its anchor
+func releaseSpilledCell(reference Reference, dv *DynamicValue, grid *Grid) {
+
+	if anchor, ok := grid.Data[dv.SpillFrom]; ok {
+		delete(anchor.DependOut, getCellKeyFromReference(reference))
+	}
+
+	delete(dv.DependIn, dv.SpillFrom)
+	dv.SpillFrom = noCellKey
+}
+
+// markSpillAnchorsDirty recomputes the anchors whose spill area contains reference, entering
+// something in a spill area blocks the spill and clearing it allows the anchor to spill again
+func markSpillAnchorsDirty(reference Reference, grid *Grid) {
+
+	row := getReferenceRowIndex(reference.String)
+	column := getReferenceColumnIndex(reference.String)
+
+	for anchorIndex, area := range grid.SpillAnchors {
+
+		if _, ok := grid.Data[anchorIndex]; !ok {
+			delete(grid.SpillAnchors, anchorIndex)
+			continue
+		}
+
+		anchorReference := getReferenceFromCellKey(anchorIndex)
+		anchorRow := getReferenceRowIndex(anchorReference.String)
+		anchorColumn := getReferenceColumnIndex(anchorReference.String)
+
+		isInside := anchorReference.SheetIndex == reference.SheetIndex && anchorReference != reference &&
+			row >= anchorRow && row < anchorRow+area.Rows && column >= anchorColumn && column < anchorColumn+area.Columns
+
+		if _, isDirty := grid.DirtyCells[anchorIndex]; isInside && !isDirty {
+			copyToDirty(anchorIndex, grid)
+		}
+	}
+}
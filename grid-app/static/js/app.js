@@ -109,6 +109,21 @@
 		this.sheetNames = [];
 		this.data = [];
 		this.dataFormulas = [];
+		this.dataErrors = [];
+		this.dataDisplay = [];
+		this.dataStyles = [];
+		this.dataConditional = [];
+		this.dataValidation = [];
+
+		// the style table, cells refer to a style by its position, the first one is the default
+		this.styles = [{}];
+
+		// workbook level defined names, each element contains: "name", "formula"
+		this.definedNames = [];
+
+		// native functions, each element contains: name, syntax, description
+		this.functions = [];
+		this.iteration = {enabled: false, maximumIterations: 100, tolerance: 0.001};
 
 		this.rowHeightsCache = [];
 		this.columnWidthsCache = [];
@@ -277,12 +292,90 @@
 			}
 		}
 
-		this.set = function(position, value, sheet){
+		this.set = function(position, value, sheet, error, display, style, conditional, validation){
 			if(!this.data[sheet][position[0]]){
 				this.data[sheet][position[0]] = [];
 			}
+			if(!this.dataErrors[sheet][position[0]]){
+				this.dataErrors[sheet][position[0]] = [];
+			}
+			if(!this.dataDisplay[sheet][position[0]]){
+				this.dataDisplay[sheet][position[0]] = [];
+			}
+			if(!this.dataStyles[sheet][position[0]]){
+				this.dataStyles[sheet][position[0]] = [];
+			}
+			if(!this.dataConditional[sheet][position[0]]){
+				this.dataConditional[sheet][position[0]] = [];
+			}
+			if(!this.dataValidation[sheet][position[0]]){
+				this.dataValidation[sheet][position[0]] = [];
+			}
 
 			this.data[sheet][position[0]][position[1]] = value.toString();
+
+			// error message is only non-empty for cells holding an error value
+			this.dataErrors[sheet][position[0]][position[1]] = error ? error : undefined;
+
+			// the value with the number format of the cell applied, only kept when it differs
+			this.dataDisplay[sheet][position[0]][position[1]] = display !== undefined && display != value ? display : undefined;
+
+			// the default style isn't kept
+			this.dataStyles[sheet][position[0]][position[1]] = style ? style : undefined;
+
+			// what conditional formats do to the cell: a style on top of its own and a data bar
+			this.dataConditional[sheet][position[0]][position[1]] = conditional;
+
+			// the message of the validation rule the cell breaks, only kept for flagged cells
+			this.dataValidation[sheet][position[0]][position[1]] = validation ? validation : undefined;
+		}
+
+		this.getValidation = function(position, sheet){
+			if(this.dataValidation[sheet] === undefined || this.dataValidation[sheet][position[0]] === undefined){
+				return undefined;
+			}
+			return this.dataValidation[sheet][position[0]][position[1]];
+		}
+
+		this.getConditional = function(position, sheet){
+			if(this.dataConditional[sheet] === undefined || this.dataConditional[sheet][position[0]] === undefined){
+				return undefined;
+			}
+			return this.dataConditional[sheet][position[0]][position[1]];
+		}
+
+		// getStyle returns the style of a cell with its conditional formats applied, undefined for the default style
+		this.getStyle = function(position, sheet){
+
+			var style = undefined;
+			if(this.dataStyles[sheet] !== undefined && this.dataStyles[sheet][position[0]] !== undefined){
+				var styleID = this.dataStyles[sheet][position[0]][position[1]];
+				if(styleID !== undefined){
+					style = this.styles[styleID];
+				}
+			}
+
+			var conditional = this.getConditional(position, sheet);
+			if(conditional !== undefined && conditional.style !== undefined){
+				style = $.extend({}, style, conditional.style);
+			}
+
+			return style;
+		}
+
+		// getDisplay returns a cell's value as shown in the sheet, with its number format applied
+		this.getDisplay = function(position, sheet){
+			if(this.dataDisplay[sheet] !== undefined && this.dataDisplay[sheet][position[0]] !== undefined && this.dataDisplay[sheet][position[0]][position[1]] !== undefined){
+				return this.dataDisplay[sheet][position[0]][position[1]];
+			}
+			return this.get(position, sheet);
+		}
+
+		this.getError = function(position, sheet){
+			if(this.dataErrors[sheet] === undefined || this.dataErrors[sheet][position[0]] === undefined){
+				return undefined;
+			}
+			return this.dataErrors[sheet][position[0]][position[1]];
 		}
 
 		this.initTabs = function(){
@@ -383,6 +476,86 @@
 
 			this.sheetDom.insertBefore(input, this.sheetDom.children[0]);
 
+			// hint with the functions matching what is typed in a formula
+			var hint = document.createElement('div');
+			$(hint).addClass('function-hint');
+			this.function_hint = $(hint);
+			this.function_hint.hide();
+			this.dom.querySelector('.formula-bar').appendChild(hint);
+
+			$(input).add(this.formula_input).on('input keyup click', function(){
+				_this.update_function_hint(this.value, this.selectionStart);
+			}).on('blur', function(){
+				_this.function_hint.hide();
+			});
+
+		}
+
+		// functionHints returns the functions whose name is being typed, or else the function
+		// of the innermost call the cursor is in
+		this.functionHints = function(formula, cursor){
+
+			if(formula.indexOf("=") != 0){
+				return [];
+			}
+
+			var text = formula.substring(0, cursor);
+
+			var typedName = text.match(/([A-Za-z][A-Za-z0-9.]*)$/);
+			if(typedName){
+				var prefix = typedName[1].toUpperCase();
+				var matches = this.functions.filter(function(f){
+					return f.name.indexOf(prefix) == 0;
+				});
+				if(matches.length > 0){
+					return matches.slice(0, 5);
+				}
+			}
+
+			// find the innermost open call, skipping strings
+			var openCalls = [];
+			var inString = false;
+			for(var i = 0; i < text.length; i++){
+				if(text[i] == '"'){
+					inString = !inString;
+				}else if(!inString && text[i] == '('){
+					openCalls.push(i);
+				}else if(!inString && text[i] == ')'){
+					openCalls.pop();
+				}
+			}
+
+			if(openCalls.length == 0){
+				return [];
+			}
+
+			var calledName = text.substring(0, openCalls[openCalls.length-1]).match(/([A-Za-z][A-Za-z0-9.]*)$/);
+			if(!calledName){
+				return [];
+			}
+
+			return this.functions.filter(function(f){
+				return f.name == calledName[1];
+			});
+		}
+
+		this.update_function_hint = function(formula, cursor){
+
+			var hints = this.functionHints(formula, cursor);
+
+			if(hints.length == 0){
+				this.function_hint.hide();
+				return;
+			}
+
+			this.function_hint.empty();
+			for(var i = 0; i < hints.length; i++){
+				var line = $("<div></div>");
+				line.append($("<span class='syntax'></span>").text(hints[i].syntax));
+				line.append($("<span class='description'></span>").text(hints[i].description));
+				this.function_hint.append(line);
+			}
+			this.function_hint.show();
 		}
 
 		this.efficientTotalWidth = function(){
@@ -596,6 +769,20 @@
 					_this.pasteSelectionAsValue();
 				} else if($(this).hasClass('sheet-size')){
 					_this.requestSheetSize();
+				}else if($(this).hasClass('number-format')){
+					_this.requestNumberFormat();
+				}else if($(this).hasClass('conditional-format')){
+					_this.requestConditionalFormat($(this).attr('data-type'), $(this).attr('data-operator'));
+				}else if($(this).hasClass('clear-conditional-formats')){
+					_this.clearConditionalFormats();
+				}else if($(this).hasClass('data-validation')){
+					_this.requestValidation($(this).attr('data-type'));
+				}else if($(this).hasClass('choose-from-list')){
+					_this.requestValidationOptions();
+				}else if($(this).hasClass('clear-validations')){
+					_this.clearValidations();
+				}else if($(this).hasClass('cell-style')){
+					_this.requestCellStyle($(this).attr('data-property'), $(this).attr('data-value'));
 				}else if($(this).hasClass('insert-column-left')){
 					_this.insertRowColumn('COLUMN','LEFT');
 				}else if($(this).hasClass('insert-column-right')){
@@ -671,6 +858,11 @@
 
 			this.data = [];
 			this.dataFormulas = [];
+			this.dataErrors = [];
+			this.dataDisplay = [];
+			this.dataStyles = [];
+			this.dataConditional = [];
+			this.dataValidation = [];
 			this.sheetSizes = [];
 			this.sheetNames = [];
 			this.selectedCellsPerSheet = [];
@@ -689,6 +881,11 @@
 
 				this.data.push([]);
 				this.dataFormulas.push([]);
+				this.dataErrors.push([]);
+				this.dataDisplay.push([]);
+				this.dataStyles.push([]);
+				this.dataConditional.push([]);
+				this.dataValidation.push([]);
 				this.selectedCellsPerSheet.push([[0,0],[0,0]]);
 			}
 
@@ -1125,7 +1322,10 @@
 						else if(e.keyCode == 39){
 							_this.translateSelection(1, 0, e.shiftKey, e.ctrlKey || e.metaKey);
 						}
-						// down arrow
+						// down arrow, with alt it opens the list of a cell with a list validation rule
+						else if(e.keyCode == 40 && e.altKey){
+							_this.requestValidationOptions();
+						}
 						else if(e.keyCode == 40){
 							_this.translateSelection(0, 1, e.shiftKey, e.ctrlKey || e.metaKey);
 						}
@@ -1200,6 +1400,10 @@
 					}
 
 				}
+				// F9 recalculates the workbook, shift F9 the active sheet
+				else if(e.keyCode == 120){
+					_this.recalculate(e.shiftKey);
+				}
 				else if(e.keyCode == 187 || e.keyCode == 61){
 					if(!_this.isFocusedOnElement()){
 						_this.show_input_field();
@@ -1285,6 +1489,26 @@
 						keyRegistered = false;
 					}
 
+				}
+				else if((e.ctrlKey || e.metaKey) && (e.keyCode == 90 || e.keyCode == 89)) {
+
+					// ctrl+z undoes, ctrl+y and ctrl+shift+z redo
+					if(!_this.isFocusedOnElement()){
+						_this.undo(e.keyCode == 89 || e.shiftKey);
+					}else{
+						keyRegistered = false;
+					}
+
+				}
+				else if((e.ctrlKey || e.metaKey) && (e.keyCode == 66 || e.keyCode == 73 || e.keyCode == 85)) {
+
+					// ctrl+b, ctrl+i and ctrl+u toggle bold, italic and underline
+					if(!_this.isFocusedOnElement()){
+						_this.requestCellStyle({66: "bold", 73: "italic", 85: "underline"}[e.keyCode], "toggle");
+					}else{
+						keyRegistered = false;
+					}
+
 				}
 				else if((e.ctrlKey || e.metaKey) && e.keyCode == 65) {
 
@@ -1350,6 +1574,40 @@
 			this.reloadPlotsData();
 		}
 
+		// undo reverts the last change to the grid, or applies the last reverted change again
+		this.undo = function(redo){
+			this.wsManager.send({arguments:[redo ? "REDO" : "UNDO"]});
+		}
+
+		// recalculate forces all formulas of the workbook, or of the active sheet, to be recomputed
+		this.recalculate = function(activeSheetOnly){
+			if(activeSheetOnly){
+				this.wsManager.send({arguments:["RECALCULATE-SHEET", ""+this.activeSheet]});
+			}else{
+				this.wsManager.send({arguments:["RECALCULATE"]});
+			}
+		}
+
+		// iterative calculation lets intentional circular references converge instead of failing
+		this.requestIterationSettings = function(){
+
+			var enabled = confirm("Enable iterative calculation for circular references?");
+
+			var maximumIterations = this.iteration.maximumIterations;
+			var tolerance = this.iteration.tolerance;
+
+			if(enabled){
+				maximumIterations = prompt("Maximum iterations:", maximumIterations);
+				tolerance = prompt("Maximum change (tolerance):", tolerance);
+
+				if(maximumIterations === null || tolerance === null){
+					return;
+				}
+			}
+
+			this.wsManager.send({arguments:["SET-ITERATION", ""+enabled, ""+maximumIterations, ""+tolerance]});
+		}
+
 		this.refreshDataRange = function(range, sheetIndex){
 			this.wsManager.send('{"arguments":["GET","'+range+'","'+sheetIndex+'"]}')
 		}
@@ -1441,6 +1699,21 @@
 					if(this.dataFormulas[this.activeSheet][r]){
 						this.dataFormulas[this.activeSheet][r][c] = undefined;
 					}
+					if(this.dataErrors[this.activeSheet][r]){
+						this.dataErrors[this.activeSheet][r][c] = undefined;
+					}
+					if(this.dataDisplay[this.activeSheet][r]){
+						this.dataDisplay[this.activeSheet][r][c] = undefined;
+					}
+					if(this.dataStyles[this.activeSheet][r]){
+						this.dataStyles[this.activeSheet][r][c] = undefined;
+					}
+					if(this.dataConditional[this.activeSheet][r]){
+						this.dataConditional[this.activeSheet][r][c] = undefined;
+					}
+					if(this.dataValidation[this.activeSheet][r]){
+						this.dataValidation[this.activeSheet][r][c] = undefined;
+					}
 				}
 			}
 
@@ -2107,8 +2380,162 @@
 			this.markSaving();
 		}
 
-		this.exportCSV = function(){
-			this.wsManager.send({arguments:["EXPORT-CSV"]});
+		// exportCSV exports the raw values, or the values as displayed with their number formats
+		this.exportCSV = function(formatted){
+			this.wsManager.send({arguments:["EXPORT-CSV", formatted ? "FORMATTED" : "RAW"]});
+		}
+
+		// requestNumberFormat sets the number format of the selected cells, e.g. #,##0.00 or 0%
+		this.requestNumberFormat = function(){
+
+			var format = prompt("Number format (e.g. #,##0.00, 0%, $#,##0.00 or yyyy-mm-dd), General to reset:", "General");
+
+			if(format !== null){
+				this.wsManager.send({arguments: ["SET-FORMAT", this.selectionRangeString(), this.activeSheet + "", format]});
+			}
+		}
+
+		// requestCellStyle changes a style property of the selected cells, properties without a value
+		// ask for one
+		this.requestCellStyle = function(property, value){
+
+			if(value === undefined){
+				value = prompt("Colour (e.g. #ffcc00), empty to reset:", "");
+			}
+
+			// bold, italic and underline toggle with the first selected cell
+			if(value == "toggle"){
+				var style = this.getStyle(this.selectedCells[0], this.activeSheet);
+				value = style && style[property] ? "false" : "true";
+			}
+
+			if(value !== null){
+				this.wsManager.send({arguments: ["SET-STYLE", this.selectionRangeString(), this.activeSheet + "", property, value]});
+			}
+		}
+
+		this.selectionRangeString = function(){
+			var range = this.selectionToLowerUpper(this.selectedCells);
+			return this.cellZeroIndexToString(range[0][0], range[0][1]) + ":" + this.cellZeroIndexToString(range[1][0], range[1][1]);
+		}
+
+		// requestConditionalFormat adds a conditional format rule to the selected cells
+		this.requestConditionalFormat = function(type, operator){
+
+			var value = "";
+			var value2 = "";
+			var properties = ["fill-color", "#ffc7ce", "font-color", "#9c0006"];
+
+			if(type == "cell-value"){
+				value = prompt("Format cells " + operator + ":", "0");
+				if(operator == "between" && value !== null){
+					value2 = prompt("and:", value);
+				}
+			}else if(type == "formula"){
+				value = prompt("Format cells for which the formula is true, written for the top left cell (e.g. =A1>B1):", "=");
+			}else if(type == "top-n"){
+				value = prompt("Number of cells:", "10");
+			}else if(type == "color-scale"){
+				properties = ["min-color", "#f8696b", "mid-color", "#ffeb84", "max-color", "#63be7b"];
+			}else if(type == "data-bar"){
+				properties = ["bar-color", "#638ec6"];
+			}
+
+			if(value === null || value2 === null){
+				return;
+			}
+
+			this.wsManager.send({arguments: ["ADD-CONDITIONAL-FORMAT", this.selectionRangeString(), this.activeSheet + "", type, operator ? operator : "", value, value2].concat(properties)});
+		}
+
+		this.clearConditionalFormats = function(){
+			this.wsManager.send({arguments: ["DELETE-CONDITIONAL-FORMATS", this.selectionRangeString(), this.activeSheet + ""]});
+		}
+
+		// requestValidation adds a validation rule to the selected cells
+		this.requestValidation = function(type){
+
+			var operator = "";
+			var value = "";
+			var value2 = "";
+
+			if(type == "list"){
+				value = prompt("Items separated by commas, or a range like =A1:A5:", "");
+			}else if(type == "formula"){
+				value = prompt("Allow values for which the formula is true, written for the top left cell (e.g. =A1>B1):", "=");
+			}else{
+				operator = prompt("Comparison (between, not-between, =, <>, >, >=, <, <=):", "between");
+				if(operator !== null){
+					value = prompt(operator == "between" || operator == "not-between" ? "From:" : "Value:", type == "date" ? "2020-01-01" : "0");
+				}
+				if(value !== null && (operator == "between" || operator == "not-between")){
+					value2 = prompt("To:", value);
+				}
+			}
+
+			if(operator === null || value === null || value2 === null){
+				return;
+			}
+
+			var reject = confirm("Reject invalid input? Cancel to keep it and flag the cell instead.");
+			var message = prompt("Message for invalid input, empty to describe the rule:", "");
+
+			if(message === null){
+				return;
+			}
+
+			this.wsManager.send({arguments: ["ADD-VALIDATION", this.selectionRangeString(), this.activeSheet + "", type, operator, value, value2, reject ? "true" : "false", message]});
+		}
+
+		this.clearValidations = function(){
+			this.wsManager.send({arguments: ["DELETE-VALIDATIONS", this.selectionRangeString(), this.activeSheet + ""]});
+		}
+
+		// requestValidationOptions asks for the items of the list rule of the selected cell
+		this.requestValidationOptions = function(){
+			this.wsManager.send({arguments: ["GET-VALIDATION-OPTIONS", this.cellZeroIndexToString(this.selectedCells[0][0], this.selectedCells[0][1]), this.activeSheet + ""]});
+		}
+
+		// showValidationOptions shows the items of a list rule below its cell, picking one sets it
+		this.showValidationOptions = function(reference, sheet, options){
+
+			$('.validation-options').remove();
+
+			if(sheet != this.activeSheet || options.length == 0){
+				return;
+			}
+
+			var rowText = reference.replace(/^\D+/g, '');
+			var position = [parseInt(rowText) - 1, this.lettersToIndex(reference.replace(rowText, '')) - 1];
+			var cellPosition = this.cellLocationToPosition(position);
+			if(cellPosition === undefined){
+				return;
+			}
+
+			var dropdown = $("<div class='validation-options'></div>");
+			for(var x = 0; x < options.length; x++){
+				dropdown.append($("<div class='validation-option'></div>").text(options[x]));
+			}
+
+			var sheetOffset = $(this.sheetDom).offset();
+			dropdown.css({
+				left: sheetOffset.left + cellPosition[0] + this.sidebarSize[0],
+				top: sheetOffset.top + cellPosition[1] + this.sidebarSize[1] + this.rowHeights(position[0]),
+				minWidth: this.columnWidths(position[1])
+			});
+
+			var _this = this;
+			dropdown.find('.validation-option').click(function(){
+				_this.set_formula(position, $(this).text(), true, sheet);
+				dropdown.remove();
+			});
+
+			$('body').append(dropdown);
+			$(document).one('mousedown', function(e){
+				if($(e.target).closest('.validation-options').length == 0){
+					dropdown.remove();
+				}
+			});
 		}
 
 		this.menuInit = function(){
@@ -2124,7 +2551,11 @@
 			});
 
 			menu.find('menu-item.export-csv').click(function(){
-				_this.exportCSV();
+				_this.exportCSV(false);
+			});
+
+			menu.find('menu-item.export-csv-formatted').click(function(){
+				_this.exportCSV(true);
 			});
 
 			menu.find('menu-item.close-workspace').click(function(e){
@@ -2140,6 +2571,26 @@
 
 			});
 
+			menu.find('menu-item.undo').click(function(){
+				_this.undo(false);
+			});
+
+			menu.find('menu-item.redo').click(function(){
+				_this.undo(true);
+			});
+
+			menu.find('menu-item.recalculate-workbook').click(function(){
+				_this.recalculate(false);
+			});
+
+			menu.find('menu-item.recalculate-sheet').click(function(){
+				_this.recalculate(true);
+			});
+
+			menu.find('menu-item.iterative-calculation').click(function(){
+				_this.requestIterationSettings();
+			});
+
 			menu.find('menu-item.plot-scatter').click(function(){
 				_this.plot('scatter');
 			});
@@ -2642,6 +3093,9 @@
 			this.ctx.fillRect(0, 0, horizontalLineEndX, this.sidebarSize[1]);
 			this.ctx.fillRect(0, 0, this.sidebarSize[0], verticalLineEndY);
 			this.ctx.fillStyle = "#000000";
+
+			// fill colours go below the grid lines
+			this.renderCellFills(drawRowStart, drawColumnStart, width, height, firstCellHeightOffset, firstCellWidthOffset);
 			
 
 			// render horizontal lines
@@ -2900,16 +3354,79 @@
 					var centeringOffset = ((this.rowHeights(i) + 2 - this.fontHeight)/2) + 1;
 
 					// get data
-					var cell_data = this.get([i, d], this.activeSheet);
+					var cell_data = this.getDisplay([i, d], this.activeSheet);
 
 					var cellMaxWidth = this.columnWidths(d) - this.textPadding - 2; // minus borders
 
+					var cellX = currentX + firstCellWidthOffset + this.sidebarSize[0];
+					var cellY = currentY + firstCellHeightOffset + this.sidebarSize[1];
+					var style = this.getStyle([i, d], this.activeSheet);
+
 					if(cell_data !== undefined && cell_data.length > 0){
 
 						this.ctx.textAlign = 'left';
 
+						var textX = cellX + this.textPadding;
+						var textY = cellY + centeringOffset;
+
+						if(style){
+							this.ctx.font = this.styleToFont(style);
+
+							if(style.fontColor){
+								this.ctx.fillStyle = style.fontColor;
+							}
+
+							if(style.horizontalAlign == 'center'){
+								this.ctx.textAlign = 'center';
+								textX = cellX + this.columnWidths(d)/2;
+							}else if(style.horizontalAlign == 'right'){
+								this.ctx.textAlign = 'right';
+								textX = cellX + this.columnWidths(d) - this.textPadding;
+							}
+
+							if(style.verticalAlign == 'top'){
+								textY = cellY + 2;
+							}else if(style.verticalAlign == 'bottom'){
+								textY = cellY + this.rowHeights(i) - this.fontHeight - 1;
+							}
+						}
+
+						// error values are shown in red
+						if(this.getError([i, d], this.activeSheet) !== undefined){
+							this.ctx.fillStyle = "#cc0000";
+						}
+
 						var fitted_cell_data = this.fittingStringFast(cell_data, cellMaxWidth);
-						this.ctx.fillText(fitted_cell_data, currentX + firstCellWidthOffset + this.textPadding + this.sidebarSize[0], currentY + firstCellHeightOffset + centeringOffset + this.sidebarSize[1]);
+						this.ctx.fillText(fitted_cell_data, textX, textY);
+
+						if(style && style.underline){
+							var textWidth = this.ctx.measureText(fitted_cell_data).width;
+							var underlineStartX = textX;
+							if(this.ctx.textAlign == 'center'){
+								underlineStartX -= textWidth/2;
+							}else if(this.ctx.textAlign == 'right'){
+								underlineStartX -= textWidth;
+							}
+							this.ctx.fillRect(underlineStartX, textY + this.fontHeight, textWidth, 1);
+						}
+
+						this.ctx.font = this.fontStyle;
+						this.ctx.fillStyle = "black";
+					}
+
+					if(style){
+						this.renderCellBorders(style, cellX, cellY, this.columnWidths(d), this.rowHeights(i));
+					}
+
+					// cells that break a validation rule get a red corner
+					if(this.getValidation([i, d], this.activeSheet) !== undefined){
+						this.ctx.fillStyle = "#cc0000";
+						this.ctx.beginPath();
+						this.ctx.moveTo(cellX + this.columnWidths(d) - 6, cellY);
+						this.ctx.lineTo(cellX + this.columnWidths(d), cellY);
+						this.ctx.lineTo(cellX + this.columnWidths(d), cellY + 6);
+						this.ctx.fill();
+						this.ctx.fillStyle = "black";
 					}
 
 
@@ -2943,6 +3460,77 @@
 
 		}
 
+		// renderCellFills draws the fill colours and data bars of the visible cells
+		this.renderCellFills = function(startRow, startColumn, width, height, firstCellHeightOffset, firstCellWidthOffset){
+
+			var currentY = 0;
+
+			for(var i = startRow; i <= this.numRows && currentY <= height + this.rowHeights(i); i++){
+
+				var currentX = 0;
+
+				for(var d = startColumn; d <= this.numColumns && currentX <= width + this.columnWidths(d); d++){
+
+					var style = this.getStyle([i, d], this.activeSheet);
+					var cellX = currentX + firstCellWidthOffset + this.sidebarSize[0];
+					var cellY = currentY + firstCellHeightOffset + this.sidebarSize[1];
+
+					if(style && style.fillColor){
+						this.ctx.fillStyle = style.fillColor;
+						this.ctx.fillRect(cellX, cellY, this.columnWidths(d), this.rowHeights(i));
+					}
+
+					// data bars of conditional formats
+					var conditional = this.getConditional([i, d], this.activeSheet);
+					if(conditional && conditional.dataBar){
+						this.ctx.fillStyle = conditional.dataBarColor;
+						this.ctx.fillRect(cellX + 2, cellY + 3, (this.columnWidths(d) - 4) * conditional.dataBar, this.rowHeights(i) - 5);
+					}
+
+					currentX += this.columnWidths(d);
+				}
+
+				currentY += this.rowHeights(i);
+			}
+
+			this.ctx.fillStyle = "#000000";
+		}
+
+		// renderCellBorders draws the borders of a cell over the grid lines
+		this.renderCellBorders = function(style, x, y, width, height){
+
+			var borderWidths = {"thin": 1, "medium": 2, "thick": 3};
+			var sides = [
+				[style.borderTop, x, y, x + width, y],
+				[style.borderRight, x + width, y, x + width, y + height],
+				[style.borderBottom, x, y + height, x + width, y + height],
+				[style.borderLeft, x, y, x, y + height]
+			];
+
+			this.ctx.strokeStyle = style.borderColor ? style.borderColor : "#000000";
+
+			for(var s = 0; s < sides.length; s++){
+				if(sides[s][0]){
+					this.ctx.lineWidth = borderWidths[sides[s][0]];
+					this.ctx.beginPath();
+					this.ctx.a_moveTo(sides[s][1], sides[s][2]);
+					this.ctx.a_lineTo(sides[s][3], sides[s][4]);
+					this.ctx.stroke();
+				}
+			}
+
+			this.ctx.strokeStyle = '#bbbbbb';
+			this.ctx.lineWidth = 1;
+		}
+
+		// styleToFont returns the canvas font of a cell style
+		this.styleToFont = function(style){
+			var font = (style.italic ? "italic " : "") + (style.bold ? "bold " : "");
+			font += style.fontSize ? style.fontSize + "pt " : "12px ";
+			font += style.fontFamily ? style.fontFamily : "Arial";
+			return font;
+		}
+
 		this.computeWLetterSize = function(){
 			var width = this.computeCellTextSize("W");
 			return width;
@@ -52,7 +52,9 @@
 
                         if (json[0] == 'SET'){
             
-                            for(var i = 1; i < json.length; i += 4){
+                            // each cell is sent as reference, value, formula, sheet, error message, displayed value, style ID,
+                            // the result of conditional formats and the message of the validation rule it breaks
+                            for(var i = 1; i < json.length; i += 9){
                                 var rowText = json[i].replace(/^\D+/g, '');
                                 var rowNumber = parseInt(rowText)-1;
                 
@@ -60,7 +62,7 @@
                                 var columnNumber = _this.app.lettersToIndex(columnText)-1;
                 
                                 var position = [rowNumber, columnNumber];
-                                _this.app.set(position,json[i+1], parseInt(json[i+3]));
+                                _this.app.set(position,json[i+1], parseInt(json[i+3]), json[i+4], json[i+5], parseInt(json[i+6]), json[i+7] ? JSON.parse(json[i+7]) : undefined, json[i+8]);
                                 
                                 // make sure to not trigger a re-send
                                 // filter empty response
@@ -80,6 +82,56 @@
                             _this.app.setSheets(json);
 
                         }
+                        else if(json[0] == "NAMES"){
+
+                            // pairs of name, formula
+                            var definedNames = [];
+                            for(var i = 1; i < json.length; i += 2){
+                                definedNames.push([json[i], json[i+1]]);
+                            }
+                            _this.app.definedNames = definedNames;
+
+                        }
+                        else if(json[0] == "FUNCTIONS"){
+
+                            // triples of name, syntax, description for autocomplete
+                            var functions = [];
+                            for(var i = 1; i < json.length; i += 3){
+                                functions.push({name: json[i], syntax: json[i+1], description: json[i+2]});
+                            }
+                            _this.app.functions = functions;
+
+                        }
+                        else if(json[0] == "STYLES"){
+
+                            // the style table, cells refer to a style by its position
+                            var styles = [];
+                            for(var i = 1; i < json.length; i++){
+                                styles.push(JSON.parse(json[i]));
+                            }
+                            _this.app.styles = styles;
+
+                        }
+                        else if(json[0] == "VALIDATION-ERROR"){
+
+                            // reference, sheet, message and whether the input was REJECTED or kept and FLAGGED
+                            if(json[4] == "REJECTED"){
+                                alert(json[1] + ": " + json[3]);
+                            }else{
+                                _this.app.console.append("<div class='message error'>" + escapeHtml(json[1] + ": " + json[3]) + "</div>");
+                                _this.app.console[0].scrollTop = _this.app.console[0].scrollHeight;
+                            }
+
+                        }
+                        else if(json[0] == "VALIDATION-OPTIONS"){
+
+                            // reference, sheet and the items of the list rule of the cell
+                            _this.app.showValidationOptions(json[1], parseInt(json[2]), json.slice(3));
+
+                        }
+                        else if(json[0] == "ITERATION"){
+                            _this.app.iteration = {enabled: json[1] == "true", maximumIterations: parseInt(json[2]), tolerance: parseFloat(json[3])};
+                        }
                         else if(json[0] == "INTERPRETER"){
                             var consoleText = json[1];
                             consoleText = escapeHtml(consoleText);
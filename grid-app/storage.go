@@ -0,0 +1,199 @@
+package main
+
+import (
+	"sort"
+)
+
+// Cells are only stored in grid.Data once something is set in them or refers to them, cells that
+// were never set read as empty. grid.SheetSizes is the logical size of a sheet, references outside
+// of it are invalid.
+
+type storedCell struct {
+	index  CellKey
+	row    int
+	column int
+	dv     *DynamicValue
+}
+
+// makeEmptyCell returns the value of a cell that was never set
+func makeEmptyCell(sheetIndex SheetID) *DynamicValue {
+	dv := makeDv("")
+	dv.SheetIndex = sheetIndex
+	return dv
+}
+
+// emptyCell is what cells that were never set read as on read paths, like evaluating formulas. It's
+// shared so it must never be changed or stored, write paths use getStoredDataFromRef.
+var emptyCell = &DynamicValue{ValueType: DynamicValueTypeString}
+
+// getCellValue returns the cell at key for reading, cells that were never set are emptyCell
+func getCellValue(key CellKey, grid *Grid) *DynamicValue {
+	if dv, ok := grid.Data[key]; ok {
+		return dv
+	}
+	return emptyCell
+}
+
+// rangeBounds returns the rows and columns of a range like "A1:B5", also when it's written from the
+// bottom right to the top left
+func rangeBounds(referenceRange ReferenceRange) (int, int, int, int) {
+
+	lowerRow, lowerColumn, upperRow, upperColumn := cellRangeBoundaries(referenceRange.String)
+
+	if upperRow < lowerRow {
+		lowerRow, upperRow = upperRow, lowerRow
+	}
+	if upperColumn < lowerColumn {
+		lowerColumn, upperColumn = upperColumn, lowerColumn
+	}
+
+	return lowerRow, lowerColumn, upperRow, upperColumn
+}
+
+// rangeCellCount returns the number of cells in a range, stored or not
+func rangeCellCount(referenceRange ReferenceRange) int {
+	lowerRow, lowerColumn, upperRow, upperColumn := rangeBounds(referenceRange)
+	return (upperRow - lowerRow + 1) * (upperColumn - lowerColumn + 1)
+}
+
+// storedRangeKeys returns the keys of the stored cells in a range in column major order, so a whole
+// column only costs the cells that hold something
+func storedRangeKeys(referenceRange ReferenceRange, grid *Grid) []CellKey {
+
+	lowerRow, lowerColumn, upperRow, upperColumn := rangeBounds(referenceRange)
+
+	keys := []CellKey{}
+
+	// small ranges are looked up cell by cell, large ones by going through the stored cells
+	if rangeCellCount(referenceRange) <= len(grid.Data) {
+
+		for column := lowerColumn; column <= upperColumn; column++ {
+			for row := lowerRow; row <= upperRow; row++ {
+				if key := makeCellKey(referenceRange.SheetIndex, row, column); grid.Data[key] != nil {
+					keys = append(keys, key)
+				}
+			}
+		}
+
+	} else {
+
+		for key := range grid.Data {
+			if key.SheetIndex() == referenceRange.SheetIndex && key.Row() >= lowerRow && key.Row() <= upperRow && key.Column() >= lowerColumn && key.Column() <= upperColumn {
+				keys = append(keys, key)
+			}
+		}
+
+		// the same order every time, sums of floats depend on it
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Column() != keys[j].Column() {
+				return keys[i].Column() < keys[j].Column()
+			}
+			return keys[i].Row() < keys[j].Row()
+		})
+	}
+
+	return keys
+}
+
+// storedRangeCells returns the values of the stored cells in a range in column major order, like
+// getDvsFromReferenceRange without the cells that were never set, for aggregates that skip empty cells
+func storedRangeCells(referenceRange ReferenceRange, grid *Grid) []*DynamicValue {
+
+	dvs := []*DynamicValue{}
+
+	for _, key := range storedRangeKeys(referenceRange, grid) {
+
+		dv := grid.Data[key]
+
+		// the formula cell of a spilled array holds the first value
+		if dv.ValueType == DynamicValueTypeArray {
+			dv = arrayFirstValue(dv)
+		}
+
+		dvs = append(dvs, dv)
+	}
+
+	return dvs
+}
+
+// getStoredDataFromRef returns the cell at reference like getDataFromRef, but stores an empty cell
+// first when it was never set, for changes to the cell that need to persist
+func getStoredDataFromRef(reference Reference, grid *Grid) *DynamicValue {
+
+	mapIndex := getCellKeyFromReference(reference)
+
+	// references that don't fit in a key get a cell that isn't stored
+	if mapIndex == noCellKey {
+		return makeEmptyCell(reference.SheetIndex)
+	}
+
+	markCellChanged(mapIndex, grid)
+
+	dv, ok := grid.Data[mapIndex]
+	if !ok {
+		dv = makeEmptyCell(reference.SheetIndex)
+		grid.Data[mapIndex] = dv
+	}
+
+	return dv
+}
+
+// isWithinSheet checks whether a reference is inside the bounds of an existing sheet
+func isWithinSheet(reference Reference, grid *Grid) bool {
+
+	if !sheetExists(reference.SheetIndex, grid) {
+		return false
+	}
+
+	row, column := parseCellString(reference.String)
+	sheetSize := getSheetSize(reference.SheetIndex, grid)
+
+	return row >= 1 && column >= 1 && row <= sheetSize.RowCount && column <= sheetSize.ColumnCount
+}
+
+// sheetCells returns the stored cells of a sheet inside its bounds, ordered by row and then column
+func sheetCells(sheetIndex SheetID, grid *Grid) []storedCell {
+
+	cells := []storedCell{}
+
+	if !sheetExists(sheetIndex, grid) {
+		return cells
+	}
+	sheetSize := getSheetSize(sheetIndex, grid)
+
+	for index, dv := range grid.Data {
+		if index.SheetIndex() == sheetIndex && index.Row() <= sheetSize.RowCount && index.Column() <= sheetSize.ColumnCount {
+			cells = append(cells, storedCell{index: index, row: index.Row(), column: index.Column(), dv: dv})
+		}
+	}
+
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].row != cells[j].row {
+			return cells[i].row < cells[j].row
+		}
+		return cells[i].column < cells[j].column
+	})
+
+	return cells
+}
+
+// isUnusedCell checks whether a stored cell is empty and isn't part of any computation
+func isUnusedCell(index CellKey, dv *DynamicValue, grid *Grid) bool {
+
+	if _, isDirty := grid.DirtyCells[index]; isDirty {
+		return false
+	}
+
+	return len(dv.DataFormula) == 0 && len(dv.Format) == 0 && dv.StyleID == defaultStyle && len(dv.DependIn) == 0 && len(dv.DependOut) == 0 && dv.SpillFrom == noCellKey
+}
+
+// removeUnusedCells removes the stored cells that read the same as cells that were never set, like
+// the empty cells of sheets from before cells were stored sparsely
+func removeUnusedCells(grid *Grid) {
+
+	for index, dv := range grid.Data {
+		if isUnusedCell(index, dv, grid) {
+			delete(grid.Data, index)
+		}
+	}
+}
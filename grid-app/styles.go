@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Cells refer to their presentation by a StyleID, the position of the style in grid.Styles. Cells that
+// look the same share one entry, so a styled sheet costs a number per cell. The first entry is the
+// default style, entries are never removed so the IDs in undo steps stay valid.
+type StyleID int32
+
+const defaultStyle StyleID = 0
+
+// CellStyle is the presentation of a cell, the zero value is the default look
+type CellStyle struct {
+	Bold            bool   `json:"bold,omitempty"`
+	Italic          bool   `json:"italic,omitempty"`
+	Underline       bool   `json:"underline,omitempty"`
+	FontFamily      string `json:"fontFamily,omitempty"`
+	FontSize        int    `json:"fontSize,omitempty"`  // in points, 0 for the default size
+	FontColor       string `json:"fontColor,omitempty"` // colours are like "#ff0000", empty for the default
+	FillColor       string `json:"fillColor,omitempty"`
+	BorderTop       string `json:"borderTop,omitempty"` // borders are thin, medium or thick, empty for none
+	BorderRight     string `json:"borderRight,omitempty"`
+	BorderBottom    string `json:"borderBottom,omitempty"`
+	BorderLeft      string `json:"borderLeft,omitempty"`
+	BorderColor     string `json:"borderColor,omitempty"`
+	HorizontalAlign string `json:"horizontalAlign,omitempty"` // left, center or right, empty to align by type
+	VerticalAlign   string `json:"verticalAlign,omitempty"`   // top, middle or bottom, empty for bottom
+}
+
+var borderStyles = map[string]bool{"": true, "thin": true, "medium": true, "thick": true}
+var horizontalAlignments = map[string]bool{"": true, "left": true, "center": true, "right": true}
+var verticalAlignments = map[string]bool{"": true, "top": true, "middle": true, "bottom": true}
+
+func defaultStyles() []CellStyle {
+	return []CellStyle{CellStyle{}}
+}
+
+// getStyle returns the style of a cell, the default style for IDs that aren't in the table
+func getStyle(styleID StyleID, grid *Grid) CellStyle {
+
+	if styleID < 0 || int(styleID) >= len(grid.Styles) {
+		return CellStyle{}
+	}
+
+	return grid.Styles[styleID]
+}
+
+// getStyleID returns the ID of a style, it's added to the table when no cell used it before
+func getStyleID(style CellStyle, grid *Grid) StyleID {
+
+	for styleID, otherStyle := range grid.Styles {
+		if otherStyle == style {
+			return StyleID(styleID)
+		}
+	}
+
+	grid.Styles = append(grid.Styles, style)
+	return StyleID(len(grid.Styles) - 1)
+}
+
+func isValidColor(color string) bool {
+
+	if len(color) == 0 {
+		return true
+	}
+
+	if color[0] != '#' || (len(color) != 4 && len(color) != 7) {
+		return false
+	}
+
+	_, err := strconv.ParseUint(color[1:], 16, 32)
+	return err == nil
+}
+
+// setStyleProperty changes one property of a style, value is the property as sent by the client
+func setStyleProperty(style *CellStyle, property string, value string) error {
+
+	switch property {
+	case "bold", "italic", "underline":
+
+		isSet, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New(property + " should be true or false")
+		}
+
+		switch property {
+		case "bold":
+			style.Bold = isSet
+		case "italic":
+			style.Italic = isSet
+		case "underline":
+			style.Underline = isSet
+		}
+
+	case "font-family":
+		style.FontFamily = value
+
+	case "font-size":
+
+		if len(value) == 0 {
+			style.FontSize = 0
+			return nil
+		}
+
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > 400 {
+			return errors.New("the font size should be a whole number from 1 to 400")
+		}
+		style.FontSize = size
+
+	case "font-color", "fill-color", "border-color":
+
+		color := strings.ToLower(value)
+		if !isValidColor(color) {
+			return errors.New("colours should be like #ff0000, " + value + " isn't")
+		}
+
+		switch property {
+		case "font-color":
+			style.FontColor = color
+		case "fill-color":
+			style.FillColor = color
+		case "border-color":
+			style.BorderColor = color
+		}
+
+	case "border-top", "border-right", "border-bottom", "border-left", "borders":
+
+		if !borderStyles[value] {
+			return errors.New("borders should be thin, medium, thick or empty, " + value + " isn't")
+		}
+
+		switch property {
+		case "border-top":
+			style.BorderTop = value
+		case "border-right":
+			style.BorderRight = value
+		case "border-bottom":
+			style.BorderBottom = value
+		case "border-left":
+			style.BorderLeft = value
+		case "borders":
+			style.BorderTop = value
+			style.BorderRight = value
+			style.BorderBottom = value
+			style.BorderLeft = value
+		}
+
+	case "horizontal-align":
+
+		if !horizontalAlignments[value] {
+			return errors.New("the horizontal alignment should be left, center or right, " + value + " isn't")
+		}
+		style.HorizontalAlign = value
+
+	case "vertical-align":
+
+		if !verticalAlignments[value] {
+			return errors.New("the vertical alignment should be top, middle or bottom, " + value + " isn't")
+		}
+		style.VerticalAlign = value
+
+	case "clear":
+		*style = CellStyle{}
+
+	default:
+		return errors.New("unknown style property " + property)
+	}
+
+	return nil
+}
+
+// setCellStyle changes a style property of the cells in a range and returns the cells that changed.
+// The outline property sets the borders on the edges of the range only.
+func setCellStyle(cellRange ReferenceRange, property string, value string, grid *Grid) ([]Reference, error) {
+
+	outline := property == "border-outline"
+	if outline {
+		property = "borders"
+	}
+
+	// check the property before changing any cell
+	if err := setStyleProperty(&CellStyle{}, property, value); err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(cellRange.String, ":") {
+		cellRange.String = cellRange.String + ":" + cellRange.String
+	}
+	lowerRow, lowerColumn, upperRow, upperColumn := cellRangeBoundaries(cellRange.String)
+
+	references := []Reference{}
+
+	for _, reference := range cellRangeToCells(cellRange) {
+
+		if !isWithinSheet(reference, grid) {
+			continue
+		}
+
+		index := getCellKeyFromReference(reference)
+
+		styleID := defaultStyle
+		if dv, ok := grid.Data[index]; ok {
+			styleID = dv.StyleID
+		}
+
+		style := getStyle(styleID, grid)
+
+		if outline {
+
+			row, column := parseCellString(reference.String)
+			if row == lowerRow {
+				style.BorderTop = value
+			}
+			if row == upperRow {
+				style.BorderBottom = value
+			}
+			if column == lowerColumn {
+				style.BorderLeft = value
+			}
+			if column == upperColumn {
+				style.BorderRight = value
+			}
+
+		} else {
+			setStyleProperty(&style, property, value)
+		}
+
+		newStyleID := getStyleID(style, grid)
+		if newStyleID == styleID {
+			continue
+		}
+
+		getStoredDataFromRef(reference, grid).StyleID = newStyleID
+		references = append(references, reference)
+	}
+
+	return references, nil
+}
+
+// sendStyles sends the style table, the cells refer to it by the style ID in SET
+func sendStyles(c *Client, grid *Grid) {
+
+	jsonData := []string{"STYLES"}
+	for _, style := range grid.Styles {
+		styleJSON, _ := json.Marshal(style)
+		jsonData = append(jsonData, string(styleJSON))
+	}
+
+	json, _ := json.Marshal(jsonData)
+	c.send <- json
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"strconv"
+	"strings"
+
+	"./functions"
 )
 
 var testCount int
@@ -11,8 +16,7 @@ var debug bool
 
 func runTests() {
 
-	debug = false
-	debug = true
+	debug = *debugTests
 
 	testCount = 0
 	testFailCount = 0
@@ -24,13 +28,13 @@ func runTests() {
 	sheetSizes := []SheetSize{SheetSize{RowCount: rowCount, ColumnCount: columnCount}, SheetSize{RowCount: rowCount, ColumnCount: columnCount}}
 
 	// For now make this a two way mapping for ordered loops and O(1) access times -- aware of redundancy of state which could cause problems
-	sheetNames := make(map[string]int8)
+	sheetNames := make(map[string]SheetID)
 	sheetNames["Sheet1"] = 0
 	sheetNames["Sheet2"] = 1
 
 	sheetList := []string{"Sheet1", "Sheet2"}
 
-	grid := Grid{Data: make(map[string]*DynamicValue), PerformanceCounting: make(map[string]int), DirtyCells: make(map[string]bool), ActiveSheet: 0, SheetNames: sheetNames, SheetList: sheetList, SheetSizes: sheetSizes}
+	grid := Grid{Data: make(map[CellKey]*DynamicValue), PerformanceCounting: make(map[string]int), DirtyCells: make(map[CellKey]bool), ActiveSheet: 0, SheetNames: sheetNames, SheetList: sheetList, SheetSizes: sheetSizes, NextSheetID: 2, DefinedNames: make(map[string]*DefinedName), SpillAnchors: make(map[CellKey]SpillArea), RangeDependents: make(map[string]map[CellKey]bool), VolatileCells: make(map[CellKey]bool), VolatileFunctions: make(map[string]bool), Iteration: defaultIterationSettings(), Styles: defaultStyles()}
 
 	if !debug {
 
@@ -40,7 +44,8 @@ func runTests() {
 		testFormula("0.1 + 0.2 * 0.3 / 0.1", true)
 		testFormula("0.1 + 0.2 * 0.3 / 0.1A", false)
 		testFormula("A1 * A20 + 0.2 - \"abc\"", true)
-		testFormula("A1 * A + 0.2 - \"abc\"", false)
+		// a bare "A" is a defined name, formulas using it compile and give #NAME? until it's defined
+		testFormula("A1 * A + 0.2 - \"abc\"", true)
 		testFormula("SUM(A1:10, 10)", false)
 		testFormula("A1 ^^ 10", false)
 		testFormula("A1 ^ 10", true)
@@ -49,7 +54,7 @@ func runTests() {
 		testFormula("SUM(A1 ^ 10, 1, A1.05)", false)
 		testFormula("A.01", false)
 		testFormula("A10+0.01", true)
-		testFormula("A10+A", false)
+		testFormula("A10+A", true)
 		testFormula("$A$10+$A1+A$2", true)
 
 		// dollar fixing references
@@ -118,6 +123,608 @@ func runTests() {
 		testString(someReferences[2], "A10")
 		testString(someReferences[3], "Blad15!$A$100")
 
+		testString(findReferenceStrings("\"C:\\\\\" + A1")[0], "A1")
+
+		// evaluation
+		testFormula("SUM(1", false)
+		testFormula("my_function(A1, 2)", true)
+		testFormula("1.5e3 + 2", true)
+
+		grid.Data[testKey("0!A1")] = &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: 5, DataFormula: "5", DependIn: make(map[CellKey]bool), DependOut: make(map[CellKey]bool)}
+
+		testEvaluate("1+2*3", "7", &grid)
+		testEvaluate("(1+2)*3", "9", &grid)
+		testEvaluate("-2^2", "4", &grid)
+		testEvaluate("2^3^2", "64", &grid)
+		testEvaluate("10+-10/10--10", "19", &grid)
+		testEvaluate("A1*-2", "-10", &grid)
+		testEvaluate("-A1+1", "-4", &grid)
+		testEvaluate("SUM(1, SUM(A1, 3), 1.5e1)", "24", &grid)
+		testEvaluate("CONCATENATE(\"a\\\"b\", LEN(\"abc\"))", "a\"b3", &grid)
+		testEvaluate("\"C:\\\\\"", "C:\\", &grid)
+		testEvaluate("1 < 2", "TRUE", &grid)
+		testEvaluate("true", "TRUE", &grid)
+		testEvaluate("Sheet2!A1", "", &grid)
+		testEvaluate("SUM(A1:A3)", "5", &grid)
+		testEvaluate("SUM(1", "#ERROR!", &grid)
+
+		// error values
+		testEvaluate("1/0", "#DIV/0!", &grid)
+		testEvaluate("\"abc\" + 1", "#VALUE!", &grid)
+		testEvaluate("1 + #N/A", "#N/A", &grid)
+		testEvaluate("SUM(1, 1/0)", "#DIV/0!", &grid)
+		testEvaluate("SQRT(-1)", "#NUM!", &grid)
+		testEvaluate("Sheet9!A1", "#REF!", &grid)
+		testEvaluate("unknown_name + 1", "#NAME?", &grid)
+		testEvaluate("IFERROR(1/0, \"x\")", "x", &grid)
+		testEvaluate("ISERROR(1/0)", "TRUE", &grid)
+		testEvaluate("ISNA(#N/A)", "TRUE", &grid)
+		testEvaluate("IF(TRUE, 1, 1/0)", "1", &grid)
+
+		// lookups, table on Sheet2
+		for i, name := range []string{"ten", "twenty", "thirty", "forty"} {
+			testSetCell("1!A"+strconv.Itoa(i+1), &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: float64((i + 1) * 10)}, &grid)
+			testSetCell("1!B"+strconv.Itoa(i+1), &DynamicValue{ValueType: DynamicValueTypeString, DataString: name}, &grid)
+		}
+		testSetCell("1!C1", &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: 1}, &grid)
+		testSetCell("1!D1", &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: 2}, &grid)
+		testSetCell("1!C2", &DynamicValue{ValueType: DynamicValueTypeString, DataString: "x"}, &grid)
+		testSetCell("1!D2", &DynamicValue{ValueType: DynamicValueTypeString, DataString: "y"}, &grid)
+
+		testEvaluate("VLOOKUP(20, Sheet2!A1:B4, 2)", "twenty", &grid)
+		testEvaluate("VLOOKUP(25, Sheet2!A1:B4, 2)", "#N/A", &grid)
+		testEvaluate("VLOOKUP(25, Sheet2!A1:B4, 2, TRUE)", "twenty", &grid)
+		testEvaluate("VLOOKUP(20, Sheet2!A1:B4, 3)", "#REF!", &grid)
+		testEvaluate("HLOOKUP(2, Sheet2!C1:D2, 2)", "y", &grid)
+		testEvaluate("MATCH(\"THIRTY\", Sheet2!B1:B4, 0)", "3", &grid)
+		testEvaluate("MATCH(35, Sheet2!A1:A4)", "3", &grid)
+		testEvaluate("INDEX(Sheet2!A1:B4, MATCH(40, Sheet2!A1:A4, 0), 2)", "forty", &grid)
+		testEvaluate("SUM(INDEX(Sheet2!A1:B4, 0, 1))", "100", &grid)
+		testEvaluate("XLOOKUP(\"tw*\", Sheet2!B1:B4, Sheet2!A1:A4, \"none\", 2)", "20", &grid)
+		testEvaluate("XLOOKUP(35, Sheet2!A1:A4, Sheet2!B1:B4, \"none\")", "none", &grid)
+		testEvaluate("XLOOKUP(35, Sheet2!A1:A4, Sheet2!B1:B4, \"none\", 1)", "forty", &grid)
+		testEvaluate("XLOOKUP(35, Sheet2!A1:A4, Sheet2!B1:B4, \"none\", -1, -1)", "thirty", &grid)
+
+		// conditional aggregation
+		testEvaluate("SUMIF(Sheet2!A1:A4, \">15\")", "90", &grid)
+		testEvaluate("SUMIF(Sheet2!B1:B4, \"t*\", Sheet2!A1:A4)", "60", &grid)
+		testEvaluate("SUMIF(Sheet2!A1:A4, \">0\", Sheet2!B1:B2)", "#VALUE!", &grid)
+		testEvaluate("SUMIFS(Sheet2!A1:A4, Sheet2!A1:A4, \">10\", Sheet2!A1:A4, \"<40\")", "50", &grid)
+		testEvaluate("COUNTIF(Sheet2!B1:B4, \"<>ten\")", "3", &grid)
+		testEvaluate("COUNTIF(Sheet2!A1:A4, 20)", "1", &grid)
+		testEvaluate("COUNTIFS(Sheet2!A1:A4, \">=20\", Sheet2!B1:B4, \"*y\")", "3", &grid)
+		testEvaluate("AVERAGEIF(Sheet2!A1:A4, \"<=20\")", "15", &grid)
+		testEvaluate("AVERAGEIF(Sheet2!A1:A4, \">100\")", "#DIV/0!", &grid)
+		testEvaluate("MAXIFS(Sheet2!A1:A4, Sheet2!B1:B4, \"t*\")", "30", &grid)
+		testEvaluate("MINIFS(Sheet2!A1:A4, Sheet2!B1:B4, \"f?rty\")", "40", &grid)
+
+		// text functions
+		testEvaluate("LEN(\"héllo wörld\")", "11", &grid)
+		testEvaluate("LEFT(\"héllo\", 2)", "hé", &grid)
+		testEvaluate("RIGHT(\"héllo\")", "o", &grid)
+		testEvaluate("MID(\"日本語テキスト\", 3, 2)", "語テ", &grid)
+		testEvaluate("FIND(\"l\", \"héllo\")", "3", &grid)
+		testEvaluate("FIND(\"L\", \"héllo\")", "#VALUE!", &grid)
+		testEvaluate("SEARCH(\"L?o\", \"héllo\")", "3", &grid)
+		testEvaluate("SUBSTITUTE(\"a-b-c\", \"-\", \"+\")", "a+b+c", &grid)
+		testEvaluate("SUBSTITUTE(\"a-b-c\", \"-\", \"+\", 2)", "a-b+c", &grid)
+		testEvaluate("TRIM(\"  a   b \")", "a b", &grid)
+		testEvaluate("UPPER(\"héllo\")", "HÉLLO", &grid)
+		testEvaluate("LOWER(\"ÀB\")", "àb", &grid)
+		testEvaluate("TEXT(1234.567, \"#,##0.00\")", "1,234.57", &grid)
+		testEvaluate("TEXT(0.256, \"0.0%\")", "25.6%", &grid)
+		testEvaluate("TEXT(-5, \"0;(0)\")", "(5)", &grid)
+		testEvaluate("TEXT(12345, \"0.00E+00\")", "1.23E+04", &grid)
+		testEvaluate("SPLIT(\"a,b;c\", \",;\")", "a", &grid)
+		testEvaluate("REGEXMATCH(\"order-123\", \"[0-9]+$\")", "TRUE", &grid)
+		testEvaluate("REGEXEXTRACT(\"order-123\", \"-([0-9]+)\")", "123", &grid)
+		testEvaluate("REGEXREPLACE(\"a1b2\", \"[0-9]\", \"\")", "ab", &grid)
+		testEvaluate("REGEXMATCH(\"a\", \"(\")", "#VALUE!", &grid)
+
+		// dates
+		testEvaluate("DATE(2020, 1, 31)", "2020-01-31", &grid)
+		testEvaluate("DATE(2020, 1, 31) + 1", "2020-02-01", &grid)
+		testEvaluate("DATE(2020, 3, 1) - DATE(2020, 2, 1)", "29", &grid)
+		testEvaluate("DATE(2020, 1, 31) + TIME(13, 5, 0)", "2020-01-31 13:05:00", &grid)
+		testEvaluate("NUMBER(DATE(2020, 1, 1))", "43831", &grid)
+		testEvaluate("EDATE(DATE(2020, 1, 31), 1)", "2020-02-29", &grid)
+		testEvaluate("EOMONTH(DATE(2021, 1, 15), 1)", "2021-02-28", &grid)
+		testEvaluate("DATEDIF(DATE(2019, 5, 20), DATE(2021, 3, 10), \"M\")", "21", &grid)
+		testEvaluate("DATEDIF(DATE(2019, 5, 20), DATE(2021, 3, 10), \"MD\")", "18", &grid)
+		testEvaluate("DATEDIF(DATE(2021, 1, 1), DATE(2020, 1, 1), \"D\")", "#NUM!", &grid)
+		testEvaluate("WEEKDAY(DATE(2020, 1, 31))", "6", &grid)
+		testEvaluate("WEEKDAY(DATE(2020, 1, 31), 2)", "5", &grid)
+		testEvaluate("DATEVALUE(\"2020-01-31T10:00:00\") > DATE(2020, 1, 31)", "TRUE", &grid)
+		testEvaluate("YEAR(\"Jan 5, 2021\")", "2021", &grid)
+		testEvaluate("TEXT(DATE(2020, 1, 5), \"d mmm yyyy\")", "5 Jan 2020", &grid)
+		testEvaluate("TEXT(DATE(2020, 1, 5) + TIME(14, 7, 0), \"hh:mm AM/PM\")", "02:07 PM", &grid)
+
+		dayFirstSerial, _ := parseDateString("31/01/2020", detectDayFirst([]string{"05/01/2020", "31/01/2020"}))
+		testString(formatDate(dayFirstSerial), "2020-01-31")
+
+		// defined names
+		testBool(defineName("TaxRate", "=0.21", 0, &grid) == nil, true)
+		testBool(defineName("Sales", "A1:A4", 1, &grid) == nil, true)
+		testString(getDefinedName("SALES", &grid).Formula, "Sheet2!A1:A4")
+		testEvaluate("TaxRate * 100", "21", &grid)
+		testEvaluate("SUM(Sales) * taxrate", "21", &grid)
+		testBool(findNameReferences("SUM(Sales)", &grid)[Reference{String: "A4", SheetIndex: 1}], true)
+		testBool(defineName("B2", "1", 0, &grid) == nil, false)
+		testBool(defineName("Loop", "Loop + 1", 0, &grid) == nil, false)
+		testBool(renameName("Sales", "Revenue", &grid) == nil, true)
+		testEvaluate("SUM(Revenue)", "100", &grid)
+		testEvaluate("SUM(Sales)", "#NAME?", &grid)
+		testEvaluate("A * 2", "#NAME?", &grid)
+		testBool(defineName("A", "5", 0, &grid) == nil, true)
+		testEvaluate("A * 2", "10", &grid)
+		deleteName("A", &grid)
+		testString(renameNameInFormula("SUM(Sales) + sales.total", "Sales", "Revenue"), "SUM(Revenue) + sales.total")
+		testString(renameNameInFormula("LET(x, 2, rate*x)", "rate", "y"), "LET(x, 2, y*x)")
+		testString(renameNameInFormula("LET(rate, rate + 1, rate*2) + rate", "rate", "y"), "LET(rate, y + 1, rate*2) + y")
+		testString(renameNameInFormula("LAMBDA(rate, rate * Rate)", "rate", "y"), "LAMBDA(rate, rate * Rate)")
+		testBool(isNameCaptured("LET(x, 2, rate*x)", "rate", "x") && isNameCaptured("LAMBDA(x, x * rate)", "rate", "x"), true)
+		testBool(isNameCaptured("LET(x, rate, x) + x", "rate", "x"), false)
+		testBool(defineName("Rate", "0.5", 0, &grid) == nil && defineName("Doubled", "LET(x, 2, Rate*x)", 0, &grid) == nil, true)
+		testBool(renameName("Rate", "x", &grid) == nil, false)
+		testBool(getDefinedName("Rate", &grid) != nil && grid.DefinedNames["DOUBLED"].Formula == "LET(x, 2, Rate*x)", true)
+		testBool(defineName("Doubled", "LAMBDA(x, x * Rate)", 0, &grid) == nil, true)
+		testBool(renameName("Rate", "x", &grid) == nil, false)
+		testBool(renameName("Rate", "Factor", &grid) == nil && grid.DefinedNames["DOUBLED"].Formula == "LAMBDA(x, x * Factor)", true)
+		deleteName("Doubled", &grid)
+		deleteName("Factor", &grid)
+		testBool(defineName("X", "Z + 1", 0, &grid) == nil, true)
+		testBool(defineName("Y", "X", 0, &grid) == nil, true)
+		testBool(renameName("Y", "Z", &grid) == nil, false)
+		testEvaluate("Y", "#NAME?", &grid)
+		grid.DefinedNames["CYCLE"] = &DefinedName{Name: "Cycle", Formula: "Cycle + 1"}
+		testEvaluate("Cycle", "#CALC!", &grid)
+		testBool(grid.DefinedNames["CYCLE"].compiled == nil, true)
+		compileDefinitions(&grid)
+		testBool(grid.DefinedNames["CYCLE"].compiled != nil && compiledDefinition(grid.DefinedNames["CYCLE"]) == grid.DefinedNames["CYCLE"].compiled, true)
+		delete(grid.DefinedNames, "CYCLE")
+		deleteName("X", &grid)
+		deleteName("Y", &grid)
+		testBool(deleteName("TaxRate", &grid) == nil, true)
+		testEvaluate("TaxRate * 100", "#NAME?", &grid)
+
+		// arrays and spilling
+		testEvaluate("SUM(SEQUENCE(4))", "10", &grid)
+		testEvaluate("SUM(Sheet2!A1:A4 * 2)", "200", &grid)
+		testEvaluate("SORT(Sheet2!B1:B4)", "forty", &grid)
+		testEvaluate("SORT(Sheet2!A1:A4, 1, -1)", "40", &grid)
+		testEvaluate("SUM(FILTER(Sheet2!A1:A4, Sheet2!A1:A4 > 15))", "90", &grid)
+		testEvaluate("FILTER(Sheet2!A1:A4, Sheet2!A1:A4 > 50)", "#CALC!", &grid)
+		testEvaluate("COUNT(UNIQUE(SEQUENCE(3, 1, 1, 0)))", "1", &grid)
+		testEvaluate("TRANSPOSE(Sheet2!C1:D2)", "1", &grid)
+
+		testSetFormula("E1", "C5 * 10", &grid)
+		testSetFormula("C3", "SEQUENCE(3)", &grid)
+		testString(convertToString(grid.Data[testKey("0!C5")]).DataString, "3")
+		testString(convertToString(grid.Data[testKey("0!E1")]).DataString, "30")
+		testSetFormula("C3", "SEQUENCE(2)", &grid)
+		testString(convertToString(grid.Data[testKey("0!C5")]).DataString, "")
+		testString(convertToString(grid.Data[testKey("0!E1")]).DataString, "0")
+		testSetFormula("C4", "\"blocked\"", &grid)
+		testString(convertToString(grid.Data[testKey("0!C3")]).DataString, "#SPILL!")
+		testSetFormula("C4", "", &grid)
+		testString(convertToString(grid.Data[testKey("0!C4")]).DataString, "2")
+		testEvaluate("SUM(C3:C5)", "3", &grid)
+
+		// whole columns and rows
+		testFormula("SUM(A:A)", true)
+		testFormula("SUM(3:5) + SUM(Sheet2!$B:C)", true)
+		testFormula("SUM(A:3)", false)
+		testEvaluate("SUM(Sheet2!A:A)", "100", &grid)
+		testEvaluate("SUM(Sheet2!Z:Z)", "#REF!", &grid)
+		testEvaluate("COUNT(Sheet2!A:A)", "4", &grid)
+		testEvaluate("AVERAGE(Sheet2!A1:A5)", "20", &grid)
+		testEvaluate("SUM(Sheet2!A1:A1000000)", "100", &grid)
+		testBool(emptyCell.ValueType == DynamicValueTypeString && len(emptyCell.DataString) == 0 && emptyCell.DependIn == nil, true)
+		testSetFormula("F1", "SUM(G:G)", &grid)
+		testSetFormula("G5", "7", &grid)
+		testString(convertToString(grid.Data[testKey("0!F1")]).DataString, "7")
+		shiftWholeRanges(0, true, 7, 1, &grid)
+		testString(grid.Data[testKey("0!F1")].DataFormula, "SUM(H:H)")
+		shiftWholeRanges(0, true, 8, -1, &grid)
+		computeDirtyCells(&grid, nil)
+		testString(convertToString(grid.Data[testKey("0!F1")]).DataString, "#REF!")
+		testString(moveWholeRanges("SUM(A:$B) + SUM(3:3)", 2, 1), "SUM(B:$B) + SUM(5:5)")
+
+		// statistics
+		testEvaluate("MAX(Sheet2!A:A)", "40", &grid)
+		testEvaluate("MIN(Sheet2!A1:B4, 5)", "5", &grid)
+		testEvaluate("MIN(\"abc\")", "#VALUE!", &grid)
+		testEvaluate("MEDIAN(Sheet2!A1:A4)", "25", &grid)
+		testEvaluate("VAR.P(Sheet2!A1:A4)", "125", &grid)
+		testEvaluate("STDEV(10)", "#DIV/0!", &grid)
+		testEvaluate("PERCENTILE(Sheet2!A1:A4, 0.25)", "17.5", &grid)
+		testEvaluate("QUARTILE(Sheet2!A1:A4, 3)", "32.5", &grid)
+		testEvaluate("PERCENTILE(Sheet2!A1:A4, 2)", "#NUM!", &grid)
+		testEvaluate("CORREL(Sheet2!A1:A4, SEQUENCE(4))", "1", &grid)
+		testEvaluate("RANK(30, Sheet2!A:A)", "2", &grid)
+		testEvaluate("RANK(30, Sheet2!A1:A4, 1)", "3", &grid)
+		testEvaluate("RANK(35, Sheet2!A1:A4)", "#N/A", &grid)
+
+		// matrices and regression
+		testEvaluate("SUM(MMULT(SEQUENCE(1, 3), SEQUENCE(3)))", "14", &grid)
+		testEvaluate("MMULT(SEQUENCE(2), SEQUENCE(2))", "#VALUE!", &grid)
+		testEvaluate("MDETERM(SEQUENCE(2, 2))", "-2", &grid)
+		testEvaluate("MINVERSE(MMULT(SEQUENCE(2), SEQUENCE(1, 2)))", "#NUM!", &grid)
+		testEvaluate("ABS(LINEST(Sheet2!A1:A5) - 10) < 0.000001", "TRUE", &grid)
+		testEvaluate("ABS(INDEX(LINEST(Sheet2!A1:A4, SEQUENCE(4), TRUE, TRUE), 3, 1) - 1) < 0.000001", "TRUE", &grid)
+		testEvaluate("INDEX(LINEST(Sheet2!A1:A4, SEQUENCE(4), FALSE, TRUE), 2, 2)", "#N/A", &grid)
+		testEvaluate("ABS(LOGEST(2 ^ SEQUENCE(3)) - 2) < 0.000001", "TRUE", &grid)
+		testEvaluate("LINEST(Sheet2!A1:A4, MMULT(SEQUENCE(4), SEQUENCE(1, 2)))", "#NUM!", &grid)
+
+		// financial functions, compared with the reference values of other spreadsheets
+		for index, value := range []float64{-70000, 12000, 15000, 18000, 21000, 26000} {
+			testSetCell("1!F"+strconv.Itoa(index+1), &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value}, &grid)
+		}
+		for index, value := range []float64{-10000, 2750, 4250, 3250, 2750} {
+			testSetCell("1!G"+strconv.Itoa(index+1), &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: value}, &grid)
+		}
+		for index, date := range []string{"2008-01-01", "2008-03-01", "2008-10-30", "2009-02-15", "2009-04-01"} {
+			serial, _ := parseDateString(date, false)
+			testSetCell("1!H"+strconv.Itoa(index+1), makeDateDv(serial), &grid)
+		}
+		testEvaluate("ABS(PMT(0.08 / 12, 10, 10000) + 1037.0321) < 0.0001", "TRUE", &grid)
+		testEvaluate("ABS(FV(0.06 / 12, 10, -200, -500, 1) - 2581.4034) < 0.0001", "TRUE", &grid)
+		testEvaluate("ABS(PV(0.08 / 12, 12 * 20, 500) + 59777.1458) < 0.0001", "TRUE", &grid)
+		testEvaluate("ABS(NPER(0.12 / 12, -100, -1000, 10000, 1) - 59.6738657) < 0.0001", "TRUE", &grid)
+		testEvaluate("ABS(NPV(0.1, -10000, 3000, 4200, 6800) - 1188.4434) < 0.0001", "TRUE", &grid)
+		testEvaluate("ABS(IRR(Sheet2!F1:F6) - 0.0866309) < 0.000001", "TRUE", &grid)
+		testEvaluate("ABS(RATE(4 * 12, -200, 8000) - 0.0077014) < 0.000001", "TRUE", &grid)
+		testEvaluate("ABS(XNPV(0.09, Sheet2!G1:G5, Sheet2!H1:H5) - 2086.6476) < 0.0001", "TRUE", &grid)
+		testEvaluate("ABS(XIRR(Sheet2!G1:G5, Sheet2!H1:H5) - 0.3733625) < 0.000001", "TRUE", &grid)
+		testEvaluate("IRR(Sheet2!A1:A4)", "#NUM!", &grid)
+		testEvaluate("XIRR(Sheet2!G1:G5, Sheet2!H1:H4)", "#NUM!", &grid)
+
+		// LET and LAMBDA
+		testEvaluate("LET(x, 2, y, x * 3, x + y)", "8", &grid)
+		testEvaluate("LET(x, 1, LET(x, 5, x) + x)", "6", &grid)
+		testEvaluate("LET(r, Sheet2!A1:A4, SUM(r) / COUNT(r))", "25", &grid)
+		testEvaluate("LET(1, 2, 3)", "#VALUE!", &grid)
+		testBool(defineName("Double", "LAMBDA(x, x * 2)", 0, &grid) == nil, true)
+		testBool(defineName("Hypotenuse", "=LAMBDA(a, b, SQRT(a ^ 2 + b ^ 2))", 0, &grid) == nil, true)
+		testBool(defineName("Forever", "LAMBDA(x, Forever(x))", 0, &grid) == nil, false)
+		testEvaluate("Double(21)", "42", &grid)
+		testEvaluate("Hypotenuse(3, Double(2))", "5", &grid)
+		testEvaluate("Double(1, 2)", "#VALUE!", &grid)
+		testEvaluate("Double", "#CALC!", &grid)
+		testBool(defineName("Scaled", "LAMBDA(x, x * $J$10)", 0, &grid) == nil, true)
+		testSetFormula("I10", "Scaled(2)", &grid)
+		testSetFormula("J10", "5", &grid)
+		testString(convertToString(grid.Data[testKey("0!I10")]).DataString, "10")
+
+		// function registry
+		testEvaluate("SQRT(4, 9)", "#VALUE!", &grid)
+		testEvaluate("NA(1)", "#VALUE!", &grid)
+		testEvaluate("LEN(Sheet2!A1:A4)", "#VALUE!", &grid)
+		testEvaluate("COUNTIFS(Sheet2!A1:A4, \">10\", Sheet2!A1:A4, \"<40\")", "2", &grid)
+		testString(parse(makeDv("IRR(1, 2, 3)"), &grid, Reference{String: "B1", SheetIndex: 0}).ErrorMessage, "IRR requires 1 or 2 arguments")
+		testString(parse(makeDv("SUMIFS(1, 2)"), &grid, Reference{String: "B1", SheetIndex: 0}).ErrorMessage, "SUMIFS requires at least 3 arguments")
+		testString(functions.Lookup("AVERAGEIFS").Syntax, "AVERAGEIFS(value_range, range1, criterion1, [range2, criterion2], ...)")
+		testBool(functions.Lookup("NOW").IsVolatile && !functions.Lookup("SUM").IsVolatile, true)
+		testBool(functions.Lookup("sum") == nil, true)
+		functions.Register(&functions.Definition{Name: "TESTDOUBLESUM", MinimumArguments: 1, MaximumArguments: 1, ArgumentKinds: []functions.ArgumentKind{functions.Range},
+			Call: func(call *functions.Call) functions.Value {
+				total := 0.0
+				for _, value := range call.Arguments[0].Values() {
+					if value.Type != functions.NumberType {
+						return functions.NewError(functions.ErrorValue, "TESTDOUBLESUM takes numbers")
+					}
+					total += value.Number
+				}
+				return functions.NewNumber(total * 2)
+			}})
+		testEvaluate("TESTDOUBLESUM(Sheet2!A1:A4)", "200", &grid)
+		testEvaluate("TESTDOUBLESUM(Sheet2!B1:B4)", "#VALUE!", &grid)
+		testEvaluate("TESTDOUBLESUM(1, 2)", "#VALUE!", &grid)
+
+		// volatile cells and recalculation
+		testSetFormula("H7", "RAND()", &grid)
+		testSetFormula("H8", "H7 * 2", &grid)
+		randomValue := grid.Data[testKey("0!H7")].DataFloat
+		testBool(grid.VolatileCells[testKey("0!H7")] && !grid.VolatileCells[testKey("0!H8")], true)
+		testSetFormula("H9", "1", &grid)
+		testBool(grid.Data[testKey("0!H7")].DataFloat != randomValue && grid.Data[testKey("0!H8")].DataFloat == grid.Data[testKey("0!H7")].DataFloat*2, true)
+		testSetFormula("H7", "0.5", &grid)
+		testBool(grid.VolatileCells[testKey("0!H7")], false)
+		testBool(defineName("Noise", "LAMBDA(x, x + RAND())", 0, &grid) == nil, true)
+		testBool(isVolatileFormula("Noise(1) + 1", &grid), true)
+		registerVolatileFunction("fetch_price", &grid)
+		testBool(isVolatileFormula("fetch_price(\"A\")", &grid), true)
+		grid.Data[testKey("0!H8")].DataFloat = 0
+		markAllDirty(0, &grid)
+		computeDirtyCells(&grid, nil)
+		testString(convertToString(grid.Data[testKey("0!H8")]).DataString, "1")
+
+		// circular references and iterative calculation
+		testSetFormula("I3", "I1 * 2", &grid)
+		testSetFormula("I1", "J1 + 1", &grid)
+		testSetFormula("J1", "I1", &grid)
+		testString(grid.Data[testKey("0!I1")].ErrorMessage, "Circular reference: I1 -> J1 -> I1")
+		testString(grid.Data[testKey("0!J1")].ErrorMessage, "Circular reference: J1 -> I1 -> J1")
+		testString(convertToString(grid.Data[testKey("0!I3")]).DataString, "#REF!")
+		testBool(setIterationSettings("true", "0", "0.001", &grid) != nil, true)
+		testBool(setIterationSettings("true", "100", "0.0001", &grid) == nil, true)
+		testSetFormula("I2", "J2 / 2 + 1", &grid)
+		testSetFormula("J2", "I2", &grid)
+		testString(strconv.FormatFloat(grid.Data[testKey("0!I2")].DataFloat, 'f', 2, 64)+" "+strconv.FormatFloat(grid.Data[testKey("0!J2")].DataFloat, 'f', 2, 64), "2.00 2.00")
+		testBool(setIterationSettings("false", "100", "0.001", &grid) == nil, true)
+
+		// cells that are ready together are computed concurrently
+		for row := 1; row <= 10; row++ {
+			formulas := map[string]string{"I": strconv.Itoa(row) + " * 2", "J": strconv.Itoa(row) + " * 3"}
+			if row == 10 {
+				formulas["J"] = "SUM(I1:J9)"
+			}
+			for column, formula := range formulas {
+				reference := Reference{String: column + strconv.Itoa(row), SheetIndex: 1}
+				dv := getDataFromRef(reference, &grid)
+				dv.ValueType = DynamicValueTypeFormula
+				dv.DataFormula = formula
+				setDataByRef(reference, setDependencies(reference, dv, &grid), &grid)
+			}
+		}
+		testBool(len(grid.DirtyCells) > parallelComputeThreshold, true)
+		computeDirtyCells(&grid, nil)
+		testString(convertToString(grid.Data[testKey("1!I10")]).DataString+" "+convertToString(grid.Data[testKey("1!J10")]).DataString, "20 225")
+
+		// cells that were never set read as empty and aren't stored
+		testEvaluate("LEN(J8) + 1", "1", &grid)
+		_, isStored := grid.Data[testKey("0!J8")]
+		testBool(isStored, false)
+		testEvaluate("K1", "#REF!", &grid)
+		getStoredDataFromRef(Reference{String: "J8", SheetIndex: 0}, &grid)
+		removeUnusedCells(&grid)
+		_, isStored = grid.Data[testKey("0!J8")]
+		testBool(isStored, false)
+		testString(jumpCellReference(Reference{String: "J2", SheetIndex: 0}, "down", &grid), "J10")
+		testString(jumpCellReference(Reference{String: "J10", SheetIndex: 0}, "up", &grid), "J2")
+		testString(jumpCellReference(Reference{String: "J1", SheetIndex: 0}, "down", &grid), "J2")
+		testString(jumpCellReference(Reference{String: "J10", SheetIndex: 0}, "right", &grid), "J10")
+
+		// cell keys
+		testString(makeCellKey(1, 10, 27).String(), "1!AA10")
+		testString(getReferenceFromCellKey(getCellKeyFromReference(Reference{String: "$B$3", SheetIndex: 2})).String, "B3")
+		testBool(testKey("0!A1") == getCellKeyFromReference(Reference{String: "A$1", SheetIndex: 0}), true)
+
+		// sheets keep their ID when sheets before them are removed, and IDs aren't reused
+		addSheet("Sheet3", SheetSize{RowCount: rowCount, ColumnCount: columnCount}, &grid)
+		sheet4, _ := addSheet("Sheet4", SheetSize{RowCount: rowCount, ColumnCount: columnCount}, &grid)
+		testSetCell("3!A1", &DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: 7, DataFormula: "7", SheetIndex: sheet4}, &grid)
+		testEvaluate("Sheet4!A1 * 2", "14", &grid)
+		removeSheet(grid.SheetNames["Sheet3"], &grid)
+		testString(strconv.Itoa(int(getSheetIDFromString("2", &grid))), "3")
+		testString(getSheetPositionString(sheet4, &grid), "2")
+		testEvaluate("Sheet4!A1 * 2", "14", &grid)
+		testEvaluate("Sheet4!C11", "#REF!", &grid)
+		sheet5, _ := addSheet("Sheet5", SheetSize{RowCount: rowCount, ColumnCount: columnCount}, &grid)
+		testString(strconv.Itoa(int(sheet5)), "4")
+		testBool(grid.NextSheetID == 5 && firstUnusedSheetID(&grid) == 5, true)
+
+		// sheet sizes are limited by what cell keys can address
+		testBool(checkSheetSize(SheetSize{RowCount: 1048576, ColumnCount: 16384}) == nil, true)
+		testBool(checkSheetSize(SheetSize{RowCount: maximumRowCount + 1, ColumnCount: 26}) == nil, false)
+		testBool(checkSheetSize(SheetSize{RowCount: 1000, ColumnCount: 0}) == nil, false)
+		_, err := addSheet("Sheet6", SheetSize{RowCount: rowCount, ColumnCount: maximumColumnCount + 1}, &grid)
+		testBool(err == nil, false)
+		_, exists := grid.SheetNames["Sheet6"]
+		testBool(exists, false)
+
+		// references beyond what keys can address don't alias cells on other sheets
+		testBool(makeCellKey(0, maximumRowCount+1, 1) == noCellKey, true)
+		testBool(getCellKeyFromReference(Reference{String: "A" + strconv.Itoa(1<<cellKeyRowBits), SheetIndex: 0}) == noCellKey, true)
+		overflowRow, _ := parseCellString("A99999999999999999999999")
+		testBool(overflowRow > maximumRowCount, true)
+		testBool(rangeFitsKeys("'a:b'!A1:B2"), true)
+		testBool(rangeFitsKeys("A1:A"+strconv.Itoa(1<<cellKeyRowBits)), false)
+		testEvaluate("A99999999999999999999999", "#REF!", &grid)
+		testEvaluate("SUM(A1:A"+strconv.Itoa(1<<cellKeyRowBits)+")", "#REF!", &grid)
+		getStoredDataFromRef(Reference{String: "A" + strconv.Itoa(1<<cellKeyRowBits), SheetIndex: 0}, &grid)
+		_, exists = grid.Data[noCellKey]
+		testBool(exists, false)
+
+		// undo and redo
+		grid.history = newUndoHistory(&grid)
+		testSetFormula("J8", "21*2", &grid)
+		recordUndoStep(&grid)
+		testSetFormula("J8", "1", &grid)
+		recordUndoStep(&grid)
+		testBool(len(grid.history.steps[1].cellsBefore) == 1 && len(grid.history.changedCells) == 0, true)
+		undo(&grid)
+		computeDirtyCells(&grid, nil)
+		testEvaluate("J8", "42", &grid)
+		undo(&grid)
+		computeDirtyCells(&grid, nil)
+		testEvaluate("LEN(J8)", "0", &grid)
+		testBool(undo(&grid) == nil, true)
+		redo(&grid)
+		computeDirtyCells(&grid, nil)
+		testEvaluate("J8", "42", &grid)
+		removeSheet(sheet4, &grid)
+		recordUndoStep(&grid)
+		undo(&grid)
+		computeDirtyCells(&grid, nil)
+		testString(getSheetPositionString(sheet4, &grid), "2")
+		testEvaluate("Sheet4!A1 * 2", "14", &grid)
+		testBool(redo(&grid) != nil, true)
+		testBool(sheetExists(sheet4, &grid), false)
+		undo(&grid)
+		testSetFormula("J8", "", &grid)
+		recordUndoStep(&grid)
+		testBool(redo(&grid) == nil, true)
+
+		// number formats
+		testSetFormula("J9", "1234.5", &grid)
+		setCellFormat(ReferenceRange{String: "J9:J9", SheetIndex: 0}, "#,##0.00", &grid)
+		recordUndoStep(&grid)
+		testString(formatCellValue(grid.Data[testKey("0!J9")]), "1,234.50")
+		testString(convertToString(grid.Data[testKey("0!J9")]).DataString, "1234.5")
+		testSetFormula("J9", "-2", &grid)
+		testString(formatCellValue(grid.Data[testKey("0!J9")]), "-2.00")
+		setCellFormat(ReferenceRange{String: "J9:J9", SheetIndex: 0}, "General", &grid)
+		recordUndoStep(&grid)
+		undo(&grid)
+		testString(grid.Data[testKey("0!J9")].Format, "#,##0.00")
+		testString(formatCellValue(&DynamicValue{ValueType: DynamicValueTypeFloat, DataFloat: 0.256, Format: "0.0%"}), "25.6%")
+		testString(formatCellValue(&DynamicValue{ValueType: DynamicValueTypeDate, DataFloat: 45000, Format: "yyyy-mm-dd"}), "2023-03-15")
+		testString(formatCellValue(&DynamicValue{ValueType: DynamicValueTypeDate, DataFloat: 45000, Format: "0.00"}), "45000.00")
+		testString(formatCellValue(&DynamicValue{ValueType: DynamicValueTypeString, DataString: "abc", Format: "0.00"}), "abc")
+		setCellFormat(ReferenceRange{String: "D9:D9", SheetIndex: 1}, "0.0", &grid)
+		removeUnusedCells(&grid)
+		_, isStored = grid.Data[testKey("1!D9")]
+		testBool(isStored, true)
+		setCellFormat(ReferenceRange{String: "D9:D9", SheetIndex: 1}, "General", &grid)
+		removeUnusedCells(&grid)
+		_, isStored = grid.Data[testKey("1!D9")]
+		testBool(isStored, false)
+
+		// styles
+		references, err := setCellStyle(ReferenceRange{String: "D8:E9", SheetIndex: 1}, "bold", "true", &grid)
+		testBool(err == nil && len(references) == 4, true)
+		testBool(grid.Data[testKey("1!D8")].StyleID == grid.Data[testKey("1!E9")].StyleID, true)
+		testBool(getStyle(grid.Data[testKey("1!E9")].StyleID, &grid).Bold, true)
+		_, err = setCellStyle(ReferenceRange{String: "D8:E9", SheetIndex: 1}, "fill-color", "red", &grid)
+		testBool(err != nil, true)
+		setCellStyle(ReferenceRange{String: "D8:E9", SheetIndex: 1}, "border-outline", "thin", &grid)
+		topLeftStyle := getStyle(grid.Data[testKey("1!D8")].StyleID, &grid)
+		testString(topLeftStyle.BorderTop+","+topLeftStyle.BorderLeft+","+topLeftStyle.BorderBottom, "thin,thin,")
+		styleCount := len(grid.Styles)
+		setCellStyle(ReferenceRange{String: "F8", SheetIndex: 1}, "bold", "true", &grid)
+		testBool(len(grid.Styles) == styleCount, true)
+		cutCells(ReferenceRange{String: "F8:F8", SheetIndex: 1}, ReferenceRange{String: "G8:G8", SheetIndex: 1}, &grid, nil)
+		testBool(getStyle(grid.Data[testKey("1!G8")].StyleID, &grid).Bold, true)
+		testBool(getDataFromRef(Reference{String: "F8", SheetIndex: 1}, &grid).StyleID == defaultStyle, true)
+		loadedGrid := FromGOB64(ToGOB64(grid))
+		testBool(getStyle(loadedGrid.Data[testKey("1!G8")].StyleID, &loadedGrid).Bold, true)
+
+		// sheets saved with string cell keys are rekeyed
+		legacyBuffer := bytes.Buffer{}
+		gob.NewEncoder(&legacyBuffer).Encode(legacyGrid{
+			Data:      map[string]*legacyDynamicValue{"1!B2": {ValueType: DynamicValueTypeFloat, DataFloat: 3, DataFormula: "3", SheetIndex: 1, DependOut: map[string]bool{"1!C2": true}}},
+			SheetList: []string{"Sheet1", "Sheet2"},
+		})
+		legacyLoaded := FromGOB64(legacyBuffer.Bytes())
+		testBool(legacyLoaded.Data[testKey("1!B2")].DataFloat == 3 && legacyLoaded.Data[testKey("1!B2")].DependOut[testKey("1!C2")], true)
+		recordUndoStep(&grid)
+		setCellStyle(ReferenceRange{String: "D8:G9", SheetIndex: 1}, "clear", "", &grid)
+		recordUndoStep(&grid)
+		removeUnusedCells(&grid)
+		_, isStored = grid.Data[testKey("1!G8")]
+		testBool(isStored, false)
+		undo(&grid)
+		testBool(getStyle(grid.Data[testKey("1!G8")].StyleID, &grid).Bold, true)
+
+		// conditional formats
+		for row, value := range []string{"5", "20", "15", "-5", "10"} {
+			setCellFormula(Reference{String: "H" + strconv.Itoa(row+1), SheetIndex: 1}, value, &grid)
+		}
+		computeDirtyCells(&grid, nil)
+		format, err := newConditionalFormat(ReferenceRange{String: "H1:H5", SheetIndex: 1}, "cell-value", ">", "10", "", []string{"fill-color", "#FFC7CE"}, &grid)
+		testBool(err == nil, true)
+		grid.ConditionalFormats = append(grid.ConditionalFormats, format)
+		testBool(len(evaluateConditionalFormats(&grid)) == 2, true)
+		testString(grid.conditionalStyles[testKey("1!H2")].Style.FillColor, "#ffc7ce")
+		_, isStored = grid.conditionalStyles[testKey("1!H5")]
+		testBool(isStored, false)
+		_, err = newConditionalFormat(ReferenceRange{String: "H1:H20", SheetIndex: 1}, "cell-value", ">", "10", "", []string{}, &grid)
+		testBool(err != nil, true)
+		format, _ = newConditionalFormat(ReferenceRange{String: "H1:H5", SheetIndex: 1}, "top-n", "bottom", "2", "", []string{"bold", "true", "fill-color", "#00ff00"}, &grid)
+		grid.ConditionalFormats = append(grid.ConditionalFormats, format)
+		evaluateConditionalFormats(&grid)
+		testBool(grid.conditionalStyles[testKey("1!H4")].Style.Bold && grid.conditionalStyles[testKey("1!H1")].Style.Bold, true)
+		testBool(grid.conditionalStyles[testKey("1!H5")].Style.Bold, false)
+		format, _ = newConditionalFormat(ReferenceRange{String: "H1:H5", SheetIndex: 1}, "formula", "", "=H1>H2", "", []string{"italic", "true"}, &grid)
+		grid.ConditionalFormats = append(grid.ConditionalFormats, format)
+		evaluateConditionalFormats(&grid)
+		testBool(grid.conditionalStyles[testKey("1!H3")].Style.Italic && !grid.conditionalStyles[testKey("1!H4")].Style.Italic, true)
+		inputs, _ := conditionalFormulaInputs(format, &grid)
+		testString(inputs[0].String+" "+inputs[1].String, "H1:H5 H2:H6")
+		testBool(conditionalFormatReads(format, []CellKey{testKey("1!H6")}, &grid) && !conditionalFormatReads(format, []CellKey{testKey("1!H7"), testKey("0!H3")}, &grid), true)
+		testString(interpolateColor("#000000", "#ffffff", 0.5), "#808080")
+		grid.ConditionalFormats = nil
+		format, _ = newConditionalFormat(ReferenceRange{String: "H1:H5", SheetIndex: 1}, "color-scale", "", "", "", []string{"min-color", "#ff0000", "max-color", "#00ff00"}, &grid)
+		grid.ConditionalFormats = append(grid.ConditionalFormats, format)
+		format, _ = newConditionalFormat(ReferenceRange{String: "H1:H5", SheetIndex: 1}, "data-bar", "", "", "", []string{}, &grid)
+		grid.ConditionalFormats = append(grid.ConditionalFormats, format)
+		evaluateConditionalFormats(&grid)
+		testString(grid.conditionalStyles[testKey("1!H4")].Style.FillColor+" "+grid.conditionalStyles[testKey("1!H2")].Style.FillColor, "#ff0000 #00ff00")
+		testString(strconv.FormatFloat(grid.conditionalStyles[testKey("1!H3")].DataBar, 'f', 2, 64), "0.80")
+		testBool(len(evaluateChangedConditionalFormats([]CellKey{testKey("0!H3")}, &grid)) == 0, true)
+		setCellFormula(Reference{String: "H2", SheetIndex: 1}, "0", &grid)
+		testBool(len(computeDirtyCells(&grid, nil)) > 1, true)
+		shiftConditionalFormats(1, false, 3, 1, &grid)
+		testString(grid.ConditionalFormats[0].Range.String, "H1:H6")
+		shiftConditionalFormats(1, true, 9, -1, &grid)
+		testString(grid.ConditionalFormats[0].Range.String, "H1:H6")
+		shiftConditionalFormats(1, true, 2, -1, &grid)
+		testString(grid.ConditionalFormats[0].Range.String, "G1:G6")
+		recordUndoStep(&grid)
+		testBool(deleteConditionalFormats(ReferenceRange{String: "G6", SheetIndex: 1}, &grid) == 2, true)
+		recordUndoStep(&grid)
+		evaluateConditionalFormats(&grid)
+		testBool(len(grid.conditionalStyles) == 0, true)
+		undo(&grid)
+		testBool(len(grid.ConditionalFormats) == 2, true)
+		redo(&grid)
+		testBool(len(grid.ConditionalFormats) == 0, true)
+
+		// validation rules
+		for _, cell := range []string{"I1", "I2", "I3", "J1", "J2", "J3"} {
+			setCellFormula(Reference{String: cell, SheetIndex: 1}, "", &grid)
+		}
+		rule, err := newValidationRule(ReferenceRange{String: "I1:I3", SheetIndex: 1}, "list", "", "Yes, No", "", true, "", &grid)
+		testBool(err == nil, true)
+		grid.ValidationRules = append(grid.ValidationRules, rule)
+		setCellFormula(Reference{String: "I1", SheetIndex: 1}, "\"yes\"", &grid)
+		setCellFormula(Reference{String: "I2", SheetIndex: 1}, "\"maybe\"", &grid)
+		computeDirtyCells(&grid, nil)
+		testString(getValidationMessage(Reference{String: "I1", SheetIndex: 1}, &grid), "")
+		testString(getValidationMessage(Reference{String: "I2", SheetIndex: 1}, &grid), "The value should be one of: Yes, No")
+		testString(getValidationMessage(Reference{String: "I3", SheetIndex: 1}, &grid), "")
+		testString(strings.Join(validationListItems(rule, &grid), "|"), "Yes|No")
+		rule, _ = newValidationRule(ReferenceRange{String: "J1:J2", SheetIndex: 1}, "list", "", "=I1:I3", "", false, "", &grid)
+		testString(strings.Join(validationListItems(rule, &grid), "|"), "yes|maybe")
+		_, err = newValidationRule(ReferenceRange{String: "J1:J2", SheetIndex: 1}, "decimal", "between", "1", "x", false, "", &grid)
+		testBool(err != nil, true)
+		rule, _ = newValidationRule(ReferenceRange{String: "J1:J2", SheetIndex: 1}, "whole-number", "between", "1", "10", false, "Enter 1 to 10", &grid)
+		grid.ValidationRules = append(grid.ValidationRules, rule)
+		setCellFormula(Reference{String: "J1", SheetIndex: 1}, "2.5", &grid)
+		setCellFormula(Reference{String: "J2", SheetIndex: 1}, "\"7\"", &grid)
+		computeDirtyCells(&grid, nil)
+		testString(getValidationMessage(Reference{String: "J1", SheetIndex: 1}, &grid), "Enter 1 to 10")
+		testString(getValidationMessage(Reference{String: "J2", SheetIndex: 1}, &grid), "")
+		rule, _ = newValidationRule(ReferenceRange{String: "J3", SheetIndex: 1}, "date", ">=", "2024-01-01", "", false, "", &grid)
+		testString(describeValidationRule(rule, &grid), "The value should be a date greater than or equal to 2024-01-01")
+		rule, _ = newValidationRule(ReferenceRange{String: "J3", SheetIndex: 1}, "formula", "", "=LEN(J3)<4", "", false, "", &grid)
+		grid.ValidationRules = append(grid.ValidationRules, rule)
+		setCellFormula(Reference{String: "J3", SheetIndex: 1}, "\"abcd\"", &grid)
+		computeDirtyCells(&grid, nil)
+		testBool(len(getValidationMessage(Reference{String: "J3", SheetIndex: 1}, &grid)) > 0, true)
+		j3 := Reference{String: "J3", SheetIndex: 1}
+		testBool(isValidValue(rule, inputValue("ab", j3, &grid), j3, &grid), true)
+		testBool(isValidValue(rule, inputValue("=CONCATENATE(\"ab\", \"cde\")", j3, &grid), j3, &grid), false)
+		testBool(isValidValue(rule, inputValue("abcde", j3, &grid), j3, &grid), false)
+		testBool(isValidValue(rule, inputValue("=\"ab\"&\"c\"", j3, &grid), j3, &grid), false)
+		testBool(inputValue("=\"ab\"&\"c\"", j3, &grid).ValueType == DynamicValueTypeError, true)
+		j2 := Reference{String: "J2", SheetIndex: 1}
+		testBool(isValidValue(grid.ValidationRules[1], inputValue("=2*3", j2, &grid), j2, &grid), true)
+		testBool(isValidValue(grid.ValidationRules[1], inputValue("=2.5", j2, &grid), j2, &grid), false)
+		testBool(checkInput(j2, "=4", &grid, nil), true)
+		testString(grid.Data[testKey("1!J2")].DataFormula, "\"7\"")
+		testString(valueFormula(&DynamicValue{ValueType: DynamicValueTypeString, DataString: "a\"b"}), "\"a\\\"b\"")
+		testString(valueFormula(&DynamicValue{ValueType: DynamicValueTypeBool, DataBool: false}), "FALSE")
+		_, err = parseSheetPosition("x", &grid)
+		testBool(err != nil, true)
+		_, err = parseSheetPosition("9", &grid)
+		testBool(err != nil, true)
+		testBool(checkArgumentCount([]string{"ADD-VALIDATION", "A1", "0"}, 8) != nil && checkArgumentCount([]string{"GET-VALIDATION-OPTIONS", "A1", "0"}, 2) == nil, true)
+		shiftValidationRules(1, false, 1, 1, &grid)
+		testString(grid.ValidationRules[0].Range.String+" "+grid.ValidationRules[2].Range.String, "I2:I4 J4:J4")
+		testBool(deleteValidationRules(ReferenceRange{String: "I4:J4", SheetIndex: 1}, &grid) == 2, true)
+
 		fmt.Println(strconv.Itoa(testCount-testFailCount) + "/" + strconv.Itoa(testCount) + " tests succeeded. Failed: " + strconv.Itoa(testFailCount))
 
 	} else {
@@ -166,3 +773,35 @@ func testFormula(formula string, expected bool) {
 		fmt.Println("[Test #" + strconv.Itoa(testCount) + " succeeded] formula: " + formula)
 	}
 }
+
+// testKey returns the key of a cell written like "0!A1"
+func testKey(index string) CellKey {
+	return getCellKeyFromMapIndex(index)
+}
+
+func testSetCell(mapIndex string, dv *DynamicValue, grid *Grid) {
+	dv.DependIn = make(map[CellKey]bool)
+	dv.DependOut = make(map[CellKey]bool)
+	grid.Data[testKey(mapIndex)] = dv
+}
+
+// testSetFormula sets a formula like the SET action does and recomputes the grid
+func testSetFormula(referenceString string, formula string, grid *Grid) {
+	reference := Reference{String: referenceString, SheetIndex: 0}
+	dv := getDataFromRef(reference, grid)
+	dv.ValueType = DynamicValueTypeFormula
+	dv.DataFormula = formula
+	setDataByRef(reference, setDependencies(reference, dv, grid), grid)
+	computeDirtyCells(grid, nil)
+}
+
+func testEvaluate(formula string, expected string, grid *Grid) {
+	testCount++
+	result := convertToString(parse(makeDv(formula), grid, Reference{String: "B1", SheetIndex: 0})).DataString
+	if result != expected {
+		fmt.Println("[Test #" + strconv.Itoa(testCount) + " failed] Expected: " + expected + ", got: " + result + " formula: " + formula)
+		testFailCount++
+	} else {
+		fmt.Println("[Test #" + strconv.Itoa(testCount) + " succeeded] formula: " + formula)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+// Actions that change the content of the grid are recorded as undo steps. A step holds the formulas,
+// formats and styles of the cells the action changed from before and after it, and the sheets,
+// defined names, conditional formats and validation rules when they changed. Values aren't recorded,
+// they're computed again from the restored formulas. Cells note when they're written, only those cells
+// are compared with the state after the last step when a step is recorded.
+
+const maximumUndoSteps = 100
+
+// undoableActions are the actions that change the content of the grid
+var undoableActions = map[string]bool{
+	"RANGE":                      true,
+	"SET":                        true,
+	"COPY":                       true,
+	"CUT":                        true,
+	"COPYASVALUE":                true,
+	"CUTASVALUE":                 true,
+	"INSERTROWCOL":               true,
+	"DELETEROW":                  true,
+	"DELETECOLUMN":               true,
+	"SORT":                       true,
+	"CSV":                        true,
+	"SET-FORMAT":                 true,
+	"SET-STYLE":                  true,
+	"ADD-CONDITIONAL-FORMAT":     true,
+	"DELETE-CONDITIONAL-FORMATS": true,
+	"ADD-VALIDATION":             true,
+	"DELETE-VALIDATIONS":         true,
+	"SETSIZE":                    true,
+	"ADDSHEET":                   true,
+	"REMOVESHEET":                true,
+	"DEFINE-NAME":                true,
+	"RENAME-NAME":                true,
+	"DELETE-NAME":                true,
+}
+
+type sheetLayout struct {
+	sheetList  []string
+	sheetNames map[string]SheetID
+	sheetSizes []SheetSize
+}
+
+// cellContent is what a cell holds apart from its computed value
+type cellContent struct {
+	formula string
+	format  string
+	style   StyleID
+}
+
+type undoStep struct {
+	cellsBefore       map[CellKey]cellContent
+	cellsAfter        map[CellKey]cellContent
+	sheetsBefore      *sheetLayout // nil when the sheets didn't change
+	sheetsAfter       *sheetLayout
+	namesBefore       map[string]string // nil when the names didn't change
+	namesAfter        map[string]string
+	formatsBefore     []ConditionalFormat // nil when the conditional formats didn't change
+	formatsAfter      []ConditionalFormat
+	validationsBefore []ValidationRule // nil when the validation rules didn't change
+	validationsAfter  []ValidationRule
+}
+
+type undoHistory struct {
+	cells        map[CellKey]cellContent // the state after the last recorded step, of the cells with content
+	changedCells map[CellKey]bool        // the cells written since the last recorded step
+	sheets       sheetLayout
+	names        map[string]string
+	formats      []ConditionalFormat
+	validations  []ValidationRule
+	steps        []undoStep
+	position     int // the steps before position can be undone, the ones from it redone
+}
+
+func getCellContents(grid *Grid) map[CellKey]cellContent {
+
+	cells := make(map[CellKey]cellContent)
+	for index := range grid.Data {
+		if content := getCellContent(index, grid); content != (cellContent{}) {
+			cells[index] = content
+		}
+	}
+	return cells
+}
+
+// getCellContent returns the content of a cell, cells without any have the zero cellContent
+func getCellContent(index CellKey, grid *Grid) cellContent {
+
+	dv, ok := grid.Data[index]
+	if !ok {
+		return cellContent{}
+	}
+	return cellContent{formula: dv.DataFormula, format: dv.Format, style: dv.StyleID}
+}
+
+// markCellChanged notes that a cell is written, it's called before the cell changes or is removed
+func markCellChanged(index CellKey, grid *Grid) {
+	if grid.history != nil {
+		grid.history.changedCells[index] = true
+	}
+}
+
+// takeCellChanges compares the cells written since the last step with the state after it, returns
+// the content from before and after of the ones that changed and makes their content the new state
+func takeCellChanges(grid *Grid) (map[CellKey]cellContent, map[CellKey]cellContent) {
+
+	history := grid.history
+	cellsBefore := make(map[CellKey]cellContent)
+	cellsAfter := make(map[CellKey]cellContent)
+
+	for index := range history.changedCells {
+
+		content := getCellContent(index, grid)
+		if history.cells[index] == content {
+			continue
+		}
+
+		cellsBefore[index] = history.cells[index]
+		cellsAfter[index] = content
+
+		if content == (cellContent{}) {
+			delete(history.cells, index)
+		} else {
+			history.cells[index] = content
+		}
+	}
+
+	history.changedCells = make(map[CellKey]bool)
+
+	return cellsBefore, cellsAfter
+}
+
+func getSheetLayout(grid *Grid) sheetLayout {
+	return copySheetLayout(sheetLayout{sheetList: grid.SheetList, sheetNames: grid.SheetNames, sheetSizes: grid.SheetSizes})
+}
+
+func copySheetLayout(layout sheetLayout) sheetLayout {
+
+	layoutCopy := sheetLayout{sheetList: append([]string{}, layout.sheetList...), sheetNames: make(map[string]SheetID), sheetSizes: append([]SheetSize{}, layout.sheetSizes...)}
+	for sheetName, sheetIndex := range layout.sheetNames {
+		layoutCopy.sheetNames[sheetName] = sheetIndex
+	}
+	return layoutCopy
+}
+
+func sheetLayoutsEqual(a sheetLayout, b sheetLayout) bool {
+
+	if len(a.sheetList) != len(b.sheetList) {
+		return false
+	}
+	for position := range a.sheetList {
+		if a.sheetList[position] != b.sheetList[position] || a.sheetSizes[position] != b.sheetSizes[position] || a.sheetNames[a.sheetList[position]] != b.sheetNames[b.sheetList[position]] {
+			return false
+		}
+	}
+	return true
+}
+
+// getNameFormulas returns the formula of each defined name by its name as entered
+func getNameFormulas(grid *Grid) map[string]string {
+
+	names := make(map[string]string)
+	for _, definition := range grid.DefinedNames {
+		names[definition.Name] = definition.Formula
+	}
+	return names
+}
+
+func nameFormulasEqual(a map[string]string, b map[string]string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for name, formula := range a {
+		if otherFormula, ok := b[name]; !ok || otherFormula != formula {
+			return false
+		}
+	}
+	return true
+}
+
+// copyConditionalFormats copies the rules of the grid, never nil so a step can tell it has them
+func copyConditionalFormats(formats []ConditionalFormat) []ConditionalFormat {
+	return append([]ConditionalFormat{}, formats...)
+}
+
+func conditionalFormatsEqual(a []ConditionalFormat, b []ConditionalFormat) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func copyValidationRules(rules []ValidationRule) []ValidationRule {
+	return append([]ValidationRule{}, rules...)
+}
+
+func validationRulesEqual(a []ValidationRule, b []ValidationRule) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newUndoHistory(grid *Grid) *undoHistory {
+	return &undoHistory{cells: getCellContents(grid), changedCells: make(map[CellKey]bool), sheets: getSheetLayout(grid), names: getNameFormulas(grid), formats: copyConditionalFormats(grid.ConditionalFormats), validations: copyValidationRules(grid.ValidationRules)}
+}
+
+// recordUndoStep compares the grid with the state after the last step and records the difference
+func recordUndoStep(grid *Grid) {
+
+	history := grid.history
+	step := undoStep{}
+
+	step.cellsBefore, step.cellsAfter = takeCellChanges(grid)
+
+	sheets := getSheetLayout(grid)
+	if !sheetLayoutsEqual(history.sheets, sheets) {
+		sheetsBefore := history.sheets
+		step.sheetsBefore = &sheetsBefore
+		step.sheetsAfter = &sheets
+	}
+
+	names := getNameFormulas(grid)
+	if !nameFormulasEqual(history.names, names) {
+		step.namesBefore = history.names
+		step.namesAfter = names
+	}
+
+	if !conditionalFormatsEqual(history.formats, grid.ConditionalFormats) {
+		step.formatsBefore = history.formats
+		step.formatsAfter = copyConditionalFormats(grid.ConditionalFormats)
+	}
+
+	history.sheets = sheets
+	history.names = names
+	if !validationRulesEqual(history.validations, grid.ValidationRules) {
+		step.validationsBefore = history.validations
+		step.validationsAfter = copyValidationRules(grid.ValidationRules)
+	}
+
+	history.formats = copyConditionalFormats(grid.ConditionalFormats)
+	history.validations = copyValidationRules(grid.ValidationRules)
+
+	if len(step.cellsBefore) == 0 && step.sheetsBefore == nil && step.namesBefore == nil && step.formatsBefore == nil && step.validationsBefore == nil {
+		return
+	}
+
+	// a new step replaces the steps that were undone
+	history.steps = append(history.steps[:history.position], step)
+	if len(history.steps) > maximumUndoSteps {
+		history.steps = history.steps[len(history.steps)-maximumUndoSteps:]
+	}
+	history.position = len(history.steps)
+}
+
+// undo restores the state from before the last step and returns it, nil when there's nothing to undo
+func undo(grid *Grid) *undoStep {
+
+	history := grid.history
+	if history.position == 0 {
+		return nil
+	}
+
+	history.position--
+	step := &history.steps[history.position]
+	applyUndoState(step.cellsBefore, step.sheetsBefore, step.namesBefore, step.formatsBefore, step.validationsBefore, grid)
+
+	return step
+}
+
+// redo applies the last undone step again and returns it, nil when there's nothing to redo
+func redo(grid *Grid) *undoStep {
+
+	history := grid.history
+	if history.position == len(history.steps) {
+		return nil
+	}
+
+	step := &history.steps[history.position]
+	history.position++
+	applyUndoState(step.cellsAfter, step.sheetsAfter, step.namesAfter, step.formatsAfter, step.validationsAfter, grid)
+
+	return step
+}
+
+func applyUndoState(cells map[CellKey]cellContent, sheets *sheetLayout, names map[string]string, formats []ConditionalFormat, validations []ValidationRule, grid *Grid) {
+
+	// sheets first, the cells and names can be on a sheet that is restored
+	if sheets != nil {
+
+		for _, sheetIndex := range grid.SheetNames {
+			if !sheetLayoutHasSheet(*sheets, sheetIndex) {
+				removeSheet(sheetIndex, grid)
+			}
+		}
+
+		layout := copySheetLayout(*sheets)
+		grid.SheetList = layout.sheetList
+		grid.SheetNames = layout.sheetNames
+		grid.SheetSizes = layout.sheetSizes
+	}
+
+	if names != nil {
+
+		for _, definition := range grid.DefinedNames {
+			if _, ok := names[definition.Name]; !ok {
+				deleteName(definition.Name, grid)
+			}
+		}
+
+		for name, formula := range names {
+			if definition := getDefinedName(name, grid); definition == nil || definition.Formula != formula || definition.Name != name {
+				defineName(name, formula, grid.ActiveSheet, grid)
+			}
+		}
+	}
+
+	for index, content := range cells {
+		if sheetExists(index.SheetIndex(), grid) {
+			reference := getReferenceFromCellKey(index)
+			setCellFormula(reference, content.formula, grid)
+			if _, ok := grid.Data[index]; ok || len(content.format) > 0 || content.style != defaultStyle {
+				dv := getStoredDataFromRef(reference, grid)
+				dv.Format = content.format
+				dv.StyleID = content.style
+			}
+		}
+	}
+
+	// the rules are evaluated again when the cells are computed
+	if formats != nil {
+		grid.ConditionalFormats = copyConditionalFormats(formats)
+	}
+	if validations != nil {
+		grid.ValidationRules = copyValidationRules(validations)
+	}
+
+	// formulas that refer to a sheet that came back or went away depend on other cells now
+	if sheets != nil {
+		refreshAllDependencies(grid)
+	}
+
+	// the restored cells are the state now, without being recorded as a step
+	takeCellChanges(grid)
+	grid.history.sheets = getSheetLayout(grid)
+	grid.history.names = getNameFormulas(grid)
+	grid.history.formats = copyConditionalFormats(grid.ConditionalFormats)
+	grid.history.validations = copyValidationRules(grid.ValidationRules)
+}
+
+func sheetLayoutHasSheet(layout sheetLayout, sheetIndex SheetID) bool {
+
+	for _, otherIndex := range layout.sheetNames {
+		if otherIndex == sheetIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// setCellFormula sets the formula of a cell like the SET action does, an empty formula clears it
+func setCellFormula(reference Reference, formula string, grid *Grid) {
+
+	if len(formula) == 0 {
+		clearCell(reference, grid)
+		return
+	}
+
+	dv := getDataFromRef(reference, grid)
+	dv.DataFormula = formula
+
+	if isValidFormula(formula) && isExplosiveFormula(formula) {
+
+		// explosive formulas are evaluated when they're set, they aren't recomputed
+		dv.ValueType = DynamicValueTypeExplosiveFormula
+
+		newDv := parse(dv, grid, reference)
+		newDv.DependIn = make(map[CellKey]bool)
+		newDv.DependOut = dv.DependOut
+		newDv.ValueType = DynamicValueTypeExplosiveFormula
+		newDv.DataFormula = formula
+
+		setDataByRef(reference, setDependencies(reference, newDv, grid), grid)
+		return
+	}
+
+	dv.ValueType = DynamicValueTypeFormula
+	setDataByRef(reference, setDependencies(reference, dv, grid), grid)
+}
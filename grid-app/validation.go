@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Validation rules restrict what can be entered in the cells of a range. Input is checked before it's
+// stored, input that breaks a rule isn't stored when the rule rejects it, otherwise it's kept and the
+// cell is flagged with the message of the rule. When rules overlap, the one added last applies. Empty
+// cells are always valid.
+
+type ValidationRule struct {
+	Range    ReferenceRange
+	Type     string // list, whole-number, decimal, date, text-length or formula
+	Operator string // how numbers, dates and lengths compare with the bounds, like between or >=
+	Value    string // the items of a list separated by commas or a range like =A1:A5, the lower bound or the formula
+	Value2   string // the upper bound of between and not-between
+	Reject   bool   // input that breaks the rule isn't stored, otherwise it's flagged
+	Message  string // shown for invalid values, the rule is described when empty
+}
+
+var validationTypes = map[string]bool{"list": true, "whole-number": true, "decimal": true, "date": true, "text-length": true, "formula": true}
+var validationOperators = map[string]bool{"between": true, "not-between": true, "=": true, "<>": true, ">": true, ">=": true, "<": true, "<=": true}
+
+// newValidationRule creates a rule from the arguments of the client
+func newValidationRule(cellRange ReferenceRange, ruleType string, operator string, value string, value2 string, reject bool, message string, grid *Grid) (ValidationRule, error) {
+
+	if !strings.Contains(cellRange.String, ":") {
+		cellRange.String = cellRange.String + ":" + cellRange.String
+	}
+
+	rule := ValidationRule{Range: cellRange, Type: ruleType, Operator: operator, Value: value, Value2: value2, Reject: reject, Message: message}
+
+	lowerRow, lowerColumn, upperRow, upperColumn := cellRangeBoundaries(cellRange.String)
+	topLeft := Reference{String: indexesToReferenceString(lowerRow, lowerColumn), SheetIndex: cellRange.SheetIndex}
+	bottomRight := Reference{String: indexesToReferenceString(upperRow, upperColumn), SheetIndex: cellRange.SheetIndex}
+
+	if !isWithinSheet(topLeft, grid) || !isWithinSheet(bottomRight, grid) {
+		return rule, errors.New("the range " + cellRange.String + " isn't inside the sheet")
+	}
+
+	if !validationTypes[ruleType] {
+		return rule, errors.New("unknown validation " + ruleType)
+	}
+
+	switch ruleType {
+	case "list":
+
+		if strings.HasPrefix(value, "=") {
+			if !isValidFormula(value[1:]) || len(findRanges(value[1:], cellRange.SheetIndex, grid)) != 1 {
+				return rule, errors.New("the list should be a range like =A1:A5, " + value + " isn't")
+			}
+		} else if len(validationListItems(rule, grid)) == 0 {
+			return rule, errors.New("the list has no items")
+		}
+
+	case "whole-number", "decimal", "date", "text-length":
+
+		if !validationOperators[operator] {
+			return rule, errors.New("unknown comparison " + operator)
+		}
+
+		bounds := []string{value}
+		if operator == "between" || operator == "not-between" {
+			bounds = append(bounds, value2)
+		}
+
+		for _, bound := range bounds {
+			if _, ok := validationNumber(bound, ruleType == "date"); !ok {
+				return rule, errors.New("the bound " + bound + " isn't a valid number or date")
+			}
+		}
+
+	case "formula":
+
+		rule.Value = strings.TrimPrefix(value, "=")
+		if len(rule.Value) == 0 || !isValidFormula(rule.Value) {
+			return rule, errors.New("the condition " + value + " isn't a valid formula")
+		}
+	}
+
+	return rule, nil
+}
+
+// deleteValidationRules removes the rules that overlap a range and returns how many were removed
+func deleteValidationRules(cellRange ReferenceRange, grid *Grid) int {
+
+	rules := []ValidationRule{}
+	for _, rule := range grid.ValidationRules {
+		if !rangesOverlap(rule.Range, cellRange) {
+			rules = append(rules, rule)
+		}
+	}
+
+	removed := len(grid.ValidationRules) - len(rules)
+	grid.ValidationRules = rules
+
+	return removed
+}
+
+// shiftValidationRules moves the ranges of the rules on a sheet like shiftConditionalFormats
+func shiftValidationRules(sheetIndex SheetID, isColumn bool, index int, amount int, grid *Grid) {
+
+	rules := []ValidationRule{}
+
+	for _, rule := range grid.ValidationRules {
+
+		if rule.Range.SheetIndex == sheetIndex {
+
+			rangeString, isRemaining := shiftRangeString(rule.Range.String, isColumn, index, amount)
+			if !isRemaining {
+				continue
+			}
+			rule.Range.String = rangeString
+		}
+
+		rules = append(rules, rule)
+	}
+
+	grid.ValidationRules = rules
+}
+
+// getValidationRule returns the rule that applies to a cell, nil when there is none
+func getValidationRule(reference Reference, grid *Grid) *ValidationRule {
+
+	cellRange := ReferenceRange{String: reference.String, SheetIndex: reference.SheetIndex}
+
+	for i := len(grid.ValidationRules) - 1; i >= 0; i-- {
+		if rangesOverlap(grid.ValidationRules[i].Range, cellRange) {
+			return &grid.ValidationRules[i]
+		}
+	}
+
+	return nil
+}
+
+// validationListItems returns the items of a list rule, as displayed
+func validationListItems(rule ValidationRule, grid *Grid) []string {
+
+	items := []string{}
+
+	if !strings.HasPrefix(rule.Value, "=") {
+		for _, item := range strings.Split(rule.Value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+
+	for _, listRange := range findRanges(rule.Value[1:], rule.Range.SheetIndex, grid) {
+		for _, reference := range cellRangeToCells(listRange) {
+			if item := formatCellValue(getDataFromRef(reference, grid)); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+	}
+
+	return items
+}
+
+// validationNumber returns the number of a bound or a value entered as text, dates as their serial
+func validationNumber(value string, isDate bool) (float64, bool) {
+
+	if number, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+		return number, true
+	}
+
+	if isDate {
+		return parseDateString(strings.TrimSpace(value), false)
+	}
+
+	return 0, false
+}
+
+func compareWithBounds(operator string, number float64, lower float64, upper float64) bool {
+
+	switch operator {
+	case "between":
+		return number >= lower && number <= upper
+	case "not-between":
+		return number < lower || number > upper
+	case "=":
+		return number == lower
+	case "<>":
+		return number != lower
+	case ">":
+		return number > lower
+	case ">=":
+		return number >= lower
+	case "<":
+		return number < lower
+	case "<=":
+		return number <= lower
+	}
+
+	return false
+}
+
+// isValidCellValue checks the value of a cell against a rule
+func isValidCellValue(rule ValidationRule, reference Reference, grid *Grid) bool {
+	return isValidValue(rule, getCellValue(getCellKeyFromReference(reference), grid), reference, grid)
+}
+
+// isValidValue checks a value for the cell at reference against a rule, the value doesn't need to be
+// stored in the cell
+func isValidValue(rule ValidationRule, dv *DynamicValue, reference Reference, grid *Grid) bool {
+
+	value := dv
+	if value.ValueType == DynamicValueTypeArray {
+		value = arrayFirstValue(value)
+	}
+
+	if isEmptyLookupValue(value) {
+		return true
+	}
+	if value.ValueType == DynamicValueTypeError {
+		return false
+	}
+
+	switch rule.Type {
+	case "list":
+
+		text := formatCellValue(dv)
+		for _, item := range validationListItems(rule, grid) {
+			if strings.EqualFold(item, text) {
+				return true
+			}
+		}
+		return false
+
+	case "formula":
+
+		lowerRow, lowerColumn, _, _ := cellRangeBoundaries(rule.Range.String)
+		topLeft := Reference{String: indexesToReferenceString(lowerRow, lowerColumn), SheetIndex: rule.Range.SheetIndex}
+
+		// the condition reads the value being checked where it refers to the cell, ranges including
+		// the cell read what it holds
+		condition := incrementFormula(rule.Value, topLeft, reference, false, grid)
+		condition = replaceReferenceStringInFormula(condition, cellValueReferences(condition, reference, value, grid))
+
+		return isFormulaTrue(condition, reference, grid)
+	}
+
+	var number float64
+
+	if rule.Type == "text-length" {
+		number = float64(len([]rune(convertToString(value).DataString)))
+	} else if isNumericValue(value) {
+		number = value.DataFloat
+	} else if value.ValueType == DynamicValueTypeString {
+
+		// numbers and dates typed as text count as such
+		parsedNumber, ok := validationNumber(value.DataString, rule.Type == "date")
+		if !ok {
+			return false
+		}
+		number = parsedNumber
+
+	} else {
+		return false
+	}
+
+	if rule.Type == "whole-number" && number != math.Trunc(number) {
+		return false
+	}
+
+	lower, _ := validationNumber(rule.Value, rule.Type == "date")
+	upper, _ := validationNumber(rule.Value2, rule.Type == "date")
+
+	return compareWithBounds(rule.Operator, number, lower, upper)
+}
+
+// describeValidationRule returns the message of a rule, or what it expects when it has none
+func describeValidationRule(rule ValidationRule, grid *Grid) string {
+
+	if len(rule.Message) > 0 {
+		return rule.Message
+	}
+
+	kinds := map[string]string{"whole-number": "a whole number", "decimal": "a number", "date": "a date", "text-length": "text with a length"}
+	comparisons := map[string]string{"=": "equal to", "<>": "not equal to", ">": "greater than", ">=": "greater than or equal to", "<": "less than", "<=": "less than or equal to"}
+
+	switch rule.Type {
+	case "list":
+		return "The value should be one of: " + strings.Join(validationListItems(rule, grid), ", ")
+	case "formula":
+		return "The value doesn't meet the condition =" + rule.Value
+	}
+
+	switch rule.Operator {
+	case "between":
+		return "The value should be " + kinds[rule.Type] + " between " + rule.Value + " and " + rule.Value2
+	case "not-between":
+		return "The value should be " + kinds[rule.Type] + " not between " + rule.Value + " and " + rule.Value2
+	}
+
+	return "The value should be " + kinds[rule.Type] + " " + comparisons[rule.Operator] + " " + rule.Value
+}
+
+// getValidationMessage returns the message of the rule a cell breaks, empty when it's valid
+func getValidationMessage(reference Reference, grid *Grid) string {
+
+	rule := getValidationRule(reference, grid)
+	if rule == nil || isValidCellValue(*rule, reference, grid) {
+		return ""
+	}
+
+	return describeValidationRule(*rule, grid)
+}
+
+// cellValueReferences maps the references to a cell in a formula to a formula of the value
+func cellValueReferences(formula string, reference Reference, value *DynamicValue, grid *Grid) map[string]string {
+
+	referenceMap := make(map[string]string)
+
+	for _, referenceString := range findReferenceStrings(formula) {
+		if !strings.Contains(referenceString, ":") && getCellKeyFromReference(getReferenceFromString(referenceString, reference.SheetIndex, grid)) == getCellKeyFromReference(reference) {
+			referenceMap[referenceString] = valueFormula(value)
+		}
+	}
+
+	return referenceMap
+}
+
+// inputValue returns what input from the client computes to in a cell without storing it, input
+// starting with = is a formula and other input is text
+func inputValue(input string, reference Reference, grid *Grid) *DynamicValue {
+
+	if strings.HasPrefix(input, "=") {
+		return parse(makeDv(input[1:]), grid, reference)
+	}
+
+	return &DynamicValue{ValueType: DynamicValueTypeString, DataString: input}
+}
+
+// checkInput checks input for a cell before it's stored and tells the client when it breaks a rule,
+// it returns false when the rule rejects the input so it shouldn't be stored
+func checkInput(reference Reference, input string, grid *Grid, c *Client) bool {
+
+	rule := getValidationRule(reference, grid)
+	if rule == nil {
+		return true
+	}
+
+	// explosive formulas write to other cells when they're evaluated, they're stored as entered
+	if strings.HasPrefix(input, "=") && isValidFormula(input[1:]) && isExplosiveFormula(input[1:]) {
+		return true
+	}
+
+	if isValidValue(*rule, inputValue(input, reference, grid), reference, grid) {
+		return true
+	}
+
+	sendValidationError(reference, describeValidationRule(*rule, grid), rule.Reject, grid, c)
+
+	return !rule.Reject
+}
+
+// sendValidationError tells the client that input broke a validation rule
+func sendValidationError(reference Reference, message string, isRejected bool, grid *Grid, c *Client) {
+
+	status := "FLAGGED"
+	if isRejected {
+		status = "REJECTED"
+	}
+
+	jsonData := []string{"VALIDATION-ERROR", reference.String, getSheetPositionString(reference.SheetIndex, grid), message, status}
+	json, _ := json.Marshal(jsonData)
+	c.send <- json
+}
+
+// sendValidationOptions sends the items of the list rule of a cell for a dropdown, none when the cell
+// has no list rule
+func sendValidationOptions(reference Reference, grid *Grid, c *Client) {
+
+	jsonData := []string{"VALIDATION-OPTIONS", reference.String, getSheetPositionString(reference.SheetIndex, grid)}
+
+	if rule := getValidationRule(reference, grid); rule != nil && rule.Type == "list" {
+		jsonData = append(jsonData, validationListItems(*rule, grid)...)
+	}
+
+	json, _ := json.Marshal(jsonData)
+	c.send <- json
+}